@@ -1,3 +1,7 @@
 module client
 
 go 1.15
+
+require auth-server v0.0.0
+
+replace auth-server => ../
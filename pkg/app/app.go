@@ -0,0 +1,181 @@
+// Package app puts the HTTP API together from the config and the stores, so
+// the server and its tests serve the same routes behind the same middleware.
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+
+	"auth-server/pkg/audit"
+	"auth-server/pkg/config"
+	"auth-server/pkg/dpop"
+	"auth-server/pkg/mailer"
+	"auth-server/pkg/password"
+	"auth-server/pkg/problem"
+	"auth-server/pkg/resourceserver"
+	"auth-server/pkg/signing"
+	"auth-server/pkg/store"
+	controllerv1 "auth-server/pkg/v1/controller"
+	extauthzv1 "auth-server/pkg/v1/extauthz"
+	middlewarev1 "auth-server/pkg/v1/middleware"
+	tokenservicev1 "auth-server/pkg/v1/service"
+	"auth-server/pkg/webhook"
+)
+
+// App is the HTTP API, and the services it shares with the Envoy external
+// authorization server
+type App struct {
+	// Router serves every route
+	Router *gin.Engine
+	// ExtAuthz answers Envoy's checks with the API's token service
+	ExtAuthz *extauthzv1.Server
+
+	configHolder *config.Holder
+	jwtService   tokenservicev1.JWTService
+	userService  tokenservicev1.UserService
+	dpopVerifier *dpop.Verifier
+	// testValidator holds the *resourceserver.Validator for /v1/test
+	testValidator atomic.Value
+}
+
+// New creates the router, with the core middleware, and adds the versioned API
+func New(configHolder *config.Holder, userStore store.UserStore, apiKeyStore store.APIKeyStore, dispatcher *webhook.Dispatcher, auditSink audit.AuditSink) (*App, error) {
+	// Core router
+	router := gin.New()
+	router.Use(middlewarev1.Tracing(), middlewarev1.RequestID(), middlewarev1.GinLogger(configHolder), middlewarev1.Metrics(), middlewarev1.Audit(auditSink), gin.CustomRecovery(problem.RecoveryHandler))
+	router.NoRoute(problem.NotFoundHandler)
+
+	// Versioned API group
+	a := &App{Router: router, configHolder: configHolder}
+	if err := a.registerV1Routes(userStore, apiKeyStore, dispatcher); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *App) registerV1Routes(userStore store.UserStore, apiKeyStore store.APIKeyStore, dispatcher *webhook.Dispatcher) error {
+	configHolder := a.configHolder
+	appConfig := configHolder.Get()
+	v1 := a.Router.Group("/v1")
+
+	mailService, err := mailer.New(appConfig.Mail)
+	if err != nil {
+		return fmt.Errorf("Failed to configure mailer: %w", err)
+	}
+	passwordPolicy, err := password.NewPolicy(appConfig.Password)
+	if err != nil {
+		return fmt.Errorf("Failed to configure password policy: %w", err)
+	}
+
+	signingKeys, err := signing.Load(appConfig.SigningKeyFiles)
+	if err != nil {
+		return fmt.Errorf("Failed to load signing keys: %w", err)
+	}
+
+	jwtServiceV1 := tokenservicev1.NewJWTService(configHolder, signingKeys)
+	actionTokenServiceV1 := tokenservicev1.NewActionTokenService(configHolder)
+	userServiceV1 := tokenservicev1.NewUserService(configHolder, userStore, apiKeyStore, mailService, actionTokenServiceV1, jwtServiceV1, passwordPolicy, dispatcher)
+	emailLoginServiceV1 := tokenservicev1.NewEmailLoginService(configHolder, userStore, mailService, actionTokenServiceV1)
+	apiKeyServiceV1 := tokenservicev1.NewAPIKeyService(configHolder, apiKeyStore, userStore)
+	clientServiceV1 := tokenservicev1.NewClientService(configHolder)
+	dpopVerifier, err := dpop.NewVerifier(dpop.Config{
+		MaxAge:        appConfig.DPoP.ProofMaxAge,
+		Leeway:        appConfig.TokenLeeway,
+		RequireNonce:  appConfig.DPoP.RequireNonce,
+		NonceLifetime: appConfig.DPoP.NonceLifetime,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to configure DPoP: %w", err)
+	}
+	dpopServiceV1 := tokenservicev1.NewDPoPService(configHolder, dpopVerifier)
+	authorizeV1 := middlewarev1.AuthorizeToken(jwtServiceV1, apiKeyServiceV1, dpopServiceV1)
+
+	// Add a test authorized endpoint, checking tokens the way other services
+	// would. The validator is replaced along with the config.
+	testValidator, err := newTestValidator(appConfig, signingKeys, dpopVerifier)
+	if err != nil {
+		return fmt.Errorf("Failed to configure resource server: %w", err)
+	}
+	a.testValidator.Store(testValidator)
+	testAuth := v1.Group("/test")
+	testAuth.Use(middlewarev1.AuthorizeResourceServer(func() *resourceserver.Validator {
+		return a.testValidator.Load().(*resourceserver.Validator)
+	}, apiKeyServiceV1))
+	testAuth.GET("/ping", pingV1)
+
+	controllerv1.NewRegisterController(v1, userServiceV1)
+	controllerv1.NewLoginController(v1, jwtServiceV1, userServiceV1, dpopServiceV1)
+	controllerv1.NewEmailLoginController(v1, configHolder, jwtServiceV1, emailLoginServiceV1, dpopServiceV1)
+	controllerv1.NewTokenController(v1, jwtServiceV1, dpopServiceV1)
+	controllerv1.NewOAuthController(v1, configHolder, jwtServiceV1, clientServiceV1)
+	controllerv1.NewLogoutController(v1, jwtServiceV1)
+	controllerv1.NewPasswordController(v1, userServiceV1, authorizeV1)
+	controllerv1.NewAPIKeyController(v1, configHolder, apiKeyServiceV1, authorizeV1)
+	controllerv1.NewWebhookController(v1, configHolder, dispatcher, authorizeV1)
+	controllerv1.NewAdminController(v1.Group("/admin"), configHolder, userServiceV1, authorizeV1)
+	controllerv1.NewVerifyController(v1, configHolder, jwtServiceV1, apiKeyServiceV1)
+	controllerv1.NewOpenAPIController(v1, configHolder)
+	controllerv1.NewJWKSController(a.Router.Group("/.well-known"), jwtServiceV1)
+
+	// Probes and build info, outside /v1 and without tokens
+	controllerv1.NewHealthController(a.Router.Group("/"), []controllerv1.ReadinessCheck{
+		{Name: "config", Check: func(ctx context.Context) error { return configHolder.Get().Validate() }},
+		{Name: "signing_keys", Check: func(ctx context.Context) error { return jwtServiceV1.CheckSigningKeys() }},
+		{Name: "user_store", Check: userStore.Ping},
+		{Name: "api_key_store", Check: apiKeyStore.Ping},
+		{Name: "webhook_outbox", Check: dispatcher.Ping},
+	})
+
+	a.jwtService = jwtServiceV1
+	a.userService = userServiceV1
+	a.dpopVerifier = dpopVerifier
+	a.ExtAuthz = extauthzv1.NewServer(configHolder, jwtServiceV1)
+	return nil
+}
+
+// ApplyConfig switches to a reloaded config. Everything derived from it is
+// prepared before anything is swapped, so a bad signing key or password
+// policy keeps the old config.
+func (a *App) ApplyConfig(newConfig config.Config) error {
+	signingKeys, err := signing.Load(newConfig.SigningKeyFiles)
+	if err != nil {
+		return err
+	}
+	testValidator, err := newTestValidator(newConfig, signingKeys, a.dpopVerifier)
+	if err != nil {
+		return err
+	}
+	passwordPolicy, err := password.NewPolicy(newConfig.Password)
+	if err != nil {
+		return err
+	}
+	a.configHolder.Set(newConfig)
+	a.jwtService.SetSigningKeys(signingKeys)
+	a.userService.SetPasswordPolicy(passwordPolicy)
+	a.testValidator.Store(testValidator)
+	newConfig.ConfigureLogger()
+	return nil
+}
+
+// newTestValidator checks tokens for the test endpoint
+func newTestValidator(config config.Config, signingKeys []signing.Key, dpopVerifier *dpop.Verifier) (*resourceserver.Validator, error) {
+	return resourceserver.New(resourceserver.Config{
+		Keys:      signing.Set(signingKeys).Keys,
+		Secret:    []byte(config.AccessTokenSecret),
+		Issuer:    config.Issuer,
+		Audience:  config.Audience,
+		Leeway:    config.TokenLeeway,
+		DPoP:      dpopVerifier,
+		PublicURL: config.PublicURL,
+	})
+}
+
+// route handler
+func pingV1(context *gin.Context) {
+	jwtUser, _ := context.MustGet("user").(tokenservicev1.JWTUser)
+	context.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Hello %s!", jwtUser.Username)})
+}
@@ -0,0 +1,1021 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"auth-server/pkg/audit"
+	"auth-server/pkg/config"
+	"auth-server/pkg/jwk"
+	"auth-server/pkg/openapi"
+	"auth-server/pkg/problem"
+	"auth-server/pkg/store"
+	controllerv1 "auth-server/pkg/v1/controller"
+	"auth-server/pkg/webhook"
+)
+
+const testPassword string = "correct horse battery staple"
+
+var (
+	mailTokenPattern = regexp.MustCompile(`token=([^\s&]+)`)
+	mailCodePattern  = regexp.MustCompile(`Your login code is (\d+)`)
+)
+
+// testAPI calls the router directly, checking every response against the
+// OpenAPI document and noting which operations have been called
+type testAPI struct {
+	t        *testing.T
+	app      *App
+	users    store.UserStore
+	document *openapi.Document
+	mailFile string
+	// mailRead is how much of the mail file has been looked at
+	mailRead int
+	called   map[string]bool
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	directory, err := ioutil.TempDir("", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailFile := filepath.Join(directory, "mail.log")
+	appConfig, err := config.Load(config.LoadOptions{Overrides: map[string]string{
+		"ACCESS_TOKEN_SECRET":  strings.Repeat("a", 32),
+		"REFRESH_TOKEN_SECRET": strings.Repeat("r", 32),
+		"ACTION_TOKEN_SECRET":  strings.Repeat("x", 32),
+		"MAIL_FILE":            mailFile,
+		"PASSWORD_RESET_URL":   "https://app.example/reset",
+		"LOG_LEVEL":            "error",
+		"CLIENTS":              `[{"client_id": "billing", "token_endpoint_auth_method": "tls_client_auth", "tls_client_auth_subject_dn": "CN=billing,O=Example", "scopes": ["reports:read"]}]`,
+		// Only the router is tested, so the certificate files are never read
+		"TLS_CLIENT_AUTH":    "optional",
+		"TLS_CLIENT_CA_FILE": filepath.Join(directory, "ca.pem"),
+		"TLS_CERT_FILE":      filepath.Join(directory, "server.pem"),
+		"TLS_KEY_FILE":       filepath.Join(directory, "server-key.pem"),
+		"WEBHOOKS":           `[{"url": "http://127.0.0.1:1/hooks", "secret": "0123456789abcdef"}]`,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appConfig.ConfigureLogger()
+	gin.SetMode(gin.TestMode)
+	configHolder := config.NewHolder(appConfig)
+
+	users := store.NewMemoryUserStore()
+	dispatcher, err := webhook.NewDispatcher(appConfig.Webhooks, store.NewMemoryDeliveryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditSink, err := audit.New(appConfig.Audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := New(configHolder, users, store.NewMemoryAPIKeyStore(), dispatcher, auditSink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAPI{
+		t:        t,
+		app:      api,
+		users:    users,
+		document: controllerv1.OpenAPIDocument(appConfig.PublicURL),
+		mailFile: mailFile,
+		called:   map[string]bool{},
+	}
+}
+
+// restart replaces the app with a new one using appConfig, as if the server
+// had been restarted. Users are kept; everything else held in memory is lost.
+func (a *testAPI) restart(appConfig config.Config) {
+	a.t.Helper()
+	dispatcher, err := webhook.NewDispatcher(appConfig.Webhooks, store.NewMemoryDeliveryStore())
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	auditSink, err := audit.New(appConfig.Audit)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	if a.app, err = New(config.NewHolder(appConfig), a.users, store.NewMemoryAPIKeyStore(), dispatcher, auditSink); err != nil {
+		a.t.Fatal(err)
+	}
+}
+
+// testRequest is a request to the API. body is sent as JSON, unless form is set.
+type testRequest struct {
+	method string
+	path   string
+	body   interface{}
+	form   url.Values
+	header http.Header
+	tls    *tls.ConnectionState
+}
+
+// do sends a request, fails the test unless it gets wantStatus, and returns
+// the decoded JSON body, if any
+func (a *testAPI) do(request testRequest, wantStatus int) (map[string]interface{}, *httptest.ResponseRecorder) {
+	a.t.Helper()
+	var body bytes.Buffer
+	contentType := ""
+	switch {
+	case request.form != nil:
+		body.WriteString(request.form.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	case request.body != nil:
+		if err := json.NewEncoder(&body).Encode(request.body); err != nil {
+			a.t.Fatal(err)
+		}
+		contentType = "application/json"
+	}
+	httpRequest := httptest.NewRequest(request.method, request.path, &body)
+	for name, values := range request.header {
+		httpRequest.Header[name] = values
+	}
+	if contentType != "" {
+		httpRequest.Header.Set("Content-Type", contentType)
+	}
+	httpRequest.TLS = request.tls
+
+	recorder := httptest.NewRecorder()
+	a.app.Router.ServeHTTP(recorder, httpRequest)
+	name := request.method + " " + httpRequest.URL.Path
+	if recorder.Code != wantStatus {
+		a.t.Fatalf("%s: got status %d, want %d: %s", name, recorder.Code, wantStatus, recorder.Body.String())
+	}
+
+	decoded := a.check(request.method, httpRequest.URL.Path, recorder)
+	object, _ := decoded.(map[string]interface{})
+	return object, recorder
+}
+
+// check fails the test if the response isn't one the document describes
+func (a *testAPI) check(method string, path string, recorder *httptest.ResponseRecorder) interface{} {
+	a.t.Helper()
+	name := method + " " + path
+	template, operation := findOperation(a.document, method, path)
+	if operation == nil {
+		a.t.Fatalf("%s: not in the OpenAPI document", name)
+	}
+	a.called[strings.ToUpper(method)+" "+template] = true
+
+	response, documented := operation.Responses[strconv.Itoa(recorder.Code)]
+	if !documented {
+		a.t.Fatalf("%s: status %d isn't documented", name, recorder.Code)
+	}
+	if len(response.Content) == 0 {
+		if recorder.Body.Len() > 0 && strings.Contains(recorder.Header().Get("Content-Type"), "json") {
+			a.t.Errorf("%s: status %d has an undocumented body: %s", name, recorder.Code, recorder.Body.String())
+		}
+		return nil
+	}
+
+	contentType, _, _ := mime.ParseMediaType(recorder.Header().Get("Content-Type"))
+	mediaType, documented := response.Content[contentType]
+	if !documented {
+		a.t.Fatalf("%s: content type %q isn't documented for status %d", name, contentType, recorder.Code)
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &decoded); err != nil {
+		a.t.Fatalf("%s: invalid JSON: %v", name, err)
+	}
+	for _, problem := range validate(a.document, mediaType.Schema, decoded, "body") {
+		a.t.Errorf("%s: status %d: %s", name, recorder.Code, problem)
+	}
+	return decoded
+}
+
+// findOperation finds the documented operation matching a request path,
+// where "{param}" segments match any segment
+func findOperation(document *openapi.Document, method string, path string) (string, *openapi.Operation) {
+	segments := strings.Split(path, "/")
+	for template, pathItem := range document.Paths {
+		templateSegments := strings.Split(template, "/")
+		if len(templateSegments) != len(segments) {
+			continue
+		}
+		matches := true
+		for i, segment := range templateSegments {
+			if segment != segments[i] && !strings.HasPrefix(segment, "{") {
+				matches = false
+				break
+			}
+		}
+		if operation, found := pathItem[strings.ToLower(method)]; matches && found {
+			return template, operation
+		}
+	}
+	return "", nil
+}
+
+// validate returns how value doesn't match schema. Objects may only hold
+// the properties their schema lists, unless it allows additional ones.
+func validate(document *openapi.Document, schema *openapi.Schema, value interface{}, where string) []string {
+	if schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		resolved, found := document.Components.Schemas[name]
+		if !found {
+			return []string{where + ": unknown schema " + schema.Ref}
+		}
+		schema = resolved
+	}
+	if value == nil {
+		if schema.Nullable {
+			return nil
+		}
+		return []string{where + ": is null"}
+	}
+
+	problems := []string{}
+	mismatch := func() []string {
+		return []string{where + ": is " + strings.TrimSpace(string(mustJSON(value))) + ", not " + schema.Type}
+	}
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		for _, name := range schema.Required {
+			if _, found := object[name]; !found {
+				problems = append(problems, where+"."+name+": is missing")
+			}
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, found := schema.Properties[name]
+			switch {
+			case found:
+				problems = append(problems, validate(document, property, object[name], where+"."+name)...)
+			case schema.AdditionalProperties != nil:
+				problems = append(problems, validate(document, schema.AdditionalProperties, object[name], where+"."+name)...)
+			case schema.Properties != nil:
+				problems = append(problems, where+"."+name+": isn't documented")
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		for i, item := range array {
+			problems = append(problems, validate(document, schema.Items, item, where+"["+strconv.Itoa(i)+"]")...)
+		}
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			return mismatch()
+		}
+		if len(schema.Enum) > 0 && !contains(schema.Enum, text) {
+			problems = append(problems, where+": "+strconv.Quote(text)+" isn't one of "+strings.Join(schema.Enum, ", "))
+		}
+		if schema.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, text); err != nil {
+				problems = append(problems, where+": isn't a date-time")
+			}
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != float64(int64(number)) {
+			return mismatch()
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return mismatch()
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return mismatch()
+		}
+	}
+	return problems
+}
+
+func mustJSON(value interface{}) []byte {
+	encoded, _ := json.Marshal(value)
+	return encoded
+}
+
+func contains(items []string, value string) bool {
+	for _, item := range items {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// mail waits for the next email matching pattern, and returns the match's first group
+func (a *testAPI) mail(pattern *regexp.Regexp) string {
+	a.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := ioutil.ReadFile(a.mailFile)
+		if len(data) > a.mailRead {
+			if match := pattern.FindSubmatchIndex(data[a.mailRead:]); match != nil {
+				value := string(data[a.mailRead+match[2] : a.mailRead+match[3]])
+				a.mailRead += match[1]
+				unescaped, err := url.QueryUnescape(value)
+				if err != nil {
+					a.t.Fatal(err)
+				}
+				return unescaped
+			}
+		}
+		if time.Now().After(deadline) {
+			a.t.Fatalf("No email matching %s was sent", pattern)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (a *testAPI) createUser(username string, roles ...string) {
+	a.t.Helper()
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	err = a.users.Create(context.Background(), store.User{
+		ID: username + "-id", Username: username, Email: username + "@example.com", PasswordHash: string(passwordHash),
+		EmailVerified: true, Roles: roles, CreatedAt: now, UpdatedAt: now,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+}
+
+func (a *testAPI) login(username string, password string) (string, string) {
+	a.t.Helper()
+	tokens, _ := a.do(testRequest{method: http.MethodPost, path: "/v1/login", body: map[string]string{"username": username, "password": password}}, http.StatusOK)
+	return tokens["access_token"].(string), tokens["refresh_token"].(string)
+}
+
+func bearer(accessToken string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + accessToken}}
+}
+
+// TestRoutesAreDocumented checks every /v1 route is in the OpenAPI
+// document, and that it describes no routes that don't exist
+func TestRoutesAreDocumented(t *testing.T) {
+	api := newTestAPI(t)
+
+	routed := map[string]bool{}
+	for _, route := range api.app.Router.Routes() {
+		if !strings.HasPrefix(route.Path, "/v1/") {
+			continue
+		}
+		routed[route.Method+" "+route.Path] = true
+		if !api.document.Documents(route.Method, route.Path) {
+			t.Errorf("%s %s is missing from the OpenAPI document", route.Method, route.Path)
+		}
+	}
+	for path, pathItem := range api.document.Paths {
+		ginPath := regexp.MustCompile(`\{([^}]+)\}`).ReplaceAllString(path, ":$1")
+		for method := range pathItem {
+			if !routed[strings.ToUpper(method)+" "+ginPath] {
+				t.Errorf("The OpenAPI document describes %s %s, which has no route", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+// TestResponsesMatchDocument calls every documented operation, and checks
+// each response against the document
+func TestResponsesMatchDocument(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("root", "admin")
+	adminToken, _ := api.login("root", testPassword)
+
+	// Docs
+	api.do(testRequest{method: http.MethodGet, path: "/v1/openapi.json"}, http.StatusOK)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/docs"}, http.StatusNotFound)
+
+	// Registration
+	api.do(testRequest{method: http.MethodPost, path: "/v1/register", body: map[string]string{
+		"username": "alice", "email": "alice@example.com", "password": testPassword,
+	}}, http.StatusCreated)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/register", body: map[string]string{
+		"username": "alice", "email": "other@example.com", "password": testPassword,
+	}}, http.StatusConflict)
+	firstToken := api.mail(mailTokenPattern)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/register/resend", body: map[string]string{"email": "alice@example.com"}}, http.StatusAccepted)
+	secondToken := api.mail(mailTokenPattern)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/register/verify", body: map[string]string{"token": secondToken}}, http.StatusOK)
+	// Verifying the address used up every token sent to it
+	api.do(testRequest{method: http.MethodGet, path: "/v1/register/verify?token=" + url.QueryEscape(firstToken)}, http.StatusBadRequest)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/register/verify", body: map[string]string{"token": "not a token"}}, http.StatusBadRequest)
+
+	// Tokens
+	accessToken, refreshToken := api.login("alice", testPassword)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/login", body: map[string]string{"username": "alice", "password": "wrong"}}, http.StatusUnauthorized)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/login", body: map[string]string{}}, http.StatusBadRequest)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/token", body: map[string]string{"refresh_token": refreshToken}}, http.StatusOK)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/test/ping", header: bearer(accessToken)}, http.StatusOK)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/test/ping"}, http.StatusUnauthorized)
+	api.do(testRequest{method: http.MethodDelete, path: "/v1/logout", body: map[string]string{"refresh_token": refreshToken}}, http.StatusNoContent)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/token", body: map[string]string{"refresh_token": refreshToken}}, http.StatusUnauthorized)
+
+	response, _ := api.do(testRequest{method: http.MethodPost, path: "/v1/login/email", body: map[string]string{"email": "alice@example.com", "method": "code"}}, http.StatusAccepted)
+	code := api.mail(mailCodePattern)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/login/email/verify", body: map[string]string{"nonce": response["nonce"].(string), "code": code}}, http.StatusOK)
+	response, _ = api.do(testRequest{method: http.MethodPost, path: "/v1/login/email", body: map[string]string{"email": "alice@example.com", "method": "link"}}, http.StatusAccepted)
+	linkToken := api.mail(mailTokenPattern)
+	query := url.Values{"nonce": {response["nonce"].(string)}, "token": {linkToken}}
+	api.do(testRequest{method: http.MethodGet, path: "/v1/login/email/verify?" + query.Encode()}, http.StatusOK)
+
+	certificate := &x509.Certificate{Raw: []byte("billing"), Subject: pkix.Name{CommonName: "billing", Organization: []string{"Example"}}}
+	clientTLS := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{certificate}}
+	api.do(testRequest{method: http.MethodPost, path: "/v1/oauth/token", form: url.Values{"grant_type": {"client_credentials"}, "client_id": {"billing"}}, tls: clientTLS}, http.StatusOK)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/oauth/token", form: url.Values{"grant_type": {"client_credentials"}, "client_id": {"billing"}}}, http.StatusUnauthorized)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/oauth/token", form: url.Values{"grant_type": {"password"}}}, http.StatusBadRequest)
+
+	// Passwords
+	newPassword := "another horse battery staple"
+	accessToken, _ = api.login("alice", testPassword)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/password/change", header: bearer(accessToken), body: map[string]string{
+		"current_password": testPassword, "new_password": newPassword,
+	}}, http.StatusNoContent)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/password/forgot", body: map[string]string{"email": "alice@example.com"}}, http.StatusAccepted)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/password/reset", body: map[string]string{
+		"token": api.mail(mailTokenPattern), "password": testPassword,
+	}}, http.StatusNoContent)
+
+	// API keys
+	accessToken, _ = api.login("alice", testPassword)
+	created, _ := api.do(testRequest{method: http.MethodPost, path: "/v1/apikeys", header: bearer(accessToken), body: map[string]interface{}{
+		"name": "ci", "expires_at": time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+	}}, http.StatusCreated)
+	keyPath := "/v1/apikeys/" + created["id"].(string)
+	apiKeyHeader := http.Header{"X-Api-Key": {created["key"].(string)}}
+	api.do(testRequest{method: http.MethodGet, path: "/v1/test/ping", header: apiKeyHeader}, http.StatusOK)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/apikeys", header: bearer(accessToken)}, http.StatusOK)
+	api.do(testRequest{method: http.MethodGet, path: keyPath, header: bearer(accessToken)}, http.StatusOK)
+	api.do(testRequest{method: http.MethodPatch, path: keyPath, header: bearer(accessToken), body: map[string]string{"name": "deploys"}}, http.StatusOK)
+	api.do(testRequest{method: http.MethodDelete, path: keyPath, header: bearer(accessToken)}, http.StatusNoContent)
+	api.do(testRequest{method: http.MethodGet, path: keyPath, header: bearer(accessToken)}, http.StatusNotFound)
+
+	// Proxies
+	_, recorder := api.do(testRequest{method: http.MethodGet, path: "/v1/verify", header: bearer(accessToken)}, http.StatusOK)
+	if recorder.Header().Get("X-Auth-User") != "alice" {
+		t.Errorf("Verify: got user %q, want alice", recorder.Header().Get("X-Auth-User"))
+	}
+	api.do(testRequest{method: http.MethodGet, path: "/v1/verify?roles=admin", header: bearer(accessToken)}, http.StatusForbidden)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/verify"}, http.StatusUnauthorized)
+
+	// Admin
+	admin := bearer(adminToken)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/admin/users", header: bearer(accessToken)}, http.StatusForbidden)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/admin/users?q=ali", header: admin}, http.StatusOK)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/admin/users", header: admin, body: map[string]interface{}{
+		"username": "bob", "email": "bob@example.com", "password": testPassword, "email_verified": true,
+	}}, http.StatusCreated)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/admin/users/bob", header: admin}, http.StatusOK)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/admin/users/nobody", header: admin}, http.StatusNotFound)
+	api.do(testRequest{method: http.MethodPatch, path: "/v1/admin/users/bob", header: admin, body: map[string]string{"email": "robert@example.com"}}, http.StatusOK)
+	api.do(testRequest{method: http.MethodPut, path: "/v1/admin/users/bob/roles", header: admin, body: map[string][]string{"roles": {"support"}, "scopes": {"reports:read"}}}, http.StatusOK)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/admin/users/bob/disable", header: admin}, http.StatusOK)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/admin/users/bob/enable", header: admin}, http.StatusOK)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/admin/users/bob/password-reset", header: admin}, http.StatusNoContent)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/admin/users/bob/unlock", header: admin}, http.StatusOK)
+	bobKey, _ := api.do(testRequest{method: http.MethodPost, path: "/v1/apikeys", header: admin, body: map[string]string{
+		"name": "bob's", "owner_type": "user", "owner": "bob",
+	}}, http.StatusCreated)
+	api.do(testRequest{method: http.MethodDelete, path: "/v1/admin/users/bob", header: admin}, http.StatusNoContent)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/admin/users", header: admin, body: map[string]interface{}{
+		"username": "bob", "email": "bob@example.com", "password": testPassword, "email_verified": true,
+	}}, http.StatusCreated)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/test/ping", header: http.Header{"X-Api-Key": {bobKey["key"].(string)}}}, http.StatusUnauthorized)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/apikeys/" + bobKey["id"].(string), header: admin}, http.StatusNotFound)
+
+	_, refreshToken = api.login("alice", testPassword)
+	listed, _ := api.do(testRequest{method: http.MethodGet, path: "/v1/admin/users/alice/sessions", header: admin}, http.StatusOK)
+	sessions := listed["sessions"].([]interface{})
+	if len(sessions) == 0 {
+		t.Fatal("Got no sessions for alice")
+	}
+	sessionPath := "/v1/admin/users/alice/sessions/" + sessions[0].(map[string]interface{})["id"].(string)
+	api.do(testRequest{method: http.MethodDelete, path: sessionPath, header: admin}, http.StatusNoContent)
+	api.do(testRequest{method: http.MethodDelete, path: sessionPath, header: admin}, http.StatusNotFound)
+	listed, _ = api.do(testRequest{method: http.MethodGet, path: "/v1/admin/users/alice/sessions", header: admin}, http.StatusOK)
+	if remaining := len(listed["sessions"].([]interface{})); remaining != len(sessions)-1 {
+		t.Errorf("Got %d sessions after revoking one of %d", remaining, len(sessions))
+	}
+	api.do(testRequest{method: http.MethodDelete, path: "/v1/admin/users/alice/sessions", header: admin}, http.StatusNoContent)
+	listed, _ = api.do(testRequest{method: http.MethodGet, path: "/v1/admin/users/alice/sessions", header: admin}, http.StatusOK)
+	if remaining := len(listed["sessions"].([]interface{})); remaining != 0 {
+		t.Errorf("Got %d sessions after revoking them all", remaining)
+	}
+	api.do(testRequest{method: http.MethodPost, path: "/v1/token", body: map[string]string{"refresh_token": refreshToken}}, http.StatusUnauthorized)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/admin/users/nobody/sessions", header: admin}, http.StatusNotFound)
+
+	listed, _ = api.do(testRequest{method: http.MethodGet, path: "/v1/admin/clients", header: admin}, http.StatusOK)
+	if clients := listed["clients"].([]interface{}); len(clients) != 1 || clients[0].(map[string]interface{})["client_id"] != "billing" {
+		t.Errorf("Got clients %v, want billing", clients)
+	}
+
+	// Webhooks, which are all still waiting to be sent as the dispatcher isn't running
+	deliveries, _ := api.do(testRequest{method: http.MethodGet, path: "/v1/webhooks/deliveries", header: admin}, http.StatusOK)
+	if len(deliveries["deliveries"].([]interface{})) == 0 {
+		t.Error("Expected webhook deliveries for the events above")
+	}
+	api.do(testRequest{method: http.MethodGet, path: "/v1/webhooks/deliveries?status=lost", header: admin}, http.StatusBadRequest)
+
+	for path, pathItem := range api.document.Paths {
+		for method := range pathItem {
+			if operation := strings.ToUpper(method) + " " + path; !api.called[operation] {
+				t.Errorf("%s was never called", operation)
+			}
+		}
+	}
+}
+
+func TestEmailLogin(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("carol")
+	start := func(email string) string {
+		response, _ := api.do(testRequest{method: http.MethodPost, path: "/v1/login/email", body: map[string]string{"email": email, "method": "code"}}, http.StatusAccepted)
+		return response["nonce"].(string)
+	}
+	verify := func(nonce string, code string, wantStatus int) map[string]interface{} {
+		response, _ := api.do(testRequest{method: http.MethodPost, path: "/v1/login/email/verify", body: map[string]string{"nonce": nonce, "code": code}}, wantStatus)
+		return response
+	}
+
+	// Unknown addresses get a nonce too
+	start("nobody@example.com")
+
+	nonce := start("carol@example.com")
+	verify(nonce, api.mail(mailCodePattern), http.StatusOK)
+
+	// A locked out user can't log in by email instead
+	nonce = start("carol@example.com")
+	code := api.mail(mailCodePattern)
+	user, err := api.users.Get(context.Background(), "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.LockedUntil = time.Now().UTC().Add(time.Hour)
+	if err := api.users.Update(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	if response := verify(nonce, code, http.StatusForbidden); response["code"] != "user_locked" {
+		t.Errorf("Got %v, want user_locked", response["code"])
+	}
+
+	// Failing to send the email looks the same as sending it
+	if err := os.Remove(api.mailFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(api.mailFile, 0700); err != nil {
+		t.Fatal(err)
+	}
+	start("carol@example.com")
+}
+
+// TestEmailLoginLimits checks wrong codes count against the user across
+// codes, and each address can only ask for so many emails
+func TestEmailLoginLimits(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("henry")
+	start := func(email string, wantStatus int) string {
+		response, _ := api.do(testRequest{method: http.MethodPost, path: "/v1/login/email", body: map[string]string{"email": email, "method": "code"}}, wantStatus)
+		nonce, _ := response["nonce"].(string)
+		return nonce
+	}
+	verify := func(nonce string, code string, wantCode string) {
+		t.Helper()
+		status := map[string]int{"invalid_credentials": http.StatusUnauthorized, "too_many_requests": http.StatusTooManyRequests}[wantCode]
+		if response, _ := api.do(testRequest{method: http.MethodPost, path: "/v1/login/email/verify", body: map[string]string{"nonce": nonce, "code": code}}, status); response["code"] != wantCode {
+			t.Errorf("Got %v, want %s", response["code"], wantCode)
+		}
+	}
+	wrong := func(code string) string {
+		return fmt.Sprintf("%06d", (mustAtoi(t, code)+1)%1000000)
+	}
+
+	firstNonce := start("henry@example.com", http.StatusAccepted)
+	firstCode := api.mail(mailCodePattern)
+	for i := 0; i < 3; i++ {
+		verify(firstNonce, wrong(firstCode), "invalid_credentials")
+	}
+
+	// A new code replaces the last one, but not the count of wrong codes
+	nonce := start("henry@example.com", http.StatusAccepted)
+	code := api.mail(mailCodePattern)
+	verify(firstNonce, firstCode, "invalid_credentials")
+	verify(nonce, wrong(code), "invalid_credentials")
+	verify(nonce, wrong(code), "invalid_credentials")
+	verify(nonce, code, "invalid_credentials")
+
+	nonce = start("henry@example.com", http.StatusAccepted)
+	verify(nonce, api.mail(mailCodePattern), "too_many_requests")
+
+	// Two more emails are allowed, registered or not, and in any case
+	start("HENRY@example.com", http.StatusAccepted)
+	start("henry@example.com", http.StatusAccepted)
+	start("Henry@Example.com", http.StatusTooManyRequests)
+	for i := 0; i < 5; i++ {
+		start("nobody@example.com", http.StatusAccepted)
+	}
+	start("nobody@example.com", http.StatusTooManyRequests)
+}
+
+func mustAtoi(t *testing.T, value string) int {
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return number
+}
+
+// TestVerifyEmailTokens checks a verification link only verifies the address
+// it was sent to, and only once, even after a restart
+func TestVerifyEmailTokens(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("root", "admin")
+	adminToken, _ := api.login("root", testPassword)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/register", body: map[string]string{
+		"username": "ivy", "email": "ivy@example.com", "password": testPassword,
+	}}, http.StatusCreated)
+	oldAddressToken := api.mail(mailTokenPattern)
+	verify := func(token string, wantStatus int) {
+		t.Helper()
+		api.do(testRequest{method: http.MethodPost, path: "/v1/register/verify", body: map[string]string{"token": token}}, wantStatus)
+	}
+
+	api.do(testRequest{method: http.MethodPatch, path: "/v1/admin/users/ivy", header: bearer(adminToken), body: map[string]string{"email": "ivy@example.org"}}, http.StatusOK)
+	verify(oldAddressToken, http.StatusBadRequest)
+
+	api.do(testRequest{method: http.MethodPost, path: "/v1/register/resend", body: map[string]string{"email": "ivy@example.org"}}, http.StatusAccepted)
+	token := api.mail(mailTokenPattern)
+	verify(token, http.StatusOK)
+	verify(token, http.StatusBadRequest)
+
+	// A new server, as after a restart, hasn't seen the token used
+	api.restart(api.app.configHolder.Get())
+	verify(token, http.StatusBadRequest)
+
+	// Nor does re-registering the name make an old link work
+	api.do(testRequest{method: http.MethodDelete, path: "/v1/admin/users/ivy", header: bearer(adminToken)}, http.StatusNoContent)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/register", body: map[string]string{
+		"username": "ivy", "email": "ivy@example.com", "password": testPassword,
+	}}, http.StatusCreated)
+	verify(oldAddressToken, http.StatusBadRequest)
+	verify(api.mail(mailTokenPattern), http.StatusOK)
+}
+
+// TestForgotPasswordDoesNotWaitForMail checks a registered address is
+// answered as quickly as an unknown one, by making sending mail hang
+func TestForgotPasswordDoesNotWaitForMail(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("dave")
+
+	// Opening a FIFO for writing blocks until something reads it
+	os.Remove(api.mailFile)
+	if err := syscall.Mkfifo(api.mailFile, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, email := range []string{"nobody@example.com", "dave@example.com"} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			api.do(testRequest{method: http.MethodPost, path: "/v1/password/forgot", body: map[string]string{"email": email}}, http.StatusAccepted)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Forgot password for %s waited for the email to be sent", email)
+		}
+	}
+
+	// The email is still sent
+	mail, err := ioutil.ReadFile(api.mailFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mailTokenPattern.Match(mail) {
+		t.Errorf("Got mail %q, want a reset token", mail)
+	}
+}
+
+func TestResendVerificationDoesNotWaitForMail(t *testing.T) {
+	api := newTestAPI(t)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/register", body: map[string]string{
+		"username": "gwen", "email": "gwen@example.com", "password": testPassword,
+	}}, http.StatusCreated)
+	api.mail(mailTokenPattern)
+
+	// Opening a FIFO for writing blocks until something reads it
+	os.Remove(api.mailFile)
+	if err := syscall.Mkfifo(api.mailFile, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, email := range []string{"nobody@example.com", "gwen@example.com"} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			api.do(testRequest{method: http.MethodPost, path: "/v1/register/resend", body: map[string]string{"email": email}}, http.StatusAccepted)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Resending verification to %s waited for the email to be sent", email)
+		}
+	}
+
+	// The email is still sent
+	mail, err := ioutil.ReadFile(api.mailFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mailTokenPattern.Match(mail) {
+		t.Errorf("Got mail %q, want a verification token", mail)
+	}
+}
+
+// newDPoPProof signs a DPoP proof for a request to path, with nonce unless it's empty
+func newDPoPProof(t *testing.T, key *ecdsa.PrivateKey, publicURL string, method string, path string, nonce string) string {
+	t.Helper()
+	public, err := jwk.New(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.MapClaims{"jti": strconv.FormatInt(time.Now().UnixNano(), 36), "htm": method, "htu": publicURL + path, "iat": time.Now().Unix()}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = "dpop+jwt"
+	token.Header["jwk"] = public
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// TestDPoPProblems checks the token routes report bad DPoP proofs as
+// problem details, like their other errors
+func TestDPoPProblems(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("hana")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicURL := api.app.configHolder.Get().PublicURL
+	login := map[string]string{"username": "hana", "password": testPassword}
+	wantProblem := func(request testRequest, wantCode string) *httptest.ResponseRecorder {
+		t.Helper()
+		response, recorder := api.do(request, http.StatusUnauthorized)
+		if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, problem.ContentType) {
+			t.Errorf("%s: got Content-Type %q, want %s", request.path, contentType, problem.ContentType)
+		}
+		if response["code"] != wantCode {
+			t.Errorf("%s: got %v, want %s", request.path, response["code"], wantCode)
+		}
+		if challenge := recorder.Header().Get("WWW-Authenticate"); !strings.HasPrefix(challenge, "DPoP ") {
+			t.Errorf("%s: got WWW-Authenticate %q, want a DPoP challenge", request.path, challenge)
+		}
+		return recorder
+	}
+
+	wantProblem(testRequest{method: http.MethodPost, path: "/v1/login", body: login, header: http.Header{"Dpop": {"not-a-proof"}}}, "invalid_dpop_proof")
+	twoProofs := http.Header{"Dpop": {
+		newDPoPProof(t, key, publicURL, http.MethodPost, "/v1/login", ""),
+		newDPoPProof(t, key, publicURL, http.MethodPost, "/v1/login", ""),
+	}}
+	wantProblem(testRequest{method: http.MethodPost, path: "/v1/login", body: login, header: twoProofs}, "invalid_dpop_proof")
+
+	// A bound refresh token needs a proof
+	tokens, _ := api.do(testRequest{method: http.MethodPost, path: "/v1/login", body: login, header: http.Header{"Dpop": {newDPoPProof(t, key, publicURL, http.MethodPost, "/v1/login", "")}}}, http.StatusOK)
+	if tokens["token_type"] != "DPoP" {
+		t.Fatalf("Got token_type %v, want DPoP", tokens["token_type"])
+	}
+	wantProblem(testRequest{method: http.MethodPost, path: "/v1/token", body: map[string]interface{}{"refresh_token": tokens["refresh_token"]}}, "invalid_dpop_proof")
+
+	appConfig := api.app.configHolder.Get()
+	appConfig.DPoP.RequireNonce = true
+	api.restart(appConfig)
+	started, _ := api.do(testRequest{method: http.MethodPost, path: "/v1/login/email", body: map[string]string{"email": "hana@example.com", "method": "code"}}, http.StatusAccepted)
+	code := api.mail(mailCodePattern)
+	recorder := wantProblem(testRequest{method: http.MethodPost, path: "/v1/login/email/verify", body: map[string]string{"nonce": started["nonce"].(string), "code": code}, header: http.Header{
+		"Dpop": {newDPoPProof(t, key, publicURL, http.MethodPost, "/v1/login/email/verify", "")},
+	}}, "use_dpop_nonce")
+	if recorder.Header().Get("DPoP-Nonce") == "" {
+		t.Error("Got no DPoP-Nonce header")
+	}
+}
+
+// TestEmailLoginFailuresAudited checks failed email logins name the user
+// the code or link was for
+func TestEmailLoginFailuresAudited(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("lena")
+	appConfig := api.app.configHolder.Get()
+	appConfig.Audit.File = filepath.Join(filepath.Dir(api.mailFile), "audit.log")
+	api.restart(appConfig)
+
+	started, _ := api.do(testRequest{method: http.MethodPost, path: "/v1/login/email", body: map[string]string{"email": "lena@example.com", "method": "code"}}, http.StatusAccepted)
+	code := api.mail(mailCodePattern)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/login/email/verify", body: map[string]string{"nonce": started["nonce"].(string), "code": fmt.Sprintf("%06d", (mustAtoi(t, code)+1)%1000000)}}, http.StatusUnauthorized)
+
+	api.do(testRequest{method: http.MethodPost, path: "/v1/login/email", body: map[string]string{"email": "lena@example.com", "method": "link"}}, http.StatusAccepted)
+	token := api.mail(mailTokenPattern)
+	api.do(testRequest{method: http.MethodPost, path: "/v1/login/email/verify", body: map[string]string{"nonce": "another-browser", "token": token}}, http.StatusUnauthorized)
+
+	lines, err := ioutil.ReadFile(appConfig.Audit.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failures := 0
+	for _, line := range bytes.Split(bytes.TrimSpace(lines), []byte("\n")) {
+		var event audit.Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != audit.EventLogin {
+			continue
+		}
+		failures++
+		if event.Outcome != audit.OutcomeFailure || event.Actor != "lena" || event.Subject != "lena" {
+			t.Errorf("Got %+v, want a failed login by lena", event)
+		}
+	}
+	if failures != 2 {
+		t.Errorf("Got %d login events, want 2", failures)
+	}
+}
+
+// TestAPIKeyScopesFollowOwner checks keys lose scopes taken away from their owner
+func TestAPIKeyScopesFollowOwner(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("root", "admin")
+	adminToken, _ := api.login("root", testPassword)
+	admin := bearer(adminToken)
+	api.createUser("erin")
+	api.do(testRequest{method: http.MethodPut, path: "/v1/admin/users/erin/roles", header: admin, body: map[string][]string{"scopes": {"reports:read", "reports:write"}}}, http.StatusOK)
+
+	accessToken, _ := api.login("erin", testPassword)
+	created, _ := api.do(testRequest{method: http.MethodPost, path: "/v1/apikeys", header: bearer(accessToken), body: map[string]interface{}{
+		"name": "reports", "scopes": []string{"reports:read", "reports:write"},
+	}}, http.StatusCreated)
+	apiKeyHeader := http.Header{"X-Api-Key": {created["key"].(string)}}
+
+	api.do(testRequest{method: http.MethodGet, path: "/v1/verify?scopes=reports:write", header: apiKeyHeader}, http.StatusOK)
+	api.do(testRequest{method: http.MethodPut, path: "/v1/admin/users/erin/roles", header: admin, body: map[string][]string{"scopes": {"reports:read"}}}, http.StatusOK)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/verify?scopes=reports:write", header: apiKeyHeader}, http.StatusForbidden)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/verify?scopes=reports:read", header: apiKeyHeader}, http.StatusOK)
+
+	// Giving the scope back gives it back to the key, which was created with it
+	api.do(testRequest{method: http.MethodPut, path: "/v1/admin/users/erin/roles", header: admin, body: map[string][]string{"scopes": {"reports:read", "reports:write"}}}, http.StatusOK)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/verify?scopes=reports:write", header: apiKeyHeader}, http.StatusOK)
+}
+
+// TestAPIKeyRolesFollowOwner checks keys act with their owner's current roles
+func TestAPIKeyRolesFollowOwner(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("root", "admin")
+	adminToken, _ := api.login("root", testPassword)
+	api.createUser("kim", "admin")
+
+	accessToken, _ := api.login("kim", testPassword)
+	created, _ := api.do(testRequest{method: http.MethodPost, path: "/v1/apikeys", header: bearer(accessToken), body: map[string]string{"name": "admin"}}, http.StatusCreated)
+	apiKeyHeader := http.Header{"X-Api-Key": {created["key"].(string)}}
+
+	api.do(testRequest{method: http.MethodGet, path: "/v1/admin/users", header: apiKeyHeader}, http.StatusOK)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/verify?roles=admin", header: apiKeyHeader}, http.StatusOK)
+
+	api.do(testRequest{method: http.MethodPut, path: "/v1/admin/users/kim/roles", header: bearer(adminToken), body: map[string][]string{"roles": {"reader"}}}, http.StatusOK)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/admin/users", header: apiKeyHeader}, http.StatusForbidden)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/verify?roles=admin", header: apiKeyHeader}, http.StatusForbidden)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/verify?roles=reader", header: apiKeyHeader}, http.StatusOK)
+}
+
+// TestTestEndpointUsesResourceServer checks /v1/test applies the
+// resourceserver settings from the config, and still accepts API keys
+func TestTestEndpointUsesResourceServer(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("frank")
+	accessToken, _ := api.login("frank", testPassword)
+	created, _ := api.do(testRequest{method: http.MethodPost, path: "/v1/apikeys", header: bearer(accessToken), body: map[string]string{"name": "ping"}}, http.StatusCreated)
+	apiKeyHeader := http.Header{"X-Api-Key": {created["key"].(string)}}
+
+	// A token that expired a few seconds ago
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss":  api.app.configHolder.Get().Issuer,
+		"exp":  time.Now().Add(-time.Second * 5).Unix(),
+		"User": map[string]string{"Username": "frank"},
+	}).SignedString([]byte(strings.Repeat("a", 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response, _ := api.do(testRequest{method: http.MethodGet, path: "/v1/test/ping", header: bearer(expired)}, http.StatusUnauthorized); response["code"] != "token_expired" {
+		t.Errorf("Got %v, want token_expired", response["code"])
+	}
+
+	newConfig := api.app.configHolder.Get()
+	newConfig.TokenLeeway = time.Minute
+	if err := api.app.ApplyConfig(newConfig); err != nil {
+		t.Fatal(err)
+	}
+	if response, _ := api.do(testRequest{method: http.MethodGet, path: "/v1/test/ping", header: bearer(expired)}, http.StatusOK); response["message"] != "Hello frank!" {
+		t.Errorf("Got %v, want a greeting for frank", response["message"])
+	}
+	api.do(testRequest{method: http.MethodGet, path: "/v1/test/ping", header: bearer(accessToken)}, http.StatusOK)
+
+	// Tokens issued before an audience was set don't have it
+	newConfig.Audience = "https://api.example.com"
+	if err := api.app.ApplyConfig(newConfig); err != nil {
+		t.Fatal(err)
+	}
+	api.do(testRequest{method: http.MethodGet, path: "/v1/test/ping", header: bearer(accessToken)}, http.StatusUnauthorized)
+	accessToken, _ = api.login("frank", testPassword)
+	api.do(testRequest{method: http.MethodGet, path: "/v1/test/ping", header: bearer(accessToken)}, http.StatusOK)
+
+	// API keys are checked before the validator sees them
+	if response, _ := api.do(testRequest{method: http.MethodGet, path: "/v1/test/ping", header: apiKeyHeader}, http.StatusOK); response["message"] != "Hello frank!" {
+		t.Errorf("Got %v, want a greeting for frank", response["message"])
+	}
+	if response, _ := api.do(testRequest{method: http.MethodGet, path: "/v1/test/ping", header: http.Header{"X-Api-Key": {"invalid"}}}, http.StatusUnauthorized); response["code"] != "invalid_api_key" {
+		t.Errorf("Got %v, want invalid_api_key", response["code"])
+	}
+}
+
+// TestAPIKeysCantManageKeys checks a key can't be used to make a key, or
+// itself, last longer
+func TestAPIKeysCantManageKeys(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("grace")
+	accessToken, _ := api.login("grace", testPassword)
+	expiresAt := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	created, _ := api.do(testRequest{method: http.MethodPost, path: "/v1/apikeys", header: bearer(accessToken), body: map[string]interface{}{
+		"name": "short-lived", "expires_at": expiresAt,
+	}}, http.StatusCreated)
+	keyPath := "/v1/apikeys/" + created["id"].(string)
+	apiKeyHeader := http.Header{"X-Api-Key": {created["key"].(string)}}
+
+	tests := []struct {
+		name    string
+		request testRequest
+	}{
+		{"create a key without an expiry", testRequest{method: http.MethodPost, path: "/v1/apikeys", body: map[string]string{"name": "forever"}}},
+		{"extend itself", testRequest{method: http.MethodPatch, path: keyPath, body: map[string]interface{}{"expires_at": expiresAt.Add(time.Hour * 24 * 365)}}},
+		{"remove its expiry", testRequest{method: http.MethodPatch, path: keyPath, body: map[string]interface{}{"expires_at": time.Time{}}}},
+		{"list keys", testRequest{method: http.MethodGet, path: "/v1/apikeys"}},
+		{"delete itself", testRequest{method: http.MethodDelete, path: keyPath}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, header := range []http.Header{apiKeyHeader, {"Authorization": {"ApiKey " + created["key"].(string)}}} {
+				test.request.header = header
+				if response, _ := api.do(test.request, http.StatusForbidden); response["code"] != "forbidden" {
+					t.Errorf("Got %v, want forbidden", response["code"])
+				}
+			}
+		})
+	}
+
+	// The key is unchanged, and still works elsewhere
+	key, _ := api.do(testRequest{method: http.MethodGet, path: keyPath, header: bearer(accessToken)}, http.StatusOK)
+	if key["expires_at"] != expiresAt.Format(time.RFC3339) {
+		t.Errorf("Got expires_at %v, want %v", key["expires_at"], expiresAt.Format(time.RFC3339))
+	}
+	api.do(testRequest{method: http.MethodGet, path: "/v1/verify", header: apiKeyHeader}, http.StatusOK)
+	if keys, _ := api.do(testRequest{method: http.MethodGet, path: "/v1/apikeys", header: bearer(accessToken)}, http.StatusOK); len(keys["api_keys"].([]interface{})) != 1 {
+		t.Errorf("Expected only the original key, got %v", keys["api_keys"])
+	}
+}
@@ -0,0 +1,173 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// maxLineLength is the longest event Verify and NewFileSink will read
+const maxLineLength int = 1024 * 1024
+
+// ErrChainBroken is returned, wrapped with the line it broke at, when an
+// audit file has been edited
+var ErrChainBroken = errors.New("Audit log hash chain is broken")
+
+// FileSink appends events to a file as JSON lines. Each event holds the
+// hash of the one before it, so editing, removing or reordering lines
+// breaks the chain, which Verify detects.
+type FileSink struct {
+	path string
+	lock sync.Mutex
+	file *os.File
+	// lastHash is the hash of the last event in the file, when it's still
+	// size bytes long. Otherwise another process has added to it since.
+	lastHash string
+	size     int64
+}
+
+// NewFileSink opens an audit file, carrying on the chain of any events
+// already in it
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open audit file: %w", err)
+	}
+	// Nothing has been read yet, so the first event reads the chain's end
+	return &FileSink{path: path, file: file, size: -1}, nil
+}
+
+// Record chains the event to the last one in the file. The file is locked
+// while it's read and written, so the server commands can add to it too,
+// and it's only read back when one of them has.
+func (s *FileSink) Record(ctx context.Context, event Event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := lockFile(s.file); err != nil {
+		return fmt.Errorf("Failed to lock audit file: %w", err)
+	}
+	defer unlockFile(s.file)
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("Failed to read audit file: %w", err)
+	}
+	if info.Size() != s.size {
+		if s.lastHash, err = lastHash(s.path); err != nil {
+			s.size = -1
+			return fmt.Errorf("Failed to read audit file: %w", err)
+		}
+	}
+
+	event = Stamp(event)
+	event.PreviousHash = s.lastHash
+	event.Hash = hash(event)
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	written, err := s.file.Write(append(encoded, '\n'))
+	if err != nil {
+		// Part of the event may have been written, so read the end again
+		s.size = -1
+		return fmt.Errorf("Failed to write audit event: %w", err)
+	}
+	s.lastHash, s.size = event.Hash, info.Size()+int64(written)
+	return nil
+}
+
+func (s *FileSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.file.Close()
+}
+
+// Verify checks the hash chain of an audit file, returning how many events
+// it holds and the hash of the last one. Keeping that hash somewhere else
+// lets a later Verify show the file wasn't rewritten from the start.
+func Verify(path string) (int, string, error) {
+	lastHash, count, err := readChain(path)
+	return count, lastHash, err
+}
+
+// readChain reads an audit file, checking every event follows the one
+// before it
+func readChain(path string) (string, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+	lastHash, count := "", 0
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return lastHash, count, fmt.Errorf("%w: line %d isn't an event: %v", ErrChainBroken, line, err)
+		}
+		if event.PreviousHash != lastHash {
+			return lastHash, count, fmt.Errorf("%w: line %d doesn't follow the event before it", ErrChainBroken, line)
+		}
+		if hash(event) != event.Hash {
+			return lastHash, count, fmt.Errorf("%w: line %d has been modified", ErrChainBroken, line)
+		}
+		lastHash = event.Hash
+		count++
+	}
+	return lastHash, count, scanner.Err()
+}
+
+// lastHash reads the hash of the last event in an audit file, from the end
+// of the file so it doesn't matter how big it gets
+func lastHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := info.Size() - int64(maxLineLength)
+	if offset < 0 {
+		offset = 0
+	}
+	tail := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(tail, offset); err != nil {
+		return "", err
+	}
+
+	lines := bytes.Split(bytes.TrimRight(tail, "\n"), []byte("\n"))
+	last := lines[len(lines)-1]
+	if len(last) == 0 {
+		return "", nil
+	}
+	var event Event
+	if err := json.Unmarshal(last, &event); err != nil {
+		return "", fmt.Errorf("%w: the last line isn't an event: %v", ErrChainBroken, err)
+	}
+	return event.Hash, nil
+}
+
+// hash is the SHA-256 hash of an event, including the hash of the event before it
+func hash(event Event) string {
+	event.Hash = ""
+	encoded, _ := json.Marshal(event)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
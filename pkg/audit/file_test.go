@@ -0,0 +1,163 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func tempAuditFile(t *testing.T) string {
+	directory, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(directory) })
+	return filepath.Join(directory, "audit.log")
+}
+
+func newTestSink(t *testing.T, path string) *FileSink {
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sink.Close() })
+	return sink
+}
+
+func record(t *testing.T, sink *FileSink, subject string) {
+	if err := sink.Record(context.Background(), Event{Type: EventLogin, Actor: subject, Subject: subject}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeChain records events for each subject, returning the file's lines
+func writeChain(t *testing.T, path string, subjects ...string) [][]byte {
+	sink := newTestSink(t, path)
+	for _, subject := range subjects {
+		record(t, sink, subject)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.SplitAfter(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name      string
+		edit      func(lines [][]byte) [][]byte
+		wantCount int
+		wantLine  int
+	}{
+		{name: "untouched", edit: func(lines [][]byte) [][]byte { return lines }, wantCount: 4},
+		{name: "blank lines are skipped", edit: func(lines [][]byte) [][]byte {
+			return [][]byte{lines[0], []byte("\n"), lines[1], lines[2], lines[3], []byte("\n")}
+		}, wantCount: 4},
+		{name: "edited event", edit: func(lines [][]byte) [][]byte {
+			lines[2] = bytes.Replace(lines[2], []byte(`"actor":"carol"`), []byte(`"actor":"mallory"`), 1)
+			return lines
+		}, wantCount: 2, wantLine: 3},
+		{name: "removed event", edit: func(lines [][]byte) [][]byte {
+			return [][]byte{lines[0], lines[2], lines[3]}
+		}, wantCount: 1, wantLine: 2},
+		{name: "reordered events", edit: func(lines [][]byte) [][]byte {
+			return [][]byte{lines[0], lines[2], lines[1], lines[3]}
+		}, wantCount: 1, wantLine: 2},
+		{name: "removed first event", edit: func(lines [][]byte) [][]byte { return lines[1:] }, wantCount: 0, wantLine: 1},
+		{name: "not an event", edit: func(lines [][]byte) [][]byte {
+			return [][]byte{lines[0], []byte("not json\n"), lines[1]}
+		}, wantCount: 1, wantLine: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := tempAuditFile(t)
+			lines := writeChain(t, path, "alice", "bob", "carol", "dave")
+			if err := ioutil.WriteFile(path, bytes.Join(test.edit(lines), nil), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			count, _, err := Verify(path)
+			if count != test.wantCount {
+				t.Errorf("got %d events, want %d", count, test.wantCount)
+			}
+			if test.wantLine == 0 {
+				if err != nil {
+					t.Errorf("got %v, want the chain to verify", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrChainBroken) || !strings.Contains(err.Error(), fmt.Sprintf("line %d ", test.wantLine)) {
+				t.Errorf("got %v, want the chain broken at line %d", err, test.wantLine)
+			}
+		})
+	}
+}
+
+func TestVerifyEmptyFile(t *testing.T) {
+	path := tempAuditFile(t)
+	newTestSink(t, path)
+	count, lastHash, err := Verify(path)
+	if count != 0 || lastHash != "" || err != nil {
+		t.Errorf("got %d, %q, %v, want an empty chain", count, lastHash, err)
+	}
+}
+
+func TestFileSinkCarriesOnAfterReopening(t *testing.T) {
+	path := tempAuditFile(t)
+	writeChain(t, path, "alice", "bob")
+	lines := writeChain(t, path, "carol")
+
+	count, lastHash, err := Verify(path)
+	if err != nil || count != 3 {
+		t.Fatalf("got %d events, %v, want 3 chained events", count, err)
+	}
+	if !bytes.Contains(lines[2], []byte(lastHash)) {
+		t.Error("The last hash isn't the last event's")
+	}
+}
+
+// TestFileSinksShareAFile writes from two sinks at once, as the server and
+// a server command would
+func TestFileSinksShareAFile(t *testing.T) {
+	path := tempAuditFile(t)
+	sinks := []*FileSink{newTestSink(t, path), newTestSink(t, path)}
+
+	var wait sync.WaitGroup
+	for i, sink := range sinks {
+		wait.Add(1)
+		go func(sink *FileSink, subject string) {
+			defer wait.Done()
+			for j := 0; j < 50; j++ {
+				if err := sink.Record(context.Background(), Event{Type: EventLogin, Subject: subject}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(sink, fmt.Sprintf("user%d", i))
+	}
+	wait.Wait()
+
+	if count, _, err := Verify(path); err != nil || count != 100 {
+		t.Errorf("got %d events, %v, want 100 chained events", count, err)
+	}
+}
+
+func TestFileSinkRereadsAfterAnotherWriter(t *testing.T) {
+	path := tempAuditFile(t)
+	first := newTestSink(t, path)
+	record(t, first, "alice")
+	record(t, newTestSink(t, path), "bob")
+	record(t, first, "carol")
+
+	if count, _, err := Verify(path); err != nil || count != 3 {
+		t.Errorf("got %d events, %v, want 3 chained events", count, err)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package audit
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile waits for an exclusive lock on file, which other processes
+// appending to it take too
+func lockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,13 @@
+package audit
+
+import "os"
+
+// lockFile does nothing on Windows, where only one process should write to
+// an audit file at a time
+func lockFile(file *os.File) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
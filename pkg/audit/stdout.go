@@ -0,0 +1,36 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// stdoutSink writes events to stdout as JSON lines, for log collectors to
+// pick up. The application log goes to stderr, so the two don't mix.
+type stdoutSink struct {
+	lock   sync.Mutex
+	output io.Writer
+}
+
+// NewStdoutSink creates an AuditSink writing to stdout
+func NewStdoutSink() AuditSink {
+	return &stdoutSink{output: os.Stdout}
+}
+
+func (s *stdoutSink) Record(ctx context.Context, event Event) error {
+	encoded, err := json.Marshal(Stamp(event))
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err = s.output.Write(append(encoded, '\n'))
+	return err
+}
+
+func (s *stdoutSink) Close() error {
+	return nil
+}
@@ -0,0 +1,86 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// webhookQueueSize is how many events can wait to be sent before new ones are dropped
+const webhookQueueSize int = 1000
+
+// ErrQueueFull is returned when events are recorded faster than a webhook accepts them
+var ErrQueueFull = errors.New("Audit webhook queue is full")
+
+// webhookSink POSTs each event as JSON to a URL. Events are sent in the
+// background, in order, so a slow receiver doesn't hold up requests.
+type webhookSink struct {
+	log    *log.Entry
+	url    string
+	client *http.Client
+	queue  chan Event
+	done   sync.WaitGroup
+	once   sync.Once
+}
+
+// NewWebhookSink creates an AuditSink sending events to url, giving up on
+// each one after timeout
+func NewWebhookSink(url string, timeout time.Duration) AuditSink {
+	s := &webhookSink{
+		log:    log.WithFields(log.Fields{"logger": "AuditWebhook", "url": url}),
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+		queue:  make(chan Event, webhookQueueSize),
+	}
+	s.done.Add(1)
+	go s.send()
+	return s
+}
+
+func (s *webhookSink) Record(ctx context.Context, event Event) error {
+	select {
+	case s.queue <- Stamp(event):
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Close sends the events still queued
+func (s *webhookSink) Close() error {
+	s.once.Do(func() { close(s.queue) })
+	s.done.Wait()
+	return nil
+}
+
+func (s *webhookSink) send() {
+	defer s.done.Done()
+	for event := range s.queue {
+		if err := s.post(event); err != nil {
+			s.log.WithError(err).WithField("event_id", event.ID).Error("Failed to send audit event")
+		}
+	}
+}
+
+func (s *webhookSink) post(event Event) error {
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	response, err := s.client.Post(s.url, "application/json", bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("Webhook responded with %s", response.Status)
+	}
+	return nil
+}
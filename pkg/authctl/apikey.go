@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const apiKeysPath string = "/v1/apikeys"
+
+// apiKey is an API key as the server describes it
+type apiKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	OwnerType  string     `json:"owner_type"`
+	Owner      string     `json:"owner"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// Key is only returned when the key is created
+	Key string `json:"key,omitempty"`
+}
+
+var apiKeyHeaders = []string{"ID", "NAME", "OWNER", "SCOPES", "CREATED", "EXPIRES", "LAST USED"}
+
+func (k apiKey) row() []string {
+	return []string{
+		k.ID, k.Name, k.OwnerType + ":" + k.Owner, join(k.Scopes),
+		formatTime(k.CreatedAt), formatTimePointer(k.ExpiresAt), formatTimePointer(k.LastUsedAt),
+	}
+}
+
+func runAPIKey(c *cli, args []string) error {
+	if len(args) == 0 {
+		return errors.New("Expected list, create, update or delete")
+	}
+	switch args[0] {
+	case "list":
+		return runAPIKeyList(c, args[1:])
+	case "create":
+		return runAPIKeyCreate(c, args[1:])
+	case "update":
+		return runAPIKeyUpdate(c, args[1:])
+	case "delete":
+		return runAPIKeyDelete(c, args[1:])
+	}
+	return fmt.Errorf("Unknown apikey command %q", args[0])
+}
+
+func runAPIKeyList(c *cli, args []string) error {
+	flags := flag.NewFlagSet("apikey list", flag.ExitOnError)
+	ownerType := flags.String("owner-type", "", "List another owner's keys (admin only): user or client")
+	owner := flags.String("owner", "", "Username or client ID, with -owner-type")
+	flags.Parse(args)
+
+	path := apiKeysPath
+	if *ownerType != "" {
+		path += "?" + url.Values{"owner_type": {*ownerType}, "owner": {*owner}}.Encode()
+	}
+	var response struct {
+		APIKeys []apiKey `json:"api_keys"`
+	}
+	if err := c.call(http.MethodGet, path, nil, &response); err != nil {
+		return err
+	}
+
+	rows := [][]string{}
+	for _, key := range response.APIKeys {
+		rows = append(rows, key.row())
+	}
+	return c.print(response.APIKeys, apiKeyHeaders, rows)
+}
+
+func runAPIKeyCreate(c *cli, args []string) error {
+	flags := flag.NewFlagSet("apikey create", flag.ExitOnError)
+	name := flags.String("name", "", "Name of the key (required)")
+	scopes := flags.String("scopes", "", "Comma-separated scopes to limit the key to")
+	expires := flags.Duration("expires", 0, "How long the key is valid, such as 720h (forever when zero)")
+	ownerType := flags.String("owner-type", "", "Create the key for another owner (admin only): user or client")
+	owner := flags.String("owner", "", "Username or client ID, with -owner-type")
+	flags.Parse(args)
+
+	if *name == "" {
+		return errors.New("-name is required")
+	}
+	request := map[string]interface{}{"name": *name, "scopes": split(*scopes)}
+	if *expires > 0 {
+		request["expires_at"] = time.Now().Add(*expires).UTC()
+	}
+	if *ownerType != "" {
+		request["owner_type"], request["owner"] = *ownerType, *owner
+	}
+
+	var key apiKey
+	if err := c.call(http.MethodPost, apiKeysPath, request, &key); err != nil {
+		return err
+	}
+	if err := c.print(key, append(apiKeyHeaders, "KEY"), [][]string{append(key.row(), key.Key)}); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Save the key now, it can't be shown again")
+	return nil
+}
+
+func runAPIKeyUpdate(c *cli, args []string) error {
+	flags := flag.NewFlagSet("apikey update", flag.ExitOnError)
+	name := flags.String("name", "", "New name")
+	scopes := flags.String("scopes", "", "New comma-separated scopes")
+	expires := flags.Duration("expires", 0, "New validity, from now")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Expected the ID of the key to update")
+	}
+	request := map[string]interface{}{}
+	if *name != "" {
+		request["name"] = *name
+	}
+	if *scopes != "" {
+		request["scopes"] = split(*scopes)
+	}
+	if *expires > 0 {
+		request["expires_at"] = time.Now().Add(*expires).UTC()
+	}
+
+	var key apiKey
+	if err := c.call(http.MethodPatch, apiKeysPath+"/"+url.PathEscape(flags.Arg(0)), request, &key); err != nil {
+		return err
+	}
+	return c.print(key, apiKeyHeaders, [][]string{key.row()})
+}
+
+func runAPIKeyDelete(c *cli, args []string) error {
+	flags := flag.NewFlagSet("apikey delete", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Expected the ID of the key to delete")
+	}
+	return c.call(http.MethodDelete, apiKeysPath+"/"+url.PathEscape(flags.Arg(0)), nil, nil)
+}
+
+func formatTimePointer(value *time.Time) string {
+	if value == nil {
+		return "-"
+	}
+	return formatTime(*value)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+)
+
+const adminClientsPath string = "/v1/admin/clients"
+
+// oauthClient is a client registered in CLIENTS, as the admin API describes it
+type oauthClient struct {
+	ClientID   string   `json:"client_id"`
+	AuthMethod string   `json:"token_endpoint_auth_method"`
+	SubjectDN  string   `json:"tls_client_auth_subject_dn"`
+	SANDNS     string   `json:"tls_client_auth_san_dns"`
+	Roles      []string `json:"roles"`
+	Scopes     []string `json:"scopes"`
+}
+
+var clientHeaders = []string{"CLIENT ID", "AUTH METHOD", "CERTIFICATE", "ROLES", "SCOPES"}
+
+func (c oauthClient) row() []string {
+	certificate := "subject " + c.SubjectDN
+	if c.SubjectDN == "" {
+		certificate = "DNS " + c.SANDNS
+	}
+	return []string{c.ClientID, c.AuthMethod, certificate, join(c.Roles), join(c.Scopes)}
+}
+
+func runClient(c *cli, args []string) error {
+	if len(args) == 0 {
+		return errors.New("Expected list")
+	}
+	switch args[0] {
+	case "list":
+		return runClientList(c, args[1:])
+	}
+	return fmt.Errorf("Unknown client command %q", args[0])
+}
+
+func runClientList(c *cli, args []string) error {
+	flags := flag.NewFlagSet("client list", flag.ExitOnError)
+	flags.Parse(args)
+
+	var response struct {
+		Clients []oauthClient `json:"clients"`
+	}
+	if err := c.call(http.MethodGet, adminClientsPath, nil, &response); err != nil {
+		return err
+	}
+	rows := [][]string{}
+	for _, client := range response.Clients {
+		rows = append(rows, client.row())
+	}
+	return c.print(response, clientHeaders, rows)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"auth-server/pkg/signing"
+)
+
+func runKeygen(c *cli, args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	algorithm := flags.String("alg", "ES256", "Signing algorithm: RS256, ES256, ES384 or ES512")
+	out := flags.String("out", "", "File to write the PEM private key to (stdout when empty)")
+	jwksOut := flags.String("jwks", "", "File to write a JWKS holding the public key to")
+	flags.Parse(args)
+
+	key, err := signing.Generate(*algorithm)
+	if err != nil {
+		return err
+	}
+	encoded, err := key.EncodePEM()
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		os.Stdout.Write(encoded)
+	} else if err := writeNewFile(*out, encoded, 0600); err != nil {
+		return err
+	}
+	if *jwksOut != "" {
+		set, err := json.MarshalIndent(signing.Set([]signing.Key{key}), "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeNewFile(*jwksOut, append(set, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Generated %s key %s\n", key.Method.Alg(), key.ID)
+	return nil
+}
+
+func runSecret(c *cli, args []string) error {
+	flags := flag.NewFlagSet("secret", flag.ExitOnError)
+	size := flags.Int("bytes", 64, "Number of random bytes, printed as hex")
+	flags.Parse(args)
+
+	if *size < 32 {
+		return errors.New("Secrets should be at least 32 bytes")
+	}
+	secret := make([]byte, *size)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdout, hex.EncodeToString(secret))
+	return nil
+}
+
+// writeNewFile refuses to overwrite an existing file, so keys aren't lost by accident
+func writeNewFile(path string, data []byte, mode os.FileMode) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	return ioutil.WriteFile(path, data, mode)
+}
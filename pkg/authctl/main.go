@@ -0,0 +1,205 @@
+// authctl is a command-line tool for logging in to and operating the auth server.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"auth-server/pkg/client"
+)
+
+const (
+	serverVariable    string = "AUTHCTL_SERVER"
+	tokenFileVariable string = "AUTHCTL_TOKEN_FILE"
+
+	defaultServer string = "http://localhost:8080"
+
+	outputTable string = "table"
+	outputJSON  string = "json"
+)
+
+// command is one authctl subcommand
+type command struct {
+	usage       string
+	description string
+	run         func(c *cli, args []string) error
+}
+
+var commands = map[string]command{
+	"login":   {"login [-username name] [-password password]", "Log in and store the tokens", runLogin},
+	"refresh": {"refresh", "Get a new access token with the stored refresh token", runRefresh},
+	"logout":  {"logout", "Revoke the stored refresh token and forget the tokens", runLogout},
+	"whoami":  {"whoami", "Show who the stored access token belongs to", runWhoami},
+	"token":   {"token decode|verify [flags] [token]", "Decode or verify a token offline", runToken},
+	"keygen":  {"keygen [-alg ES256] [-out file] [-jwks file]", "Generate a signing key", runKeygen},
+	"secret":  {"secret [-bytes 64]", "Generate a random secret, such as ACCESS_TOKEN_SECRET", runSecret},
+	"apikey":  {"apikey list|create|update|delete [flags]", "Manage API keys, including other users' and clients' as an admin", runAPIKey},
+	"user":    {"user list|get|create|update|delete|roles|disable|enable|reset-password|unlock|sessions|revoke-sessions [flags]", "Manage users and their sessions, as an admin", runUser},
+	"client":  {"client list", "List the OAuth clients registered in CLIENTS, as an admin", runClient},
+}
+
+// cli holds the global flags shared by every command
+type cli struct {
+	server    string
+	tokenFile string
+	output    string
+	stdout    io.Writer
+}
+
+func main() {
+	c := &cli{stdout: os.Stdout}
+
+	flags := flag.NewFlagSet("authctl", flag.ExitOnError)
+	flags.StringVar(&c.server, "server", fromEnv(serverVariable, defaultServer), "Auth server address (or "+serverVariable+")")
+	flags.StringVar(&c.tokenFile, "token-file", fromEnv(tokenFileVariable, defaultTokenFile()), "Where tokens are stored (or "+tokenFileVariable+")")
+	flags.StringVar(&c.output, "o", outputTable, "Output format: table or json")
+	flags.Usage = func() { usage(flags) }
+	flags.Parse(os.Args[1:])
+
+	if flags.NArg() == 0 {
+		usage(flags)
+		os.Exit(2)
+	}
+	if c.output != outputTable && c.output != outputJSON {
+		fmt.Fprintf(os.Stderr, "Unknown output format %q\n", c.output)
+		os.Exit(2)
+	}
+	cmd, found := commands[flags.Arg(0)]
+	if !found {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", flags.Arg(0))
+		usage(flags)
+		os.Exit(2)
+	}
+
+	if err := cmd.run(c, flags.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage(flags *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: authctl [flags] <command>\n\nCommands:\n")
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writer := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(writer, "  %s\t%s\n", commands[name].usage, commands[name].description)
+	}
+	writer.Flush()
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flags.PrintDefaults()
+}
+
+// client returns an auth server client using the stored tokens
+func (c *cli) client() (*client.Client, error) {
+	return client.New(client.Config{
+		BaseURL: c.server,
+		Store:   client.NewFileTokenStore(c.tokenFile),
+	})
+}
+
+// call sends an authenticated JSON request to the auth server, decoding the response into response when it's set
+func (c *cli) call(method, path string, request interface{}, response interface{}) error {
+	authClient, err := c.client()
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader
+	if request != nil {
+		encoded, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	httpRequest, err := http.NewRequest(method, strings.TrimSuffix(c.server, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+
+	httpResponse, err := authClient.HTTPClient().Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return err
+	}
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode > 299 {
+		return client.NewAPIError(httpResponse.StatusCode, responseBody)
+	}
+	if response == nil || len(responseBody) == 0 {
+		return nil
+	}
+	return json.Unmarshal(responseBody, response)
+}
+
+// print writes value as JSON, or as a table of rows under headers
+func (c *cli) print(value interface{}, headers []string, rows [][]string) error {
+	if c.output == outputJSON {
+		encoder := json.NewEncoder(c.stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	}
+
+	writer := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	if len(headers) > 0 {
+		fmt.Fprintln(writer, strings.Join(headers, "\t"))
+	}
+	for _, row := range rows {
+		fmt.Fprintln(writer, strings.Join(row, "\t"))
+	}
+	return writer.Flush()
+}
+
+// defaultTokenFile keeps tokens in the user's config directory
+func defaultTokenFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".authctl-tokens.json"
+	}
+	return filepath.Join(dir, "authctl", "tokens.json")
+}
+
+func fromEnv(variable string, defaultValue string) string {
+	if value, exists := os.LookupEnv(variable); exists {
+		return value
+	}
+	return defaultValue
+}
+
+// join formats a list for a table cell
+func join(items []string) string {
+	if len(items) == 0 {
+		return "-"
+	}
+	return strings.Join(items, ",")
+}
+
+// split parses a comma-separated flag, ignoring empty items
+func split(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
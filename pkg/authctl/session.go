@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	passwordVariable string = "AUTHCTL_PASSWORD"
+	verifyPath       string = "/v1/verify"
+)
+
+func runLogin(c *cli, args []string) error {
+	flags := flag.NewFlagSet("login", flag.ExitOnError)
+	username := flags.String("username", "", "Username (prompted for when empty)")
+	password := flags.String("password", "", "Password (or "+passwordVariable+", prompted for when both are empty)")
+	flags.Parse(args)
+
+	if *username == "" {
+		value, err := prompt("Username: ", false)
+		if err != nil {
+			return err
+		}
+		*username = value
+	}
+	if *password == "" {
+		*password = os.Getenv(passwordVariable)
+	}
+	if *password == "" {
+		value, err := prompt("Password: ", true)
+		if err != nil {
+			return err
+		}
+		*password = value
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.tokenFile), 0700); err != nil {
+		return err
+	}
+	authClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	if err := authClient.Login(context.Background(), *username, *password); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Logged in as %s\n", *username)
+	return nil
+}
+
+func runRefresh(c *cli, args []string) error {
+	authClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	if err := authClient.Refresh(context.Background()); err != nil {
+		return err
+	}
+	tokens, err := authClient.Tokens()
+	if err != nil {
+		return err
+	}
+	return c.print(
+		map[string]interface{}{"expires_at": tokens.Expiry},
+		[]string{"EXPIRES"},
+		[][]string{{formatTime(tokens.Expiry)}},
+	)
+}
+
+func runLogout(c *cli, args []string) error {
+	authClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	if err := authClient.Logout(context.Background()); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Logged out")
+	return nil
+}
+
+// runWhoami asks the server, rather than decoding the token, so revoked or expired tokens show up
+func runWhoami(c *cli, args []string) error {
+	authClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	response, err := authClient.HTTPClient().Get(strings.TrimSuffix(c.server, "/") + verifyPath)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Token was not accepted: %s", response.Status)
+	}
+	tokens, err := authClient.Tokens()
+	if err != nil {
+		return err
+	}
+
+	username := response.Header.Get("X-Auth-User")
+	roles := split(response.Header.Get("X-Auth-Roles"))
+	scopes := split(response.Header.Get("X-Auth-Scopes"))
+	return c.print(
+		map[string]interface{}{"username": username, "roles": roles, "scopes": scopes, "expires_at": tokens.Expiry},
+		[]string{"USERNAME", "ROLES", "SCOPES", "EXPIRES"},
+		[][]string{{username, join(roles), join(scopes), formatTime(tokens.Expiry)}},
+	)
+}
+
+// prompt reads a line from the terminal, without echoing it when secret is set
+func prompt(label string, secret bool) (string, error) {
+	fmt.Fprint(os.Stderr, label)
+	if secret && terminal.IsTerminal(int(os.Stdin.Fd())) {
+		value, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(value), err
+	}
+	value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if value = strings.TrimRight(value, "\r\n"); value == "" && err != nil {
+		return "", errors.New("No input")
+	}
+	return value, nil
+}
+
+func formatTime(value time.Time) string {
+	if value.IsZero() {
+		return "-"
+	}
+	return value.Local().Format(time.RFC3339)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"auth-server/pkg/jwk"
+	"auth-server/pkg/resourceserver"
+	"auth-server/pkg/signing"
+)
+
+func runToken(c *cli, args []string) error {
+	if len(args) == 0 {
+		return errors.New("Expected decode or verify")
+	}
+	switch args[0] {
+	case "decode":
+		return runTokenDecode(c, args[1:])
+	case "verify":
+		return runTokenVerify(c, args[1:])
+	}
+	return fmt.Errorf("Unknown token command %q", args[0])
+}
+
+// runTokenDecode shows what's in a token, without checking it
+func runTokenDecode(c *cli, args []string) error {
+	flags := flag.NewFlagSet("token decode", flag.ExitOnError)
+	flags.Parse(args)
+
+	token, err := c.tokenArgument(flags)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("Not a JWT")
+	}
+	header := map[string]interface{}{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return fmt.Errorf("Invalid token header: %w", err)
+	}
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return fmt.Errorf("Invalid token claims: %w", err)
+	}
+
+	rows := fieldRows("header", header)
+	rows = append(rows, fieldRows("claims", claims)...)
+	return c.print(map[string]interface{}{"header": header, "claims": claims}, []string{"FIELD", "VALUE"}, rows)
+}
+
+// runTokenVerify checks a token the way a resource server would
+func runTokenVerify(c *cli, args []string) error {
+	flags := flag.NewFlagSet("token verify", flag.ExitOnError)
+	secret := flags.String("secret", "", "Shared secret, for HS256 tokens")
+	keyFile := flags.String("key", "", "PEM public or private key file")
+	jwks := flags.String("jwks", "", "JWKS URL or file")
+	issuer := flags.String("issuer", "", "Required issuer")
+	audience := flags.String("audience", "", "Required audience")
+	leeway := flags.Duration("leeway", 0, "Allowed clock skew")
+	flags.Parse(args)
+
+	token, err := c.tokenArgument(flags)
+	if err != nil {
+		return err
+	}
+
+	config := resourceserver.Config{
+		Secret:   []byte(*secret),
+		Issuer:   *issuer,
+		Audience: *audience,
+		Leeway:   *leeway,
+	}
+	if *keyFile != "" {
+		key, err := readPublicKey(*keyFile)
+		if err != nil {
+			return err
+		}
+		config.Keys = append(config.Keys, key)
+	}
+	if strings.HasPrefix(*jwks, "http://") || strings.HasPrefix(*jwks, "https://") {
+		config.JWKSURL = *jwks
+	} else if *jwks != "" {
+		data, err := ioutil.ReadFile(*jwks)
+		if err != nil {
+			return err
+		}
+		var set jwk.Set
+		if err := json.Unmarshal(data, &set); err != nil {
+			return fmt.Errorf("Invalid JWKS file: %w", err)
+		}
+		config.Keys = append(config.Keys, set.Keys...)
+	}
+
+	validator, err := resourceserver.New(config)
+	if err != nil {
+		return errors.New("One of -secret, -key or -jwks is required")
+	}
+	claims, err := validator.Validate(token)
+	if err != nil {
+		return err
+	}
+
+	expires := time.Unix(claims.ExpiresAt, 0)
+	return c.print(claims, []string{"VALID", "SUBJECT", "ROLES", "SCOPES", "EXPIRES"}, [][]string{
+		{"yes", claims.Subject, join(claims.User.Roles), join(claims.User.Scopes), formatTime(expires)},
+	})
+}
+
+// tokenArgument is the token given on the command line, or else the stored access token
+func (c *cli) tokenArgument(flags *flag.FlagSet) (string, error) {
+	if flags.NArg() > 0 {
+		return strings.TrimSpace(flags.Arg(0)), nil
+	}
+	authClient, err := c.client()
+	if err != nil {
+		return "", err
+	}
+	tokens, err := authClient.Tokens()
+	if err != nil {
+		return "", err
+	}
+	return tokens.AccessToken, nil
+}
+
+// readPublicKey reads a PEM public key, or the public half of a private key.
+// Its key ID is its thumbprint, as the server uses.
+func readPublicKey(path string) (jwk.Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return jwk.Key{}, err
+	}
+	if private, err := signing.Parse(data); err == nil {
+		return private.Public, nil
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return jwk.Key{}, fmt.Errorf("No PEM key found in %s", path)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return jwk.Key{}, err
+	}
+	key, err := jwk.New(publicKey)
+	if err != nil {
+		return jwk.Key{}, err
+	}
+	key.KeyID, err = key.Thumbprint()
+	return key, err
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// fieldRows lists the fields of a JSON object, sorted, for a table
+func fieldRows(prefix string, fields map[string]interface{}) [][]string {
+	names := []string{}
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rows := [][]string{}
+	for _, name := range names {
+		value, isString := fields[name].(string)
+		if !isString {
+			encoded, _ := json.Marshal(fields[name])
+			value = string(encoded)
+		}
+		rows = append(rows, []string{prefix + "." + name, value})
+	}
+	return rows
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const adminUsersPath string = "/v1/admin/users"
+
+// user is a user as the admin API describes them
+type user struct {
+	ID            string     `json:"id"`
+	Username      string     `json:"username"`
+	Email         string     `json:"email"`
+	EmailVerified bool       `json:"email_verified"`
+	Disabled      bool       `json:"disabled"`
+	Roles         []string   `json:"roles"`
+	Scopes        []string   `json:"scopes"`
+	FailedLogins  int        `json:"failed_logins"`
+	LockedUntil   *time.Time `json:"locked_until"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// userSession is one of a user's refresh tokens, as the admin API describes it
+type userSession struct {
+	ID        string    `json:"id"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Bound     bool      `json:"bound"`
+}
+
+var userSessionHeaders = []string{"ID", "ISSUED", "EXPIRES", "BOUND"}
+
+func (s userSession) row() []string {
+	return []string{s.ID, formatTime(s.IssuedAt), formatTime(s.ExpiresAt), strconv.FormatBool(s.Bound)}
+}
+
+var userHeaders = []string{"USERNAME", "EMAIL", "VERIFIED", "DISABLED", "ROLES", "SCOPES", "LOCKED UNTIL", "CREATED"}
+
+func (u user) row() []string {
+	return []string{
+		u.Username, u.Email, strconv.FormatBool(u.EmailVerified), strconv.FormatBool(u.Disabled),
+		join(u.Roles), join(u.Scopes), formatTimePointer(u.LockedUntil), formatTime(u.CreatedAt),
+	}
+}
+
+func runUser(c *cli, args []string) error {
+	if len(args) == 0 {
+		return errors.New("Expected list, get, create, update, delete, roles, disable, enable, reset-password, unlock, sessions or revoke-sessions")
+	}
+	switch args[0] {
+	case "list":
+		return runUserList(c, args[1:])
+	case "get":
+		return runUserAction(c, "user get", http.MethodGet, "", args[1:])
+	case "create":
+		return runUserCreate(c, args[1:])
+	case "update":
+		return runUserUpdate(c, args[1:])
+	case "delete":
+		return runUserAction(c, "user delete", http.MethodDelete, "", args[1:])
+	case "roles":
+		return runUserRoles(c, args[1:])
+	case "disable":
+		return runUserAction(c, "user disable", http.MethodPost, "/disable", args[1:])
+	case "enable":
+		return runUserAction(c, "user enable", http.MethodPost, "/enable", args[1:])
+	case "reset-password":
+		if err := runUserAction(c, "user reset-password", http.MethodPost, "/password-reset", args[1:]); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "The user has been emailed a password reset token")
+		return nil
+	case "unlock":
+		return runUserAction(c, "user unlock", http.MethodPost, "/unlock", args[1:])
+	case "sessions":
+		return runUserSessions(c, args[1:])
+	case "revoke-sessions":
+		return runUserRevokeSessions(c, args[1:])
+	}
+	return fmt.Errorf("Unknown user command %q", args[0])
+}
+
+func runUserList(c *cli, args []string) error {
+	flags := flag.NewFlagSet("user list", flag.ExitOnError)
+	query := flags.String("q", "", "Only users whose username or email address contains this")
+	role := flags.String("role", "", "Only users with this role")
+	scope := flags.String("scope", "", "Only users with this scope")
+	disabled := flags.String("disabled", "", "Only disabled (true) or enabled (false) users")
+	locked := flags.String("locked", "", "Only locked out (true) or unlocked (false) users")
+	verified := flags.String("verified", "", "Only users whose email address is verified (true) or not (false)")
+	offset := flags.Int("offset", 0, "How many users to skip")
+	limit := flags.Int("limit", 0, "How many users to show (the server's default when zero)")
+	flags.Parse(args)
+
+	values := url.Values{}
+	for name, value := range map[string]string{
+		"q": *query, "role": *role, "scope": *scope, "disabled": *disabled, "locked": *locked, "email_verified": *verified,
+	} {
+		if value != "" {
+			values.Set(name, value)
+		}
+	}
+	if *offset > 0 {
+		values.Set("offset", strconv.Itoa(*offset))
+	}
+	if *limit > 0 {
+		values.Set("limit", strconv.Itoa(*limit))
+	}
+
+	path := adminUsersPath
+	if len(values) > 0 {
+		path += "?" + values.Encode()
+	}
+	var response struct {
+		Users  []user `json:"users"`
+		Total  int    `json:"total"`
+		Offset int    `json:"offset"`
+		Limit  int    `json:"limit"`
+	}
+	if err := c.call(http.MethodGet, path, nil, &response); err != nil {
+		return err
+	}
+
+	rows := [][]string{}
+	for _, user := range response.Users {
+		rows = append(rows, user.row())
+	}
+	if err := c.print(response, userHeaders, rows); err != nil {
+		return err
+	}
+	if c.output != outputJSON && response.Offset+len(response.Users) < response.Total {
+		fmt.Fprintf(os.Stderr, "Showing %d of %d users, use -offset %d for more\n", len(response.Users), response.Total, response.Offset+len(response.Users))
+	}
+	return nil
+}
+
+func runUserCreate(c *cli, args []string) error {
+	flags := flag.NewFlagSet("user create", flag.ExitOnError)
+	username := flags.String("username", "", "Username (required)")
+	email := flags.String("email", "", "Email address (required)")
+	password := flags.String("password", "", "Password (or "+passwordVariable+", prompted for when both are empty)")
+	verified := flags.Bool("verified", false, "Treat the email address as verified")
+	roles := flags.String("roles", "", "Comma-separated roles")
+	scopes := flags.String("scopes", "", "Comma-separated scopes")
+	flags.Parse(args)
+
+	if *username == "" || *email == "" {
+		return errors.New("-username and -email are required")
+	}
+	if *password == "" {
+		*password = os.Getenv(passwordVariable)
+	}
+	if *password == "" {
+		value, err := prompt("Password: ", true)
+		if err != nil {
+			return err
+		}
+		*password = value
+	}
+
+	request := map[string]interface{}{
+		"username": *username, "email": *email, "password": *password,
+		"email_verified": *verified, "roles": split(*roles), "scopes": split(*scopes),
+	}
+	var created user
+	if err := c.call(http.MethodPost, adminUsersPath, request, &created); err != nil {
+		return err
+	}
+	return c.print(created, userHeaders, [][]string{created.row()})
+}
+
+func runUserUpdate(c *cli, args []string) error {
+	flags := flag.NewFlagSet("user update", flag.ExitOnError)
+	email := flags.String("email", "", "New email address, which is unverified unless -verified is given")
+	verified := flags.String("verified", "", "Whether the email address is verified: true or false")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Expected the username of the user to update")
+	}
+	request := map[string]interface{}{}
+	if *email != "" {
+		request["email"] = *email
+	}
+	if *verified != "" {
+		value, err := strconv.ParseBool(*verified)
+		if err != nil {
+			return errors.New("-verified must be true or false")
+		}
+		request["email_verified"] = value
+	}
+
+	var updated user
+	if err := c.call(http.MethodPatch, adminUsersPath+"/"+url.PathEscape(flags.Arg(0)), request, &updated); err != nil {
+		return err
+	}
+	return c.print(updated, userHeaders, [][]string{updated.row()})
+}
+
+func runUserRoles(c *cli, args []string) error {
+	flags := flag.NewFlagSet("user roles", flag.ExitOnError)
+	roles := flags.String("roles", "", "Comma-separated roles, replacing the user's current ones")
+	scopes := flags.String("scopes", "", "Comma-separated scopes, replacing the user's current ones")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Expected the username of the user to change")
+	}
+	request := map[string]interface{}{"roles": split(*roles), "scopes": split(*scopes)}
+	var updated user
+	if err := c.call(http.MethodPut, adminUsersPath+"/"+url.PathEscape(flags.Arg(0))+"/roles", request, &updated); err != nil {
+		return err
+	}
+	return c.print(updated, userHeaders, [][]string{updated.row()})
+}
+
+// runUserAction calls an admin route for the user named in args, printing
+// the user when the server returns them
+func runUserAction(c *cli, name string, method string, suffix string, args []string) error {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Expected a username")
+	}
+	var response *user
+	if err := c.call(method, adminUsersPath+"/"+url.PathEscape(flags.Arg(0))+suffix, nil, &response); err != nil {
+		return err
+	}
+	if response == nil {
+		return nil
+	}
+	return c.print(response, userHeaders, [][]string{response.row()})
+}
+
+func runUserSessions(c *cli, args []string) error {
+	flags := flag.NewFlagSet("user sessions", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Expected a username")
+	}
+	var response struct {
+		Sessions []userSession `json:"sessions"`
+	}
+	if err := c.call(http.MethodGet, adminUsersPath+"/"+url.PathEscape(flags.Arg(0))+"/sessions", nil, &response); err != nil {
+		return err
+	}
+	rows := [][]string{}
+	for _, session := range response.Sessions {
+		rows = append(rows, session.row())
+	}
+	return c.print(response, userSessionHeaders, rows)
+}
+
+// runUserRevokeSessions revokes the sessions given after the username, or
+// all of the user's sessions when none are
+func runUserRevokeSessions(c *cli, args []string) error {
+	flags := flag.NewFlagSet("user revoke-sessions", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return errors.New("Expected a username, and optionally the IDs of the sessions to revoke")
+	}
+	sessionsPath := adminUsersPath + "/" + url.PathEscape(flags.Arg(0)) + "/sessions"
+	if flags.NArg() == 1 {
+		if err := c.call(http.MethodDelete, sessionsPath, nil, nil); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "The user has been signed out everywhere")
+		return nil
+	}
+	for _, sessionID := range flags.Args()[1:] {
+		if err := c.call(http.MethodDelete, sessionsPath+"/"+url.PathEscape(sessionID), nil, nil); err != nil {
+			return fmt.Errorf("Failed to revoke session %s: %w", sessionID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+// Package client talks to the auth server on behalf of a user. It logs in,
+// keeps the tokens in a TokenStore, and provides an http.RoundTripper that
+// sends the access token with each request, refreshing it when needed.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	loginPath   string = "/v1/login"
+	tokenPath   string = "/v1/token"
+	logoutPath  string = "/v1/logout"
+	userAgent   string = "auth-server-client"
+	contentType string = "application/json"
+
+	defaultTimeout       time.Duration = time.Second * 10
+	defaultRefreshBefore time.Duration = time.Second * 5
+)
+
+// ErrNotLoggedIn is returned when there are no tokens to use
+var ErrNotLoggedIn = errors.New("Not logged in")
+
+// APIError is a response from the auth server that wasn't successful
+type APIError struct {
+	StatusCode int
+	// Code is the stable error code, such as "token_expired", to match on
+	Code    string
+	Message string
+	// RequestID finds the request in the auth server's logs
+	RequestID string
+}
+
+// NewAPIError reads an unsuccessful response's body. Most endpoints respond
+// with problem details; the OAuth token endpoint uses RFC 6749's format.
+func NewAPIError(statusCode int, body []byte) *APIError {
+	var errorBody struct {
+		Code             string `json:"code"`
+		Detail           string `json:"detail"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+		RequestID        string `json:"request_id"`
+	}
+	json.Unmarshal(body, &errorBody)
+	apiError := &APIError{StatusCode: statusCode, Code: errorBody.Code, Message: errorBody.Detail, RequestID: errorBody.RequestID}
+	if apiError.Code == "" {
+		apiError.Code, apiError.Message = errorBody.Error, errorBody.ErrorDescription
+	}
+	return apiError
+}
+
+func (e *APIError) Error() string {
+	switch {
+	case e.Message != "":
+		return fmt.Sprintf("Auth server responded %d: %s", e.StatusCode, e.Message)
+	case e.Code != "":
+		return fmt.Sprintf("Auth server responded %d: %s", e.StatusCode, e.Code)
+	}
+	return fmt.Sprintf("Auth server responded %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Config sets where the auth server is, and how tokens are kept
+type Config struct {
+	// BaseURL is the auth server's address, such as https://auth.example.com
+	BaseURL string
+	// HTTPClient talks to the auth server. Defaults to a client with a 10
+	// second timeout.
+	HTTPClient *http.Client
+	// Store keeps the tokens. Defaults to keeping them in memory.
+	Store TokenStore
+	// RefreshBefore is how long before it expires the access token is
+	// refreshed. Defaults to 5 seconds.
+	RefreshBefore time.Duration
+}
+
+// Client logs in to the auth server and keeps the resulting tokens fresh. It's
+// safe for concurrent use.
+type Client struct {
+	baseURL       string
+	httpClient    *http.Client
+	store         TokenStore
+	refreshBefore time.Duration
+	now           func() time.Time
+
+	// refreshLock is held while refreshing, so concurrent requests that need
+	// a new access token share a single refresh
+	refreshLock sync.Mutex
+	// refreshes counts refreshes, so callers that waited for refreshLock can
+	// tell one happened even when the new token is identical to the old one,
+	// as tokens issued within the same second are. It's read atomically.
+	refreshes uint64
+}
+
+func New(config Config) (*Client, error) {
+	if config.BaseURL == "" {
+		return nil, errors.New("BaseURL is required")
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: defaultTimeout}
+	}
+	if config.Store == nil {
+		config.Store = NewMemoryTokenStore()
+	}
+	if config.RefreshBefore <= 0 {
+		config.RefreshBefore = defaultRefreshBefore
+	}
+	return &Client{
+		baseURL:       strings.TrimSuffix(config.BaseURL, "/"),
+		httpClient:    config.HTTPClient,
+		store:         config.Store,
+		refreshBefore: config.RefreshBefore,
+		now:           time.Now,
+	}, nil
+}
+
+// Login exchanges a username and password for tokens, and stores them
+func (c *Client) Login(ctx context.Context, username, password string) error {
+	var response struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	request := map[string]string{"username": username, "password": password}
+	if err := c.call(ctx, http.MethodPost, loginPath, request, &response); err != nil {
+		return err
+	}
+	return c.store.Save(Tokens{
+		AccessToken:  response.AccessToken,
+		RefreshToken: response.RefreshToken,
+		Expiry:       tokenExpiry(response.AccessToken),
+	})
+}
+
+// Tokens returns the stored tokens, as they are
+func (c *Client) Tokens() (Tokens, error) {
+	tokens, err := c.store.Load()
+	if err == ErrNoTokens {
+		return Tokens{}, ErrNotLoggedIn
+	}
+	return tokens, err
+}
+
+// AccessToken returns an access token to use, refreshing it first if it's
+// about to expire
+func (c *Client) AccessToken(ctx context.Context) (string, error) {
+	accessToken, _, err := c.accessToken(ctx)
+	return accessToken, err
+}
+
+// accessToken is AccessToken, also returning how many refreshes had
+// happened before the token was read, for refreshing it again later
+func (c *Client) accessToken(ctx context.Context) (string, uint64, error) {
+	refreshes := atomic.LoadUint64(&c.refreshes)
+	tokens, err := c.Tokens()
+	if err != nil {
+		return "", 0, err
+	}
+	if !c.expiring(tokens) {
+		return tokens.AccessToken, refreshes, nil
+	}
+	accessToken, err := c.refresh(ctx, tokens.AccessToken, refreshes)
+	return accessToken, atomic.LoadUint64(&c.refreshes), err
+}
+
+// Refresh gets a new access token with the refresh token, even if the current one is still valid
+func (c *Client) Refresh(ctx context.Context) error {
+	refreshes := atomic.LoadUint64(&c.refreshes)
+	tokens, err := c.Tokens()
+	if err != nil {
+		return err
+	}
+	_, err = c.refresh(ctx, tokens.AccessToken, refreshes)
+	return err
+}
+
+// refresh replaces stale, which was read after the given number of
+// refreshes, unless another caller already has while we waited for the lock
+func (c *Client) refresh(ctx context.Context, stale string, refreshes uint64) (string, error) {
+	c.refreshLock.Lock()
+	defer c.refreshLock.Unlock()
+
+	tokens, err := c.Tokens()
+	if err != nil {
+		return "", err
+	}
+	if tokens.AccessToken != stale || atomic.LoadUint64(&c.refreshes) != refreshes {
+		return tokens.AccessToken, nil
+	}
+	if tokens.RefreshToken == "" {
+		return "", ErrNotLoggedIn
+	}
+
+	var response struct {
+		AccessToken string `json:"access_token"`
+	}
+	request := map[string]string{"refresh_token": tokens.RefreshToken}
+	if err := c.call(ctx, http.MethodPost, tokenPath, request, &response); err != nil {
+		return "", err
+	}
+
+	tokens.AccessToken = response.AccessToken
+	tokens.Expiry = tokenExpiry(response.AccessToken)
+	if err := c.store.Save(tokens); err != nil {
+		return "", err
+	}
+	atomic.AddUint64(&c.refreshes, 1)
+	return tokens.AccessToken, nil
+}
+
+// Logout revokes the refresh token and clears the stored tokens
+func (c *Client) Logout(ctx context.Context) error {
+	tokens, err := c.Tokens()
+	if err != nil {
+		return err
+	}
+	if tokens.RefreshToken != "" {
+		request := map[string]string{"refresh_token": tokens.RefreshToken}
+		if err := c.call(ctx, http.MethodDelete, logoutPath, request, nil); err != nil {
+			return err
+		}
+	}
+	return c.store.Clear()
+}
+
+// Close logs out, if logged in. Clients using a persistent store to stay
+// logged in between runs shouldn't call it.
+func (c *Client) Close() error {
+	err := c.Logout(context.Background())
+	if err == ErrNotLoggedIn {
+		return nil
+	}
+	return err
+}
+
+// HTTPClient returns an HTTP client that authenticates its requests, as
+// described for Transport
+func (c *Client) HTTPClient() *http.Client {
+	return &http.Client{Transport: c.Transport(nil)}
+}
+
+// expiring reports whether the access token should be refreshed before use
+func (c *Client) expiring(tokens Tokens) bool {
+	if tokens.Expiry.IsZero() {
+		return false
+	}
+	return c.now().Add(c.refreshBefore).After(tokens.Expiry)
+}
+
+// call sends a JSON request to the auth server, decoding the response into response when it's set
+func (c *Client) call(ctx context.Context, method, path string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", contentType)
+	httpRequest.Header.Set("Accept", contentType)
+	httpRequest.Header.Set("User-Agent", userAgent)
+
+	httpResponse, err := c.httpClient.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return err
+	}
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode > 299 {
+		return NewAPIError(httpResponse.StatusCode, responseBody)
+	}
+	if response == nil {
+		return nil
+	}
+	if err := json.Unmarshal(responseBody, response); err != nil {
+		return fmt.Errorf("Failed to read response from %s: %w", path, err)
+	}
+	return nil
+}
+
+// tokenExpiry reads the exp claim of a token, without checking its signature.
+// That's the job of whoever receives the token.
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		ExpiresAt int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.ExpiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.ExpiresAt, 0)
+}
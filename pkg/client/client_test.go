@@ -0,0 +1,325 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"auth-server/pkg/app"
+	"auth-server/pkg/audit"
+	"auth-server/pkg/config"
+	"auth-server/pkg/store"
+	"auth-server/pkg/webhook"
+)
+
+const (
+	testUsername string = "alice"
+	testPassword string = "correct horse battery staple"
+)
+
+// testServer runs the real router, counting the calls made to each path
+type testServer struct {
+	*httptest.Server
+	lock  sync.Mutex
+	calls map[string]int
+}
+
+func newTestServer(t *testing.T) *testServer {
+	appConfig, err := config.Load(config.LoadOptions{Overrides: map[string]string{
+		"ACCESS_TOKEN_SECRET":  strings.Repeat("a", 32),
+		"REFRESH_TOKEN_SECRET": strings.Repeat("r", 32),
+		"ACTION_TOKEN_SECRET":  strings.Repeat("x", 32),
+		"LOG_LEVEL":            "error",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appConfig.ConfigureLogger()
+	gin.SetMode(gin.TestMode)
+
+	users := store.NewMemoryUserStore()
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	err = users.Create(context.Background(), store.User{
+		ID: "alice-id", Username: testUsername, Email: "alice@example.com", PasswordHash: string(passwordHash),
+		EmailVerified: true, CreatedAt: now, UpdatedAt: now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatcher, err := webhook.NewDispatcher(appConfig.Webhooks, store.NewMemoryDeliveryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditSink, err := audit.New(appConfig.Audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := app.New(config.NewHolder(appConfig), users, store.NewMemoryAPIKeyStore(), dispatcher, auditSink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &testServer{calls: map[string]int{}}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		server.lock.Lock()
+		server.calls[request.URL.Path]++
+		server.lock.Unlock()
+		api.Router.ServeHTTP(writer, request)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *testServer) callCount(path string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.calls[path]
+}
+
+func newTestClient(t *testing.T, server *testServer, store TokenStore) *Client {
+	client, err := New(Config{BaseURL: server.URL, Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func login(t *testing.T, client *Client) {
+	if err := client.Login(context.Background(), testUsername, testPassword); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ping calls an endpoint needing an access token through the client's transport
+func ping(t *testing.T, client *Client, server *testServer) {
+	response, err := client.HTTPClient().Get(server.URL + "/v1/test/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(response.Body)
+		t.Fatalf("Ping responded %d: %s", response.StatusCode, body)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(t, server, nil)
+
+	if _, err := client.Tokens(); err != ErrNotLoggedIn {
+		t.Fatalf("Tokens before logging in: got %v, want ErrNotLoggedIn", err)
+	}
+
+	err := client.Login(context.Background(), testUsername, "wrong password")
+	var apiError *APIError
+	if !errors.As(err, &apiError) || apiError.StatusCode != http.StatusUnauthorized || apiError.Code != "invalid_credentials" || apiError.RequestID == "" {
+		t.Fatalf("Login with the wrong password: got %#v", err)
+	}
+
+	login(t, client)
+	tokens, err := client.Tokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("Missing tokens: %+v", tokens)
+	}
+	if until := time.Until(tokens.Expiry); until <= 0 || until > time.Hour {
+		t.Errorf("Unexpected access token expiry %s", tokens.Expiry)
+	}
+	ping(t, client, server)
+	if calls := server.callCount(tokenPath); calls != 0 {
+		t.Errorf("A fresh access token was refreshed %d times", calls)
+	}
+}
+
+func TestAccessTokenRefreshesBeforeExpiry(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(t, server, nil)
+	login(t, client)
+
+	// Within RefreshBefore of the access token's expiry
+	tokens, _ := client.Tokens()
+	client.now = func() time.Time { return tokens.Expiry.Add(-client.refreshBefore / 2) }
+
+	if _, err := client.AccessToken(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if calls := server.callCount(tokenPath); calls != 1 {
+		t.Fatalf("Got %d refreshes, want 1", calls)
+	}
+	refreshed, _ := client.Tokens()
+	if refreshed.RefreshToken != tokens.RefreshToken {
+		t.Error("The refresh token changed")
+	}
+}
+
+func TestTransportRetriesAfterUnauthorized(t *testing.T) {
+	server := newTestServer(t)
+	memoryStore := NewMemoryTokenStore()
+	client := newTestClient(t, server, memoryStore)
+	login(t, client)
+
+	// An access token the server won't accept, though it hasn't expired
+	tokens, _ := client.Tokens()
+	tokens.AccessToken = "revoked"
+	tokens.Expiry = time.Now().Add(time.Hour)
+	if err := memoryStore.Save(tokens); err != nil {
+		t.Fatal(err)
+	}
+
+	ping(t, client, server)
+	if calls := server.callCount(tokenPath); calls != 1 {
+		t.Errorf("Got %d refreshes, want 1", calls)
+	}
+	if calls := server.callCount("/v1/test/ping"); calls != 2 {
+		t.Errorf("Got %d pings, want 2", calls)
+	}
+}
+
+func TestConcurrentRefreshesShareOneCall(t *testing.T) {
+	server := newTestServer(t)
+	memoryStore := NewMemoryTokenStore()
+	client := newTestClient(t, server, memoryStore)
+	login(t, client)
+
+	// The access token is about to expire. It's refreshed straight after
+	// logging in, so the new one is likely identical apart from its expiry.
+	tokens, _ := client.Tokens()
+	tokens.Expiry = time.Now()
+	if err := memoryStore.Save(tokens); err != nil {
+		t.Fatal(err)
+	}
+
+	var wait sync.WaitGroup
+	var failures int32
+	for i := 0; i < 20; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if _, err := client.AccessToken(context.Background()); err != nil {
+				atomic.AddInt32(&failures, 1)
+			}
+		}()
+	}
+	wait.Wait()
+
+	if failures > 0 {
+		t.Errorf("%d callers failed to get an access token", failures)
+	}
+	if calls := server.callCount(tokenPath); calls != 1 {
+		t.Fatalf("Got %d refreshes, want exactly 1", calls)
+	}
+}
+
+func TestCloseLogsOut(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(t, server, nil)
+	login(t, client)
+	tokens, _ := client.Tokens()
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if calls := server.callCount(logoutPath); calls != 1 {
+		t.Errorf("Got %d logouts, want 1", calls)
+	}
+	if _, err := client.Tokens(); err != ErrNotLoggedIn {
+		t.Errorf("Tokens after Close: got %v, want ErrNotLoggedIn", err)
+	}
+
+	// The refresh token was revoked
+	other := newTestClient(t, server, nil)
+	other.store.Save(tokens)
+	var apiError *APIError
+	if err := other.Refresh(context.Background()); !errors.As(err, &apiError) || apiError.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Refreshing with a revoked refresh token: got %v", err)
+	}
+
+	// Closing again has nothing to do
+	if err := client.Close(); err != nil {
+		t.Errorf("Close when logged out: %v", err)
+	}
+}
+
+func TestFileTokenStore(t *testing.T) {
+	directory, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "tokens.json")
+	tokenStore := NewFileTokenStore(path)
+
+	if _, err := tokenStore.Load(); err != ErrNoTokens {
+		t.Fatalf("Load before saving: got %v, want ErrNoTokens", err)
+	}
+
+	saved := Tokens{AccessToken: "access", RefreshToken: "refresh", Expiry: time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)}
+	if err := tokenStore.Save(saved); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Got permissions %v, want 0600", info.Mode().Perm())
+	}
+	files, _ := ioutil.ReadDir(directory)
+	if len(files) != 1 {
+		t.Errorf("Got %d files, want only the token file", len(files))
+	}
+
+	// Another store on the same file, as after a restart
+	loaded, err := NewFileTokenStore(path).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.AccessToken != saved.AccessToken || loaded.RefreshToken != saved.RefreshToken || !loaded.Expiry.Equal(saved.Expiry) {
+		t.Errorf("Got %+v, want %+v", loaded, saved)
+	}
+
+	if err := tokenStore.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokenStore.Load(); err != ErrNoTokens {
+		t.Errorf("Load after Clear: got %v, want ErrNoTokens", err)
+	}
+	if err := tokenStore.Clear(); err != nil {
+		t.Errorf("Clearing an empty store: %v", err)
+	}
+}
+
+func TestFileTokenStoreKeepsLoginBetweenClients(t *testing.T) {
+	server := newTestServer(t)
+	directory, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "tokens.json")
+
+	login(t, newTestClient(t, server, NewFileTokenStore(path)))
+	ping(t, newTestClient(t, server, NewFileTokenStore(path)), server)
+	if calls := server.callCount(loginPath); calls != 1 {
+		t.Errorf("Got %d logins, want 1", calls)
+	}
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrNoTokens is returned by a TokenStore that holds no tokens
+var ErrNoTokens = errors.New("No tokens stored")
+
+// Tokens are what a login returns
+type Tokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	// Expiry is when the access token expires, read from its exp claim. It's
+	// zero when the token has no exp claim.
+	Expiry time.Time `json:"expiry,omitempty"`
+}
+
+// TokenStore keeps tokens between requests, and possibly between runs
+type TokenStore interface {
+	// Load returns ErrNoTokens when nothing is stored
+	Load() (Tokens, error)
+	Save(tokens Tokens) error
+	Clear() error
+}
+
+type memoryTokenStore struct {
+	lock   sync.Mutex
+	tokens *Tokens
+}
+
+// NewMemoryTokenStore keeps tokens until the process exits
+func NewMemoryTokenStore() TokenStore {
+	return &memoryTokenStore{}
+}
+
+func (s *memoryTokenStore) Load() (Tokens, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.tokens == nil {
+		return Tokens{}, ErrNoTokens
+	}
+	return *s.tokens, nil
+}
+
+func (s *memoryTokenStore) Save(tokens Tokens) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tokens = &tokens
+	return nil
+}
+
+func (s *memoryTokenStore) Clear() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tokens = nil
+	return nil
+}
+
+type fileTokenStore struct {
+	path string
+	lock sync.Mutex
+}
+
+// NewFileTokenStore keeps tokens in a JSON file, readable only by its owner,
+// so they survive restarts
+func NewFileTokenStore(path string) TokenStore {
+	return &fileTokenStore{path: path}
+}
+
+func (s *fileTokenStore) Load() (Tokens, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return Tokens{}, ErrNoTokens
+	}
+	if err != nil {
+		return Tokens{}, err
+	}
+	var tokens Tokens
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return Tokens{}, err
+	}
+	if tokens.AccessToken == "" && tokens.RefreshToken == "" {
+		return Tokens{}, ErrNoTokens
+	}
+	return tokens, nil
+}
+
+func (s *fileTokenStore) Save(tokens Tokens) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a crash can't leave half a file behind
+	temp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(temp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), s.path)
+}
+
+func (s *fileTokenStore) Clear() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
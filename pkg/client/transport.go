@@ -0,0 +1,71 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+type transport struct {
+	client *Client
+	base   http.RoundTripper
+}
+
+// Transport sends requests through base (http.DefaultTransport when nil) with
+// the access token as an "Authorization: Bearer" header. The token is
+// refreshed shortly before it expires, and once more if a request gets a 401
+// anyway, after which the request is retried.
+func (c *Client) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{client: c, base: base}
+}
+
+func (t *transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	accessToken, refreshes, err := t.client.accessToken(request.Context())
+	if err != nil {
+		closeBody(request)
+		return nil, err
+	}
+
+	response, err := t.base.RoundTrip(authorize(request, accessToken))
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+
+	// The token may have been revoked or the clocks may disagree, so refresh
+	// once and retry, if the body can be sent again
+	if request.Body != nil && request.GetBody == nil {
+		return response, nil
+	}
+	accessToken, err = t.client.refresh(request.Context(), accessToken, refreshes)
+	if err != nil {
+		// Let the caller see the original 401
+		return response, nil
+	}
+	retry := authorize(request, accessToken)
+	if request.Body != nil {
+		if retry.Body, err = request.GetBody(); err != nil {
+			return response, nil
+		}
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+
+	return t.base.RoundTrip(retry)
+}
+
+// authorize copies a request, since a RoundTripper mustn't modify the one it's given
+func authorize(request *http.Request, accessToken string) *http.Request {
+	clone := request.Clone(request.Context())
+	clone.Header.Set("Authorization", "Bearer "+accessToken)
+	return clone
+}
+
+// closeBody closes the request body, as a RoundTripper must even when it fails
+func closeBody(request *http.Request) {
+	if request.Body != nil {
+		request.Body.Close()
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"auth-server/pkg/audit"
+	"auth-server/pkg/config"
+	"auth-server/pkg/mailer"
+	"auth-server/pkg/password"
+	"auth-server/pkg/signing"
+	"auth-server/pkg/store"
+	tokenservicev1 "auth-server/pkg/v1/service"
+	"auth-server/pkg/version"
+	"auth-server/pkg/webhook"
+)
+
+// commandActor is the actor of audit events recorded by server commands
+const commandActor string = "cli"
+
+func runKeygen(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	algorithm := flags.String("alg", "ES256", "Signing algorithm: RS256, ES256, ES384 or ES512")
+	out := flags.String("out", "signing.pem", "File to write the PEM private key to")
+	jwksOut := flags.String("jwks", "jwks.json", "File to write a JWKS holding the public key to")
+	flags.Parse(args)
+
+	key, err := signing.Generate(*algorithm)
+	if err != nil {
+		return err
+	}
+	encoded, err := key.EncodePEM()
+	if err != nil {
+		return err
+	}
+	set, err := json.MarshalIndent(signing.Set([]signing.Key{key}), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Never overwrite a key, which would invalidate every token it signed
+	for _, path := range []string{*out, *jwksOut} {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s already exists", path)
+		}
+	}
+	if err := ioutil.WriteFile(*out, encoded, 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*jwksOut, append(set, '\n'), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s key %s to %s, and its public key to %s\n", key.Method.Alg(), key.ID, *out, *jwksOut)
+	return nil
+}
+
+func runUser(args []string) error {
+	if len(args) == 0 {
+		return errors.New("Expected add, passwd or disable")
+	}
+	switch args[0] {
+	case "add":
+		return runUserAdd(args[1:])
+	case "passwd":
+		return runUserPasswd(args[1:])
+	case "disable":
+		return runUserDisable(args[1:])
+	}
+	return fmt.Errorf("Unknown user command %q", args[0])
+}
+
+func runUserAdd(args []string) error {
+	flags := flag.NewFlagSet("user add", flag.ExitOnError)
+	username := flags.String("username", "", "Username (required)")
+	email := flags.String("email", "", "Email address (required)")
+	newPassword := flags.String("password", "", "Password (prompted for when empty)")
+	roles := flags.String("roles", "", "Comma-separated roles")
+	scopes := flags.String("scopes", "", "Comma-separated scopes")
+	verified := flags.Bool("verified", true, "Treat the email address as verified")
+	configOptions := addConfigFlags(flags)
+	flags.Parse(args)
+
+	if *username == "" || *email == "" {
+		return errors.New("-username and -email are required")
+	}
+	services, err := newCommandServices(configOptions)
+	if err != nil {
+		return err
+	}
+	defer services.Close()
+	if *newPassword == "" {
+		if *newPassword, err = promptPassword(); err != nil {
+			return err
+		}
+	}
+
+	user, err := services.users.Create(context.Background(), store.User{
+		Username:      *username,
+		Email:         *email,
+		EmailVerified: *verified,
+		Roles:         splitList(*roles),
+		Scopes:        splitList(*scopes),
+	}, *newPassword)
+	services.recordAudit(audit.EventUserCreated, *username, err)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added user %s (%s)\n", user.Username, user.ID)
+	return nil
+}
+
+func runUserPasswd(args []string) error {
+	flags := flag.NewFlagSet("user passwd", flag.ExitOnError)
+	username := flags.String("username", "", "Username (required)")
+	newPassword := flags.String("password", "", "New password (prompted for when empty)")
+	configOptions := addConfigFlags(flags)
+	flags.Parse(args)
+
+	if *username == "" {
+		return errors.New("-username is required")
+	}
+	services, err := newCommandServices(configOptions)
+	if err != nil {
+		return err
+	}
+	defer services.Close()
+	if *newPassword == "" {
+		if *newPassword, err = promptPassword(); err != nil {
+			return err
+		}
+	}
+
+	err = services.users.SetPassword(context.Background(), *username, *newPassword)
+	services.recordAudit(audit.EventUserPasswordSet, *username, err)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Changed the password of %s\n", *username)
+	return nil
+}
+
+func runUserDisable(args []string) error {
+	flags := flag.NewFlagSet("user disable", flag.ExitOnError)
+	username := flags.String("username", "", "Username (required)")
+	enable := flags.Bool("enable", false, "Re-enable the user instead")
+	configOptions := addConfigFlags(flags)
+	flags.Parse(args)
+
+	if *username == "" {
+		return errors.New("-username is required")
+	}
+	services, err := newCommandServices(configOptions)
+	if err != nil {
+		return err
+	}
+	defer services.Close()
+
+	err = services.users.SetDisabled(context.Background(), *username, !*enable)
+	eventType := audit.EventUserDisabled
+	if *enable {
+		eventType = audit.EventUserEnabled
+	}
+	services.recordAudit(eventType, *username, err)
+	if err != nil {
+		return err
+	}
+	if *enable {
+		fmt.Printf("Enabled %s\n", *username)
+	} else {
+		fmt.Printf("Disabled %s\n", *username)
+	}
+	return nil
+}
+
+// commandServices are what the user commands work with
+type commandServices struct {
+	users  tokenservicev1.UserService
+	audit  audit.AuditSink
+	outbox store.DeliveryStore
+}
+
+// newCommandServices works on the user store file directly. The server
+// keeps its own copy of the users in memory, and would overwrite changes made
+// while it runs. Changes are recorded in the audit sinks the server uses, and
+// webhook deliveries are left in WEBHOOK_OUTBOX_FILE for the server to send.
+func newCommandServices(configOptions *configFlags) (*commandServices, error) {
+	appConfig, err := configOptions.load()
+	if err != nil {
+		return nil, err
+	}
+	if appConfig.UserStoreFile == "" {
+		return nil, errors.New("USER_STORE_FILE isn't set, so there are no saved users to manage")
+	}
+
+	userStore, err := store.NewFileUserStore(appConfig.UserStoreFile)
+	if err != nil {
+		return nil, err
+	}
+	passwordPolicy, err := password.NewPolicy(appConfig.Password)
+	if err != nil {
+		return nil, err
+	}
+	auditSink, err := audit.New(appConfig.Audit)
+	if err != nil {
+		return nil, err
+	}
+	outbox, err := newDeliveryStore(appConfig)
+	if err != nil {
+		return nil, err
+	}
+	dispatcher, err := webhook.NewDispatcher(appConfig.Webhooks, outbox)
+	if err != nil {
+		return nil, err
+	}
+	// Nothing is emailed by these commands, no users are deleted along with
+	// their API keys, and there are no sessions to revoke
+	mailService := mailer.NewLogMailer(config.MailConfig{})
+	configHolder := config.NewHolder(appConfig)
+	jwtService := tokenservicev1.NewJWTService(configHolder, nil)
+	actionTokenService := tokenservicev1.NewActionTokenService(configHolder)
+	return &commandServices{
+		users:  tokenservicev1.NewUserService(configHolder, userStore, store.NewMemoryAPIKeyStore(), mailService, actionTokenService, jwtService, passwordPolicy, dispatcher),
+		audit:  auditSink,
+		outbox: outbox,
+	}, nil
+}
+
+// Close saves the audit events and webhook deliveries
+func (s *commandServices) Close() {
+	if err := s.audit.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to close audit sinks: %v\n", err)
+	}
+	if err := s.outbox.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save webhook outbox: %v\n", err)
+	}
+}
+
+// recordAudit records a change made to a user by a command
+func (s *commandServices) recordAudit(eventType string, username string, err error) {
+	event := audit.Event{Type: eventType, Actor: commandActor, Subject: username, Outcome: audit.OutcomeSuccess}
+	if err != nil {
+		event.Outcome, event.Reason = audit.OutcomeFailure, err.Error()
+	}
+	if err := s.audit.Record(context.Background(), event); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record audit event: %v\n", err)
+	}
+}
+
+func runAudit(args []string) error {
+	if len(args) == 0 || args[0] != "verify" {
+		return errors.New("Expected verify")
+	}
+	flags := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	path := flags.String("file", "", "Audit file to check, instead of AUDIT_FILE")
+	configOptions := addConfigFlags(flags)
+	flags.Parse(args[1:])
+
+	if *path == "" {
+		appConfig, err := configOptions.load()
+		if err != nil {
+			return err
+		}
+		if *path = appConfig.Audit.File; *path == "" {
+			return errors.New("AUDIT_FILE isn't set, so pass -file")
+		}
+	}
+
+	count, lastHash, err := audit.Verify(*path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *path, err)
+	}
+	fmt.Printf("%s: %d events, chain intact\nLast hash: %s\n", *path, count, lastHash)
+	return nil
+}
+
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configOptions := addConfigFlags(flags)
+	flags.Parse(args)
+
+	appConfig, err := configOptions.load()
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{appConfig.UserStoreFile, appConfig.APIKeyStoreFile} {
+		if path == "" {
+			continue
+		}
+		version, err := store.MigrateFile(path)
+		if err != nil {
+			return err
+		}
+		if version == store.SchemaVersion {
+			fmt.Printf("%s is up to date\n", path)
+		} else {
+			fmt.Printf("Migrated %s from schema version %d to %d\n", path, version, store.SchemaVersion)
+		}
+	}
+	return nil
+}
+
+// runCheckConfig loads everything serve would, reporting all problems found
+func runCheckConfig(args []string) error {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	configOptions := addConfigFlags(flags)
+	flags.Parse(args)
+
+	// Invalid settings are listed with the rest, after the settings themselves
+	problems := []string{}
+	appConfig, err := configOptions.load()
+	var validationErr *config.ValidationError
+	if errors.As(err, &validationErr) {
+		problems = append(problems, validationErr.Problems...)
+	} else if err != nil {
+		return err
+	}
+	if _, err := signing.Load(appConfig.SigningKeyFiles); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if passwordPolicy, err := password.NewPolicy(appConfig.Password); err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		passwordPolicy.Close()
+	}
+	if _, err := newUserStore(appConfig); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := newAPIKeyStore(appConfig); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, setting := range appConfig.Redacted().Settings() {
+		fmt.Fprintf(writer, "%s\t%s\n", setting.Name, setting.Value)
+	}
+	writer.Flush()
+
+	if len(problems) > 0 {
+		return &config.ValidationError{Problems: problems}
+	}
+	fmt.Fprintln(os.Stderr, "Configuration is valid")
+	return nil
+}
+
+// promptPassword reads a password from the terminal without echoing it, or a line from stdin
+func promptPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		value, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(value), err
+	}
+	value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if value = strings.TrimRight(value, "\r\n"); value == "" && err != nil {
+		return "", errors.New("No password given")
+	}
+	return value, nil
+}
+
+// splitList parses a comma-separated flag, ignoring empty items
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// runVersion prints what build this is
+func runVersion(args []string) error {
+	info := version.Get()
+	fmt.Printf("authserver %s (commit %s, built %s, %s)\n", info.Version, info.Commit, info.Date, info.GoVersion)
+	return nil
+}
@@ -1,8 +1,8 @@
 package config
 
 import (
-	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -13,15 +13,172 @@ const (
 	logLevelVariable           string = "LOG_LEVEL"
 	accessTokenVariable        string = "ACCESS_TOKEN_SECRET"
 	refreshTokenVariable       string = "REFRESH_TOKEN_SECRET"
+	actionTokenVariable        string = "ACTION_TOKEN_SECRET"
 	accessTokenExpireVariable  string = "ACCESS_TOKEN_EXPIRE"
 	refreshTokenExpireVariable string = "REFRESH_TOKEN_EXPIRE"
 	issuerVariable             string = "ISSUER"
+	audienceVariable           string = "AUDIENCE"
+	signingKeyFilesVariable    string = "SIGNING_KEY_FILES"
+	tokenLeewayVariable        string = "TOKEN_LEEWAY"
+	publicURLVariable          string = "PUBLIC_URL"
+	userStoreFileVariable      string = "USER_STORE_FILE"
+	apiKeyStoreFileVariable    string = "API_KEY_STORE_FILE"
+	adminRoleVariable          string = "ADMIN_ROLE"
+	clientsVariable            string = "CLIENTS"
+
+	listenAddressVariable     string = "LISTEN_ADDRESS"
+	tlsCertFileVariable       string = "TLS_CERT_FILE"
+	tlsKeyFileVariable        string = "TLS_KEY_FILE"
+	tlsClientCAFileVariable   string = "TLS_CLIENT_CA_FILE"
+	tlsClientAuthVariable     string = "TLS_CLIENT_AUTH"
+	readTimeoutVariable       string = "READ_TIMEOUT"
+	readHeaderTimeoutVariable string = "READ_HEADER_TIMEOUT"
+	writeTimeoutVariable      string = "WRITE_TIMEOUT"
+	idleTimeoutVariable       string = "IDLE_TIMEOUT"
+	shutdownTimeoutVariable   string = "SHUTDOWN_TIMEOUT"
+
+	passwordMinLengthVariable        string = "PASSWORD_MIN_LENGTH"
+	passwordMaxLengthVariable        string = "PASSWORD_MAX_LENGTH"
+	passwordRequireUpperVariable     string = "PASSWORD_REQUIRE_UPPERCASE"
+	passwordRequireLowerVariable     string = "PASSWORD_REQUIRE_LOWERCASE"
+	passwordRequireDigitVariable     string = "PASSWORD_REQUIRE_DIGIT"
+	passwordRequireSymbolVariable    string = "PASSWORD_REQUIRE_SYMBOL"
+	passwordDisallowUsernameVariable string = "PASSWORD_DISALLOW_USERNAME"
+	breachedPasswordsFileVariable    string = "BREACHED_PASSWORDS_FILE"
+	passwordResetTokenExpireVariable string = "PASSWORD_RESET_TOKEN_EXPIRE"
+	passwordResetURLVariable         string = "PASSWORD_RESET_URL"
+	verificationTokenExpireVariable  string = "VERIFICATION_TOKEN_EXPIRE"
+	allowUnverifiedLoginVariable     string = "ALLOW_UNVERIFIED_LOGIN"
+	unverifiedLoginScopesVariable    string = "UNVERIFIED_LOGIN_SCOPES"
+
+	dpopProofMaxAgeVariable   string = "DPOP_PROOF_MAX_AGE"
+	dpopRequireNonceVariable  string = "DPOP_REQUIRE_NONCE"
+	dpopNonceLifetimeVariable string = "DPOP_NONCE_LIFETIME"
+
+	emailLoginExpireVariable      string = "EMAIL_LOGIN_EXPIRE"
+	emailLoginMaxAttemptsVariable string = "EMAIL_LOGIN_MAX_ATTEMPTS"
+	emailLoginMaxEmailsVariable   string = "EMAIL_LOGIN_MAX_EMAILS"
+
+	forwardAuthCookieVariable   string = "FORWARD_AUTH_COOKIE"
+	forwardAuthLoginURLVariable string = "FORWARD_AUTH_LOGIN_URL"
+
+	logFormatVariable        string = "LOG_FORMAT"
+	logSkipPathsVariable     string = "LOG_SKIP_PATHS"
+	logSampleRatioVariable   string = "LOG_SAMPLE_RATIO"
+	logHeadersVariable       string = "LOG_HEADERS"
+	logRedactHeadersVariable string = "LOG_REDACT_HEADERS"
+	logRedactParamsVariable  string = "LOG_REDACT_QUERY_PARAMS"
+
+	swaggerUIVariable          string = "SWAGGER_UI"
+	swaggerUIAssetsURLVariable string = "SWAGGER_UI_ASSETS_URL"
+
+	metricsAddressVariable string = "METRICS_ADDRESS"
+
+	tracingExporterVariable     string = "TRACING_EXPORTER"
+	tracingServiceNameVariable  string = "TRACING_SERVICE_NAME"
+	tracingSampleRatioVariable  string = "TRACING_SAMPLE_RATIO"
+	tracingOTLPEndpointVariable string = "TRACING_OTLP_ENDPOINT"
+	tracingOTLPInsecureVariable string = "TRACING_OTLP_INSECURE"
+
+	lockoutThresholdVariable string = "LOCKOUT_THRESHOLD"
+	lockoutDurationVariable  string = "LOCKOUT_DURATION"
+
+	webhooksVariable               string = "WEBHOOKS"
+	webhookOutboxFileVariable      string = "WEBHOOK_OUTBOX_FILE"
+	webhookTimeoutVariable         string = "WEBHOOK_TIMEOUT"
+	webhookMaxAttemptsVariable     string = "WEBHOOK_MAX_ATTEMPTS"
+	webhookRetryBackoffVariable    string = "WEBHOOK_RETRY_BACKOFF"
+	webhookMaxRetryBackoffVariable string = "WEBHOOK_MAX_RETRY_BACKOFF"
+
+	auditFileVariable           string = "AUDIT_FILE"
+	auditStdoutVariable         string = "AUDIT_STDOUT"
+	auditWebhookURLVariable     string = "AUDIT_WEBHOOK_URL"
+	auditWebhookTimeoutVariable string = "AUDIT_WEBHOOK_TIMEOUT"
+
+	extAuthzAddressVariable string = "EXT_AUTHZ_ADDRESS"
+	extAuthzRoutesVariable  string = "EXT_AUTHZ_ROUTES"
+
+	mailerVariable       string = "MAILER"
+	mailFromVariable     string = "MAIL_FROM"
+	mailFileVariable     string = "MAIL_FILE"
+	smtpHostVariable     string = "SMTP_HOST"
+	smtpPortVariable     string = "SMTP_PORT"
+	smtpUsernameVariable string = "SMTP_USERNAME"
+	smtpPasswordVariable string = "SMTP_PASSWORD"
 
 	// Default values
-	defaultAccessTokenExpire  time.Duration = time.Second * 15
-	defaultRefreshTokenExpire time.Duration = time.Minute * 1
-	defaultLogLevel           log.Level     = log.InfoLevel
-	defaultIssuer             string        = "markliederbach/auth-service"
+	defaultAccessTokenExpire       time.Duration = time.Second * 15
+	defaultRefreshTokenExpire      time.Duration = time.Minute * 1
+	defaultLogLevel                log.Level     = log.InfoLevel
+	defaultLogFormat               string        = LogFormatJSON
+	defaultLogSampleRatio          float64       = 1
+	defaultIssuer                  string        = "markliederbach/auth-service"
+	defaultPublicURL               string        = "http://localhost:8080"
+	defaultAdminRole               string        = "admin"
+	defaultListenAddress           string        = ":8080"
+	defaultTLSClientAuth           string        = TLSClientAuthNone
+	defaultReadTimeout             time.Duration = time.Second * 30
+	defaultReadHeaderTimeout       time.Duration = time.Second * 10
+	defaultWriteTimeout            time.Duration = time.Second * 30
+	defaultIdleTimeout             time.Duration = time.Minute * 2
+	defaultShutdownTimeout         time.Duration = time.Second * 30
+	defaultPasswordMinLength       int           = 8
+	defaultPasswordMaxLength       int           = 64
+	defaultPasswordResetExpire     time.Duration = time.Minute * 30
+	defaultVerificationTokenExpire time.Duration = time.Hour * 24
+	defaultDPoPProofMaxAge         time.Duration = time.Minute
+	defaultDPoPNonceLifetime       time.Duration = time.Minute * 5
+	defaultEmailLoginExpire        time.Duration = time.Minute * 10
+	defaultEmailLoginMaxAttempts   int           = 5
+	defaultEmailLoginMaxEmails     int           = 5
+	defaultForwardAuthCookie       string        = "access_token"
+	defaultSwaggerUIAssetsURL      string        = "https://unpkg.com/swagger-ui-dist@5"
+	defaultTracingExporter         string        = TracingExporterNone
+	defaultTracingServiceName      string        = "auth-server"
+	defaultTracingSampleRatio      float64       = 1
+	defaultTracingOTLPEndpoint     string        = "localhost:4318"
+	defaultAuditWebhookTimeout     time.Duration = time.Second * 5
+	defaultLockoutDuration         time.Duration = time.Minute * 15
+	defaultWebhookTimeout          time.Duration = time.Second * 10
+	defaultWebhookMaxAttempts      int           = 8
+	defaultWebhookRetryBackoff     time.Duration = time.Second * 30
+	defaultWebhookMaxRetryBackoff  time.Duration = time.Hour
+	defaultMailer                  string        = MailerLog
+	defaultMailFrom                string        = "auth-server@localhost"
+	defaultSMTPPort                int           = 587
+)
+
+// Supported values for the LOG_FORMAT variable
+const (
+	LogFormatJSON string = "json"
+	// LogFormatText is logfmt, or colored key=value pairs in a terminal
+	LogFormatText string = "text"
+)
+
+// Supported values for the MAILER variable
+const (
+	MailerLog  string = "log"
+	MailerSMTP string = "smtp"
+)
+
+// Supported values for the TRACING_EXPORTER variable
+const (
+	TracingExporterNone   string = "none"
+	TracingExporterStdout string = "stdout"
+	TracingExporterOTLP   string = "otlp"
+)
+
+// Supported token_endpoint_auth_method values of clients
+const (
+	// ClientAuthTLS authenticates clients with their TLS client certificate (RFC 8705)
+	ClientAuthTLS string = "tls_client_auth"
+)
+
+// Supported values for the TLS_CLIENT_AUTH variable
+const (
+	TLSClientAuthNone     string = "none"
+	TLSClientAuthOptional string = "optional"
+	TLSClientAuthRequire  string = "require"
 )
 
 // Config holds all configuration data about the currently-running service
@@ -29,34 +186,435 @@ type Config struct {
 	// Required variables
 	AccessTokenSecret  string
 	RefreshTokenSecret string
+	ActionTokenSecret  string
 
 	// Optional variables
 	LogLevel           log.Level
 	AccessTokenExpire  time.Duration
 	RefreshTokenExpire time.Duration
 	Issuer             string
+	// Audience is set as the aud claim of access tokens, when not empty
+	Audience string
+	// SigningKeyFiles are PEM private keys access tokens are signed with.
+	// The first one signs new tokens; the rest are still published, so
+	// tokens they signed keep working until they expire. When empty, access
+	// tokens are signed with AccessTokenSecret.
+	SigningKeyFiles []string
+	// TokenLeeway is how much clock skew is allowed when checking token times
+	TokenLeeway     time.Duration
+	PublicURL       string
+	UserStoreFile   string
+	APIKeyStoreFile string
+	// AdminRole is the role that allows managing other users' resources
+	AdminRole string
+	// Clients are the OAuth clients that can get access tokens of their own
+	Clients []ClientConfig
+
+	Server       ServerConfig
+	Password     PasswordConfig
+	Registration RegistrationConfig
+	DPoP         DPoPConfig
+	EmailLogin   EmailLoginConfig
+	Lockout      LockoutConfig
+	Webhooks     WebhooksConfig
+	ForwardAuth  ForwardAuthConfig
+	Log          LogConfig
+	SwaggerUI    SwaggerUIConfig
+	Metrics      MetricsConfig
+	Tracing      TracingConfig
+	Audit        AuditConfig
+	ExtAuthz     ExtAuthzConfig
+	Mail         MailConfig
+}
+
+// ClientConfig registers an OAuth client. Clients get access tokens with
+// the client_credentials grant, authenticating with a TLS client
+// certificate issued by TLS_CLIENT_CA_FILE.
+type ClientConfig struct {
+	ClientID   string `json:"client_id"`
+	AuthMethod string `json:"token_endpoint_auth_method"`
+	// SubjectDN is the certificate subject the client must present, such
+	// as "CN=billing,O=Example"
+	SubjectDN string `json:"tls_client_auth_subject_dn,omitempty"`
+	// SANDNS is a DNS name the client's certificate must hold, instead of SubjectDN
+	SANDNS string   `json:"tls_client_auth_san_dns,omitempty"`
+	Roles  []string `json:"roles,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// ServerConfig controls the HTTP listener
+type ServerConfig struct {
+	// Address to listen on, such as ":8080"
+	Address string
+	// TLSCertFile and TLSKeyFile are a PEM certificate and private key. When
+	// set, the server only accepts HTTPS, and reloads them when they change.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile holds the PEM certificates client certificates are
+	// checked against, when TLSClientAuth is optional or require
+	TLSClientCAFile string
+	TLSClientAuth   string
+
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownTimeout is how long requests in flight get to finish when the
+	// server is stopped
+	ShutdownTimeout time.Duration
+}
+
+// PasswordConfig controls which passwords are accepted and how they are reset
+type PasswordConfig struct {
+	MinLength        int
+	MaxLength        int
+	RequireUppercase bool
+	RequireLowercase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+	DisallowUsername bool
+	// BreachedPasswordsFile is a local copy of the Have I Been Pwned
+	// password hashes. Passwords found in it are rejected.
+	BreachedPasswordsFile string
+
+	ResetTokenExpire time.Duration
+	// ResetURL is a page that accepts the reset token as a query parameter
+	// and submits it along with the new password. When empty, the token
+	// itself is emailed.
+	ResetURL string
+}
+
+// RegistrationConfig controls self-service sign up and email verification
+type RegistrationConfig struct {
+	VerificationTokenExpire time.Duration
+	// AllowUnverifiedLogin lets users log in before verifying their email
+	// address, restricted to UnverifiedLoginScopes.
+	AllowUnverifiedLogin  bool
+	UnverifiedLoginScopes []string
+}
+
+// DPoPConfig controls the proofs (RFC 9449) that bind tokens to a key held
+// by the client
+type DPoPConfig struct {
+	// ProofMaxAge is how long after it's made a proof is accepted
+	ProofMaxAge time.Duration
+	// RequireNonce makes proofs carry a nonce the server handed out in a
+	// DPoP-Nonce header, so they can't be made ahead of time
+	RequireNonce  bool
+	NonceLifetime time.Duration
+}
+
+// EmailLoginConfig controls passwordless login with emailed links and codes
+type EmailLoginConfig struct {
+	// Expire is how long links and codes are valid, and the window the limits below apply to
+	Expire time.Duration
+	// MaxAttempts is how many wrong codes a user can enter, across all their
+	// codes, before codes stop working for the rest of the window
+	MaxAttempts int
+	// MaxEmails is how many login emails can be asked for, for each address, in the window
+	MaxEmails int
+}
+
+// LockoutConfig controls locking users out after too many wrong passwords
+type LockoutConfig struct {
+	// Threshold is how many wrong passwords in a row lock a user out. Zero
+	// turns lockouts off.
+	Threshold int
+	Duration  time.Duration
+}
+
+// WebhooksConfig controls the webhooks notified of identity events
+type WebhooksConfig struct {
+	Endpoints []WebhookEndpoint
+	// OutboxFile keeps deliveries until they're sent, so they survive a
+	// restart. They're kept in memory when it's empty.
+	OutboxFile string
+	Timeout    time.Duration
+	// MaxAttempts is how many times a delivery is tried before giving up
+	MaxAttempts int
+	// RetryBackoff is the wait before the first retry, which doubles with
+	// each retry after it, up to MaxRetryBackoff
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+}
+
+// WebhookEndpoint is a URL notified of identity events
+type WebhookEndpoint struct {
+	URL string `json:"url"`
+	// Secret signs each request, so the receiver can tell it came from here
+	Secret string `json:"secret"`
+	// Events are the event types sent to the URL. Every type is sent when it's empty.
+	Events []string `json:"events,omitempty"`
 }
 
-// Load creates a new instance of Config, using all available
-// defaults and overrides.
-func Load() Config {
+// ForwardAuthConfig controls the endpoint reverse proxies ask whether to let a request through
+type ForwardAuthConfig struct {
+	// Cookie may hold the access token, for requests from browsers
+	Cookie string
+	// LoginURL is where browsers without a valid token are redirected. When
+	// empty, they get a 401 like any other client.
+	LoginURL string
+}
+
+// LogConfig controls what's logged about each request, and how
+type LogConfig struct {
+	// Format is "json", or "text" for local development
+	Format string
+	// SkipPaths are request paths, such as health checks, that aren't
+	// logged when they succeed
+	SkipPaths []string
+	// SampleRatio is the share of successful requests logged, from 0 to 1.
+	// Failed requests are always logged.
+	SampleRatio float64
+	// Headers are the request headers added to request logs, or "*" for
+	// all of them. The values of RedactHeaders are hidden.
+	Headers       []string
+	RedactHeaders []string
+	// RedactQueryParams are query parameters whose values are hidden in
+	// logged URIs and referers, such as tokens and codes
+	RedactQueryParams []string
+}
+
+// SwaggerUIConfig controls the page for browsing the OpenAPI document
+type SwaggerUIConfig struct {
+	Enabled bool
+	// AssetsURL is where Swagger UI's scripts and styles are loaded from,
+	// such as a CDN or a copy of swagger-ui-dist served elsewhere
+	AssetsURL string
+}
+
+// MetricsConfig controls the Prometheus metrics endpoint
+type MetricsConfig struct {
+	// Address to serve /metrics on, such as ":9090". It's kept off the main
+	// listener, so it needn't be exposed publicly. Disabled when empty.
+	Address string
+}
+
+// TracingConfig controls where OpenTelemetry spans are exported
+type TracingConfig struct {
+	// Exporter is "none", "stdout" for local development, or "otlp"
+	Exporter    string
+	ServiceName string
+	// SampleRatio is the fraction of new traces recorded. Traces started by
+	// callers are recorded when the caller recorded them.
+	SampleRatio float64
+	// OTLPEndpoint is the host and port of an OTLP/HTTP collector
+	OTLPEndpoint string
+	// OTLPInsecure sends spans over plain HTTP
+	OTLPInsecure bool
+}
+
+// AuditConfig controls where audit events are written. Any combination of
+// sinks may be used; events are discarded when none are.
+type AuditConfig struct {
+	// File is appended to as JSON lines, each holding the hash of the one
+	// before, so edits can be detected
+	File   string
+	Stdout bool
+	// WebhookURL is sent each event in a POST request
+	WebhookURL     string
+	WebhookTimeout time.Duration
+}
+
+// ExtAuthzConfig controls the Envoy external authorization gRPC service
+type ExtAuthzConfig struct {
+	// Address to listen on, such as ":9001". The service is disabled when empty.
+	Address string
+	Routes  []ExtAuthzRoute
+}
+
+// ExtAuthzRoute sets what's needed to reach requests matching it. Requests
+// matching no route only need a valid access token.
+type ExtAuthzRoute struct {
+	// Prefix of the request path, matched against whole segments of the
+	// decoded and cleaned path. The longest matching prefix wins.
+	Prefix string `json:"prefix"`
+	// Host restricts the route to one host, when set
+	Host string `json:"host,omitempty"`
+	// Methods restricts the route to some HTTP methods, when set
+	Methods []string `json:"methods,omitempty"`
+	// Public routes let anyone through, without a token
+	Public bool     `json:"public,omitempty"`
+	Roles  []string `json:"roles,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// MailConfig controls how outgoing email is delivered
+type MailConfig struct {
+	Mailer string
+	From   string
+	// File is where the log mailer writes messages. When empty, messages
+	// are written to the application log instead.
+	File string
+
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+}
+
+// Load creates a new instance of Config. Each setting comes from the first
+// of these that has it: options.Overrides, the environment, the config file
+// at options.File (or CONFIG_FILE), or its default. Every problem found is
+// reported together in a *ValidationError, along with the config as far as
+// it could be loaded. Nothing is applied, so call ConfigureLogger once the
+// config is in use.
+func Load(options LoadOptions) (Config, error) {
+	l, err := newLoader(options)
+	if err != nil {
+		return Config{}, err
+	}
+
 	config := Config{
-		AccessTokenSecret:  fromEnvString(accessTokenVariable, true, ""),
-		RefreshTokenSecret: fromEnvString(refreshTokenVariable, true, ""),
+		AccessTokenSecret:  l.string(accessTokenVariable, true, ""),
+		RefreshTokenSecret: l.string(refreshTokenVariable, true, ""),
+		ActionTokenSecret:  l.string(actionTokenVariable, true, ""),
+
+		LogLevel:           l.logLevel(logLevelVariable, false, defaultLogLevel),
+		AccessTokenExpire:  l.duration(accessTokenExpireVariable, false, defaultAccessTokenExpire),
+		RefreshTokenExpire: l.duration(refreshTokenExpireVariable, false, defaultRefreshTokenExpire),
+		Issuer:             l.string(issuerVariable, false, defaultIssuer),
+		Audience:           l.string(audienceVariable, false, ""),
+		SigningKeyFiles:    l.list(signingKeyFilesVariable, false, []string{}),
+		TokenLeeway:        l.duration(tokenLeewayVariable, false, 0),
+		PublicURL:          strings.TrimSuffix(l.string(publicURLVariable, false, defaultPublicURL), "/"),
+		UserStoreFile:      l.string(userStoreFileVariable, false, ""),
+		APIKeyStoreFile:    l.string(apiKeyStoreFileVariable, false, ""),
+		AdminRole:          l.string(adminRoleVariable, false, defaultAdminRole),
+
+		Server: ServerConfig{
+			Address:           l.string(listenAddressVariable, false, defaultListenAddress),
+			TLSCertFile:       l.string(tlsCertFileVariable, false, ""),
+			TLSKeyFile:        l.string(tlsKeyFileVariable, false, ""),
+			TLSClientCAFile:   l.string(tlsClientCAFileVariable, false, ""),
+			TLSClientAuth:     l.string(tlsClientAuthVariable, false, defaultTLSClientAuth),
+			ReadTimeout:       l.duration(readTimeoutVariable, false, defaultReadTimeout),
+			ReadHeaderTimeout: l.duration(readHeaderTimeoutVariable, false, defaultReadHeaderTimeout),
+			WriteTimeout:      l.duration(writeTimeoutVariable, false, defaultWriteTimeout),
+			IdleTimeout:       l.duration(idleTimeoutVariable, false, defaultIdleTimeout),
+			ShutdownTimeout:   l.duration(shutdownTimeoutVariable, false, defaultShutdownTimeout),
+		},
+
+		Password: PasswordConfig{
+			MinLength:             l.int(passwordMinLengthVariable, false, defaultPasswordMinLength),
+			MaxLength:             l.int(passwordMaxLengthVariable, false, defaultPasswordMaxLength),
+			RequireUppercase:      l.bool(passwordRequireUpperVariable, false, false),
+			RequireLowercase:      l.bool(passwordRequireLowerVariable, false, false),
+			RequireDigit:          l.bool(passwordRequireDigitVariable, false, false),
+			RequireSymbol:         l.bool(passwordRequireSymbolVariable, false, false),
+			DisallowUsername:      l.bool(passwordDisallowUsernameVariable, false, true),
+			BreachedPasswordsFile: l.string(breachedPasswordsFileVariable, false, ""),
+
+			ResetTokenExpire: l.duration(passwordResetTokenExpireVariable, false, defaultPasswordResetExpire),
+			ResetURL:         l.string(passwordResetURLVariable, false, ""),
+		},
 
-		LogLevel:           fromEnvLogLevel(logLevelVariable, false, defaultLogLevel),
-		AccessTokenExpire:  fromEnvDuration(accessTokenExpireVariable, false, defaultAccessTokenExpire),
-		RefreshTokenExpire: fromEnvDuration(refreshTokenExpireVariable, false, defaultRefreshTokenExpire),
-		Issuer:             fromEnvString(issuerVariable, false, defaultIssuer),
+		Registration: RegistrationConfig{
+			VerificationTokenExpire: l.duration(verificationTokenExpireVariable, false, defaultVerificationTokenExpire),
+			AllowUnverifiedLogin:    l.bool(allowUnverifiedLoginVariable, false, false),
+			UnverifiedLoginScopes:   l.list(unverifiedLoginScopesVariable, false, []string{}),
+		},
+
+		DPoP: DPoPConfig{
+			ProofMaxAge:   l.duration(dpopProofMaxAgeVariable, false, defaultDPoPProofMaxAge),
+			RequireNonce:  l.bool(dpopRequireNonceVariable, false, false),
+			NonceLifetime: l.duration(dpopNonceLifetimeVariable, false, defaultDPoPNonceLifetime),
+		},
+
+		EmailLogin: EmailLoginConfig{
+			Expire:      l.duration(emailLoginExpireVariable, false, defaultEmailLoginExpire),
+			MaxAttempts: l.int(emailLoginMaxAttemptsVariable, false, defaultEmailLoginMaxAttempts),
+			MaxEmails:   l.int(emailLoginMaxEmailsVariable, false, defaultEmailLoginMaxEmails),
+		},
+
+		Lockout: LockoutConfig{
+			Threshold: l.int(lockoutThresholdVariable, false, 0),
+			Duration:  l.duration(lockoutDurationVariable, false, defaultLockoutDuration),
+		},
+
+		Webhooks: WebhooksConfig{
+			OutboxFile:      l.string(webhookOutboxFileVariable, false, ""),
+			Timeout:         l.duration(webhookTimeoutVariable, false, defaultWebhookTimeout),
+			MaxAttempts:     l.int(webhookMaxAttemptsVariable, false, defaultWebhookMaxAttempts),
+			RetryBackoff:    l.duration(webhookRetryBackoffVariable, false, defaultWebhookRetryBackoff),
+			MaxRetryBackoff: l.duration(webhookMaxRetryBackoffVariable, false, defaultWebhookMaxRetryBackoff),
+		},
+
+		ForwardAuth: ForwardAuthConfig{
+			Cookie:   l.string(forwardAuthCookieVariable, false, defaultForwardAuthCookie),
+			LoginURL: l.string(forwardAuthLoginURLVariable, false, ""),
+		},
+
+		Log: LogConfig{
+			Format:            l.string(logFormatVariable, false, defaultLogFormat),
+			SkipPaths:         l.list(logSkipPathsVariable, false, []string{"/healthz", "/readyz"}),
+			SampleRatio:       l.float(logSampleRatioVariable, false, defaultLogSampleRatio),
+			Headers:           l.list(logHeadersVariable, false, []string{}),
+			RedactHeaders:     l.list(logRedactHeadersVariable, false, []string{"Authorization", "Proxy-Authorization", "Cookie", "X-API-Key", "DPoP"}),
+			RedactQueryParams: l.list(logRedactParamsVariable, false, []string{"token", "code", "access_token", "refresh_token", "password", "client_secret", "api_key"}),
+		},
+
+		SwaggerUI: SwaggerUIConfig{
+			Enabled:   l.bool(swaggerUIVariable, false, false),
+			AssetsURL: strings.TrimSuffix(l.string(swaggerUIAssetsURLVariable, false, defaultSwaggerUIAssetsURL), "/"),
+		},
+
+		Metrics: MetricsConfig{
+			Address: l.string(metricsAddressVariable, false, ""),
+		},
+
+		Tracing: TracingConfig{
+			Exporter:     l.string(tracingExporterVariable, false, defaultTracingExporter),
+			ServiceName:  l.string(tracingServiceNameVariable, false, defaultTracingServiceName),
+			SampleRatio:  l.float(tracingSampleRatioVariable, false, defaultTracingSampleRatio),
+			OTLPEndpoint: l.string(tracingOTLPEndpointVariable, false, defaultTracingOTLPEndpoint),
+			OTLPInsecure: l.bool(tracingOTLPInsecureVariable, false, false),
+		},
+
+		Audit: AuditConfig{
+			File:           l.string(auditFileVariable, false, ""),
+			Stdout:         l.bool(auditStdoutVariable, false, false),
+			WebhookURL:     l.string(auditWebhookURLVariable, false, ""),
+			WebhookTimeout: l.duration(auditWebhookTimeoutVariable, false, defaultAuditWebhookTimeout),
+		},
+
+		ExtAuthz: ExtAuthzConfig{
+			Address: l.string(extAuthzAddressVariable, false, ""),
+		},
+
+		Mail: MailConfig{
+			Mailer:       l.string(mailerVariable, false, defaultMailer),
+			From:         l.string(mailFromVariable, false, defaultMailFrom),
+			File:         l.string(mailFileVariable, false, ""),
+			SMTPHost:     l.string(smtpHostVariable, false, ""),
+			SMTPPort:     l.int(smtpPortVariable, false, defaultSMTPPort),
+			SMTPUsername: l.string(smtpUsernameVariable, false, ""),
+			SMTPPassword: l.string(smtpPasswordVariable, false, ""),
+		},
 	}
 
-	config.configureLogger()
+	l.json(extAuthzRoutesVariable, false, &config.ExtAuthz.Routes)
+	l.json(clientsVariable, false, &config.Clients)
+	l.json(webhooksVariable, false, &config.Webhooks.Endpoints)
 
-	return config
+	problems := l.finish()
+	if err := config.Validate(); err != nil {
+		problems = append(problems, err.(*ValidationError).Problems...)
+	}
+	if len(problems) > 0 {
+		return config, &ValidationError{Problems: problems}
+	}
+
+	return config, nil
 }
 
-func (c *Config) configureLogger() {
-	log.SetFormatter(&log.JSONFormatter{})
+// ConfigureLogger applies the logging settings
+func (c Config) ConfigureLogger() {
+	if c.Log.Format == LogFormatText {
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	} else {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
 	log.SetOutput(os.Stdout)
 	gin.SetMode(gin.ReleaseMode)
 
@@ -68,45 +626,3 @@ func (c *Config) configureLogger() {
 
 	log.SetLevel(c.LogLevel)
 }
-
-func fromEnvString(variable string, required bool, defaultValue string) string {
-	rawValue, exists := fromEnv(variable, required)
-	if !exists {
-		rawValue = defaultValue
-	}
-	return rawValue
-}
-
-func fromEnvDuration(variable string, required bool, defaultValue time.Duration) time.Duration {
-	var err error
-	value := defaultValue
-	rawValue, exists := fromEnv(variable, required)
-	if exists {
-		value, err = time.ParseDuration(rawValue)
-		if err != nil {
-			panic(err)
-		}
-	}
-	return value
-}
-
-func fromEnvLogLevel(variable string, required bool, defaultValue log.Level) log.Level {
-	var err error
-	value := defaultValue
-	rawValue, exists := fromEnv(variable, required)
-	if exists {
-		value, err = log.ParseLevel(rawValue)
-		if err != nil {
-			panic(err)
-		}
-	}
-	return value
-}
-
-func fromEnv(variable string, required bool) (string, bool) {
-	value, exists := os.LookupEnv(variable)
-	if !exists && required {
-		panic(fmt.Errorf("Missing required environment variable %s", variable))
-	}
-	return value, exists
-}
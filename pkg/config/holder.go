@@ -0,0 +1,31 @@
+package config
+
+import (
+	"sync/atomic"
+)
+
+// Holder holds the current config, which can be swapped while the server is
+// running. Services read settings through it whenever they need them, so a
+// reload takes effect without restarting.
+type Holder struct {
+	current atomic.Value
+}
+
+// NewHolder creates a Holder for an initial config
+func NewHolder(config Config) *Holder {
+	holder := &Holder{}
+	holder.Set(config)
+	return holder
+}
+
+// Get returns the current config. Callers needing several settings should
+// keep the result, rather than calling Get for each, so they don't see a
+// mix of two configs.
+func (h *Holder) Get() Config {
+	return h.current.Load().(Config)
+}
+
+// Set swaps in a new config. It isn't validated again.
+func (h *Holder) Set(config Config) {
+	h.current.Store(config)
+}
@@ -0,0 +1,306 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	configFileVariable string = "CONFIG_FILE"
+	// secretFileSuffix names variables holding the path of a file to read a
+	// secret from, such as a mounted Docker or Kubernetes secret
+	secretFileSuffix string = "_FILE"
+)
+
+// secretVariables can also be read from files, with secretFileSuffix
+var secretVariables = map[string]bool{
+	accessTokenVariable:  true,
+	refreshTokenVariable: true,
+	actionTokenVariable:  true,
+	smtpPasswordVariable: true,
+}
+
+// LoadOptions sets where Load looks for settings, besides the environment
+type LoadOptions struct {
+	// File is a YAML or JSON config file. When empty, CONFIG_FILE is used, if set.
+	File string
+	// Overrides take precedence over every other source, such as for
+	// command-line flags. They're keyed by variable name, like LOG_LEVEL.
+	Overrides map[string]string
+}
+
+// FilePath returns the config file to read, if any
+func (o LoadOptions) FilePath() string {
+	if o.File != "" {
+		return o.File
+	}
+	return os.Getenv(configFileVariable)
+}
+
+// loader looks up settings in each source in turn, noting problems rather
+// than stopping at the first one
+type loader struct {
+	overrides map[string]string
+	file      map[string]string
+	filePath  string
+	// used records every variable looked up, to find unknown settings in the file
+	used     map[string]bool
+	problems []string
+}
+
+func newLoader(options LoadOptions) (*loader, error) {
+	l := &loader{
+		overrides: options.Overrides,
+		file:      map[string]string{},
+		filePath:  options.FilePath(),
+		used:      map[string]bool{configFileVariable: true},
+	}
+	if l.overrides == nil {
+		l.overrides = map[string]string{}
+	}
+	if l.filePath == "" {
+		return l, nil
+	}
+
+	data, err := ioutil.ReadFile(l.filePath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read config file: %w", err)
+	}
+	// YAML is a superset of JSON, so this reads both
+	var settings map[string]interface{}
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %w", l.filePath, err)
+	}
+	for key, value := range settings {
+		rawValue, err := fileValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for %s in %s: %w", key, l.filePath, err)
+		}
+		l.file[strings.ToUpper(key)] = rawValue
+	}
+	return l, nil
+}
+
+// fileValue turns a value from the config file into the string the same
+// environment variable would hold. Lists of plain values are comma-separated,
+// and anything more structured is encoded as JSON.
+func fileValue(value interface{}) (string, error) {
+	switch typed := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return typed, nil
+	case []interface{}:
+		items := []string{}
+		for _, item := range typed {
+			switch item.(type) {
+			case map[interface{}]interface{}, []interface{}:
+				return jsonValue(typed)
+			}
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ","), nil
+	case map[interface{}]interface{}:
+		return jsonValue(typed)
+	}
+	return fmt.Sprint(value), nil
+}
+
+func jsonValue(value interface{}) (string, error) {
+	encoded, err := json.Marshal(jsonCompatible(value))
+	return string(encoded), err
+}
+
+// jsonCompatible converts the maps the YAML decoder produces, which JSON can't encode
+func jsonCompatible(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[interface{}]interface{}:
+		converted := map[string]interface{}{}
+		for key, item := range typed {
+			converted[fmt.Sprint(key)] = jsonCompatible(item)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(typed))
+		for i, item := range typed {
+			converted[i] = jsonCompatible(item)
+		}
+		return converted
+	}
+	return value
+}
+
+// lookup finds the raw value of a variable, from the highest-precedence source that has it
+func (l *loader) lookup(variable string, required bool) (string, bool) {
+	l.used[variable] = true
+	if secretVariables[variable] {
+		l.used[variable+secretFileSuffix] = true
+	}
+
+	if value, exists := l.overrides[variable]; exists {
+		return value, true
+	}
+	if value, exists := os.LookupEnv(variable); exists {
+		return value, true
+	}
+	if secretVariables[variable] {
+		if value, exists := l.secretFromFile(os.LookupEnv(variable + secretFileSuffix)); exists {
+			return value, true
+		}
+	}
+	if value, exists := l.file[variable]; exists {
+		return value, true
+	}
+	if secretVariables[variable] {
+		if value, exists := l.secretFromFile(l.file[variable+secretFileSuffix], true); exists {
+			return value, true
+		}
+	}
+
+	if required {
+		l.problem("Missing required setting %s", variable)
+	}
+	return "", false
+}
+
+// secretFromFile reads a secret from path, when set. Trailing newlines are
+// dropped, as editors and `echo` add them.
+func (l *loader) secretFromFile(path string, set bool) (string, bool) {
+	if !set || path == "" {
+		return "", false
+	}
+	data, err := ioutil.ReadFile(filepath.Clean(path))
+	if err != nil {
+		l.problem("Failed to read secret: %v", err)
+		return "", false
+	}
+	return strings.TrimRight(string(data), "\r\n"), true
+}
+
+// finish returns every problem found, including settings in the file that don't exist
+func (l *loader) finish() []string {
+	unknown := []string{}
+	for variable := range l.file {
+		if !l.used[variable] {
+			unknown = append(unknown, strings.ToLower(variable))
+		}
+	}
+	sort.Strings(unknown)
+	for _, variable := range unknown {
+		l.problem("Unknown setting %s in %s", variable, l.filePath)
+	}
+	return l.problems
+}
+
+func (l *loader) problem(format string, args ...interface{}) {
+	l.problems = append(l.problems, fmt.Sprintf(format, args...))
+}
+
+func (l *loader) string(variable string, required bool, defaultValue string) string {
+	rawValue, exists := l.lookup(variable, required)
+	if !exists {
+		rawValue = defaultValue
+	}
+	return rawValue
+}
+
+func (l *loader) duration(variable string, required bool, defaultValue time.Duration) time.Duration {
+	rawValue, exists := l.lookup(variable, required)
+	if !exists {
+		return defaultValue
+	}
+	value, err := time.ParseDuration(rawValue)
+	if err != nil {
+		l.problem("%s must be a duration, such as 15m or 24h: %q", variable, rawValue)
+		return defaultValue
+	}
+	return value
+}
+
+func (l *loader) int(variable string, required bool, defaultValue int) int {
+	rawValue, exists := l.lookup(variable, required)
+	if !exists {
+		return defaultValue
+	}
+	value, err := strconv.Atoi(rawValue)
+	if err != nil {
+		l.problem("%s must be a whole number: %q", variable, rawValue)
+		return defaultValue
+	}
+	return value
+}
+
+func (l *loader) float(variable string, required bool, defaultValue float64) float64 {
+	rawValue, exists := l.lookup(variable, required)
+	if !exists {
+		return defaultValue
+	}
+	value, err := strconv.ParseFloat(rawValue, 64)
+	if err != nil {
+		l.problem("%s must be a number: %q", variable, rawValue)
+		return defaultValue
+	}
+	return value
+}
+
+func (l *loader) bool(variable string, required bool, defaultValue bool) bool {
+	rawValue, exists := l.lookup(variable, required)
+	if !exists {
+		return defaultValue
+	}
+	value, err := strconv.ParseBool(rawValue)
+	if err != nil {
+		l.problem("%s must be true or false: %q", variable, rawValue)
+		return defaultValue
+	}
+	return value
+}
+
+// list parses a comma-separated variable, ignoring empty items
+func (l *loader) list(variable string, required bool, defaultValue []string) []string {
+	rawValue, exists := l.lookup(variable, required)
+	if !exists {
+		return defaultValue
+	}
+	value := []string{}
+	for _, item := range strings.Split(rawValue, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			value = append(value, item)
+		}
+	}
+	return value
+}
+
+// json decodes a JSON variable into value, leaving it untouched when unset
+func (l *loader) json(variable string, required bool, value interface{}) {
+	rawValue, exists := l.lookup(variable, required)
+	if !exists {
+		return
+	}
+	if err := json.Unmarshal([]byte(rawValue), value); err != nil {
+		l.problem("%s must be valid JSON: %v", variable, err)
+	}
+}
+
+func (l *loader) logLevel(variable string, required bool, defaultValue log.Level) log.Level {
+	rawValue, exists := l.lookup(variable, required)
+	if !exists {
+		return defaultValue
+	}
+	value, err := log.ParseLevel(rawValue)
+	if err != nil {
+		l.problem("%s must be one of trace, debug, info, warn, error, fatal or panic: %q", variable, rawValue)
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,216 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// setenv sets or, for a nil value, unsets a variable for the rest of the test
+func setenv(t *testing.T, variable string, value *string) {
+	previous, existed := os.LookupEnv(variable)
+	t.Cleanup(func() {
+		if existed {
+			os.Setenv(variable, previous)
+		} else {
+			os.Unsetenv(variable)
+		}
+	})
+	if value == nil {
+		os.Unsetenv(variable)
+	} else {
+		os.Setenv(variable, *value)
+	}
+}
+
+func writeFile(t *testing.T, directory, name, content string) string {
+	path := filepath.Join(directory, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLookupPrecedence(t *testing.T) {
+	value := func(s string) *string { return &s }
+
+	tests := []struct {
+		name     string
+		variable string
+		// Each source, from highest precedence to lowest, set when not nil
+		override, env, envFile, file, fileFile *string
+		// envFileMissing points the environment secret file variable at a missing file
+		envFileMissing bool
+		want           string
+		wantExists     bool
+		wantProblems   int
+	}{
+		{
+			name:     "override over everything",
+			variable: accessTokenVariable,
+			override: value("override"), env: value("env"), envFile: value("env-file"), file: value("file"), fileFile: value("file-file"),
+			want: "override", wantExists: true,
+		},
+		{
+			name:     "empty override",
+			variable: accessTokenVariable,
+			override: value(""), env: value("env"),
+			want: "", wantExists: true,
+		},
+		{
+			name:     "environment over secret files and the config file",
+			variable: accessTokenVariable,
+			env:      value("env"), envFile: value("env-file"), file: value("file"), fileFile: value("file-file"),
+			want: "env", wantExists: true,
+		},
+		{
+			name:     "environment secret file over the config file",
+			variable: accessTokenVariable,
+			envFile:  value("env-file\n"), file: value("file"), fileFile: value("file-file"),
+			want: "env-file", wantExists: true,
+		},
+		{
+			name:     "config file over its secret file",
+			variable: accessTokenVariable,
+			file:     value("file"), fileFile: value("file-file"),
+			want: "file", wantExists: true,
+		},
+		{
+			name:     "config file secret file",
+			variable: accessTokenVariable,
+			fileFile: value("file-file\r\n"),
+			want:     "file-file", wantExists: true,
+		},
+		{
+			name:           "missing environment secret file",
+			variable:       accessTokenVariable,
+			envFileMissing: true, file: value("file"),
+			want: "file", wantExists: true, wantProblems: 1,
+		},
+		{
+			name:         "required and missing",
+			variable:     accessTokenVariable,
+			wantProblems: 1,
+		},
+		{
+			name:     "secret files only for secrets",
+			variable: logLevelVariable,
+			envFile:  value("debug"), fileFile: value("debug"),
+			// The config file's log_level_file is an unknown setting
+			wantProblems: 2,
+		},
+		{
+			name:     "environment over the config file",
+			variable: logLevelVariable,
+			env:      value("debug"), file: value("warn"),
+			want: "debug", wantExists: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory, err := ioutil.TempDir("", "config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(directory)
+
+			options := LoadOptions{Overrides: map[string]string{}}
+			if test.override != nil {
+				options.Overrides[test.variable] = *test.override
+			}
+
+			setenv(t, configFileVariable, nil)
+			setenv(t, test.variable, test.env)
+			envFile := (*string)(nil)
+			if test.envFile != nil {
+				envFile = value(writeFile(t, directory, "env-secret", *test.envFile))
+			} else if test.envFileMissing {
+				envFile = value(filepath.Join(directory, "missing"))
+			}
+			setenv(t, test.variable+secretFileSuffix, envFile)
+
+			settings := []string{}
+			if test.file != nil {
+				settings = append(settings, strings.ToLower(test.variable)+": "+*test.file)
+			}
+			if test.fileFile != nil {
+				path := writeFile(t, directory, "file-secret", *test.fileFile)
+				settings = append(settings, strings.ToLower(test.variable+secretFileSuffix)+": "+path)
+			}
+			options.File = writeFile(t, directory, "config.yaml", strings.Join(settings, "\n"))
+
+			l, err := newLoader(options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, exists := l.lookup(test.variable, true)
+			if got != test.want || exists != test.wantExists {
+				t.Errorf("lookup() = %q, %v, want %q, %v", got, exists, test.want, test.wantExists)
+			}
+			if problems := l.finish(); len(problems) != test.wantProblems {
+				t.Errorf("Expected %d problems, got %v", test.wantProblems, problems)
+			}
+		})
+	}
+}
+
+func TestFileValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{name: "string", value: "value", want: "value"},
+		{name: "null", value: nil, want: ""},
+		{name: "number", value: 15, want: "15"},
+		{name: "bool", value: true, want: "true"},
+		{name: "list", value: []interface{}{"a", 1, true}, want: "a,1,true"},
+		{name: "empty list", value: []interface{}{}, want: ""},
+		{
+			name:  "list of maps",
+			value: []interface{}{map[interface{}]interface{}{"id": "web", "scopes": []interface{}{"read"}}},
+			want:  `[{"id":"web","scopes":["read"]}]`,
+		},
+		{name: "map", value: map[interface{}]interface{}{"a": 1}, want: `{"a":1}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := fileValue(test.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("fileValue() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUnknownSettings(t *testing.T) {
+	directory, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	setenv(t, configFileVariable, nil)
+
+	// Keys are matched case-insensitively, and JSON files work as YAML does
+	path := writeFile(t, directory, "config.json", `{"Log_Level": "warn", "log_levle": "debug", "access_token_secret_file": "", "colour": "blue"}`)
+	l, err := newLoader(LoadOptions{File: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.lookup(logLevelVariable, false)
+	l.lookup(accessTokenVariable, false)
+
+	want := []string{
+		"Unknown setting colour in " + path,
+		"Unknown setting log_levle in " + path,
+	}
+	if problems := l.finish(); !reflect.DeepEqual(problems, want) {
+		t.Errorf("finish() = %v, want %v", problems, want)
+	}
+}
@@ -0,0 +1,289 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	redacted string = "[REDACTED]"
+	// minSecretLength is the shortest token signing secret accepted. HS256
+	// keys shorter than its 256-bit output weaken it.
+	minSecretLength int = 32
+	// minWebhookSecretLength keeps webhook signatures from being guessed
+	minWebhookSecretLength int = 16
+)
+
+// ValidationError lists every problem found in a config
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Invalid configuration: %s", strings.Join(e.Problems, "; "))
+}
+
+// Validate checks that settings make sense together, beyond what Load
+// checks while parsing them
+func (c Config) Validate() error {
+	problems := []string{}
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	secrets := map[string]string{
+		accessTokenVariable:  c.AccessTokenSecret,
+		refreshTokenVariable: c.RefreshTokenSecret,
+		actionTokenVariable:  c.ActionTokenSecret,
+	}
+	for _, variable := range []string{accessTokenVariable, refreshTokenVariable, actionTokenVariable} {
+		if secret := secrets[variable]; secret != "" && len(secret) < minSecretLength {
+			problem("%s must be at least %d characters", variable, minSecretLength)
+		}
+	}
+	if c.AccessTokenSecret != "" && (c.AccessTokenSecret == c.RefreshTokenSecret || c.AccessTokenSecret == c.ActionTokenSecret) ||
+		c.RefreshTokenSecret != "" && c.RefreshTokenSecret == c.ActionTokenSecret {
+		problem("%s, %s and %s must all be different", accessTokenVariable, refreshTokenVariable, actionTokenVariable)
+	}
+
+	if c.AccessTokenExpire <= 0 {
+		problem("%s must be positive", accessTokenExpireVariable)
+	}
+	if c.RefreshTokenExpire < c.AccessTokenExpire {
+		problem("%s can't be shorter than %s", refreshTokenExpireVariable, accessTokenExpireVariable)
+	}
+	if c.TokenLeeway < 0 {
+		problem("%s can't be negative", tokenLeewayVariable)
+	}
+	if c.Log.Format != LogFormatJSON && c.Log.Format != LogFormatText {
+		problem("%s must be %q or %q", logFormatVariable, LogFormatJSON, LogFormatText)
+	}
+	for _, path := range c.Log.SkipPaths {
+		if !strings.HasPrefix(path, "/") {
+			problem("%s must only hold paths starting with \"/\", not %q", logSkipPathsVariable, path)
+		}
+	}
+	if c.Log.SampleRatio < 0 || c.Log.SampleRatio > 1 {
+		problem("%s must be from 0 to 1", logSampleRatioVariable)
+	}
+	if c.SwaggerUI.Enabled && c.SwaggerUI.AssetsURL == "" {
+		problem("%s is required when %s is set", swaggerUIAssetsURLVariable, swaggerUIVariable)
+	}
+	if c.Server.Address == "" {
+		problem("%s can't be empty", listenAddressVariable)
+	}
+	if (c.Server.TLSCertFile == "") != (c.Server.TLSKeyFile == "") {
+		problem("%s and %s must be set together", tlsCertFileVariable, tlsKeyFileVariable)
+	}
+	switch c.Server.TLSClientAuth {
+	case TLSClientAuthNone:
+	case TLSClientAuthOptional, TLSClientAuthRequire:
+		if c.Server.TLSClientCAFile == "" || c.Server.TLSCertFile == "" {
+			problem("%s and %s are required when %s is %q", tlsClientCAFileVariable, tlsCertFileVariable, tlsClientAuthVariable, c.Server.TLSClientAuth)
+		}
+	default:
+		problem("%s must be %q, %q or %q", tlsClientAuthVariable, TLSClientAuthNone, TLSClientAuthOptional, TLSClientAuthRequire)
+	}
+	timeouts := map[string]time.Duration{
+		readTimeoutVariable:       c.Server.ReadTimeout,
+		readHeaderTimeoutVariable: c.Server.ReadHeaderTimeout,
+		writeTimeoutVariable:      c.Server.WriteTimeout,
+		idleTimeoutVariable:       c.Server.IdleTimeout,
+	}
+	for _, variable := range []string{readTimeoutVariable, readHeaderTimeoutVariable, writeTimeoutVariable, idleTimeoutVariable} {
+		if timeouts[variable] < 0 {
+			problem("%s can't be negative", variable)
+		}
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		problem("%s must be positive", shutdownTimeoutVariable)
+	}
+	clientIDs := map[string]bool{}
+	for _, client := range c.Clients {
+		switch {
+		case client.ClientID == "":
+			problem("Every client in %s needs a client_id", clientsVariable)
+		case clientIDs[client.ClientID]:
+			problem("Client %q is in %s more than once", client.ClientID, clientsVariable)
+		case client.AuthMethod != ClientAuthTLS:
+			problem("Client %q must use token_endpoint_auth_method %q", client.ClientID, ClientAuthTLS)
+		case (client.SubjectDN == "") == (client.SANDNS == ""):
+			problem("Client %q needs one of tls_client_auth_subject_dn or tls_client_auth_san_dns", client.ClientID)
+		}
+		clientIDs[client.ClientID] = true
+	}
+	if len(c.Clients) > 0 && c.Server.TLSClientAuth == TLSClientAuthNone {
+		problem("Clients in %s need %s to be %q or %q", clientsVariable, tlsClientAuthVariable, TLSClientAuthOptional, TLSClientAuthRequire)
+	}
+	if c.Password.MinLength < 1 {
+		problem("%s must be at least 1", passwordMinLengthVariable)
+	}
+	if c.Password.MaxLength < c.Password.MinLength {
+		problem("%s can't be less than %s", passwordMaxLengthVariable, passwordMinLengthVariable)
+	}
+	if c.DPoP.ProofMaxAge <= 0 {
+		problem("%s must be positive", dpopProofMaxAgeVariable)
+	}
+	if c.DPoP.NonceLifetime <= 0 {
+		problem("%s must be positive", dpopNonceLifetimeVariable)
+	}
+	if c.EmailLogin.MaxAttempts < 1 {
+		problem("%s must be at least 1", emailLoginMaxAttemptsVariable)
+	}
+	if c.EmailLogin.MaxEmails < 1 {
+		problem("%s must be at least 1", emailLoginMaxEmailsVariable)
+	}
+	if c.Lockout.Threshold < 0 {
+		problem("%s can't be negative", lockoutThresholdVariable)
+	}
+	if c.Lockout.Duration <= 0 {
+		problem("%s must be positive", lockoutDurationVariable)
+	}
+	for _, endpoint := range c.Webhooks.Endpoints {
+		if endpointURL, err := url.Parse(endpoint.URL); err != nil || (endpointURL.Scheme != "http" && endpointURL.Scheme != "https") || endpointURL.Host == "" {
+			problem("Every webhook in %s needs an http or https url", webhooksVariable)
+		} else if len(endpoint.Secret) < minWebhookSecretLength {
+			problem("Webhook %s needs a secret of at least %d characters", endpoint.URL, minWebhookSecretLength)
+		}
+	}
+	if c.Webhooks.Timeout <= 0 {
+		problem("%s must be positive", webhookTimeoutVariable)
+	}
+	if c.Webhooks.MaxAttempts < 1 {
+		problem("%s must be at least 1", webhookMaxAttemptsVariable)
+	}
+	if c.Webhooks.RetryBackoff <= 0 {
+		problem("%s must be positive", webhookRetryBackoffVariable)
+	}
+	if c.Webhooks.MaxRetryBackoff < c.Webhooks.RetryBackoff {
+		problem("%s can't be shorter than %s", webhookMaxRetryBackoffVariable, webhookRetryBackoffVariable)
+	}
+	switch c.Tracing.Exporter {
+	case TracingExporterNone, TracingExporterStdout:
+	case TracingExporterOTLP:
+		if c.Tracing.OTLPEndpoint == "" {
+			problem("%s is required when %s is %q", tracingOTLPEndpointVariable, tracingExporterVariable, TracingExporterOTLP)
+		}
+	default:
+		problem("%s must be %q, %q or %q", tracingExporterVariable, TracingExporterNone, TracingExporterStdout, TracingExporterOTLP)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		problem("%s must be between 0 and 1", tracingSampleRatioVariable)
+	}
+	if c.Audit.WebhookURL != "" {
+		if webhookURL, err := url.Parse(c.Audit.WebhookURL); err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+			problem("%s must be an http or https URL", auditWebhookURLVariable)
+		}
+	}
+	if c.Audit.WebhookTimeout <= 0 {
+		problem("%s must be positive", auditWebhookTimeoutVariable)
+	}
+	switch c.Mail.Mailer {
+	case MailerLog:
+	case MailerSMTP:
+		if c.Mail.SMTPHost == "" {
+			problem("%s is required when %s is %q", smtpHostVariable, mailerVariable, MailerSMTP)
+		}
+	default:
+		problem("%s must be %q or %q", mailerVariable, MailerLog, MailerSMTP)
+	}
+	for _, route := range c.ExtAuthz.Routes {
+		if !strings.HasPrefix(route.Prefix, "/") {
+			problem("Every route in %s needs a prefix starting with \"/\"", extAuthzRoutesVariable)
+			break
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// Redacted returns a copy of the config with its secrets hidden, for showing to people
+func (c Config) Redacted() Config {
+	hide := func(secret *string) {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	hide(&c.AccessTokenSecret)
+	hide(&c.RefreshTokenSecret)
+	hide(&c.ActionTokenSecret)
+	hide(&c.Mail.SMTPPassword)
+	// Copy the endpoints, so the secrets in the original config are left alone
+	c.Webhooks.Endpoints = append([]WebhookEndpoint(nil), c.Webhooks.Endpoints...)
+	for i := range c.Webhooks.Endpoints {
+		hide(&c.Webhooks.Endpoints[i].Secret)
+	}
+	return c
+}
+
+// Setting is one config value, named by its path in Config
+type Setting struct {
+	Name  string
+	Value string
+}
+
+// SettingChange is a setting that differs between two configs
+type SettingChange struct {
+	Name string
+	Old  string
+	New  string
+}
+
+// Changes lists the settings that differ between two configs. Secrets are
+// redacted, so only show that they changed.
+func Changes(old Config, new Config) []SettingChange {
+	oldSettings, newSettings := old.Settings(), new.Settings()
+	oldRedacted, newRedacted := old.Redacted().Settings(), new.Redacted().Settings()
+
+	changes := []SettingChange{}
+	for i := range oldSettings {
+		if oldSettings[i].Value != newSettings[i].Value {
+			changes = append(changes, SettingChange{Name: oldSettings[i].Name, Old: oldRedacted[i].Value, New: newRedacted[i].Value})
+		}
+	}
+	return changes
+}
+
+// Settings lists every config value, in the order they're declared
+func (c Config) Settings() []Setting {
+	return settings("", reflect.ValueOf(c))
+}
+
+func settings(prefix string, value reflect.Value) []Setting {
+	result := []Setting{}
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		fieldValue := value.Field(i)
+		name := prefix + field.Name
+
+		switch typed := fieldValue.Interface().(type) {
+		case time.Duration:
+			result = append(result, Setting{name, typed.String()})
+		case log.Level:
+			result = append(result, Setting{name, typed.String()})
+		case []string:
+			result = append(result, Setting{name, strings.Join(typed, ",")})
+		default:
+			if fieldValue.Kind() == reflect.Struct {
+				result = append(result, settings(name+".", fieldValue)...)
+				continue
+			}
+			if fieldValue.Kind() == reflect.Slice {
+				encoded, _ := json.Marshal(typed)
+				result = append(result, Setting{name, string(encoded)})
+				continue
+			}
+			result = append(result, Setting{name, fmt.Sprint(typed)})
+		}
+	}
+	return result
+}
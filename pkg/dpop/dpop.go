@@ -0,0 +1,273 @@
+// Package dpop checks DPoP proofs (RFC 9449), which show that the caller
+// holds the private key a token is bound to, and issues the nonces servers
+// may require in them.
+package dpop
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"auth-server/pkg/jwk"
+)
+
+const (
+	// Header is the request header proofs are sent in
+	Header string = "DPoP"
+	// NonceHeader is the response header carrying a nonce for the next proof
+	NonceHeader string = "DPoP-Nonce"
+	// Scheme is the Authorization scheme for DPoP-bound access tokens
+	Scheme string = "DPoP"
+
+	proofType string = "dpop+jwt"
+	// maxIDLength keeps proofs from filling the replay cache with huge IDs
+	maxIDLength int = 256
+
+	defaultMaxAge        time.Duration = time.Minute
+	defaultNonceLifetime time.Duration = time.Minute * 5
+)
+
+var (
+	// ErrInvalidProof is returned, wrapped with the reason, for proofs that can't be accepted
+	ErrInvalidProof = errors.New("Invalid DPoP proof")
+	// ErrUseNonce is returned when a proof needs a fresh nonce from NonceHeader
+	ErrUseNonce = errors.New("DPoP proof requires a nonce")
+)
+
+// signingMethods are the asymmetric algorithms proofs may be signed with
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// Config sets how strict a Verifier is
+type Config struct {
+	// MaxAge is how old a proof's iat may be. Defaults to a minute.
+	MaxAge time.Duration
+	// Leeway allows for clock skew when checking iat
+	Leeway time.Duration
+	// RequireNonce makes proofs carry a nonce from Nonce
+	RequireNonce bool
+	// NonceLifetime is how long a nonce is accepted for. Defaults to 5 minutes.
+	NonceLifetime time.Duration
+}
+
+// Verifier checks proofs, remembering the ones it has seen so they can't be
+// replayed. It's safe for concurrent use.
+type Verifier struct {
+	config Config
+	// nonceKey signs nonces, which are only valid where they were issued
+	nonceKey []byte
+	now      func() time.Time
+
+	lock sync.Mutex
+	// seen maps each accepted proof to when it gets too old to be accepted again
+	seen map[string]int64
+}
+
+// claims are the contents of a proof
+type claims struct {
+	ID              string `json:"jti"`
+	Method          string `json:"htm"`
+	URI             string `json:"htu"`
+	IssuedAt        int64  `json:"iat"`
+	AccessTokenHash string `json:"ath,omitempty"`
+	Nonce           string `json:"nonce,omitempty"`
+}
+
+// Valid is left to Verify, which knows the request
+func (c *claims) Valid() error {
+	return nil
+}
+
+// NewVerifier creates a Verifier with a random key for its nonces
+func NewVerifier(config Config) (*Verifier, error) {
+	if config.MaxAge <= 0 {
+		config.MaxAge = defaultMaxAge
+	}
+	if config.NonceLifetime <= 0 {
+		config.NonceLifetime = defaultNonceLifetime
+	}
+	nonceKey := make([]byte, 32)
+	if _, err := rand.Read(nonceKey); err != nil {
+		return nil, err
+	}
+	return &Verifier{
+		config:   config,
+		nonceKey: nonceKey,
+		now:      time.Now,
+		seen:     map[string]int64{},
+	}, nil
+}
+
+// RequiresNonce reports whether proofs need a nonce
+func (v *Verifier) RequiresNonce() bool {
+	return v.config.RequireNonce
+}
+
+// Verify checks a proof sent with a request to uri, returning the
+// thumbprint (RFC 7638) of the key that signed it. The query and fragment
+// of uri are ignored. When the proof accompanies an access token, its hash
+// must be in the proof's ath claim.
+func (v *Verifier) Verify(proof string, method string, uri string, accessToken string) (string, error) {
+	if proof == "" {
+		return "", invalid("missing proof")
+	}
+
+	var thumbprint string
+	proofClaims := &claims{}
+	parser := &jwt.Parser{ValidMethods: signingMethods, SkipClaimsValidation: true}
+	token, err := parser.ParseWithClaims(proof, proofClaims, func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); !strings.EqualFold(typ, proofType) {
+			return nil, fmt.Errorf("typ must be %s", proofType)
+		}
+		key, err := headerKey(token.Header["jwk"])
+		if err != nil {
+			return nil, err
+		}
+		if thumbprint, err = key.Thumbprint(); err != nil {
+			return nil, err
+		}
+		return key.PublicKey()
+	})
+	if err != nil {
+		var validationErr *jwt.ValidationError
+		if errors.As(err, &validationErr) && validationErr.Inner != nil {
+			err = validationErr.Inner
+		}
+		return "", invalid(err.Error())
+	}
+	if !token.Valid {
+		return "", invalid("bad signature")
+	}
+
+	now := v.now()
+	if proofClaims.ID == "" || len(proofClaims.ID) > maxIDLength {
+		return "", invalid("missing or oversized jti")
+	}
+	if proofClaims.Method != method {
+		return "", invalid("htm doesn't match the request")
+	}
+	if !sameURI(proofClaims.URI, uri) {
+		return "", invalid("htu doesn't match the request")
+	}
+	issuedAt := time.Unix(proofClaims.IssuedAt, 0)
+	if proofClaims.IssuedAt == 0 || issuedAt.After(now.Add(v.config.Leeway)) || issuedAt.Before(now.Add(-v.config.MaxAge-v.config.Leeway)) {
+		return "", invalid("iat is too old or in the future")
+	}
+	if accessToken != "" {
+		if subtle.ConstantTimeCompare([]byte(proofClaims.AccessTokenHash), []byte(AccessTokenHash(accessToken))) != 1 {
+			return "", invalid("ath doesn't match the access token")
+		}
+	}
+	if v.config.RequireNonce && !v.validNonce(proofClaims.Nonce, now) {
+		return "", ErrUseNonce
+	}
+
+	if !v.remember(thumbprint+":"+proofClaims.ID, issuedAt.Add(v.config.MaxAge+v.config.Leeway).Unix(), now.Unix()) {
+		return "", invalid("proof has already been used")
+	}
+	return thumbprint, nil
+}
+
+// Nonce returns a nonce for clients to put in their next proofs. It holds
+// when it was issued and a MAC, so nothing needs to be stored.
+func (v *Verifier) Nonce() string {
+	issuedAt := make([]byte, 8)
+	binary.BigEndian.PutUint64(issuedAt, uint64(v.now().Unix()))
+	return base64.RawURLEncoding.EncodeToString(append(issuedAt, v.nonceMAC(issuedAt)...))
+}
+
+func (v *Verifier) validNonce(nonce string, now time.Time) bool {
+	decoded, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(decoded) != 8+sha256.Size {
+		return false
+	}
+	issuedAt, mac := decoded[:8], decoded[8:]
+	if !hmac.Equal(mac, v.nonceMAC(issuedAt)) {
+		return false
+	}
+	age := now.Sub(time.Unix(int64(binary.BigEndian.Uint64(issuedAt)), 0))
+	return age >= -v.config.Leeway && age <= v.config.NonceLifetime
+}
+
+func (v *Verifier) nonceMAC(issuedAt []byte) []byte {
+	mac := hmac.New(sha256.New, v.nonceKey)
+	mac.Write(issuedAt)
+	return mac.Sum(nil)
+}
+
+// remember records a proof until it expires, reporting false if it was
+// already recorded
+func (v *Verifier) remember(key string, expiresAt int64, now int64) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for seenKey, seenExpiresAt := range v.seen {
+		if seenExpiresAt < now {
+			delete(v.seen, seenKey)
+		}
+	}
+	if _, found := v.seen[key]; found {
+		return false
+	}
+	v.seen[key] = expiresAt
+	return true
+}
+
+// AccessTokenHash is the base64url-encoded SHA-256 hash of an access token,
+// as used in ath
+func AccessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// headerKey reads the public key from a proof's jwk header, refusing
+// private keys
+func headerKey(header interface{}) (jwk.Key, error) {
+	members, valid := header.(map[string]interface{})
+	if !valid {
+		return jwk.Key{}, errors.New("missing jwk header")
+	}
+	if _, private := members["d"]; private {
+		return jwk.Key{}, errors.New("jwk header must be a public key")
+	}
+	encoded, err := json.Marshal(members)
+	if err != nil {
+		return jwk.Key{}, err
+	}
+	var key jwk.Key
+	if err := json.Unmarshal(encoded, &key); err != nil {
+		return jwk.Key{}, err
+	}
+	return key, nil
+}
+
+// sameURI compares htu with the request's URI, ignoring query strings and
+// fragments, and the case of the scheme and host
+func sameURI(claimed string, expected string) bool {
+	claimedURL, err := url.Parse(claimed)
+	if err != nil {
+		return false
+	}
+	expectedURL, err := url.Parse(expected)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(claimedURL.Scheme, expectedURL.Scheme) &&
+		strings.EqualFold(claimedURL.Host, expectedURL.Host) &&
+		claimedURL.EscapedPath() == expectedURL.EscapedPath()
+}
+
+func invalid(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidProof, reason)
+}
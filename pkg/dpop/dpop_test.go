@@ -0,0 +1,257 @@
+package dpop
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"auth-server/pkg/jwk"
+)
+
+const (
+	testMethod      string = "POST"
+	testURI         string = "https://auth.example.com/api/v1/token"
+	testAccessToken string = "access-token"
+)
+
+var testNow = time.Unix(1700000000, 0)
+
+func generateKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// newProof signs a proof for testMethod and testURI, after edit has had a
+// chance to change its header and claims
+func newProof(t *testing.T, key *ecdsa.PrivateKey, edit func(header map[string]interface{}, claims jwt.MapClaims)) string {
+	public, err := jwk.New(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"jti": "proof-id",
+		"htm": testMethod,
+		"htu": testURI,
+		"iat": testNow.Unix(),
+	})
+	token.Header["typ"] = proofType
+	token.Header["jwk"] = public
+	if edit != nil {
+		edit(token.Header, token.Claims.(jwt.MapClaims))
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func newTestVerifier(t *testing.T, config Config) *Verifier {
+	verifier, err := NewVerifier(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier.now = func() time.Time { return testNow }
+	return verifier
+}
+
+func TestVerify(t *testing.T) {
+	key := generateKey(t)
+	otherKey := generateKey(t)
+	public, _ := jwk.New(&key.PublicKey)
+	thumbprint, _ := public.Thumbprint()
+
+	tests := []struct {
+		name        string
+		config      Config
+		edit        func(header map[string]interface{}, claims jwt.MapClaims)
+		proof       string
+		uri         string
+		accessToken string
+		wantErr     error
+	}{
+		{name: "valid"},
+		{name: "typ in another case", edit: func(header map[string]interface{}, claims jwt.MapClaims) { header["typ"] = "DPoP+JWT" }},
+		{name: "query and fragment ignored", uri: testURI + "?state=1#top"},
+		{name: "scheme and host in another case", uri: strings.Replace(testURI, "https://auth.example.com", "HTTPS://Auth.Example.com", 1)},
+		{
+			name: "bound to an access token",
+			edit: func(header map[string]interface{}, claims jwt.MapClaims) {
+				claims["ath"] = AccessTokenHash(testAccessToken)
+			},
+			accessToken: testAccessToken,
+		},
+		{
+			name:   "iat within the leeway",
+			config: Config{Leeway: time.Second * 10},
+			edit:   func(header map[string]interface{}, claims jwt.MapClaims) { claims["iat"] = testNow.Unix() + 5 },
+		},
+		{name: "missing proof", proof: "-", wantErr: ErrInvalidProof},
+		{name: "not a JWT", proof: "proof", wantErr: ErrInvalidProof},
+		{name: "wrong typ", edit: func(header map[string]interface{}, claims jwt.MapClaims) { header["typ"] = "JWT" }, wantErr: ErrInvalidProof},
+		{name: "missing jwk", edit: func(header map[string]interface{}, claims jwt.MapClaims) { delete(header, "jwk") }, wantErr: ErrInvalidProof},
+		{
+			name: "private jwk",
+			edit: func(header map[string]interface{}, claims jwt.MapClaims) {
+				header["jwk"] = map[string]interface{}{"kty": public.KeyType, "crv": public.Curve, "x": public.X, "y": public.Y, "d": "secret"}
+			},
+			wantErr: ErrInvalidProof,
+		},
+		{
+			name: "signed with another key",
+			edit: func(header map[string]interface{}, claims jwt.MapClaims) {
+				other, _ := jwk.New(&otherKey.PublicKey)
+				header["jwk"] = other
+			},
+			wantErr: ErrInvalidProof,
+		},
+		{name: "missing jti", edit: func(header map[string]interface{}, claims jwt.MapClaims) { delete(claims, "jti") }, wantErr: ErrInvalidProof},
+		{
+			name: "oversized jti",
+			edit: func(header map[string]interface{}, claims jwt.MapClaims) {
+				claims["jti"] = strings.Repeat("a", maxIDLength+1)
+			},
+			wantErr: ErrInvalidProof,
+		},
+		{name: "wrong htm", edit: func(header map[string]interface{}, claims jwt.MapClaims) { claims["htm"] = "GET" }, wantErr: ErrInvalidProof},
+		{name: "wrong htu path", uri: testURI + "/other", wantErr: ErrInvalidProof},
+		{name: "wrong htu host", uri: strings.Replace(testURI, "auth.", "evil.", 1), wantErr: ErrInvalidProof},
+		{name: "missing iat", edit: func(header map[string]interface{}, claims jwt.MapClaims) { delete(claims, "iat") }, wantErr: ErrInvalidProof},
+		{
+			name: "iat too old",
+			edit: func(header map[string]interface{}, claims jwt.MapClaims) {
+				claims["iat"] = testNow.Add(-time.Minute * 2).Unix()
+			},
+			wantErr: ErrInvalidProof,
+		},
+		{
+			name:    "iat in the future",
+			edit:    func(header map[string]interface{}, claims jwt.MapClaims) { claims["iat"] = testNow.Unix() + 5 },
+			wantErr: ErrInvalidProof,
+		},
+		{name: "missing ath", accessToken: testAccessToken, wantErr: ErrInvalidProof},
+		{
+			name:        "ath for another access token",
+			edit:        func(header map[string]interface{}, claims jwt.MapClaims) { claims["ath"] = AccessTokenHash("other") },
+			accessToken: testAccessToken,
+			wantErr:     ErrInvalidProof,
+		},
+		{name: "missing nonce", config: Config{RequireNonce: true}, wantErr: ErrUseNonce},
+		{
+			name:    "invalid nonce",
+			config:  Config{RequireNonce: true},
+			edit:    func(header map[string]interface{}, claims jwt.MapClaims) { claims["nonce"] = "nonce" },
+			wantErr: ErrUseNonce,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifier := newTestVerifier(t, test.config)
+			proof := test.proof
+			switch proof {
+			case "":
+				proof = newProof(t, key, test.edit)
+			case "-":
+				proof = ""
+			}
+			uri := test.uri
+			if uri == "" {
+				uri = testURI
+			}
+
+			got, err := verifier.Verify(proof, testMethod, uri, test.accessToken)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, test.wantErr)
+			}
+			if err == nil && got != thumbprint {
+				t.Errorf("Verify() = %s, want %s", got, thumbprint)
+			}
+		})
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	key := generateKey(t)
+	verifier := newTestVerifier(t, Config{})
+	proof := newProof(t, key, nil)
+
+	if _, err := verifier.Verify(proof, testMethod, testURI, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(proof, testMethod, testURI, ""); !errors.Is(err, ErrInvalidProof) {
+		t.Errorf("Expected a replayed proof to be refused, got %v", err)
+	}
+
+	// The same jti from another key is a different proof
+	if _, err := verifier.Verify(newProof(t, generateKey(t), nil), testMethod, testURI, ""); err != nil {
+		t.Errorf("Expected another key's proof to be accepted, got %v", err)
+	}
+
+	// Once the proof is too old to be accepted anyway, it's forgotten
+	verifier.now = func() time.Time { return testNow.Add(time.Minute * 2) }
+	verifier.Verify(newProof(t, key, func(header map[string]interface{}, claims jwt.MapClaims) {
+		claims["jti"] = "later"
+		claims["iat"] = testNow.Add(time.Minute * 2).Unix()
+	}), testMethod, testURI, "")
+	if len(verifier.seen) != 1 {
+		t.Errorf("Expected expired proofs to be forgotten, %d remembered", len(verifier.seen))
+	}
+}
+
+func TestNonce(t *testing.T) {
+	key := generateKey(t)
+	other := newTestVerifier(t, Config{})
+
+	tests := []struct {
+		name string
+		// issued is how long before the proof the nonce was issued
+		issued  time.Duration
+		nonce   func(verifier *Verifier) string
+		wantErr error
+	}{
+		{name: "fresh", nonce: (*Verifier).Nonce},
+		{name: "nearly expired", issued: defaultNonceLifetime, nonce: (*Verifier).Nonce},
+		{name: "expired", issued: defaultNonceLifetime + time.Second, nonce: (*Verifier).Nonce, wantErr: ErrUseNonce},
+		{name: "issued in the future", issued: -time.Minute, nonce: (*Verifier).Nonce, wantErr: ErrUseNonce},
+		{name: "from another verifier", nonce: func(*Verifier) string { return other.Nonce() }, wantErr: ErrUseNonce},
+		{
+			name: "tampered with",
+			nonce: func(verifier *Verifier) string {
+				// Changing the first character changes when it claims to be issued
+				nonce := []byte(verifier.Nonce())
+				if nonce[0] == 'A' {
+					nonce[0] = 'B'
+				} else {
+					nonce[0] = 'A'
+				}
+				return string(nonce)
+			},
+			wantErr: ErrUseNonce,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifier := newTestVerifier(t, Config{RequireNonce: true})
+			if !verifier.RequiresNonce() {
+				t.Fatal("Expected the verifier to require nonces")
+			}
+			verifier.now = func() time.Time { return testNow.Add(-test.issued) }
+			nonce := test.nonce(verifier)
+			verifier.now = func() time.Time { return testNow }
+
+			proof := newProof(t, key, func(header map[string]interface{}, claims jwt.MapClaims) { claims["nonce"] = nonce })
+			if _, err := verifier.Verify(proof, testMethod, testURI, ""); !errors.Is(err, test.wantErr) {
+				t.Errorf("Verify() error = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+// Package jwk converts public keys to and from JSON Web Keys (RFC 7517), and
+// computes their thumbprints (RFC 7638).
+package jwk
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Key types
+const (
+	KeyTypeRSA string = "RSA"
+	KeyTypeEC  string = "EC"
+)
+
+var (
+	ErrUnsupportedKey = errors.New("Unsupported key type")
+	ErrInvalidKey     = errors.New("Invalid key")
+)
+
+// Key is a public JSON Web Key. Only RSA and EC keys are supported.
+type Key struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// EC keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// Set is a JWK Set, as served from a JWKS URL
+type Set struct {
+	Keys []Key `json:"keys"`
+}
+
+// Find returns the key with a key ID
+func (s Set) Find(keyID string) (Key, bool) {
+	for _, key := range s.Keys {
+		if key.KeyID == keyID {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+// New builds a key from an *rsa.PublicKey or *ecdsa.PublicKey. Its key ID is
+// left empty; Thumbprint is a good choice for one.
+func New(publicKey crypto.PublicKey) (Key, error) {
+	switch publicKey := publicKey.(type) {
+	case *rsa.PublicKey:
+		return Key{
+			KeyType: KeyTypeRSA,
+			N:       encode(publicKey.N.Bytes()),
+			E:       encode(big.NewInt(int64(publicKey.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		return Key{
+			KeyType: KeyTypeEC,
+			Curve:   publicKey.Curve.Params().Name,
+			X:       encode(pad(publicKey.X.Bytes(), size)),
+			Y:       encode(pad(publicKey.Y.Bytes(), size)),
+		}, nil
+	}
+	return Key{}, ErrUnsupportedKey
+}
+
+// PublicKey decodes the key into an *rsa.PublicKey or *ecdsa.PublicKey
+func (k Key) PublicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case KeyTypeRSA:
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, ErrInvalidKey
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case KeyTypeEC:
+		curve, err := curveByName(k.Curve)
+		if err != nil {
+			return nil, err
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		publicKey := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, ErrInvalidKey
+		}
+		return publicKey, nil
+	}
+	return nil, ErrUnsupportedKey
+}
+
+// Thumbprint is the base64url-encoded SHA-256 hash of the key's required
+// members, as described in RFC 7638
+func (k Key) Thumbprint() (string, error) {
+	var members interface{}
+	switch k.KeyType {
+	// Members must be in lexicographic order, which the struct fields keep
+	case KeyTypeRSA:
+		members = struct {
+			E       string `json:"e"`
+			KeyType string `json:"kty"`
+			N       string `json:"n"`
+		}{k.E, k.KeyType, k.N}
+	case KeyTypeEC:
+		members = struct {
+			Curve   string `json:"crv"`
+			KeyType string `json:"kty"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		}{k.Curve, k.KeyType, k.X, k.Y}
+	default:
+		return "", ErrUnsupportedKey
+	}
+	canonical, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return encode(sum[:]), nil
+}
+
+func curveByName(name string) (elliptic.Curve, error) {
+	switch name {
+	case "P-256":
+		return elliptic.P256(), nil
+	case "P-384":
+		return elliptic.P384(), nil
+	case "P-521":
+		return elliptic.P521(), nil
+	}
+	return nil, fmt.Errorf("Unsupported curve %q", name)
+}
+
+// pad left-pads EC coordinates to the curve size, as RFC 7518 requires
+func pad(value []byte, size int) []byte {
+	if len(value) >= size {
+		return value
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(value):], value)
+	return padded
+}
+
+func encode(value []byte) string {
+	return base64.RawURLEncoding.EncodeToString(value)
+}
+
+func decode(value string) ([]byte, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	return decoded, nil
+}
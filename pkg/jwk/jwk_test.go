@@ -0,0 +1,159 @@
+package jwk
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestThumbprint(t *testing.T) {
+	// The example from RFC 7638, section 3.1
+	key := Key{
+		KeyType:   KeyTypeRSA,
+		KeyID:     "2011-04-29",
+		Algorithm: "RS256",
+		N:         "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:         "AQAB",
+	}
+	thumbprint, err := key.Thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; thumbprint != want {
+		t.Errorf("Thumbprint() = %s, want %s", thumbprint, want)
+	}
+
+	if _, err := (Key{KeyType: "oct"}).Thumbprint(); err != ErrUnsupportedKey {
+		t.Errorf("Expected ErrUnsupportedKey, got %v", err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		curve elliptic.Curve
+		// size is the length of each EC coordinate
+		size int
+	}{
+		{name: "RSA"},
+		{name: "P-256", curve: elliptic.P256(), size: 32},
+		{name: "P-384", curve: elliptic.P384(), size: 48},
+		{name: "P-521", curve: elliptic.P521(), size: 66},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var public interface{} = &rsaKey.PublicKey
+			if test.curve != nil {
+				ecKey, err := ecdsa.GenerateKey(test.curve, rand.Reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				public = &ecKey.PublicKey
+			}
+
+			key, err := New(public)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.curve != nil {
+				x, _ := decode(key.X)
+				y, _ := decode(key.Y)
+				if len(x) != test.size || len(y) != test.size {
+					t.Errorf("Expected %d byte coordinates, got %d and %d", test.size, len(x), len(y))
+				}
+			}
+
+			// Through JSON and back, as a JWKS client would see it
+			encoded, err := json.Marshal(Set{Keys: []Key{key}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var set Set
+			if err := json.Unmarshal(encoded, &set); err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := set.Keys[0].PublicKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, public) {
+				t.Error("Expected the decoded key to match the original")
+			}
+
+			before, _ := key.Thumbprint()
+			after, _ := set.Keys[0].Thumbprint()
+			if before == "" || before != after {
+				t.Errorf("Expected matching thumbprints, got %q and %q", before, after)
+			}
+		})
+	}
+}
+
+func TestNewUnsupported(t *testing.T) {
+	if _, err := New("not a key"); err != ErrUnsupportedKey {
+		t.Errorf("Expected ErrUnsupportedKey, got %v", err)
+	}
+}
+
+func TestPublicKeyInvalid(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, _ := New(&ecKey.PublicKey)
+
+	tests := []struct {
+		name    string
+		key     Key
+		wantErr error
+	}{
+		{name: "unsupported type", key: Key{KeyType: "oct"}, wantErr: ErrUnsupportedKey},
+		{name: "RSA bad base64", key: Key{KeyType: KeyTypeRSA, N: "!!", E: "AQAB"}, wantErr: ErrInvalidKey},
+		{name: "RSA empty modulus", key: Key{KeyType: KeyTypeRSA, E: "AQAB"}, wantErr: ErrInvalidKey},
+		{name: "RSA exponent too small", key: Key{KeyType: KeyTypeRSA, N: "AQAB", E: "AQ"}, wantErr: ErrInvalidKey},
+		{name: "RSA exponent too large", key: Key{KeyType: KeyTypeRSA, N: "AQAB", E: "AQAAAAAA"}, wantErr: ErrInvalidKey},
+		{name: "EC unsupported curve", key: Key{KeyType: KeyTypeEC, Curve: "P-224", X: valid.X, Y: valid.Y}},
+		{name: "EC bad base64", key: Key{KeyType: KeyTypeEC, Curve: "P-256", X: "!!", Y: valid.Y}, wantErr: ErrInvalidKey},
+		{name: "EC point not on curve", key: Key{KeyType: KeyTypeEC, Curve: "P-256", X: valid.Y, Y: valid.X}, wantErr: ErrInvalidKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.key.PublicKey()
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+				t.Errorf("Expected %v, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSetFind(t *testing.T) {
+	set := Set{Keys: []Key{{KeyType: KeyTypeRSA, KeyID: "one"}, {KeyType: KeyTypeEC, KeyID: "two"}}}
+	tests := []struct {
+		keyID    string
+		wantType string
+		found    bool
+	}{
+		{"one", KeyTypeRSA, true},
+		{"two", KeyTypeEC, true},
+		{"three", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		key, found := set.Find(test.keyID)
+		if found != test.found || key.KeyType != test.wantType {
+			t.Errorf("Find(%q) = %v, %v, want %v, %v", test.keyID, key.KeyType, found, test.wantType, test.found)
+		}
+	}
+}
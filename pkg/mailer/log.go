@@ -0,0 +1,53 @@
+package mailer
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"auth-server/pkg/config"
+)
+
+// logMailer is meant for local development. It appends messages to a file,
+// or writes them to the application log when no file is configured.
+type logMailer struct {
+	log  *log.Entry
+	from string
+	path string
+	lock sync.Mutex
+}
+
+// NewLogMailer creates a Mailer that never leaves the machine
+func NewLogMailer(config config.MailConfig) Mailer {
+	return &logMailer{
+		log:  log.WithFields(log.Fields{"logger": "LogMailer"}),
+		from: config.From,
+		path: config.File,
+	}
+}
+
+func (m *logMailer) Send(message Message) error {
+	if m.path == "" {
+		m.log.WithFields(log.Fields{
+			"to":      message.To,
+			"subject": message.Subject,
+			"body":    message.Body,
+		}).Info("Sending email")
+		return nil
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	file, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open mail file: %w", err)
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "%s\n\n%s\n\n", formatHeaders(m.from, message, time.Now()), message.Body)
+	return err
+}
@@ -0,0 +1,30 @@
+package mailer
+
+import (
+	"fmt"
+
+	"auth-server/pkg/config"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers email to users
+type Mailer interface {
+	Send(message Message) error
+}
+
+// New creates the Mailer selected by the configuration
+func New(mailConfig config.MailConfig) (Mailer, error) {
+	switch mailConfig.Mailer {
+	case config.MailerLog:
+		return NewLogMailer(mailConfig), nil
+	case config.MailerSMTP:
+		return NewSMTPMailer(mailConfig)
+	}
+	return nil, fmt.Errorf("Unknown mailer %q", mailConfig.Mailer)
+}
@@ -0,0 +1,58 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"auth-server/pkg/config"
+)
+
+type smtpMailer struct {
+	address string
+	auth    smtp.Auth
+	from    string
+}
+
+// NewSMTPMailer creates a Mailer that relays through an SMTP server
+func NewSMTPMailer(config config.MailConfig) (Mailer, error) {
+	if config.SMTPHost == "" {
+		return nil, errors.New("SMTP mailer requires a host")
+	}
+
+	var auth smtp.Auth
+	if config.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", config.SMTPUsername, config.SMTPPassword, config.SMTPHost)
+	}
+
+	return &smtpMailer{
+		address: net.JoinHostPort(config.SMTPHost, strconv.Itoa(config.SMTPPort)),
+		auth:    auth,
+		from:    config.From,
+	}, nil
+}
+
+func (m *smtpMailer) Send(message Message) error {
+	body := strings.ReplaceAll(message.Body, "\n", "\r\n")
+	data := fmt.Sprintf("%s\r\n\r\n%s\r\n", formatHeaders(m.from, message, time.Now()), body)
+	return smtp.SendMail(m.address, m.auth, m.from, []string{message.To}, []byte(data))
+}
+
+// formatHeaders renders the headers of a plain-text message, stripping line
+// breaks so user input can't inject headers of its own.
+func formatHeaders(from string, message Message, now time.Time) string {
+	clean := strings.NewReplacer("\r", "", "\n", "")
+	headers := []string{
+		"From: " + clean.Replace(from),
+		"To: " + clean.Replace(message.To),
+		"Subject: " + clean.Replace(message.Subject),
+		"Date: " + now.Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	return strings.Join(headers, "\r\n")
+}
@@ -1,54 +1,301 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 
-	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 
+	"auth-server/pkg/app"
+	"auth-server/pkg/audit"
 	"auth-server/pkg/config"
-	controllerv1 "auth-server/pkg/v1/controller"
-	middlewarev1 "auth-server/pkg/v1/middleware"
-	tokenservicev1 "auth-server/pkg/v1/service"
+	"auth-server/pkg/metrics"
+	"auth-server/pkg/server"
+	"auth-server/pkg/store"
+	"auth-server/pkg/tracing"
+	"auth-server/pkg/webhook"
 )
 
 const (
 	defaultLogLevel log.Level = log.InfoLevel
 )
 
+// command is one subcommand of the server binary
+type command struct {
+	usage       string
+	description string
+	run         func(args []string) error
+}
+
+var commands = map[string]command{
+	"serve":        {"serve [config flags]", "Run the server (the default)", runServe},
+	"keygen":       {"keygen [-alg ES256] [-out signing.pem] [-jwks jwks.json]", "Write a new signing key and a JWKS holding its public key", runKeygen},
+	"user":         {"user add|passwd|disable [flags] [config flags]", "Manage users in USER_STORE_FILE, while the server is stopped", runUser},
+	"migrate":      {"migrate [config flags]", "Upgrade the store files to the current schema version", runMigrate},
+	"check-config": {"check-config [config flags]", "Validate the configuration and print it, with secrets redacted", runCheckConfig},
+	"audit":        {"audit verify [-file audit.log] [config flags]", "Check the hash chain of an audit file hasn't been broken", runAudit},
+	"version":      {"version", "Print the version, commit and build date", runVersion},
+}
+
 func main() {
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, found := commands[name]
+	if !found {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: authserver <command> [flags]\n\nCommands:\n")
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writer := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(writer, "  %s\t%s\n", commands[name].usage, commands[name].description)
+	}
+	writer.Flush()
+	fmt.Fprintf(os.Stderr, "\nConfig flags:\n"+
+		"  -config file\tYAML or JSON config file, instead of CONFIG_FILE\n"+
+		"  -set NAME=VALUE\tOverride a setting, such as -set LOG_LEVEL=debug. Can be repeated.\n")
+}
+
+// configFlags are the flags of every command that loads the config
+type configFlags struct {
+	file      string
+	overrides map[string]string
+}
+
+func addConfigFlags(flags *flag.FlagSet) *configFlags {
+	options := &configFlags{overrides: map[string]string{}}
+	flags.StringVar(&options.file, "config", "", "YAML or JSON config file, instead of CONFIG_FILE")
+	flags.Var(options, "set", "Override a setting, such as LOG_LEVEL=debug. Can be repeated.")
+	return options
+}
+
+// String and Set make configFlags a flag.Value, for -set
+func (f *configFlags) String() string {
+	return ""
+}
+
+func (f *configFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("Expected NAME=VALUE, not %q", value)
+	}
+	f.overrides[strings.ToUpper(parts[0])] = parts[1]
+	return nil
+}
 
-	appConfig := config.Load()
+// options are where to load the config from
+func (f *configFlags) options() config.LoadOptions {
+	return config.LoadOptions{File: f.file, Overrides: f.overrides}
+}
+
+// load reads the config, with the flags taking precedence over the
+// environment and the config file, and applies its logging settings
+func (f *configFlags) load() (config.Config, error) {
+	appConfig, err := config.Load(f.options())
+	if err != nil {
+		return appConfig, err
+	}
+	appConfig.ConfigureLogger()
+	return appConfig, nil
+}
+
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configOptions := addConfigFlags(flags)
+	flags.Parse(args)
+
+	appConfig, err := configOptions.load()
+	if err != nil {
+		return err
+	}
+	configHolder := config.NewHolder(appConfig)
+
+	shutdownTracing, err := tracing.Setup(appConfig.Tracing)
+	if err != nil {
+		return fmt.Errorf("Failed to set up tracing: %w", err)
+	}
+	// Flush any spans not exported yet before exiting
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), appConfig.Server.ShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			log.WithError(err).Error("Failed to flush traces")
+		}
+	}()
+
+	userStore, err := newUserStore(appConfig)
+	if err != nil {
+		return fmt.Errorf("Failed to open user store: %w", err)
+	}
+	apiKeyStore, err := newAPIKeyStore(appConfig)
+	if err != nil {
+		return fmt.Errorf("Failed to open API key store: %w", err)
+	}
+	// Whatever happens, save what the stores hold before exiting
+	defer func() {
+		for _, closer := range []interface{ Close() error }{userStore, apiKeyStore} {
+			if err := closer.Close(); err != nil {
+				log.WithError(err).Error("Failed to save store")
+			}
+		}
+	}()
+
+	// Webhook deliveries left over from before a restart are sent along with new ones
+	deliveryStore, err := newDeliveryStore(appConfig)
+	if err != nil {
+		return fmt.Errorf("Failed to open webhook outbox: %w", err)
+	}
+	dispatcher, err := webhook.NewDispatcher(appConfig.Webhooks, deliveryStore)
+	if err != nil {
+		return err
+	}
+	dispatcher.Start()
+	defer func() {
+		dispatcher.Close()
+		if err := deliveryStore.Close(); err != nil {
+			log.WithError(err).Error("Failed to save webhook outbox")
+		}
+	}()
 
-	// Core router
-	router := gin.New()
-	router.Use(middlewarev1.GinLogger(), gin.Recovery())
+	auditSink, err := audit.New(appConfig.Audit)
+	if err != nil {
+		return fmt.Errorf("Failed to open audit sinks: %w", err)
+	}
+	defer func() {
+		if err := auditSink.Close(); err != nil {
+			log.WithError(err).Error("Failed to close audit sinks")
+		}
+	}()
 
-	// Versioned API group
-	registerV1Routes(appConfig, router)
+	api, err := app.New(configHolder, userStore, apiKeyStore, dispatcher, auditSink)
+	if err != nil {
+		return err
+	}
 
-	// Serve on default port (8080)
-	router.Run()
+	// Reload the config on SIGHUP, or when the config file changes
+	go newConfigReloader(configOptions.options(), configHolder, api.ApplyConfig).watch()
+
+	httpServer, err := server.New(appConfig.Server, api.Router)
+	if err != nil {
+		return err
+	}
+	listeners := []listener{{"HTTP", httpServer.Serve}}
+	// Prometheus metrics, on their own listener
+	if appConfig.Metrics.Address != "" {
+		listeners = append(listeners, listener{"metrics", func(ctx context.Context) error {
+			return metrics.ListenAndServe(ctx, appConfig.Metrics.Address, appConfig.Server.ShutdownTimeout)
+		}})
+	}
+	// Envoy external authorization, over gRPC on its own listener
+	if appConfig.ExtAuthz.Address != "" {
+		listeners = append(listeners, listener{"Envoy external authorization", api.ExtAuthz.ListenAndServe})
+	}
+	return serveAll(stopSignal(), listeners)
+}
+
+// listener serves until its context is done, then drains and returns
+type listener struct {
+	name  string
+	serve func(ctx context.Context) error
 }
 
-func registerV1Routes(config config.Config, router *gin.Engine) {
-	v1 := router.Group("/v1")
+// serveAll runs every listener until ctx is done, or one of them fails, and
+// then stops them all together. It returns once they've all drained, with
+// the first failure.
+func serveAll(ctx context.Context, listeners []listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l listener) {
+			err := l.serve(ctx)
+			if err != nil {
+				err = fmt.Errorf("%s server stopped: %w", l.name, err)
+			}
+			// Whichever stops first stops the rest
+			cancel()
+			errs <- err
+		}(l)
+	}
 
-	jwtServiceV1 := tokenservicev1.NewJWTService(config)
+	var firstErr error
+	for range listeners {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// stopSignal is done once the server is asked to stop, with SIGTERM or an interrupt
+func stopSignal() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		received := <-signals
+		log.WithField("signal", received.String()).Info("Stopping")
+		cancel()
+	}()
+	return ctx
+}
 
-	// Add a test authorized endpoint
-	testAuth := v1.Group("/test")
-	testAuth.Use(middlewarev1.AuthorizeToken(jwtServiceV1))
-	testAuth.GET("/ping", pingV1)
+// newUserStore persists users to USER_STORE_FILE, or keeps them in memory when it isn't set
+func newUserStore(config config.Config) (store.UserStore, error) {
+	if config.UserStoreFile == "" {
+		return store.TraceUserStore(store.NewMemoryUserStore(), "memory"), nil
+	}
+	userStore, err := store.NewFileUserStore(config.UserStoreFile)
+	if err != nil {
+		return nil, err
+	}
+	return store.TraceUserStore(userStore, "file"), nil
+}
 
-	controllerv1.NewLoginController(v1, jwtServiceV1)
-	controllerv1.NewTokenController(v1, jwtServiceV1)
-	controllerv1.NewLogoutController(v1, jwtServiceV1)
+// newAPIKeyStore persists API keys to API_KEY_STORE_FILE, or keeps them in memory when it isn't set
+func newAPIKeyStore(config config.Config) (store.APIKeyStore, error) {
+	if config.APIKeyStoreFile == "" {
+		return store.TraceAPIKeyStore(store.NewMemoryAPIKeyStore(), "memory"), nil
+	}
+	apiKeyStore, err := store.NewFileAPIKeyStore(config.APIKeyStoreFile)
+	if err != nil {
+		return nil, err
+	}
+	return store.TraceAPIKeyStore(apiKeyStore, "file"), nil
 }
 
-// route handler
-func pingV1(context *gin.Context) {
-	jwtUser, _ := context.MustGet("user").(tokenservicev1.JWTUser)
-	context.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Hello %s!", jwtUser.Username)})
+// newDeliveryStore keeps the webhook outbox in WEBHOOK_OUTBOX_FILE, or in memory when it isn't set
+func newDeliveryStore(config config.Config) (store.DeliveryStore, error) {
+	if config.Webhooks.OutboxFile == "" {
+		return store.TraceDeliveryStore(store.NewMemoryDeliveryStore(), "memory"), nil
+	}
+	deliveryStore, err := store.NewFileDeliveryStore(config.Webhooks.OutboxFile)
+	if err != nil {
+		return nil, err
+	}
+	return store.TraceDeliveryStore(deliveryStore, "file"), nil
 }
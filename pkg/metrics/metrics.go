@@ -0,0 +1,190 @@
+// Package metrics holds the Prometheus metrics the server records, and
+// serves them in the Prometheus text format on their own listener.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const namespace string = "auth_server"
+
+// Login outcomes
+const (
+	OutcomeSuccess            string = "success"
+	OutcomeInvalidCredentials string = "invalid_credentials"
+	OutcomeForbidden          string = "forbidden"
+	OutcomeError              string = "error"
+)
+
+// Grants tokens are issued with
+const (
+	GrantPassword          string = "password"
+	GrantEmail             string = "email"
+	GrantRefreshToken      string = "refresh_token"
+	GrantClientCredentials string = "client_credentials"
+)
+
+// Reasons tokens are refused
+const (
+	ReasonMissing     string = "missing"
+	ReasonExpired     string = "expired"
+	ReasonSignature   string = "signature"
+	ReasonInvalid     string = "invalid"
+	ReasonUnknownKey  string = "unknown_key"
+	ReasonRevoked     string = "revoked"
+	ReasonCertificate string = "certificate"
+	ReasonDPoP        string = "dpop"
+)
+
+var (
+	// Logins counts login attempts by method (password or email) and outcome
+	Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "Login attempts by method and outcome.",
+	}, []string{"method", "outcome"})
+
+	// TokensIssued counts tokens by type (access or refresh) and the grant they were issued for
+	TokensIssued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_issued_total",
+		Help:      "Tokens issued by type and grant.",
+	}, []string{"type", "grant"})
+
+	// RefreshFailures counts refresh tokens that couldn't be exchanged, by reason
+	RefreshFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "refresh_failures_total",
+		Help:      "Refresh tokens refused by reason.",
+	}, []string{"reason"})
+
+	// ValidationFailures counts access tokens refused by reason
+	ValidationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_validation_failures_total",
+		Help:      "Access tokens refused by reason.",
+	}, []string{"reason"})
+
+	// Revocations counts refresh tokens revoked, by whether the user logged
+	// out, an admin revoked one session, or all of a user's sessions were ended
+	Revocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "revocations_total",
+		Help:      "Refresh tokens revoked by reason.",
+	}, []string{"reason"})
+
+	// RequestDuration records how long requests take, by route pattern
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to handle requests by method, route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// SigningDuration records how long signing tokens takes, by algorithm
+	SigningDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "token_signing_duration_seconds",
+		Help:      "Time taken to sign tokens by algorithm.",
+		Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05},
+	}, []string{"algorithm"})
+
+	// VerificationDuration records how long checking tokens takes, by type
+	VerificationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "token_verification_duration_seconds",
+		Help:      "Time taken to verify tokens by type.",
+		Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05},
+	}, []string{"type"})
+
+	// RefreshSessions is the number of refresh tokens that can still be used
+	RefreshSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "refresh_sessions",
+		Help:      "Refresh tokens that haven't been used up or revoked.",
+	})
+
+	// SigningKeys is the number of signing keys loaded
+	SigningKeys = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "signing_keys",
+		Help:      "Signing keys loaded, including older ones kept for verification.",
+	})
+)
+
+// Registry holds every metric above, along with Go runtime and process metrics
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		Logins, TokensIssued, RefreshFailures, ValidationFailures, Revocations,
+		RequestDuration, SigningDuration, VerificationDuration, RefreshSessions, SigningKeys,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+// Since returns the seconds elapsed since start, for observing in a histogram
+func Since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+// TokenFailureReason sorts an error from parsing a token into one of the reasons above
+func TokenFailureReason(err error) string {
+	var validationErr *jwt.ValidationError
+	if !errors.As(err, &validationErr) {
+		return ReasonInvalid
+	}
+	switch {
+	case validationErr.Errors&jwt.ValidationErrorExpired != 0:
+		return ReasonExpired
+	case validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+		return ReasonSignature
+	case validationErr.Errors&jwt.ValidationErrorUnverifiable != 0:
+		return ReasonUnknownKey
+	}
+	return ReasonInvalid
+}
+
+// ListenAndServe serves /metrics on its own address, so it can be kept
+// away from the public API, until ctx is done. Scrapes in flight then get
+// up to shutdownTimeout to finish.
+func ListenAndServe(ctx context.Context, address string, shutdownTimeout time.Duration) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+
+	log.WithFields(log.Fields{"logger": "Metrics", "address": address}).Info("Serving metrics")
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package password
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BreachedChecker reports whether a password is known to have been leaked
+type BreachedChecker interface {
+	IsBreached(password string) (bool, error)
+	// Close releases the corpus, once nothing is checking passwords with it
+	Close() error
+}
+
+// hashLength is the length of a hex-encoded SHA-1 hash
+const hashLength int = 40
+
+// prefixLength is how many hash characters name each range file
+const prefixLength int = 5
+
+type hibpFileChecker struct {
+	file *os.File
+	size int64
+}
+
+type hibpRangeChecker struct {
+	dir string
+}
+
+// NewHIBPChecker creates a BreachedChecker from a local copy of the Have I
+// Been Pwned password corpus, so passwords never leave the machine. path is
+// either a single file of uppercase "HASH:COUNT" lines sorted by hash, or a
+// directory of range files named after the first five characters of the
+// hash (for example "21BD1.txt") holding "SUFFIX:COUNT" lines.
+func NewHIBPChecker(path string) (BreachedChecker, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open breached password corpus: %w", err)
+	}
+	if info.IsDir() {
+		return &hibpRangeChecker{dir: path}, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open breached password corpus: %w", err)
+	}
+	return &hibpFileChecker{file: file, size: info.Size()}, nil
+}
+
+func hashPassword(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func (c *hibpFileChecker) IsBreached(password string) (bool, error) {
+	return c.contains([]byte(hashPassword(password)))
+}
+
+func (c *hibpFileChecker) Close() error {
+	return c.file.Close()
+}
+
+// contains binary searches the sorted file by byte offset, which keeps
+// lookups fast without loading the (very large) corpus into memory.
+func (c *hibpFileChecker) contains(target []byte) (bool, error) {
+
+	// Invariant: if the target line exists, it starts in [low, high)
+	low, high := int64(0), c.size
+	for low < high {
+		middle := low + (high-low)/2
+		start, line, err := c.lineFrom(middle)
+		if err != nil {
+			return false, err
+		}
+		if line == nil {
+			high = middle
+			continue
+		}
+
+		switch bytes.Compare(lineHash(line, hashLength), target) {
+		case 0:
+			return true, nil
+		case -1:
+			low = start + int64(len(line))
+		default:
+			high = middle
+		}
+	}
+	return false, nil
+}
+
+// lineFrom returns the first full line starting at or after offset, with
+// its starting offset. line is nil if there isn't one.
+func (c *hibpFileChecker) lineFrom(offset int64) (int64, []byte, error) {
+	start := offset
+	if offset > 0 {
+		// Back up one byte, so a line starting exactly at offset isn't skipped
+		start = offset - 1
+	}
+	reader := bufio.NewReader(io.NewSectionReader(c.file, start, c.size-start))
+
+	if offset > 0 {
+		skipped, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return 0, nil, nil
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		start += int64(len(skipped))
+	}
+
+	line, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return 0, nil, err
+	}
+	if len(line) == 0 {
+		return 0, nil, nil
+	}
+	return start, line, nil
+}
+
+func (c *hibpRangeChecker) IsBreached(password string) (bool, error) {
+	hash := hashPassword(password)
+	prefix, suffix := hash[:prefixLength], []byte(hash[prefixLength:])
+
+	file, err := os.Open(filepath.Join(c.dir, prefix+".txt"))
+	if os.IsNotExist(err) {
+		file, err = os.Open(filepath.Join(c.dir, prefix))
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if bytes.Equal(lineHash(scanner.Bytes(), hashLength-prefixLength), suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// Close does nothing, as range files are only open while they're read
+func (c *hibpRangeChecker) Close() error {
+	return nil
+}
+
+// lineHash returns the uppercased hash at the start of a "HASH:COUNT" line
+func lineHash(line []byte, length int) []byte {
+	if index := bytes.IndexAny(line, ":\r\n"); index >= 0 {
+		line = line[:index]
+	}
+	if len(line) > length {
+		line = line[:length]
+	}
+	return bytes.ToUpper(line)
+}
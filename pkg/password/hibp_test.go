@@ -0,0 +1,136 @@
+package password
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	directory, err := ioutil.TempDir("", "hibp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(directory) })
+	return directory
+}
+
+// corpusLines returns sorted "HASH:COUNT" lines for passwords, and for
+// filler more made-up ones
+func corpusLines(passwords []string, filler int) []string {
+	lines := []string{}
+	for _, password := range passwords {
+		lines = append(lines, hashPassword(password)+":3")
+	}
+	for i := 0; i < filler; i++ {
+		lines = append(lines, fmt.Sprintf("%s:%d", hashPassword(fmt.Sprintf("filler-%d", i)), i+1))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestHIBPFileChecker(t *testing.T) {
+	breached := []string{"password", "123456", "correct horse battery staple"}
+	notBreached := []string{"not in the corpus", "", "Password"}
+
+	tests := []struct {
+		name      string
+		passwords []string
+		filler    int
+		ending    string
+		trailing  bool
+		lowercase bool
+	}{
+		{name: "empty file"},
+		{name: "one line", passwords: breached[:1], ending: "\n", trailing: true},
+		{name: "one line without a newline", passwords: breached[:1], ending: "\n"},
+		{name: "small", passwords: breached, filler: 10, ending: "\n", trailing: true},
+		{name: "large", passwords: breached, filler: 5000, ending: "\n", trailing: true},
+		{name: "CRLF line endings", passwords: breached, filler: 500, ending: "\r\n", trailing: true},
+		{name: "no trailing newline", passwords: breached, filler: 500, ending: "\n"},
+		{name: "lowercase hashes", passwords: breached, filler: 500, ending: "\n", trailing: true, lowercase: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := strings.Join(corpusLines(test.passwords, test.filler), test.ending)
+			if test.trailing {
+				content += test.ending
+			}
+			if test.lowercase {
+				content = strings.ToLower(content)
+			}
+			path := filepath.Join(tempDir(t), "pwned-passwords.txt")
+			if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			checker, err := NewHIBPChecker(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer checker.Close()
+
+			for _, password := range test.passwords {
+				if found, err := checker.IsBreached(password); err != nil || !found {
+					t.Errorf("IsBreached(%q) = %v, %v, want true", password, found, err)
+				}
+			}
+			// Every line is found, including the first and the last
+			for i := 0; i < test.filler; i++ {
+				password := fmt.Sprintf("filler-%d", i)
+				if found, err := checker.IsBreached(password); err != nil || !found {
+					t.Errorf("IsBreached(%q) = %v, %v, want true", password, found, err)
+				}
+			}
+			for _, password := range notBreached {
+				if found, err := checker.IsBreached(password); err != nil || found {
+					t.Errorf("IsBreached(%q) = %v, %v, want false", password, found, err)
+				}
+			}
+		})
+	}
+}
+
+func TestHIBPRangeChecker(t *testing.T) {
+	directory := tempDir(t)
+	write := func(name string, passwords ...string) {
+		lines := []string{}
+		for _, password := range passwords {
+			lines = append(lines, hashPassword(password)[prefixLength:]+":7")
+		}
+		if err := ioutil.WriteFile(filepath.Join(directory, name), []byte(strings.Join(lines, "\r\n")), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Range files may be named with or without .txt
+	write(hashPassword("password")[:prefixLength]+".txt", "password")
+	write(hashPassword("123456")[:prefixLength], "123456")
+
+	checker, err := NewHIBPChecker(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checker.Close()
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"password", true},
+		{"123456", true},
+		{"not in the corpus", false},
+	}
+	for _, test := range tests {
+		if found, err := checker.IsBreached(test.password); err != nil || found != test.want {
+			t.Errorf("IsBreached(%q) = %v, %v, want %v", test.password, found, err, test.want)
+		}
+	}
+}
+
+func TestNewHIBPCheckerMissingCorpus(t *testing.T) {
+	if _, err := NewHIBPChecker(filepath.Join(tempDir(t), "missing.txt")); err == nil {
+		t.Error("Expected an error for a missing corpus")
+	}
+}
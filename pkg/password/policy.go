@@ -0,0 +1,136 @@
+package password
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"auth-server/pkg/config"
+)
+
+// bcrypt ignores everything past this many bytes
+const maxBytes int = 72
+
+// Violation codes
+const (
+	ViolationTooShort         string = "too_short"
+	ViolationTooLong          string = "too_long"
+	ViolationMissingUppercase string = "missing_uppercase"
+	ViolationMissingLowercase string = "missing_lowercase"
+	ViolationMissingDigit     string = "missing_digit"
+	ViolationMissingSymbol    string = "missing_symbol"
+	ViolationContainsUsername string = "contains_username"
+	ViolationBreached         string = "breached"
+)
+
+// Violation is a single rule a password failed
+type Violation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PolicyError lists every rule a password failed
+type PolicyError struct {
+	Violations []Violation
+}
+
+func (e *PolicyError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, violation := range e.Violations {
+		messages = append(messages, violation.Message)
+	}
+	return fmt.Sprintf("Password does not meet the password policy: %s", strings.Join(messages, "; "))
+}
+
+// Policy decides which passwords users may choose
+type Policy struct {
+	config   config.PasswordConfig
+	breached BreachedChecker
+}
+
+// NewPolicy creates a Policy from the configuration, opening the breached
+// password corpus if one is configured.
+func NewPolicy(passwordConfig config.PasswordConfig) (*Policy, error) {
+	policy := &Policy{config: passwordConfig}
+	if passwordConfig.BreachedPasswordsFile != "" {
+		breached, err := NewHIBPChecker(passwordConfig.BreachedPasswordsFile)
+		if err != nil {
+			return nil, err
+		}
+		policy.breached = breached
+	}
+	return policy, nil
+}
+
+// Close releases the breached password corpus. The policy can't check
+// passwords afterwards.
+func (p *Policy) Close() error {
+	if p.breached == nil {
+		return nil
+	}
+	return p.breached.Close()
+}
+
+// Check returns a *PolicyError if the password breaks any rules, or another
+// error if the rules couldn't be checked.
+func (p *Policy) Check(password string, username string) error {
+	violations := []Violation{}
+	add := func(code string, format string, args ...interface{}) {
+		violations = append(violations, Violation{Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < p.config.MinLength {
+		add(ViolationTooShort, "Password must be at least %d characters", p.config.MinLength)
+	}
+	if (p.config.MaxLength > 0 && length > p.config.MaxLength) || len(password) > maxBytes {
+		add(ViolationTooLong, "Password is too long")
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, char := range password {
+		switch {
+		case unicode.IsUpper(char):
+			hasUpper = true
+		case unicode.IsLower(char):
+			hasLower = true
+		case unicode.IsDigit(char):
+			hasDigit = true
+		case unicode.IsPunct(char) || unicode.IsSymbol(char) || unicode.IsSpace(char):
+			hasSymbol = true
+		}
+	}
+	if p.config.RequireUppercase && !hasUpper {
+		add(ViolationMissingUppercase, "Password must contain an uppercase letter")
+	}
+	if p.config.RequireLowercase && !hasLower {
+		add(ViolationMissingLowercase, "Password must contain a lowercase letter")
+	}
+	if p.config.RequireDigit && !hasDigit {
+		add(ViolationMissingDigit, "Password must contain a digit")
+	}
+	if p.config.RequireSymbol && !hasSymbol {
+		add(ViolationMissingSymbol, "Password must contain a symbol")
+	}
+
+	if p.config.DisallowUsername && username != "" &&
+		strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		add(ViolationContainsUsername, "Password must not contain the username")
+	}
+
+	if p.breached != nil {
+		breached, err := p.breached.IsBreached(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			add(ViolationBreached, "Password has appeared in a data breach and can't be used")
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
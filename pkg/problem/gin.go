@@ -0,0 +1,36 @@
+package problem
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// Abort ends a Gin request with err. Its code and cause are added to the
+// request logger, so they're logged along with the request.
+func Abort(context *gin.Context, err *Error) {
+	if requestLogger, ok := context.Value("request_logger").(*log.Entry); ok {
+		requestLogger = requestLogger.WithField("error_code", err.Code)
+		if err.Cause != nil {
+			requestLogger = requestLogger.WithError(err.Cause)
+		}
+		context.Set("request_logger", requestLogger)
+	}
+	if challenge := err.Challenge(); challenge != "" {
+		context.Header("WWW-Authenticate", challenge)
+	}
+	// Set first, so it isn't replaced with application/json
+	context.Header("Content-Type", ContentType)
+	context.AbortWithStatusJSON(err.Status, err.Details(context.GetString("request_id")))
+}
+
+// NotFoundHandler answers requests matching no route
+func NotFoundHandler(context *gin.Context) {
+	Abort(context, New(NotFound, "No route matches "+context.Request.Method+" "+context.Request.URL.Path))
+}
+
+// RecoveryHandler answers requests whose handler panicked, for gin.CustomRecovery
+func RecoveryHandler(context *gin.Context, recovered interface{}) {
+	Abort(context, Wrap(Internal, fmt.Errorf("Panic: %v", recovered)))
+}
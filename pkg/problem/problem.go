@@ -0,0 +1,175 @@
+// Package problem is the catalogue of errors the API responds with. Each
+// kind of error has a stable code clients can rely on, and is written as
+// RFC 7807 problem details. What caused an error is logged, but never
+// returned, so library and store messages don't leak to clients.
+package problem
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"auth-server/pkg/password"
+)
+
+const (
+	// ContentType is the media type of problem details
+	ContentType string = "application/problem+json"
+	// typePrefix makes each code a URI, for the type member
+	typePrefix string = "urn:auth-server:problem:"
+)
+
+// Problem is one kind of error, with the status it's returned with
+type Problem struct {
+	Code   string
+	Status int
+	Title  string
+	// challenge is the RFC 6750 error code sent in the WWW-Authenticate
+	// header, for problems with the caller's credentials
+	challenge string
+}
+
+// The catalogue
+var (
+	InvalidRequest     = Problem{Code: "invalid_request", Status: http.StatusBadRequest, Title: "The request is malformed or missing a required field"}
+	WeakPassword       = Problem{Code: "weak_password", Status: http.StatusBadRequest, Title: "The password doesn't meet the password policy"}
+	InvalidActionToken = Problem{Code: "invalid_action_token", Status: http.StatusBadRequest, Title: "The emailed token is invalid or has expired"}
+	InvalidCredentials = Problem{Code: "invalid_credentials", Status: http.StatusUnauthorized, Title: "The credentials are wrong"}
+	MissingToken       = Problem{Code: "missing_token", Status: http.StatusUnauthorized, Title: "An access token or API key is required"}
+	InvalidToken       = Problem{Code: "invalid_token", Status: http.StatusUnauthorized, Title: "The token is invalid", challenge: "invalid_token"}
+	TokenExpired       = Problem{Code: "token_expired", Status: http.StatusUnauthorized, Title: "The token has expired", challenge: "invalid_token"}
+	TokenRevoked       = Problem{Code: "token_revoked", Status: http.StatusUnauthorized, Title: "The token has been revoked, or was never issued", challenge: "invalid_token"}
+	InvalidAPIKey      = Problem{Code: "invalid_api_key", Status: http.StatusUnauthorized, Title: "The API key is invalid or has expired", challenge: "invalid_token"}
+	InvalidDPoPProof   = Problem{Code: "invalid_dpop_proof", Status: http.StatusUnauthorized, Title: "The DPoP proof is invalid", challenge: "invalid_dpop_proof"}
+	UseDPoPNonce       = Problem{Code: "use_dpop_nonce", Status: http.StatusUnauthorized, Title: "The DPoP proof needs the nonce in the DPoP-Nonce header", challenge: "use_dpop_nonce"}
+	IncorrectPassword  = Problem{Code: "incorrect_password", Status: http.StatusForbidden, Title: "The current password is wrong"}
+	InsufficientScope  = Problem{Code: "insufficient_scope", Status: http.StatusForbidden, Title: "The token lacks a required role or scope", challenge: "insufficient_scope"}
+	Forbidden          = Problem{Code: "forbidden", Status: http.StatusForbidden, Title: "The caller isn't allowed to do this"}
+	EmailNotVerified   = Problem{Code: "email_not_verified", Status: http.StatusForbidden, Title: "The email address hasn't been verified"}
+	UserDisabled       = Problem{Code: "user_disabled", Status: http.StatusForbidden, Title: "The account is disabled"}
+	UserLocked         = Problem{Code: "user_locked", Status: http.StatusForbidden, Title: "The account is locked after too many failed logins"}
+	NotFound           = Problem{Code: "not_found", Status: http.StatusNotFound, Title: "Not found"}
+	Conflict           = Problem{Code: "conflict", Status: http.StatusConflict, Title: "It already exists"}
+	TooManyRequests    = Problem{Code: "too_many_requests", Status: http.StatusTooManyRequests, Title: "Too many attempts; try again later"}
+	Internal           = Problem{Code: "internal_error", Status: http.StatusInternalServerError, Title: "Something went wrong, and has been logged"}
+)
+
+// Catalogue lists every problem, for documentation
+var Catalogue = []Problem{
+	InvalidRequest, WeakPassword, InvalidActionToken, InvalidCredentials, MissingToken, InvalidToken,
+	TokenExpired, TokenRevoked, InvalidAPIKey, InvalidDPoPProof, UseDPoPNonce, IncorrectPassword,
+	InsufficientScope, Forbidden, EmailNotVerified, UserDisabled, UserLocked, NotFound, Conflict,
+	TooManyRequests, Internal,
+}
+
+// Type is the problem's type URI
+func (p Problem) Type() string {
+	return typePrefix + p.Code
+}
+
+// Error is a problem that happened to a request
+type Error struct {
+	Problem
+	// Detail explains this occurrence to the client. The title is used when it's empty.
+	Detail string
+	// Cause is what went wrong inside, which is logged but never returned
+	Cause error
+	// Scheme is the authentication scheme challenged in WWW-Authenticate, "Bearer" by default
+	Scheme string
+
+	// Violations are the password policy rules a password broke
+	Violations []password.Violation
+	// InvalidParams are the request fields that failed validation
+	InvalidParams []InvalidParam
+}
+
+// InvalidParam is a request field that failed validation, and the rule it broke
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// New creates an Error with detail for the client
+func New(problem Problem, detail string) *Error {
+	return &Error{Problem: problem, Detail: detail}
+}
+
+// Wrap creates an Error caused by cause, which is kept from the client
+func Wrap(problem Problem, cause error) *Error {
+	return &Error{Problem: problem, Cause: cause}
+}
+
+func (e *Error) Error() string {
+	message := e.Code + ": " + e.detail()
+	if e.Cause != nil {
+		message += ": " + e.Cause.Error()
+	}
+	return message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+func (e *Error) detail() string {
+	if e.Detail != "" {
+		return e.Detail
+	}
+	return e.Title
+}
+
+// Details is the body of a problem response
+type Details struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	// Code is the problem's stable code, which clients should match on
+	Code string `json:"code"`
+	// RequestID finds the request in the server's logs
+	RequestID     string               `json:"request_id,omitempty"`
+	Violations    []password.Violation `json:"violations,omitempty"`
+	InvalidParams []InvalidParam       `json:"invalid_params,omitempty"`
+}
+
+// Details returns the body to respond with
+func (e *Error) Details(requestID string) Details {
+	return Details{
+		Type:          e.Type(),
+		Title:         e.Title,
+		Status:        e.Status,
+		Detail:        e.detail(),
+		Code:          e.Code,
+		RequestID:     requestID,
+		Violations:    e.Violations,
+		InvalidParams: e.InvalidParams,
+	}
+}
+
+// Challenge is the WWW-Authenticate header to send, as RFC 6750 and RFC
+// 9449 describe. Every 401 gets one; 403s only get one for insufficient
+// scope. Requests without credentials get a challenge without an error code.
+func (e *Error) Challenge() string {
+	if e.Status != http.StatusUnauthorized && e.challenge == "" {
+		return ""
+	}
+	scheme := e.Scheme
+	if scheme == "" {
+		scheme = "Bearer"
+	}
+	if e.challenge == "" {
+		return scheme
+	}
+	return fmt.Sprintf("%s error=%q, error_description=%q", scheme, e.challenge, strings.ReplaceAll(e.detail(), `"`, "'"))
+}
+
+// Write sends an Error as the response, for handlers outside Gin
+func Write(writer http.ResponseWriter, err *Error, requestID string) {
+	if challenge := err.Challenge(); challenge != "" {
+		writer.Header().Set("WWW-Authenticate", challenge)
+	}
+	writer.Header().Set("Content-Type", ContentType)
+	writer.WriteHeader(err.Status)
+	json.NewEncoder(writer).Encode(err.Details(requestID))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"auth-server/pkg/config"
+)
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval time.Duration = 2 * time.Second
+
+// restartSettings only take effect when the server starts, as they set up
+// stores, listeners, the DPoP replay cache and the mailer. Names ending in "." cover a whole section.
+var restartSettings = []string{"Server.", "UserStoreFile", "APIKeyStoreFile", "Mail.", "ExtAuthz.Address", "Metrics.", "Tracing.", "Audit.", "Webhooks.", "DPoP."}
+
+// applyConfigFunc prepares everything a new config needs and swaps it in,
+// leaving the current config alone if anything fails
+type applyConfigFunc func(newConfig config.Config) error
+
+// configReloader reloads the config on SIGHUP, or when the config file changes
+type configReloader struct {
+	log     *log.Entry
+	options config.LoadOptions
+	holder  *config.Holder
+	apply   applyConfigFunc
+}
+
+func newConfigReloader(options config.LoadOptions, holder *config.Holder, apply applyConfigFunc) *configReloader {
+	return &configReloader{
+		log:     log.WithFields(log.Fields{"logger": "ConfigReloader"}),
+		options: options,
+		holder:  holder,
+		apply:   apply,
+	}
+}
+
+// watch reloads the config whenever it's asked to, forever
+func (r *configReloader) watch() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	// Polling is enough for a file that rarely changes, and also notices
+	// files replaced through symlinks, as Kubernetes does with ConfigMaps
+	path := r.options.FilePath()
+	lastModified := fileVersion(path)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-signals:
+			r.reload("SIGHUP")
+		case <-ticker.C:
+			if path == "" {
+				continue
+			}
+			if modified := fileVersion(path); modified != lastModified {
+				lastModified = modified
+				r.reload("config file changed")
+			}
+		}
+	}
+}
+
+// fileVersion changes whenever a file does
+func fileVersion(path string) string {
+	if path == "" {
+		return ""
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%v/%d", info.ModTime(), info.Size())
+}
+
+// reload loads and applies the config again, keeping the current one if
+// the new one has any problems
+func (r *configReloader) reload(reason string) {
+	reloadLogger := r.log.WithField("reason", reason)
+	reloadLogger.Info("Reloading config")
+
+	newConfig, err := config.Load(r.options)
+	if err != nil {
+		reloadLogger.WithError(err).Error("Keeping the current config, as the new one is invalid")
+		return
+	}
+	oldConfig := r.holder.Get()
+	changes := config.Changes(oldConfig, newConfig)
+	if len(changes) == 0 {
+		reloadLogger.Info("Config is unchanged")
+		return
+	}
+	if err := r.apply(newConfig); err != nil {
+		reloadLogger.WithError(err).Error("Keeping the current config, as the new one couldn't be applied")
+		return
+	}
+
+	for _, change := range changes {
+		changeLogger := reloadLogger.WithFields(log.Fields{"setting": change.Name, "old": change.Old, "new": change.New})
+		if needsRestart(change.Name) {
+			changeLogger.Warn("Setting changed, but only takes effect after a restart")
+		} else {
+			changeLogger.Info("Setting changed")
+		}
+	}
+}
+
+func needsRestart(name string) bool {
+	for _, setting := range restartSettings {
+		if name == setting || (strings.HasSuffix(setting, ".") && strings.HasPrefix(name, setting)) {
+			return true
+		}
+	}
+	return false
+}
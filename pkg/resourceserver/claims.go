@@ -0,0 +1,49 @@
+package resourceserver
+
+import (
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Claims are the contents of a validated access token
+type Claims struct {
+	jwt.StandardClaims
+	User User
+	// Confirmation is set when the token is bound to a key its holder must prove they have
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+}
+
+// Confirmation binds a token to a key, as the cnf claim (RFC 7800)
+type Confirmation struct {
+	// CertificateThumbprint binds the token to a TLS client certificate (RFC 8705)
+	CertificateThumbprint string `json:"x5t#S256,omitempty"`
+	// KeyThumbprint binds the token to the key signing its DPoP proofs (RFC 9449)
+	KeyThumbprint string `json:"jkt,omitempty"`
+}
+
+// User is who the access token was issued to
+type User struct {
+	Username string
+	// ClientID is set when the caller is a client rather than a user
+	ClientID string   `json:",omitempty"`
+	Roles    []string `json:",omitempty"`
+	Scopes   []string `json:",omitempty"`
+}
+
+// HasRole reports whether the token grants a role
+func (c *Claims) HasRole(role string) bool {
+	return contains(c.User.Roles, role)
+}
+
+// HasScope reports whether the token grants a scope
+func (c *Claims) HasScope(scope string) bool {
+	return contains(c.User.Scopes, scope)
+}
+
+func contains(items []string, value string) bool {
+	for _, item := range items {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
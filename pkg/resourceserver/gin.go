@@ -0,0 +1,38 @@
+package resourceserver
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"auth-server/pkg/dpop"
+	"auth-server/pkg/problem"
+)
+
+// GinContextKey is where GinMiddleware stores the validated claims in the Gin context
+const GinContextKey string = "resourceserver.claims"
+
+// GinMiddleware rejects requests without a valid access token with a 401, and
+// makes the token's claims available to later handlers through GinClaims
+func (v *Validator) GinMiddleware() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		claims, err := v.ValidateRequest(context.Request)
+		if err != nil {
+			if nonce := v.DPoPNonce(); nonce != "" {
+				context.Header(dpop.NonceHeader, nonce)
+			}
+			problem.Abort(context, Problem(err))
+			return
+		}
+		context.Set(GinContextKey, claims)
+		context.Request = context.Request.WithContext(NewContext(context.Request.Context(), claims))
+	}
+}
+
+// GinClaims returns the claims GinMiddleware validated
+func GinClaims(context *gin.Context) (*Claims, bool) {
+	value, found := context.Get(GinContextKey)
+	if !found {
+		return nil, false
+	}
+	claims, found := value.(*Claims)
+	return claims, found
+}
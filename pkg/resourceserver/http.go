@@ -0,0 +1,79 @@
+package resourceserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"auth-server/pkg/dpop"
+	"auth-server/pkg/problem"
+)
+
+type contextKey struct{}
+
+// Middleware rejects requests without a valid access token with a 401, and
+// makes the token's claims available to next through FromContext
+func (v *Validator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		claims, err := v.ValidateRequest(request)
+		if err != nil {
+			if nonce := v.DPoPNonce(); nonce != "" {
+				writer.Header().Set(dpop.NonceHeader, nonce)
+			}
+			problem.Write(writer, Problem(err), "")
+			return
+		}
+		next.ServeHTTP(writer, request.WithContext(NewContext(request.Context(), claims)))
+	})
+}
+
+// NewContext returns a copy of ctx carrying claims
+func NewContext(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, contextKey{}, claims)
+}
+
+// FromContext returns the claims Middleware validated
+func FromContext(ctx context.Context) (*Claims, bool) {
+	claims, found := ctx.Value(contextKey{}).(*Claims)
+	return claims, found
+}
+
+// clientErrors are the errors from ValidateRequest whose messages are
+// written for clients. Others, such as failures to fetch keys, are only
+// described by their problem's title.
+var clientErrors = []error{
+	ErrMissingToken, ErrInvalidToken, ErrTokenExpired, ErrTokenNotYetValid, ErrInvalidIssuer,
+	ErrInvalidAudience, ErrUnknownKey, ErrCertificateMismatch, ErrDPoPRequired, ErrDPoPMismatch,
+}
+
+// Problem is the problem to respond with for an error from ValidateRequest,
+// using the same codes as the auth server does. err is kept as the cause,
+// which GinMiddleware adds to the request logger, but isn't returned.
+func Problem(err error) *problem.Error {
+	problemErr := problem.Wrap(problem.InvalidToken, err)
+	for _, clientError := range clientErrors {
+		if err == clientError {
+			problemErr.Detail = err.Error()
+		}
+	}
+	switch {
+	case err == ErrMissingToken:
+		problemErr.Problem = problem.MissingToken
+	case err == ErrTokenExpired:
+		problemErr.Problem = problem.TokenExpired
+	case errors.Is(err, dpop.ErrUseNonce):
+		problemErr.Problem, problemErr.Scheme = problem.UseDPoPNonce, dpop.Scheme
+	case errors.Is(err, dpop.ErrInvalidProof):
+		problemErr.Problem, problemErr.Scheme = problem.InvalidDPoPProof, dpop.Scheme
+	case err == ErrDPoPMismatch:
+		problemErr.Scheme = dpop.Scheme
+	}
+	return problemErr
+}
+
+// Challenge is the WWW-Authenticate header to send with a 401, as described
+// in RFC 6750, or RFC 9449 for problems with DPoP proofs. Requests without a
+// token don't get an error code.
+func Challenge(err error) string {
+	return Problem(err).Challenge()
+}
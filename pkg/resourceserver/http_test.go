@@ -0,0 +1,40 @@
+package resourceserver
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"auth-server/pkg/dpop"
+	"auth-server/pkg/problem"
+)
+
+func TestProblem(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantCode   string
+		wantDetail string
+	}{
+		{"missing token", ErrMissingToken, problem.MissingToken.Code, ErrMissingToken.Error()},
+		{"expired token", ErrTokenExpired, problem.TokenExpired.Code, ErrTokenExpired.Error()},
+		{"wrong audience", ErrInvalidAudience, problem.InvalidToken.Code, ErrInvalidAudience.Error()},
+		{"nonce needed", fmt.Errorf("%w: fresh nonce", dpop.ErrUseNonce), problem.UseDPoPNonce.Code, problem.UseDPoPNonce.Title},
+		{"invalid proof", fmt.Errorf("%w: htu doesn't match", dpop.ErrInvalidProof), problem.InvalidDPoPProof.Code, problem.InvalidDPoPProof.Title},
+		{"keys can't be fetched", errors.New("Failed to fetch http://10.0.0.7/jwks.json: connection refused"), problem.InvalidToken.Code, problem.InvalidToken.Title},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			problemErr := Problem(test.err)
+			if problemErr.Code != test.wantCode {
+				t.Errorf("got code %s, want %s", problemErr.Code, test.wantCode)
+			}
+			if detail := problemErr.Details("").Detail; detail != test.wantDetail {
+				t.Errorf("got detail %q, want %q", detail, test.wantDetail)
+			}
+			if problemErr.Cause != test.err {
+				t.Errorf("got cause %v, want %v", problemErr.Cause, test.err)
+			}
+		})
+	}
+}
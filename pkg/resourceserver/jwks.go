@@ -0,0 +1,102 @@
+package resourceserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"auth-server/pkg/jwk"
+)
+
+// remoteKeySet caches the keys served at a JWKS URL. They're fetched again
+// when they get old, or when a token names a key that isn't cached, which
+// happens after the auth server rotates its keys.
+type remoteKeySet struct {
+	url                string
+	client             *http.Client
+	refreshInterval    time.Duration
+	minRefreshInterval time.Duration
+	now                func() time.Time
+
+	// lock is held while fetching, so concurrent requests wait for one fetch
+	lock      sync.Mutex
+	keys      map[string]interface{}
+	fetchedAt time.Time
+}
+
+func newRemoteKeySet(config Config) *remoteKeySet {
+	return &remoteKeySet{
+		url:                config.JWKSURL,
+		client:             config.HTTPClient,
+		refreshInterval:    config.RefreshInterval,
+		minRefreshInterval: config.MinRefreshInterval,
+		now:                time.Now,
+		keys:               map[string]interface{}{},
+	}
+}
+
+// find returns the public key with a key ID, fetching the keys again if needed
+func (s *remoteKeySet) find(keyID string) (interface{}, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.now()
+	stale := now.Sub(s.fetchedAt) >= s.refreshInterval
+	key, found := s.keys[keyID]
+	if found && !stale {
+		return key, nil
+	}
+	// Unknown key IDs are rate limited, so they can't be used to hammer the JWKS URL
+	if !stale && now.Sub(s.fetchedAt) < s.minRefreshInterval {
+		return nil, ErrUnknownKey
+	}
+
+	if err := s.refresh(); err != nil {
+		// Keep using the keys we have until the JWKS URL is reachable again
+		if found {
+			return key, nil
+		}
+		return nil, err
+	}
+	if key, found = s.keys[keyID]; !found {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// refresh replaces the cached keys with the ones currently served
+func (s *remoteKeySet) refresh() error {
+	// Failures count as a fetch too, so an outage isn't retried on every request
+	s.fetchedAt = s.now()
+
+	response, err := s.client.Get(s.url)
+	if err != nil {
+		return fmt.Errorf("Failed to fetch signing keys: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to fetch signing keys: %s", response.Status)
+	}
+
+	var set jwk.Set
+	if err := json.NewDecoder(response.Body).Decode(&set); err != nil {
+		return fmt.Errorf("Invalid signing keys: %w", err)
+	}
+
+	keys := map[string]interface{}{}
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		publicKey, err := key.PublicKey()
+		if err != nil {
+			// Skip keys we don't understand, rather than failing every token
+			continue
+		}
+		keys[key.KeyID] = publicKey
+	}
+	s.keys = keys
+	return nil
+}
@@ -0,0 +1,320 @@
+// Package resourceserver validates access tokens issued by the auth server,
+// for services that accept them. Tokens are checked against keys fetched from
+// the auth server's JWKS URL, or against a static key or secret. Adapters are
+// provided for net/http and Gin.
+package resourceserver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"auth-server/pkg/dpop"
+	"auth-server/pkg/jwk"
+)
+
+const (
+	defaultRefreshInterval    time.Duration = time.Hour
+	defaultMinRefreshInterval time.Duration = time.Second * 10
+	defaultHTTPTimeout        time.Duration = time.Second * 10
+)
+
+var (
+	ErrMissingToken     = errors.New("Missing access token")
+	ErrInvalidToken     = errors.New("Invalid access token")
+	ErrTokenExpired     = errors.New("Access token is expired")
+	ErrTokenNotYetValid = errors.New("Access token is not valid yet")
+	ErrInvalidIssuer    = errors.New("Access token has the wrong issuer")
+	ErrInvalidAudience  = errors.New("Access token has the wrong audience")
+	ErrUnknownKey       = errors.New("Access token is signed with an unknown key")
+	// ErrCertificateMismatch is returned when a certificate-bound token is
+	// presented without the certificate it's bound to
+	ErrCertificateMismatch = errors.New("Access token is bound to a different TLS client certificate")
+	// ErrDPoPRequired is returned when a DPoP-bound token is sent without
+	// the DPoP scheme, or when DPoP isn't configured
+	ErrDPoPRequired = errors.New("Access token is bound to a DPoP key, and must be sent with the DPoP scheme")
+	// ErrDPoPMismatch is returned when a DPoP proof is signed with a key the token isn't bound to
+	ErrDPoPMismatch = errors.New("Access token is bound to a different DPoP key")
+)
+
+// Config sets where signing keys come from, and what's checked in each token.
+// At least one of JWKSURL, Keys or Secret is needed.
+type Config struct {
+	// JWKSURL is fetched for the auth server's public keys, such as
+	// https://auth.example.com/.well-known/jwks.json
+	JWKSURL string
+	// Keys are static public keys, such as ones read from a JWKS file
+	Keys []jwk.Key
+	// Secret validates HS256 tokens, when the auth server has no signing
+	// keys and signs with its ACCESS_TOKEN_SECRET
+	Secret []byte
+
+	// Issuer must match the iss claim, when set
+	Issuer string
+	// Audience must match the aud claim, when set
+	Audience string
+	// Leeway allows for clock skew when checking exp and nbf
+	Leeway time.Duration
+
+	// HTTPClient fetches JWKSURL. Defaults to a client with a 10 second timeout.
+	HTTPClient *http.Client
+	// RefreshInterval is how long fetched keys are used before being
+	// fetched again. Defaults to an hour.
+	RefreshInterval time.Duration
+	// MinRefreshInterval limits how often a token with an unknown key ID can
+	// make keys be fetched again. Defaults to 10 seconds.
+	MinRefreshInterval time.Duration
+
+	// ClientCertificate finds the TLS client certificate a request was sent
+	// with, to check certificate-bound tokens against. Defaults to the
+	// certificate of the request's own TLS connection; services behind a
+	// proxy that terminates TLS can read one the proxy forwards instead.
+	ClientCertificate func(request *http.Request) *x509.Certificate
+
+	// DPoP checks the proofs sent with DPoP-bound tokens. They're refused when it's nil.
+	DPoP *dpop.Verifier
+	// PublicURL is where the service is reached, such as
+	// https://api.example.com, which DPoP proofs must name along with the
+	// request path. Defaults to the scheme and Host of each request.
+	PublicURL string
+}
+
+// Validator checks access tokens. It's safe for concurrent use.
+type Validator struct {
+	config     Config
+	staticKeys map[string]interface{}
+	remoteKeys *remoteKeySet
+	now        func() time.Time
+}
+
+// New checks the config and parses any static keys. Keys at JWKSURL are
+// fetched when first needed.
+func New(config Config) (*Validator, error) {
+	if config.JWKSURL == "" && len(config.Keys) == 0 && len(config.Secret) == 0 {
+		return nil, errors.New("One of JWKSURL, Keys or Secret is required")
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = defaultRefreshInterval
+	}
+	if config.MinRefreshInterval <= 0 {
+		config.MinRefreshInterval = defaultMinRefreshInterval
+	}
+	if config.ClientCertificate == nil {
+		config.ClientCertificate = tlsClientCertificate
+	}
+
+	staticKeys := map[string]interface{}{}
+	for _, key := range config.Keys {
+		publicKey, err := key.PublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key %q: %w", key.KeyID, err)
+		}
+		staticKeys[key.KeyID] = publicKey
+	}
+
+	validator := &Validator{
+		config:     config,
+		staticKeys: staticKeys,
+		now:        time.Now,
+	}
+	if config.JWKSURL != "" {
+		validator.remoteKeys = newRemoteKeySet(config)
+	}
+	return validator, nil
+}
+
+// Validate checks a token's signature, issuer, audience and lifetime, and
+// returns its claims. It doesn't check what the token is bound to, as it
+// doesn't have the request; use ValidateRequest, or CheckCertificate.
+func (v *Validator) Validate(encodedToken string) (*Claims, error) {
+	if encodedToken == "" {
+		return nil, ErrMissingToken
+	}
+
+	claims := &Claims{}
+	// Time-based claims are checked below, with leeway
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.ParseWithClaims(encodedToken, claims, v.keyFunc)
+	if err != nil {
+		var validationErr *jwt.ValidationError
+		if errors.As(err, &validationErr) && errors.Is(validationErr.Inner, ErrUnknownKey) {
+			return nil, ErrUnknownKey
+		}
+		return nil, ErrInvalidToken
+	}
+	if !token.Valid {
+		return nil, ErrInvalidToken
+	}
+
+	now := v.now()
+	leeway := int64(v.config.Leeway / time.Second)
+	if claims.ExpiresAt == 0 || now.Unix() > claims.ExpiresAt+leeway {
+		return nil, ErrTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Unix()+leeway < claims.NotBefore {
+		return nil, ErrTokenNotYetValid
+	}
+	if v.config.Issuer != "" && claims.Issuer != v.config.Issuer {
+		return nil, ErrInvalidIssuer
+	}
+	if v.config.Audience != "" && claims.Audience != v.config.Audience {
+		return nil, ErrInvalidAudience
+	}
+	return claims, nil
+}
+
+// ValidateRequest validates the token in a request's Authorization header.
+// Certificate-bound tokens must be sent with the same TLS client
+// certificate, and DPoP-bound tokens with the DPoP scheme and a proof
+// signed with the same key.
+func (v *Validator) ValidateRequest(request *http.Request) (*Claims, error) {
+	scheme, token := authorization(request)
+	if !strings.EqualFold(scheme, "Bearer") && !strings.EqualFold(scheme, dpop.Scheme) {
+		token = ""
+	}
+	claims, err := v.Validate(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckCertificate(claims, v.config.ClientCertificate(request)); err != nil {
+		return nil, err
+	}
+	if err := v.checkDPoP(request, scheme, token, claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// DPoPNonce returns a nonce for the client's next DPoP proof, or an empty
+// string when proofs don't need one
+func (v *Validator) DPoPNonce() string {
+	if v.config.DPoP == nil || !v.config.DPoP.RequiresNonce() {
+		return ""
+	}
+	return v.config.DPoP.Nonce()
+}
+
+// checkDPoP makes sure DPoP-bound tokens come with a proof signed with the
+// key they're bound to
+func (v *Validator) checkDPoP(request *http.Request, scheme string, token string, claims *Claims) error {
+	boundKey := ""
+	if claims.Confirmation != nil {
+		boundKey = claims.Confirmation.KeyThumbprint
+	}
+	if !strings.EqualFold(scheme, dpop.Scheme) {
+		if boundKey != "" {
+			return ErrDPoPRequired
+		}
+		return nil
+	}
+	if boundKey == "" {
+		return ErrInvalidToken
+	}
+	if v.config.DPoP == nil {
+		return ErrDPoPRequired
+	}
+
+	proofs := request.Header.Values(dpop.Header)
+	if len(proofs) != 1 {
+		return fmt.Errorf("%w: exactly one %s header is required", dpop.ErrInvalidProof, dpop.Header)
+	}
+	thumbprint, err := v.config.DPoP.Verify(proofs[0], request.Method, v.requestURL(request), token)
+	if err != nil {
+		return err
+	}
+	if thumbprint != boundKey {
+		return ErrDPoPMismatch
+	}
+	return nil
+}
+
+// requestURL is the URL a DPoP proof for the request must name
+func (v *Validator) requestURL(request *http.Request) string {
+	if v.config.PublicURL != "" {
+		return strings.TrimSuffix(v.config.PublicURL, "/") + request.URL.Path
+	}
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + request.Host + request.URL.Path
+}
+
+// CheckCertificate makes sure a certificate-bound token is presented with
+// the certificate it's bound to. Tokens that aren't bound pass.
+func CheckCertificate(claims *Claims, certificate *x509.Certificate) error {
+	if claims.Confirmation == nil || claims.Confirmation.CertificateThumbprint == "" {
+		return nil
+	}
+	if certificate == nil || subtle.ConstantTimeCompare([]byte(CertificateThumbprint(certificate)), []byte(claims.Confirmation.CertificateThumbprint)) != 1 {
+		return ErrCertificateMismatch
+	}
+	return nil
+}
+
+// CertificateThumbprint returns the base64url-encoded SHA-256 hash of a
+// certificate, as used in x5t#S256
+func CertificateThumbprint(certificate *x509.Certificate) string {
+	sum := sha256.Sum256(certificate.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func tlsClientCertificate(request *http.Request) *x509.Certificate {
+	if request.TLS == nil || len(request.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return request.TLS.PeerCertificates[0]
+}
+
+// BearerToken returns the token from an "Authorization: Bearer ..." header, or an empty string
+func BearerToken(request *http.Request) string {
+	scheme, token := authorization(request)
+	if !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return token
+}
+
+// authorization splits the Authorization header into its scheme and token
+func authorization(request *http.Request) (string, string) {
+	splits := strings.SplitN(request.Header.Get("Authorization"), " ", 2)
+	if len(splits) != 2 {
+		return "", ""
+	}
+	return splits[0], strings.TrimSpace(splits[1])
+}
+
+// keyFunc picks the key a token must be signed with
+func (v *Validator) keyFunc(token *jwt.Token) (interface{}, error) {
+	if _, valid := token.Method.(*jwt.SigningMethodHMAC); valid {
+		if len(v.config.Secret) == 0 {
+			return nil, ErrUnknownKey
+		}
+		return v.config.Secret, nil
+	}
+	switch token.Method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA, *jwt.SigningMethodRSAPSS:
+	default:
+		return nil, fmt.Errorf("Invalid token algorithm %v", token.Header["alg"])
+	}
+
+	keyID, _ := token.Header["kid"].(string)
+	if key, found := v.staticKeys[keyID]; found {
+		return key, nil
+	}
+	if v.remoteKeys != nil {
+		return v.remoteKeys.find(keyID)
+	}
+	return nil, ErrUnknownKey
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certificateCheckInterval is how often the certificate files are checked for changes
+const certificateCheckInterval time.Duration = 10 * time.Second
+
+// certificateReloader serves a TLS certificate, loading it again when its
+// files change, so renewed certificates are picked up without a restart
+type certificateReloader struct {
+	log      *log.Entry
+	certFile string
+	keyFile  string
+
+	lock        sync.Mutex
+	certificate *tls.Certificate
+	// version identifies the files the certificate was loaded from
+	version string
+	checked time.Time
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{
+		log:      log.WithFields(log.Fields{"logger": "CertificateReloader"}),
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. When the files have
+// changed but can't be loaded, such as while they are being replaced, the
+// current certificate is kept.
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if time.Since(r.checked) >= certificateCheckInterval {
+		r.checked = time.Now()
+		if r.filesVersion() != r.version {
+			if err := r.load(); err != nil {
+				r.log.WithError(err).Error("Failed to reload TLS certificate, keeping the current one")
+			} else {
+				r.log.WithField("file", r.certFile).Info("Reloaded TLS certificate")
+			}
+		}
+	}
+	return r.certificate, nil
+}
+
+// load reads the certificate and key. Callers hold the lock, if needed.
+func (r *certificateReloader) load() error {
+	version := r.filesVersion()
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load TLS certificate: %w", err)
+	}
+	r.certificate = &certificate
+	r.version = version
+	r.checked = time.Now()
+	return nil
+}
+
+// filesVersion changes whenever either file does
+func (r *certificateReloader) filesVersion() string {
+	version := ""
+	for _, path := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(path); err == nil {
+			version += fmt.Sprintf("%v/%d;", info.ModTime(), info.Size())
+		}
+	}
+	return version
+}
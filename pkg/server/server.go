@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"auth-server/pkg/config"
+)
+
+// Server serves HTTP, or HTTPS when a certificate is configured, until it's
+// stopped
+type Server struct {
+	log    *log.Entry
+	config config.ServerConfig
+	http   *http.Server
+}
+
+// New creates a Server for a handler, loading its TLS certificates
+func New(config config.ServerConfig, handler http.Handler) (*Server, error) {
+	serverLogger := log.WithFields(log.Fields{"logger": "Server"})
+	s := &Server{
+		log:    serverLogger,
+		config: config,
+		http: &http.Server{
+			Addr:              config.Address,
+			Handler:           handler,
+			ReadTimeout:       config.ReadTimeout,
+			ReadHeaderTimeout: config.ReadHeaderTimeout,
+			WriteTimeout:      config.WriteTimeout,
+			IdleTimeout:       config.IdleTimeout,
+			// Such as TLS handshake errors, which are the client's problem
+			ErrorLog: stdlog.New(serverLogger.WriterLevel(log.WarnLevel), "", 0),
+		},
+	}
+	if config.TLSCertFile == "" {
+		return s, nil
+	}
+
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	s.http.TLSConfig = tlsConfig
+	return s, nil
+}
+
+func newTLSConfig(serverConfig config.ServerConfig) (*tls.Config, error) {
+	certificates, err := newCertificateReloader(serverConfig.TLSCertFile, serverConfig.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certificates.GetCertificate,
+	}
+
+	switch serverConfig.TLSClientAuth {
+	case "", config.TLSClientAuthNone:
+		return tlsConfig, nil
+	case config.TLSClientAuthOptional:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case config.TLSClientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	data, err := ioutil.ReadFile(serverConfig.TLSClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read client CA file: %w", err)
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in %s", serverConfig.TLSClientCAFile)
+	}
+	return tlsConfig, nil
+}
+
+// Serve listens on the configured address, and serves until ctx is done. It
+// then stops accepting connections, and waits up to ShutdownTimeout for
+// requests in flight to finish.
+func (s *Server) Serve(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.config.Address)
+	if err != nil {
+		return err
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		if s.http.TLSConfig != nil {
+			s.log.WithField("address", s.config.Address).Info("Serving HTTPS")
+			served <- s.http.ServeTLS(listener, "", "")
+		} else {
+			s.log.WithField("address", s.config.Address).Info("Serving HTTP")
+			served <- s.http.Serve(listener)
+		}
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.log.WithField("timeout", s.config.ShutdownTimeout.String()).Info("Shutting down, waiting for requests in flight")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+	if err := s.http.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("Requests were still in flight after %s: %w", s.config.ShutdownTimeout, err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+// Package signing loads the asymmetric keys access tokens are signed with.
+// Their public halves are published as a JWK Set, so resource servers can
+// check tokens without sharing a secret.
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"auth-server/pkg/jwk"
+)
+
+var ErrNoPrivateKey = errors.New("No private key found")
+
+// Key is a private signing key, with the JWT algorithm it signs with. Its ID
+// is the key's JWK thumbprint, which is sent as the kid token header.
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+	// Private is an *rsa.PrivateKey or *ecdsa.PrivateKey
+	Private interface{}
+	Public  jwk.Key
+}
+
+// Load reads a PEM private key from each file
+func Load(paths []string) ([]Key, error) {
+	keys := []Key{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid signing key %s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Parse decodes a PEM-encoded RSA or EC private key, in PKCS #1, SEC 1 or PKCS #8 form
+func Parse(data []byte) (Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Key{}, ErrNoPrivateKey
+	}
+
+	var private interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return Key{}, ErrNoPrivateKey
+	}
+	if err != nil {
+		return Key{}, err
+	}
+	return New(private)
+}
+
+// New wraps an *rsa.PrivateKey or *ecdsa.PrivateKey. RSA keys sign with
+// RS256, and EC keys with the ES algorithm matching their curve.
+func New(private interface{}) (Key, error) {
+	var method jwt.SigningMethod
+	var public jwk.Key
+	var err error
+	switch private := private.(type) {
+	case *rsa.PrivateKey:
+		if private.N.BitLen() < 2048 {
+			return Key{}, errors.New("RSA keys must be at least 2048 bits")
+		}
+		method = jwt.SigningMethodRS256
+		public, err = jwk.New(&private.PublicKey)
+	case *ecdsa.PrivateKey:
+		switch private.Curve.Params().Name {
+		case "P-256":
+			method = jwt.SigningMethodES256
+		case "P-384":
+			method = jwt.SigningMethodES384
+		case "P-521":
+			method = jwt.SigningMethodES512
+		default:
+			return Key{}, jwk.ErrUnsupportedKey
+		}
+		public, err = jwk.New(&private.PublicKey)
+	default:
+		return Key{}, jwk.ErrUnsupportedKey
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	id, err := public.Thumbprint()
+	if err != nil {
+		return Key{}, err
+	}
+	public.KeyID = id
+	public.Use = "sig"
+	public.Algorithm = method.Alg()
+
+	return Key{ID: id, Method: method, Private: private, Public: public}, nil
+}
+
+// Generate creates a new key for one of the algorithms New picks: RS256,
+// ES256, ES384 or ES512
+func Generate(algorithm string) (Key, error) {
+	var private interface{}
+	var err error
+	switch algorithm {
+	case jwt.SigningMethodRS256.Alg():
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jwt.SigningMethodES256.Alg():
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jwt.SigningMethodES384.Alg():
+		private, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case jwt.SigningMethodES512.Alg():
+		private, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	default:
+		return Key{}, fmt.Errorf("Unsupported algorithm %q", algorithm)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+	return New(private)
+}
+
+// EncodePEM encodes the private key as PKCS #8, which Parse reads back
+func (k Key) EncodePEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.Private)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// Set lists the public keys, for publishing at a JWKS URL
+func Set(keys []Key) jwk.Set {
+	set := jwk.Set{Keys: []jwk.Key{}}
+	for _, key := range keys {
+		set.Keys = append(set.Keys, key.Public)
+	}
+	return set
+}
@@ -0,0 +1,227 @@
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestNew(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		curve      elliptic.Curve
+		wantMethod jwt.SigningMethod
+		wantType   string
+		wantErr    bool
+	}{
+		{name: "RSA", wantMethod: jwt.SigningMethodRS256, wantType: "RSA"},
+		{name: "P-256", curve: elliptic.P256(), wantMethod: jwt.SigningMethodES256, wantType: "EC"},
+		{name: "P-384", curve: elliptic.P384(), wantMethod: jwt.SigningMethodES384, wantType: "EC"},
+		{name: "P-521", curve: elliptic.P521(), wantMethod: jwt.SigningMethodES512, wantType: "EC"},
+		{name: "P-224", curve: elliptic.P224(), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var private interface{} = rsaKey
+			if test.curve != nil {
+				if private, err = ecdsa.GenerateKey(test.curve, rand.Reader); err != nil {
+					t.Fatal(err)
+				}
+			}
+			key, err := New(private)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if key.Method != test.wantMethod || key.Public.Algorithm != test.wantMethod.Alg() {
+				t.Errorf("Expected %s, got method %s and JWK alg %s", test.wantMethod.Alg(), key.Method.Alg(), key.Public.Algorithm)
+			}
+			if key.Public.KeyType != test.wantType || key.Public.Use != "sig" {
+				t.Errorf("Unexpected public key %+v", key.Public)
+			}
+			if thumbprint, _ := key.Public.Thumbprint(); key.ID == "" || key.ID != thumbprint || key.Public.KeyID != key.ID {
+				t.Errorf("Expected the key ID to be the thumbprint %s, got %s", thumbprint, key.ID)
+			}
+
+			// Tokens signed with the private key check out against the published key
+			signed, err := jwt.NewWithClaims(key.Method, jwt.StandardClaims{Subject: "alice"}).SignedString(key.Private)
+			if err != nil {
+				t.Fatal(err)
+			}
+			public, err := Set([]Key{key}).Keys[0].PublicKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := jwt.Parse(signed, func(*jwt.Token) (interface{}, error) { return public, nil }); err != nil {
+				t.Errorf("Expected the token to verify: %v", err)
+			}
+		})
+	}
+
+	if _, err := New("not a key"); err == nil {
+		t.Error("Expected an error for an unsupported key")
+	}
+}
+
+func TestParse(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallRSAKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p224Key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec1, _ := x509.MarshalECPrivateKey(ecKey)
+	p224, _ := x509.MarshalECPrivateKey(p224Key)
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(ecKey)
+	encode := func(blockType string, der []byte) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	}
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantMethod jwt.SigningMethod
+		wantErr    bool
+	}{
+		{name: "PKCS #1", data: encode("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)), wantMethod: jwt.SigningMethodRS256},
+		{name: "SEC 1", data: encode("EC PRIVATE KEY", sec1), wantMethod: jwt.SigningMethodES256},
+		{name: "PKCS #8", data: encode("PRIVATE KEY", pkcs8), wantMethod: jwt.SigningMethodES256},
+		{name: "RSA key too small", data: encode("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(smallRSAKey)), wantErr: true},
+		{name: "unsupported curve", data: encode("EC PRIVATE KEY", p224), wantErr: true},
+		{name: "public key", data: encode("PUBLIC KEY", []byte("key")), wantErr: true},
+		{name: "corrupt key", data: encode("EC PRIVATE KEY", []byte("key")), wantErr: true},
+		{name: "not PEM", data: []byte("key"), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := Parse(test.data)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && key.Method != test.wantMethod {
+				t.Errorf("Expected %s, got %s", test.wantMethod.Alg(), key.Method.Alg())
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	directory, err := ioutil.TempDir("", "signing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := New(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(private)
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	valid := filepath.Join(directory, "valid.pem")
+	invalid := filepath.Join(directory, "invalid.pem")
+	ioutil.WriteFile(valid, encoded, 0600)
+	ioutil.WriteFile(invalid, []byte("key"), 0600)
+
+	tests := []struct {
+		name    string
+		paths   []string
+		wantIDs int
+		wantErr bool
+	}{
+		{name: "no files"},
+		{name: "one file", paths: []string{valid}, wantIDs: 1},
+		{name: "missing file", paths: []string{valid, filepath.Join(directory, "missing.pem")}, wantErr: true},
+		{name: "invalid file", paths: []string{invalid}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys, err := Load(test.paths)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if len(keys) != test.wantIDs {
+				t.Errorf("Expected %d keys, got %d", test.wantIDs, len(keys))
+			}
+			for _, loaded := range keys {
+				if loaded.ID != key.ID {
+					t.Errorf("Expected key %s, got %s", key.ID, loaded.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		wantType  string
+		wantErr   bool
+	}{
+		{algorithm: "RS256", wantType: "RSA"},
+		{algorithm: "ES256", wantType: "EC"},
+		{algorithm: "ES384", wantType: "EC"},
+		{algorithm: "ES512", wantType: "EC"},
+		{algorithm: "HS256", wantErr: true},
+		{algorithm: "none", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.algorithm, func(t *testing.T) {
+			key, err := Generate(test.algorithm)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Generate() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if key.Method.Alg() != test.algorithm || key.Public.Algorithm != test.algorithm {
+				t.Errorf("Expected %s, got method %s and JWK alg %s", test.algorithm, key.Method.Alg(), key.Public.Algorithm)
+			}
+			if key.Public.KeyType != test.wantType {
+				t.Errorf("Expected a %s key, got %s", test.wantType, key.Public.KeyType)
+			}
+
+			// The key survives being saved
+			encoded, err := key.EncodePEM()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := Parse(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.ID != key.ID || parsed.Method != key.Method {
+				t.Errorf("Expected %s %s after parsing, got %s %s", key.Method.Alg(), key.ID, parsed.Method.Alg(), parsed.ID)
+			}
+		})
+	}
+}
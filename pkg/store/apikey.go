@@ -0,0 +1,47 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Owners of API keys
+const (
+	OwnerUser   string = "user"
+	OwnerClient string = "client"
+)
+
+// APIKey is a long-lived credential belonging to a user or client. Only a
+// hash of the secret part of the key is kept.
+type APIKey struct {
+	// ID is the public prefix of the key, used to look it up
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	OwnerType  string    `json:"owner_type"`
+	Owner      string    `json:"owner"`
+	SecretHash string    `json:"secret_hash"`
+	Scopes     []string  `json:"scopes,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	// ExpiresAt is zero for keys that never expire
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// Expired reports whether the key can no longer be used
+func (k APIKey) Expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && now.After(k.ExpiresAt)
+}
+
+// APIKeyStore persists API keys
+type APIKeyStore interface {
+	Create(ctx context.Context, key APIKey) error
+	Get(ctx context.Context, id string) (APIKey, error)
+	Update(ctx context.Context, key APIKey) error
+	Delete(ctx context.Context, id string) error
+	// List returns every key belonging to an owner, or all keys when ownerType is empty
+	List(ctx context.Context, ownerType string, owner string) ([]APIKey, error)
+	// Ping checks the store can still be read and written, for readiness checks
+	Ping(ctx context.Context) error
+	// Close saves anything not saved yet, such as when the server stops
+	Close() error
+}
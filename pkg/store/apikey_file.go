@@ -0,0 +1,82 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// fileAPIKeyStore keeps API keys in memory and writes the full set to a
+// JSON file after every change.
+type fileAPIKeyStore struct {
+	*memoryAPIKeyStore
+	path string
+	// writeLock serializes changes so the file always matches the latest state
+	writeLock sync.Mutex
+}
+
+// NewFileAPIKeyStore creates an APIKeyStore backed by a JSON file, loading
+// any keys already saved at path.
+func NewFileAPIKeyStore(path string) (APIKeyStore, error) {
+	s := &fileAPIKeyStore{
+		memoryAPIKeyStore: newMemoryAPIKeyStore(),
+		path:              path,
+	}
+
+	var keys []APIKey
+	if err := readJSONFile(path, &keys); err != nil {
+		return nil, fmt.Errorf("Failed to load API key store %s: %w", path, err)
+	}
+	for _, key := range keys {
+		s.keys[key.ID] = key
+	}
+	return s, nil
+}
+
+func (s *fileAPIKeyStore) Create(ctx context.Context, key APIKey) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if err := s.memoryAPIKeyStore.Create(ctx, key); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *fileAPIKeyStore) Update(ctx context.Context, key APIKey) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if err := s.memoryAPIKeyStore.Update(ctx, key); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *fileAPIKeyStore) Delete(ctx context.Context, id string) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if err := s.memoryAPIKeyStore.Delete(ctx, id); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// save replaces the file with the current set of keys
+func (s *fileAPIKeyStore) save() error {
+	keys, _ := s.List(context.Background(), "", "")
+	return writeJSONFile(s.path, keys)
+}
+
+// Ping checks the file can still be replaced
+func (s *fileAPIKeyStore) Ping(ctx context.Context) error {
+	return checkWritable(s.path)
+}
+
+// Close waits for any change in progress, and saves the file a final time
+func (s *fileAPIKeyStore) Close() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.save()
+}
@@ -0,0 +1,89 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+type memoryAPIKeyStore struct {
+	lock sync.RWMutex
+	keys map[string]APIKey
+}
+
+// NewMemoryAPIKeyStore creates an APIKeyStore that only lives as long as the process
+func NewMemoryAPIKeyStore() APIKeyStore {
+	return newMemoryAPIKeyStore()
+}
+
+func newMemoryAPIKeyStore() *memoryAPIKeyStore {
+	return &memoryAPIKeyStore{keys: map[string]APIKey{}}
+}
+
+func (s *memoryAPIKeyStore) Create(ctx context.Context, key APIKey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.keys[key.ID]; exists {
+		return ErrConflict
+	}
+	s.keys[key.ID] = key
+	return nil
+}
+
+func (s *memoryAPIKeyStore) Get(ctx context.Context, id string) (APIKey, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	key, exists := s.keys[id]
+	if !exists {
+		return APIKey{}, ErrNotFound
+	}
+	return key, nil
+}
+
+func (s *memoryAPIKeyStore) Update(ctx context.Context, key APIKey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.keys[key.ID]; !exists {
+		return ErrNotFound
+	}
+	s.keys[key.ID] = key
+	return nil
+}
+
+func (s *memoryAPIKeyStore) Delete(ctx context.Context, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.keys[id]; !exists {
+		return ErrNotFound
+	}
+	delete(s.keys, id)
+	return nil
+}
+
+func (s *memoryAPIKeyStore) List(ctx context.Context, ownerType string, owner string) ([]APIKey, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	keys := []APIKey{}
+	for _, key := range s.keys {
+		if ownerType == "" || (key.OwnerType == ownerType && key.Owner == owner) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+// Ping always succeeds, as there's nothing to reach
+func (s *memoryAPIKeyStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close does nothing, as there's nowhere to save to
+func (s *memoryAPIKeyStore) Close() error {
+	return nil
+}
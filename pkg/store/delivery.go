@@ -0,0 +1,47 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Statuses of webhook deliveries
+const (
+	DeliveryPending   string = "pending"
+	DeliveryDelivered string = "delivered"
+	DeliveryFailed    string = "failed"
+)
+
+// Delivery is one event waiting to be sent, or already sent, to one webhook
+type Delivery struct {
+	ID        string `json:"id"`
+	EventID   string `json:"event_id"`
+	EventType string `json:"event_type"`
+	URL       string `json:"url"`
+	// Payload is the request body, signed again for each attempt
+	Payload  json.RawMessage `json:"payload"`
+	Status   string          `json:"status"`
+	Attempts int             `json:"attempts"`
+	// LastError and LastStatusCode describe the latest failed attempt
+	LastError      string    `json:"last_error,omitempty"`
+	LastStatusCode int       `json:"last_status_code,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	// NextAttemptAt is when a pending delivery is tried next
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	DeliveredAt   time.Time `json:"delivered_at"`
+}
+
+// DeliveryStore is the outbox of webhook deliveries, which keeps them
+// until they're sent
+type DeliveryStore interface {
+	Create(ctx context.Context, delivery Delivery) error
+	Update(ctx context.Context, delivery Delivery) error
+	Delete(ctx context.Context, id string) error
+	// List returns deliveries oldest first, optionally only those with status
+	List(ctx context.Context, status string) ([]Delivery, error)
+	// Ping checks the store can still be read and written, for readiness checks
+	Ping(ctx context.Context) error
+	// Close saves anything not saved yet, such as when the server stops
+	Close() error
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// fileDeliveryStore keeps deliveries in memory and writes the full set to a
+// JSON file after every change, so pending ones survive a restart.
+type fileDeliveryStore struct {
+	*memoryDeliveryStore
+	path string
+	// writeLock serializes changes so the file always matches the latest state
+	writeLock sync.Mutex
+}
+
+// NewFileDeliveryStore creates a DeliveryStore backed by a JSON file,
+// loading any deliveries already saved at path.
+func NewFileDeliveryStore(path string) (DeliveryStore, error) {
+	s := &fileDeliveryStore{
+		memoryDeliveryStore: newMemoryDeliveryStore(),
+		path:                path,
+	}
+
+	var deliveries []Delivery
+	if err := readJSONFile(path, &deliveries); err != nil {
+		return nil, fmt.Errorf("Failed to load webhook outbox %s: %w", path, err)
+	}
+	for _, delivery := range deliveries {
+		s.deliveries[delivery.ID] = delivery
+	}
+	return s, nil
+}
+
+func (s *fileDeliveryStore) Create(ctx context.Context, delivery Delivery) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if err := s.memoryDeliveryStore.Create(ctx, delivery); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *fileDeliveryStore) Update(ctx context.Context, delivery Delivery) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if err := s.memoryDeliveryStore.Update(ctx, delivery); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *fileDeliveryStore) Delete(ctx context.Context, id string) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if err := s.memoryDeliveryStore.Delete(ctx, id); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// save replaces the file with the current set of deliveries
+func (s *fileDeliveryStore) save() error {
+	deliveries, _ := s.List(context.Background(), "")
+	return writeJSONFile(s.path, deliveries)
+}
+
+// Ping checks the file can still be replaced
+func (s *fileDeliveryStore) Ping(ctx context.Context) error {
+	return checkWritable(s.path)
+}
+
+// Close waits for any change in progress, and saves the file a final time
+func (s *fileDeliveryStore) Close() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.save()
+}
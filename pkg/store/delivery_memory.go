@@ -0,0 +1,79 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+type memoryDeliveryStore struct {
+	lock       sync.RWMutex
+	deliveries map[string]Delivery
+}
+
+// NewMemoryDeliveryStore creates a DeliveryStore that only lives as long as
+// the process, so pending deliveries are lost when it stops
+func NewMemoryDeliveryStore() DeliveryStore {
+	return newMemoryDeliveryStore()
+}
+
+func newMemoryDeliveryStore() *memoryDeliveryStore {
+	return &memoryDeliveryStore{deliveries: map[string]Delivery{}}
+}
+
+func (s *memoryDeliveryStore) Create(ctx context.Context, delivery Delivery) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.deliveries[delivery.ID]; exists {
+		return ErrConflict
+	}
+	s.deliveries[delivery.ID] = delivery
+	return nil
+}
+
+func (s *memoryDeliveryStore) Update(ctx context.Context, delivery Delivery) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.deliveries[delivery.ID]; !exists {
+		return ErrNotFound
+	}
+	s.deliveries[delivery.ID] = delivery
+	return nil
+}
+
+func (s *memoryDeliveryStore) Delete(ctx context.Context, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.deliveries[id]; !exists {
+		return ErrNotFound
+	}
+	delete(s.deliveries, id)
+	return nil
+}
+
+func (s *memoryDeliveryStore) List(ctx context.Context, status string) ([]Delivery, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	deliveries := []Delivery{}
+	for _, delivery := range s.deliveries {
+		if status == "" || delivery.Status == status {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].CreatedAt.Before(deliveries[j].CreatedAt) })
+	return deliveries, nil
+}
+
+// Ping always succeeds, as there's nothing to reach
+func (s *memoryDeliveryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close does nothing, as there's nowhere to save to
+func (s *memoryDeliveryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// SchemaVersion is the version of the file format the file stores write.
+// Version 0 files hold a bare list of records; later versions wrap the list
+// in an object recording the version.
+const SchemaVersion int = 1
+
+// schemaFile is how file stores lay out their files
+type schemaFile struct {
+	Version int             `json:"version"`
+	Records json.RawMessage `json:"records"`
+}
+
+// readJSONFile decodes the records in a file written by writeJSONFile. A
+// missing file leaves records untouched. Files written by a newer version
+// are refused, rather than risk losing what this version doesn't understand.
+func readJSONFile(path string, records interface{}) error {
+	version, data, err := readSchemaFile(path)
+	if err != nil || data == nil {
+		return err
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("%s has schema version %d, but only up to %d is supported", path, version, SchemaVersion)
+	}
+	return json.Unmarshal(data, records)
+}
+
+// readSchemaFile returns the schema version of a file and its raw records.
+// A missing file has no records.
+func readSchemaFile(path string) (int, json.RawMessage, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return SchemaVersion, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		return 0, trimmed, nil
+	}
+
+	var file schemaFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return 0, nil, err
+	}
+	return file.Version, file.Records, nil
+}
+
+// writeJSONFile atomically replaces a file with records, in the current
+// schema version. The data is synced to disk before the file is replaced.
+// The file is only readable by the current user, as it may hold secrets.
+func writeJSONFile(path string, records interface{}) error {
+	encoded, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(schemaFile{Version: SchemaVersion, Records: encoded}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// checkWritable opens path if it exists, then creates and removes a
+// temporary file beside it, as writeJSONFile does
+func checkWritable(path string) error {
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		file.Close()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// MigrateFile upgrades a file store's file to the current schema version,
+// returning the version it was at. Missing and up to date files are left alone.
+func MigrateFile(path string) (int, error) {
+	version, data, err := readSchemaFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read %s: %w", path, err)
+	}
+	if data == nil || version == SchemaVersion {
+		return version, nil
+	}
+	if version > SchemaVersion {
+		return version, fmt.Errorf("%s has schema version %d, but only up to %d is supported", path, version, SchemaVersion)
+	}
+
+	// Version 1 only added the wrapper, so the records are carried over as they are
+	var records []json.RawMessage
+	if err := json.Unmarshal(data, &records); err != nil {
+		return version, fmt.Errorf("Failed to read %s: %w", path, err)
+	}
+	return version, writeJSONFile(path, records)
+}
@@ -0,0 +1,187 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	directory, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(directory) })
+	return directory
+}
+
+type record struct {
+	Name string `json:"name"`
+}
+
+func TestReadJSONFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []record
+		wantErr bool
+	}{
+		{name: "missing file"},
+		{name: "version 0 bare list", content: `[{"name":"alice"}]`, want: []record{{"alice"}}},
+		{name: "version 0 with whitespace", content: "\n  [{\"name\":\"alice\"}]\n", want: []record{{"alice"}}},
+		{name: "current version", content: `{"version":1,"records":[{"name":"alice"},{"name":"bob"}]}`, want: []record{{"alice"}, {"bob"}}},
+		{name: "newer version", content: `{"version":2,"records":[]}`, wantErr: true},
+		{name: "not json", content: `alice`, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(tempDir(t), "records.json")
+			if test.content != "" {
+				if err := ioutil.WriteFile(path, []byte(test.content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var records []record
+			err := readJSONFile(path, &records)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("readJSONFile() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(records, test.want) {
+				t.Errorf("readJSONFile() = %v, want %v", records, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteJSONFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		records  []record
+	}{
+		{name: "new file", records: []record{{"alice"}}},
+		{name: "replaces a file", existing: `[{"name":"old"}]`, records: []record{{"alice"}, {"bob"}}},
+		{name: "no records", existing: `{"version":1,"records":[{"name":"old"}]}`, records: []record{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory := tempDir(t)
+			path := filepath.Join(directory, "records.json")
+			if test.existing != "" {
+				if err := ioutil.WriteFile(path, []byte(test.existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writeJSONFile(path, test.records); err != nil {
+				t.Fatal(err)
+			}
+
+			// The temporary file was renamed into place
+			entries, err := ioutil.ReadDir(directory)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || entries[0].Name() != "records.json" {
+				t.Errorf("Expected only records.json, found %d files", len(entries))
+			}
+			if mode := entries[0].Mode().Perm(); mode != 0600 {
+				t.Errorf("Expected mode 0600, got %o", mode)
+			}
+
+			data, _ := ioutil.ReadFile(path)
+			var file schemaFile
+			if err := json.Unmarshal(data, &file); err != nil {
+				t.Fatal(err)
+			}
+			if file.Version != SchemaVersion {
+				t.Errorf("Expected version %d, got %d", SchemaVersion, file.Version)
+			}
+			var records []record
+			if err := readJSONFile(path, &records); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(records, test.records) {
+				t.Errorf("Read back %v, want %v", records, test.records)
+			}
+		})
+	}
+}
+
+func TestWriteJSONFileFailureKeepsFile(t *testing.T) {
+	directory := tempDir(t)
+	path := filepath.Join(directory, "records.json")
+	if err := writeJSONFile(path, []record{{"alice"}}); err != nil {
+		t.Fatal(err)
+	}
+	// Records that can't be encoded fail before anything is written
+	if err := writeJSONFile(path, []interface{}{make(chan int)}); err == nil {
+		t.Fatal("Expected an error encoding a channel")
+	}
+
+	var records []record
+	if err := readJSONFile(path, &records); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(records, []record{{"alice"}}) {
+		t.Errorf("Expected the original records, got %v", records)
+	}
+	if entries, _ := ioutil.ReadDir(directory); len(entries) != 1 {
+		t.Errorf("Expected no temporary files left behind, found %d files", len(entries))
+	}
+}
+
+func TestMigrateFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		wantVersion int
+		wantErr     bool
+		// wantContent is the file after migrating, when it should have changed
+		wantContent []record
+	}{
+		{name: "missing file", wantVersion: SchemaVersion},
+		{name: "version 0", content: `[{"name":"alice"}]`, wantVersion: 0, wantContent: []record{{"alice"}}},
+		{name: "current version", content: `{"version":1,"records":[{"name":"alice"}]}`, wantVersion: 1},
+		{name: "newer version", content: `{"version":2,"records":[]}`, wantVersion: 2, wantErr: true},
+		{name: "version 0 not a list of records", content: `[1, 2`, wantVersion: 0, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(tempDir(t), "records.json")
+			if test.content != "" {
+				if err := ioutil.WriteFile(path, []byte(test.content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			version, err := MigrateFile(path)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("MigrateFile() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err == nil && version != test.wantVersion {
+				t.Errorf("MigrateFile() = %d, want %d", version, test.wantVersion)
+			}
+
+			data, _ := ioutil.ReadFile(path)
+			if test.wantContent == nil {
+				if string(data) != test.content {
+					t.Errorf("Expected the file to be left alone, got %s", data)
+				}
+				return
+			}
+			fileVersion, _, err := readSchemaFile(path)
+			if err != nil || fileVersion != SchemaVersion {
+				t.Errorf("Expected version %d after migrating, got %d (%v)", SchemaVersion, fileVersion, err)
+			}
+			var records []record
+			if err := readJSONFile(path, &records); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(records, test.wantContent) {
+				t.Errorf("Migrated records = %v, want %v", records, test.wantContent)
+			}
+		})
+	}
+}
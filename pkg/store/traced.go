@@ -0,0 +1,192 @@
+package store
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("auth-server/pkg/store")
+
+// backendKey records which store backend handled a call
+const backendKey = attribute.Key("store.backend")
+
+// tracedUserStore records a span for each call to the UserStore it wraps
+type tracedUserStore struct {
+	store   UserStore
+	backend string
+}
+
+// TraceUserStore wraps a UserStore so each call is traced, labelled with
+// the backend's name
+func TraceUserStore(store UserStore, backend string) UserStore {
+	return &tracedUserStore{store: store, backend: backend}
+}
+
+func (s *tracedUserStore) Create(ctx context.Context, user User) error {
+	ctx, span := startSpan(ctx, "UserStore.Create", s.backend)
+	defer span.End()
+	return endSpan(span, s.store.Create(ctx, user))
+}
+
+func (s *tracedUserStore) Get(ctx context.Context, username string) (User, error) {
+	ctx, span := startSpan(ctx, "UserStore.Get", s.backend)
+	defer span.End()
+	user, err := s.store.Get(ctx, username)
+	return user, endSpan(span, err)
+}
+
+func (s *tracedUserStore) GetByEmail(ctx context.Context, email string) (User, error) {
+	ctx, span := startSpan(ctx, "UserStore.GetByEmail", s.backend)
+	defer span.End()
+	user, err := s.store.GetByEmail(ctx, email)
+	return user, endSpan(span, err)
+}
+
+func (s *tracedUserStore) Update(ctx context.Context, user User) error {
+	ctx, span := startSpan(ctx, "UserStore.Update", s.backend)
+	defer span.End()
+	return endSpan(span, s.store.Update(ctx, user))
+}
+
+func (s *tracedUserStore) Delete(ctx context.Context, username string) error {
+	ctx, span := startSpan(ctx, "UserStore.Delete", s.backend)
+	defer span.End()
+	return endSpan(span, s.store.Delete(ctx, username))
+}
+
+func (s *tracedUserStore) List(ctx context.Context) ([]User, error) {
+	ctx, span := startSpan(ctx, "UserStore.List", s.backend)
+	defer span.End()
+	users, err := s.store.List(ctx)
+	return users, endSpan(span, err)
+}
+
+func (s *tracedUserStore) Ping(ctx context.Context) error {
+	ctx, span := startSpan(ctx, "UserStore.Ping", s.backend)
+	defer span.End()
+	return endSpan(span, s.store.Ping(ctx))
+}
+
+func (s *tracedUserStore) Close() error {
+	return s.store.Close()
+}
+
+// tracedAPIKeyStore records a span for each call to the APIKeyStore it wraps
+type tracedAPIKeyStore struct {
+	store   APIKeyStore
+	backend string
+}
+
+// TraceAPIKeyStore wraps an APIKeyStore so each call is traced, labelled
+// with the backend's name
+func TraceAPIKeyStore(store APIKeyStore, backend string) APIKeyStore {
+	return &tracedAPIKeyStore{store: store, backend: backend}
+}
+
+func (s *tracedAPIKeyStore) Create(ctx context.Context, key APIKey) error {
+	ctx, span := startSpan(ctx, "APIKeyStore.Create", s.backend)
+	defer span.End()
+	return endSpan(span, s.store.Create(ctx, key))
+}
+
+func (s *tracedAPIKeyStore) Get(ctx context.Context, id string) (APIKey, error) {
+	ctx, span := startSpan(ctx, "APIKeyStore.Get", s.backend)
+	defer span.End()
+	key, err := s.store.Get(ctx, id)
+	return key, endSpan(span, err)
+}
+
+func (s *tracedAPIKeyStore) Update(ctx context.Context, key APIKey) error {
+	ctx, span := startSpan(ctx, "APIKeyStore.Update", s.backend)
+	defer span.End()
+	return endSpan(span, s.store.Update(ctx, key))
+}
+
+func (s *tracedAPIKeyStore) Delete(ctx context.Context, id string) error {
+	ctx, span := startSpan(ctx, "APIKeyStore.Delete", s.backend)
+	defer span.End()
+	return endSpan(span, s.store.Delete(ctx, id))
+}
+
+func (s *tracedAPIKeyStore) List(ctx context.Context, ownerType string, owner string) ([]APIKey, error) {
+	ctx, span := startSpan(ctx, "APIKeyStore.List", s.backend)
+	defer span.End()
+	keys, err := s.store.List(ctx, ownerType, owner)
+	return keys, endSpan(span, err)
+}
+
+func (s *tracedAPIKeyStore) Ping(ctx context.Context) error {
+	ctx, span := startSpan(ctx, "APIKeyStore.Ping", s.backend)
+	defer span.End()
+	return endSpan(span, s.store.Ping(ctx))
+}
+
+func (s *tracedAPIKeyStore) Close() error {
+	return s.store.Close()
+}
+
+// tracedDeliveryStore records a span for each call to the DeliveryStore it wraps
+type tracedDeliveryStore struct {
+	store   DeliveryStore
+	backend string
+}
+
+// TraceDeliveryStore wraps a DeliveryStore so each call is traced, labelled
+// with the backend's name
+func TraceDeliveryStore(store DeliveryStore, backend string) DeliveryStore {
+	return &tracedDeliveryStore{store: store, backend: backend}
+}
+
+func (s *tracedDeliveryStore) Create(ctx context.Context, delivery Delivery) error {
+	ctx, span := startSpan(ctx, "DeliveryStore.Create", s.backend)
+	defer span.End()
+	return endSpan(span, s.store.Create(ctx, delivery))
+}
+
+func (s *tracedDeliveryStore) Update(ctx context.Context, delivery Delivery) error {
+	ctx, span := startSpan(ctx, "DeliveryStore.Update", s.backend)
+	defer span.End()
+	return endSpan(span, s.store.Update(ctx, delivery))
+}
+
+func (s *tracedDeliveryStore) Delete(ctx context.Context, id string) error {
+	ctx, span := startSpan(ctx, "DeliveryStore.Delete", s.backend)
+	defer span.End()
+	return endSpan(span, s.store.Delete(ctx, id))
+}
+
+func (s *tracedDeliveryStore) List(ctx context.Context, status string) ([]Delivery, error) {
+	ctx, span := startSpan(ctx, "DeliveryStore.List", s.backend)
+	defer span.End()
+	deliveries, err := s.store.List(ctx, status)
+	return deliveries, endSpan(span, err)
+}
+
+func (s *tracedDeliveryStore) Ping(ctx context.Context) error {
+	ctx, span := startSpan(ctx, "DeliveryStore.Ping", s.backend)
+	defer span.End()
+	return endSpan(span, s.store.Ping(ctx))
+}
+
+func (s *tracedDeliveryStore) Close() error {
+	return s.store.Close()
+}
+
+func startSpan(ctx context.Context, name string, backend string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindInternal), trace.WithAttributes(backendKey.String(backend)))
+}
+
+// endSpan marks the span as failed for errors other than ErrNotFound and
+// ErrConflict, which callers expect, and passes err through
+func endSpan(span trace.Span, err error) error {
+	if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrConflict) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
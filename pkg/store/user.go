@@ -0,0 +1,60 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a record does not exist
+	ErrNotFound = errors.New("Record not found")
+	// ErrConflict is returned when a record would violate a uniqueness constraint
+	ErrConflict = errors.New("Record already exists")
+)
+
+// User is a registered account
+type User struct {
+	ID            string `json:"id"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	PasswordHash  string `json:"password_hash"`
+	EmailVerified bool   `json:"email_verified"`
+	// Disabled users can't log in, by any means
+	Disabled  bool      `json:"disabled,omitempty"`
+	Roles     []string  `json:"roles,omitempty"`
+	Scopes    []string  `json:"scopes,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// FailedLogins counts wrong passwords since the last login
+	FailedLogins int `json:"failed_logins,omitempty"`
+	// LockedUntil is when a lockout ends, and zero when the user isn't locked out
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// Locked reports whether the user is locked out for entering too many wrong passwords
+func (u User) Locked(now time.Time) bool {
+	return now.Before(u.LockedUntil)
+}
+
+// UserStore persists user accounts. Usernames and email addresses are
+// unique, compared case-insensitively.
+type UserStore interface {
+	Create(ctx context.Context, user User) error
+	Get(ctx context.Context, username string) (User, error)
+	GetByEmail(ctx context.Context, email string) (User, error)
+	Update(ctx context.Context, user User) error
+	Delete(ctx context.Context, username string) error
+	List(ctx context.Context) ([]User, error)
+	// Ping checks the store can still be read and written, for readiness checks
+	Ping(ctx context.Context) error
+	// Close saves anything not saved yet, such as when the server stops
+	Close() error
+}
+
+// normalize returns the key used for case-insensitive lookups
+func normalize(value string) string {
+	return strings.ToLower(strings.TrimSpace(value))
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// fileUserStore keeps users in memory and writes the full set to a JSON
+// file after every change.
+type fileUserStore struct {
+	*memoryUserStore
+	path string
+	// writeLock serializes changes so the file always matches the latest state
+	writeLock sync.Mutex
+}
+
+// NewFileUserStore creates a UserStore backed by a JSON file, loading any
+// users already saved at path.
+func NewFileUserStore(path string) (UserStore, error) {
+	s := &fileUserStore{
+		memoryUserStore: newMemoryUserStore(),
+		path:            path,
+	}
+
+	var users []User
+	if err := readJSONFile(path, &users); err != nil {
+		return nil, fmt.Errorf("Failed to load user store %s: %w", path, err)
+	}
+	for _, user := range users {
+		s.put(user)
+	}
+	return s, nil
+}
+
+func (s *fileUserStore) Create(ctx context.Context, user User) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if err := s.memoryUserStore.Create(ctx, user); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *fileUserStore) Update(ctx context.Context, user User) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if err := s.memoryUserStore.Update(ctx, user); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *fileUserStore) Delete(ctx context.Context, username string) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if err := s.memoryUserStore.Delete(ctx, username); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// save replaces the file with the current set of users
+func (s *fileUserStore) save() error {
+	users, _ := s.List(context.Background())
+	return writeJSONFile(s.path, users)
+}
+
+// Ping checks the file can still be replaced
+func (s *fileUserStore) Ping(ctx context.Context) error {
+	return checkWritable(s.path)
+}
+
+// Close waits for any change in progress, and saves the file a final time
+func (s *fileUserStore) Close() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.save()
+}
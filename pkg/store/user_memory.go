@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+type memoryUserStore struct {
+	lock    sync.RWMutex
+	users   map[string]User
+	byEmail map[string]string
+}
+
+// NewMemoryUserStore creates a UserStore that only lives as long as the process
+func NewMemoryUserStore() UserStore {
+	return newMemoryUserStore()
+}
+
+func newMemoryUserStore() *memoryUserStore {
+	return &memoryUserStore{
+		users:   map[string]User{},
+		byEmail: map[string]string{},
+	}
+}
+
+func (s *memoryUserStore) Create(ctx context.Context, user User) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := normalize(user.Username)
+	if _, exists := s.users[key]; exists {
+		return ErrConflict
+	}
+	if _, exists := s.byEmail[normalize(user.Email)]; exists {
+		return ErrConflict
+	}
+	s.put(user)
+	return nil
+}
+
+func (s *memoryUserStore) Get(ctx context.Context, username string) (User, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	user, exists := s.users[normalize(username)]
+	if !exists {
+		return User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (s *memoryUserStore) GetByEmail(ctx context.Context, email string) (User, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	key, exists := s.byEmail[normalize(email)]
+	if !exists {
+		return User{}, ErrNotFound
+	}
+	return s.users[key], nil
+}
+
+func (s *memoryUserStore) Update(ctx context.Context, user User) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := normalize(user.Username)
+	existing, exists := s.users[key]
+	if !exists {
+		return ErrNotFound
+	}
+	if owner, taken := s.byEmail[normalize(user.Email)]; taken && owner != key {
+		return ErrConflict
+	}
+	delete(s.byEmail, normalize(existing.Email))
+	s.put(user)
+	return nil
+}
+
+func (s *memoryUserStore) Delete(ctx context.Context, username string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := normalize(username)
+	existing, exists := s.users[key]
+	if !exists {
+		return ErrNotFound
+	}
+	delete(s.byEmail, normalize(existing.Email))
+	delete(s.users, key)
+	return nil
+}
+
+func (s *memoryUserStore) List(ctx context.Context) ([]User, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].CreatedAt.Before(users[j].CreatedAt) })
+	return users, nil
+}
+
+// put stores a user and its indexes. The caller must hold the write lock.
+func (s *memoryUserStore) put(user User) {
+	key := normalize(user.Username)
+	s.users[key] = user
+	s.byEmail[normalize(user.Email)] = key
+}
+
+// Ping always succeeds, as there's nothing to reach
+func (s *memoryUserStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close does nothing, as there's nowhere to save to
+func (s *memoryUserStore) Close() error {
+	return nil
+}
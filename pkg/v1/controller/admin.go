@@ -0,0 +1,474 @@
+package controller
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"auth-server/pkg/audit"
+	"auth-server/pkg/config"
+	"auth-server/pkg/problem"
+	"auth-server/pkg/store"
+	tokenservice "auth-server/pkg/v1/service"
+)
+
+const (
+	adminUsersRoute       string = "/users"
+	adminUserRoute        string = "/users/:username"
+	adminUserRolesRoute   string = "/users/:username/roles"
+	adminUserDisableRoute string = "/users/:username/disable"
+	adminUserEnableRoute  string = "/users/:username/enable"
+	adminUserResetRoute   string = "/users/:username/password-reset"
+	adminUserUnlockRoute  string = "/users/:username/unlock"
+	adminSessionsRoute    string = "/users/:username/sessions"
+	adminSessionRoute     string = "/users/:username/sessions/:id"
+	adminClientsRoute     string = "/clients"
+
+	defaultAdminUsersLimit int = 50
+)
+
+type ListUsersRequest struct {
+	Offset int    `form:"offset" binding:"min=0"`
+	Limit  int    `form:"limit" binding:"omitempty,min=1,max=500"`
+	Query  string `form:"q"`
+	Role   string `form:"role"`
+	Scope  string `form:"scope"`
+	// Nil filters match everyone
+	Disabled      *bool `form:"disabled"`
+	Locked        *bool `form:"locked"`
+	EmailVerified *bool `form:"email_verified"`
+}
+
+type CreateUserRequest struct {
+	Username      string   `json:"username" binding:"required"`
+	Email         string   `json:"email" binding:"required"`
+	Password      string   `json:"password" binding:"required"`
+	EmailVerified bool     `json:"email_verified"`
+	Roles         []string `json:"roles"`
+	Scopes        []string `json:"scopes"`
+}
+
+type UpdateUserRequest struct {
+	Email         *string `json:"email"`
+	EmailVerified *bool   `json:"email_verified"`
+}
+
+type SetUserRolesRequest struct {
+	Roles  []string `json:"roles"`
+	Scopes []string `json:"scopes"`
+}
+
+type AdminController struct {
+	log         *log.Entry
+	group       *gin.RouterGroup
+	config      *config.Holder
+	userService tokenservice.UserService
+	authorize   gin.HandlerFunc
+}
+
+// NewAdminController registers the routes admins use to manage users, their
+// sessions and clients. Every
+// route needs a token with the admin role.
+func NewAdminController(group *gin.RouterGroup, config *config.Holder, userService tokenservice.UserService, authorize gin.HandlerFunc) *AdminController {
+	adminController := &AdminController{
+		log:         log.WithFields(log.Fields{"logger": "AdminControllerV1"}),
+		group:       group,
+		config:      config,
+		userService: userService,
+		authorize:   authorize,
+	}
+	adminController.registerRoutes()
+	return adminController
+}
+
+func (c *AdminController) registerRoutes() {
+	c.group.Use(c.authorize, c.requireAdmin)
+	c.group.GET(adminUsersRoute, c.List)
+	c.group.POST(adminUsersRoute, c.Create)
+	c.group.GET(adminUserRoute, c.Get)
+	c.group.PATCH(adminUserRoute, c.Update)
+	c.group.DELETE(adminUserRoute, c.Delete)
+	c.group.PUT(adminUserRolesRoute, c.SetRoles)
+	c.group.POST(adminUserDisableRoute, c.Disable)
+	c.group.POST(adminUserEnableRoute, c.Enable)
+	c.group.POST(adminUserResetRoute, c.RequirePasswordReset)
+	c.group.POST(adminUserUnlockRoute, c.Unlock)
+	c.group.GET(adminSessionsRoute, c.Sessions)
+	c.group.DELETE(adminSessionsRoute, c.RevokeSessions)
+	c.group.DELETE(adminSessionRoute, c.RevokeSession)
+	c.group.GET(adminClientsRoute, c.Clients)
+}
+
+// requireAdmin refuses tokens without the admin role
+func (c *AdminController) requireAdmin(context *gin.Context) {
+	jwtUser, _ := context.MustGet("user").(tokenservice.JWTUser)
+	if !jwtUser.HasRole(c.config.Get().AdminRole) {
+		problem.Abort(context, problem.New(problem.Forbidden, "Only admins can manage users"))
+		return
+	}
+	context.Next()
+}
+
+// List returns a page of users, oldest first, with how many match the filters
+func (c *AdminController) List(context *gin.Context) {
+	var request ListUsersRequest
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "AdminController.List")
+	defer span.End()
+
+	if err := context.ShouldBindQuery(&request); err != nil {
+		problem.Abort(context, bindingProblem(err))
+		return
+	}
+	if request.Limit == 0 {
+		request.Limit = defaultAdminUsersLimit
+	}
+
+	users, total, err := c.userService.List(context.Request.Context(), tokenservice.UserFilter{
+		Query:         request.Query,
+		Role:          request.Role,
+		Scope:         request.Scope,
+		Disabled:      request.Disabled,
+		Locked:        request.Locked,
+		EmailVerified: request.EmailVerified,
+		Offset:        request.Offset,
+		Limit:         request.Limit,
+	})
+	if err != nil {
+		problem.Abort(context, problem.Wrap(problem.Internal, err))
+		return
+	}
+
+	response := make([]gin.H, 0, len(users))
+	for _, user := range users {
+		response = append(response, adminUserResponse(user))
+	}
+	context.JSON(http.StatusOK, gin.H{
+		"users":  response,
+		"total":  total,
+		"offset": request.Offset,
+		"limit":  request.Limit,
+	})
+}
+
+func (c *AdminController) Create(context *gin.Context) {
+	var request CreateUserRequest
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "AdminController.Create")
+	defer span.End()
+
+	if err := context.ShouldBindJSON(&request); err != nil {
+		problem.Abort(context, bindingProblem(err))
+		return
+	}
+
+	user, err := c.userService.Create(context.Request.Context(), store.User{
+		Username:      request.Username,
+		Email:         request.Email,
+		EmailVerified: request.EmailVerified,
+		Roles:         request.Roles,
+		Scopes:        request.Scopes,
+	}, request.Password)
+	recordAudit(context, auditOutcome(audit.Event{Type: audit.EventUserCreated, Subject: request.Username}, err))
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+	context.JSON(http.StatusCreated, adminUserResponse(user))
+}
+
+func (c *AdminController) Get(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "AdminController.Get")
+	defer span.End()
+
+	user, err := c.userService.Get(context.Request.Context(), context.Param("username"))
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+	context.JSON(http.StatusOK, adminUserResponse(user))
+}
+
+// Update changes a user's email address, or whether it's verified. A new
+// address is unverified unless the request says otherwise.
+func (c *AdminController) Update(context *gin.Context) {
+	var request UpdateUserRequest
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "AdminController.Update")
+	defer span.End()
+
+	if err := context.ShouldBindJSON(&request); err != nil {
+		problem.Abort(context, bindingProblem(err))
+		return
+	}
+
+	username := context.Param("username")
+	user, err := c.userService.Update(context.Request.Context(), username, tokenservice.UserUpdate{
+		Email:         request.Email,
+		EmailVerified: request.EmailVerified,
+	})
+	recordAudit(context, auditOutcome(audit.Event{Type: audit.EventUserUpdated, Subject: username}, err))
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+	context.JSON(http.StatusOK, adminUserResponse(user))
+}
+
+// Delete removes a user and signs them out everywhere. Their API keys are
+// deleted along with them.
+func (c *AdminController) Delete(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "AdminController.Delete")
+	defer span.End()
+
+	username, ok := c.notSelf(context, "Admins can't delete themselves")
+	if !ok {
+		return
+	}
+
+	err := c.userService.Delete(context.Request.Context(), username)
+	recordAudit(context, auditOutcome(audit.Event{Type: audit.EventUserDeleted, Subject: username}, err))
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+	recordAudit(context, audit.Event{Type: audit.EventSessionsRevoked, Subject: username})
+	context.Status(http.StatusNoContent)
+}
+
+// SetRoles replaces a user's roles and scopes. They're signed out
+// everywhere, as refresh tokens would otherwise keep the old ones.
+func (c *AdminController) SetRoles(context *gin.Context) {
+	var request SetUserRolesRequest
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "AdminController.SetRoles")
+	defer span.End()
+
+	if err := context.ShouldBindJSON(&request); err != nil {
+		problem.Abort(context, bindingProblem(err))
+		return
+	}
+
+	username := context.Param("username")
+	user, err := c.userService.SetRoles(context.Request.Context(), username, request.Roles, request.Scopes)
+	recordAudit(context, auditOutcome(audit.Event{Type: audit.EventUserRolesSet, Subject: username}, err))
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+	recordAudit(context, audit.Event{Type: audit.EventSessionsRevoked, Subject: username})
+	context.JSON(http.StatusOK, adminUserResponse(user))
+}
+
+// Disable stops a user logging in, and revokes their refresh tokens so
+// they're signed out as soon as their access tokens expire
+func (c *AdminController) Disable(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "AdminController.Disable")
+	defer span.End()
+
+	username, ok := c.notSelf(context, "Admins can't disable themselves")
+	if !ok {
+		return
+	}
+	c.setDisabled(context, username, true, audit.EventUserDisabled)
+}
+
+func (c *AdminController) Enable(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "AdminController.Enable")
+	defer span.End()
+
+	c.setDisabled(context, context.Param("username"), false, audit.EventUserEnabled)
+}
+
+func (c *AdminController) setDisabled(context *gin.Context, username string, disabled bool, eventType string) {
+	err := c.userService.SetDisabled(context.Request.Context(), username, disabled)
+	recordAudit(context, auditOutcome(audit.Event{Type: eventType, Subject: username}, err))
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+	if disabled {
+		recordAudit(context, audit.Event{Type: audit.EventSessionsRevoked, Subject: username})
+	}
+
+	user, err := c.userService.Get(context.Request.Context(), username)
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+	context.JSON(http.StatusOK, adminUserResponse(user))
+}
+
+// RequirePasswordReset stops a user's password from working, signs them
+// out everywhere, and emails them a token to choose a new one
+func (c *AdminController) RequirePasswordReset(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "AdminController.RequirePasswordReset")
+	defer span.End()
+
+	username := context.Param("username")
+	err := c.userService.RequirePasswordReset(context.Request.Context(), username)
+	recordAudit(context, auditOutcome(audit.Event{Type: audit.EventUserPasswordResetRequired, Subject: username}, err))
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+	recordAudit(context, audit.Event{Type: audit.EventSessionsRevoked, Subject: username})
+	context.Status(http.StatusNoContent)
+}
+
+// Unlock ends a lockout after too many failed logins
+func (c *AdminController) Unlock(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "AdminController.Unlock")
+	defer span.End()
+
+	username := context.Param("username")
+	user, err := c.userService.Unlock(context.Request.Context(), username)
+	recordAudit(context, auditOutcome(audit.Event{Type: audit.EventUserUnlocked, Subject: username}, err))
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+	context.JSON(http.StatusOK, adminUserResponse(user))
+}
+
+// Sessions lists a user's refresh tokens, newest first, by IDs that can't
+// be used as tokens
+func (c *AdminController) Sessions(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "AdminController.Sessions")
+	defer span.End()
+
+	sessions, err := c.userService.Sessions(context.Request.Context(), context.Param("username"))
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+	response := make([]gin.H, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, gin.H{
+			"id":         session.ID,
+			"issued_at":  session.IssuedAt,
+			"expires_at": session.ExpiresAt,
+			"bound":      session.Bound,
+		})
+	}
+	context.JSON(http.StatusOK, gin.H{"sessions": response})
+}
+
+// RevokeSession revokes one of a user's refresh tokens. Access tokens
+// issued with it keep working until they expire.
+func (c *AdminController) RevokeSession(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "AdminController.RevokeSession")
+	defer span.End()
+
+	username := context.Param("username")
+	err := c.userService.RevokeSession(context.Request.Context(), username, context.Param("id"))
+	recordAudit(context, auditOutcome(audit.Event{Type: audit.EventSessionsRevoked, Subject: username}, err))
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+	context.Status(http.StatusNoContent)
+}
+
+// RevokeSessions signs a user out everywhere
+func (c *AdminController) RevokeSessions(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "AdminController.RevokeSessions")
+	defer span.End()
+
+	username := context.Param("username")
+	err := c.userService.RevokeSessions(context.Request.Context(), username)
+	recordAudit(context, auditOutcome(audit.Event{Type: audit.EventSessionsRevoked, Subject: username}, err))
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+	context.Status(http.StatusNoContent)
+}
+
+// Clients lists the OAuth clients registered in CLIENTS
+func (c *AdminController) Clients(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "AdminController.Clients")
+	defer span.End()
+
+	clients := c.config.Get().Clients
+	response := make([]gin.H, 0, len(clients))
+	for _, client := range clients {
+		response = append(response, gin.H{
+			"client_id":                  client.ClientID,
+			"token_endpoint_auth_method": client.AuthMethod,
+			"tls_client_auth_subject_dn": client.SubjectDN,
+			"tls_client_auth_san_dns":    client.SANDNS,
+			"roles":                      nonNil(client.Roles),
+			"scopes":                     nonNil(client.Scopes),
+		})
+	}
+	context.JSON(http.StatusOK, gin.H{"clients": response})
+}
+
+// notSelf returns the username in the path, refusing admins acting on
+// themselves, so they can't lock everyone out by accident
+func (c *AdminController) notSelf(context *gin.Context, detail string) (string, bool) {
+	jwtUser, _ := context.MustGet("user").(tokenservice.JWTUser)
+	username := context.Param("username")
+	if jwtUser.ClientID == "" && strings.EqualFold(jwtUser.Username, username) {
+		problem.Abort(context, problem.New(problem.Forbidden, detail))
+		return "", false
+	}
+	return username, true
+}
+
+// adminUserResponse describes a user, leaving out their password hash
+func adminUserResponse(user store.User) gin.H {
+	response := gin.H{
+		"id":             user.ID,
+		"username":       user.Username,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+		"disabled":       user.Disabled,
+		"roles":          nonNil(user.Roles),
+		"scopes":         nonNil(user.Scopes),
+		"failed_logins":  user.FailedLogins,
+		"locked_until":   nil,
+		"created_at":     user.CreatedAt,
+		"updated_at":     user.UpdatedAt,
+	}
+	if user.Locked(time.Now().UTC()) {
+		response["locked_until"] = user.LockedUntil
+	}
+	return response
+}
+
+// nonNil returns an empty list for nil, so it's sent as [] rather than null
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
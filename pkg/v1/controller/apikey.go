@@ -0,0 +1,295 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"auth-server/pkg/audit"
+	"auth-server/pkg/config"
+	"auth-server/pkg/problem"
+	"auth-server/pkg/store"
+	tokenservice "auth-server/pkg/v1/service"
+)
+
+const (
+	apiKeysRoute string = "/apikeys"
+	apiKeyRoute  string = "/apikeys/:id"
+)
+
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	// OwnerType and Owner let admins create keys for other users, or for clients
+	OwnerType string `json:"owner_type"`
+	Owner     string `json:"owner"`
+}
+
+type UpdateAPIKeyRequest struct {
+	Name      *string    `json:"name"`
+	Scopes    *[]string  `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type APIKeyController struct {
+	log           *log.Entry
+	group         *gin.RouterGroup
+	config        *config.Holder
+	apiKeyService tokenservice.APIKeyService
+	authorize     gin.HandlerFunc
+}
+
+// NewAPIKeyController registers the API key routes. Users manage their own
+// keys; admins can manage anyone's.
+func NewAPIKeyController(group *gin.RouterGroup, config *config.Holder, apiKeyService tokenservice.APIKeyService, authorize gin.HandlerFunc) *APIKeyController {
+	apiKeyController := &APIKeyController{
+		log:           log.WithFields(log.Fields{"logger": "APIKeyControllerV1"}),
+		group:         group,
+		config:        config,
+		apiKeyService: apiKeyService,
+		authorize:     authorize,
+	}
+	apiKeyController.registerRoutes()
+	return apiKeyController
+}
+
+func (c *APIKeyController) registerRoutes() {
+	c.group.POST(apiKeysRoute, c.authorize, c.Create)
+	c.group.GET(apiKeysRoute, c.authorize, c.List)
+	c.group.GET(apiKeyRoute, c.authorize, c.Get)
+	c.group.PATCH(apiKeyRoute, c.authorize, c.Update)
+	c.group.DELETE(apiKeyRoute, c.authorize, c.Delete)
+}
+
+func (c *APIKeyController) Create(context *gin.Context) {
+	var request CreateAPIKeyRequest
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "APIKeyController.Create")
+	defer span.End()
+
+	if err := context.ShouldBindJSON(&request); err != nil {
+		problem.Abort(context, bindingProblem(err))
+		return
+	}
+
+	jwtUser, ok := c.caller(context)
+	if !ok {
+		return
+	}
+
+	ownerType, owner := store.OwnerUser, jwtUser.Username
+	if request.OwnerType != "" || request.Owner != "" {
+		if !jwtUser.HasRole(c.config.Get().AdminRole) {
+			problem.Abort(context, problem.New(problem.Forbidden, "Only admins can create keys for others"))
+			return
+		}
+		if request.OwnerType != store.OwnerUser && request.OwnerType != store.OwnerClient || request.Owner == "" {
+			problem.Abort(context, problem.New(problem.InvalidRequest, "owner_type must be \"user\" or \"client\", with an owner"))
+			return
+		}
+		ownerType, owner = request.OwnerType, request.Owner
+	} else if !jwtUser.HasRole(c.config.Get().AdminRole) {
+		// Users can't give their keys more than they have themselves
+		for _, scope := range request.Scopes {
+			if !jwtUser.HasScope(scope) {
+				problem.Abort(context, problem.New(problem.Forbidden, "Keys can't have scopes you don't have"))
+				return
+			}
+		}
+	}
+
+	var expiresAt time.Time
+	if request.ExpiresAt != nil {
+		expiresAt = request.ExpiresAt.UTC()
+	}
+
+	key, rawKey, err := c.apiKeyService.Create(context.Request.Context(), ownerType, owner, request.Name, request.Scopes, expiresAt)
+	recordAudit(context, auditOutcome(audit.Event{Type: audit.EventAPIKeyCreated, Subject: owner, Resource: key.ID}, err))
+	if err != nil {
+		problem.Abort(context, problem.Wrap(problem.Internal, err))
+		return
+	}
+
+	response := apiKeyResponse(key)
+	// The full key is never shown again
+	response["key"] = rawKey
+	context.JSON(http.StatusCreated, response)
+}
+
+func (c *APIKeyController) List(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "APIKeyController.List")
+	defer span.End()
+
+	jwtUser, ok := c.caller(context)
+	if !ok {
+		return
+	}
+
+	ownerType, owner := store.OwnerUser, jwtUser.Username
+	if context.Query("owner_type") != "" && jwtUser.HasRole(c.config.Get().AdminRole) {
+		ownerType, owner = context.Query("owner_type"), context.Query("owner")
+	}
+
+	keys, err := c.apiKeyService.List(context.Request.Context(), ownerType, owner)
+	if err != nil {
+		problem.Abort(context, problem.Wrap(problem.Internal, err))
+		return
+	}
+
+	response := make([]gin.H, 0, len(keys))
+	for _, key := range keys {
+		response = append(response, apiKeyResponse(key))
+	}
+	context.JSON(http.StatusOK, gin.H{"api_keys": response})
+}
+
+func (c *APIKeyController) Get(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "APIKeyController.Get")
+	defer span.End()
+
+	key, ok := c.lookup(context)
+	if !ok {
+		return
+	}
+	context.JSON(http.StatusOK, apiKeyResponse(key))
+}
+
+func (c *APIKeyController) Update(context *gin.Context) {
+	var request UpdateAPIKeyRequest
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "APIKeyController.Update")
+	defer span.End()
+
+	if err := context.ShouldBindJSON(&request); err != nil {
+		problem.Abort(context, bindingProblem(err))
+		return
+	}
+
+	key, ok := c.lookup(context)
+	if !ok {
+		return
+	}
+
+	jwtUser, _ := context.MustGet("user").(tokenservice.JWTUser)
+	if request.Name != nil {
+		key.Name = *request.Name
+	}
+	if request.Scopes != nil {
+		if !jwtUser.HasRole(c.config.Get().AdminRole) {
+			for _, scope := range *request.Scopes {
+				if !jwtUser.HasScope(scope) {
+					problem.Abort(context, problem.New(problem.Forbidden, "Keys can't have scopes you don't have"))
+					return
+				}
+			}
+		}
+		key.Scopes = *request.Scopes
+	}
+	if request.ExpiresAt != nil {
+		key.ExpiresAt = request.ExpiresAt.UTC()
+	}
+
+	err := c.apiKeyService.Update(context.Request.Context(), key)
+	recordAudit(context, auditOutcome(audit.Event{Type: audit.EventAPIKeyUpdated, Subject: key.Owner, Resource: key.ID}, err))
+	if err != nil {
+		problem.Abort(context, problem.Wrap(problem.Internal, err))
+		return
+	}
+	context.JSON(http.StatusOK, apiKeyResponse(key))
+}
+
+func (c *APIKeyController) Delete(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "APIKeyController.Delete")
+	defer span.End()
+
+	key, ok := c.lookup(context)
+	if !ok {
+		return
+	}
+
+	err := c.apiKeyService.Delete(context.Request.Context(), key.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		err = nil
+	}
+	recordAudit(context, auditOutcome(audit.Event{Type: audit.EventAPIKeyDeleted, Subject: key.Owner, Resource: key.ID}, err))
+	if err != nil {
+		problem.Abort(context, problem.Wrap(problem.Internal, err))
+		return
+	}
+	context.Status(http.StatusNoContent)
+}
+
+// caller returns the authenticated user, refusing clients, which can't manage
+// keys. Callers using an API key are refused too, so a key can't be used to
+// make keys that outlive it.
+func (c *APIKeyController) caller(context *gin.Context) (tokenservice.JWTUser, bool) {
+	jwtUser, _ := context.MustGet("user").(tokenservice.JWTUser)
+	if jwtUser.ClientID != "" {
+		problem.Abort(context, problem.New(problem.Forbidden, "Clients can't manage API keys"))
+		return tokenservice.JWTUser{}, false
+	}
+	if context.GetBool("api_key") {
+		problem.Abort(context, problem.New(problem.Forbidden, "API keys can't be used to manage API keys"))
+		return tokenservice.JWTUser{}, false
+	}
+	return jwtUser, true
+}
+
+// lookup finds the key named in the path, if the caller is allowed to see it
+func (c *APIKeyController) lookup(context *gin.Context) (store.APIKey, bool) {
+	jwtUser, ok := c.caller(context)
+	if !ok {
+		return store.APIKey{}, false
+	}
+
+	key, err := c.apiKeyService.Get(context.Request.Context(), context.Param("id"))
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		problem.Abort(context, problem.Wrap(problem.Internal, err))
+		return store.APIKey{}, false
+	}
+
+	owned := key.OwnerType == store.OwnerUser && key.Owner == jwtUser.Username
+	if err != nil || !(owned || jwtUser.HasRole(c.config.Get().AdminRole)) {
+		// Keys belonging to others look the same as missing ones
+		problem.Abort(context, problem.New(problem.NotFound, store.ErrNotFound.Error()))
+		return store.APIKey{}, false
+	}
+	return key, true
+}
+
+// apiKeyResponse describes a key without its secret hash
+func apiKeyResponse(key store.APIKey) gin.H {
+	scopes := key.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
+	response := gin.H{
+		"id":           key.ID,
+		"name":         key.Name,
+		"owner_type":   key.OwnerType,
+		"owner":        key.Owner,
+		"scopes":       scopes,
+		"created_at":   key.CreatedAt,
+		"expires_at":   nil,
+		"last_used_at": nil,
+	}
+	if !key.ExpiresAt.IsZero() {
+		response["expires_at"] = key.ExpiresAt
+	}
+	if !key.LastUsedAt.IsZero() {
+		response["last_used_at"] = key.LastUsedAt
+	}
+	return response
+}
@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"auth-server/pkg/audit"
+	tokenservice "auth-server/pkg/v1/service"
+)
+
+// recordAudit records a security event, adding where the request came from
+// and, once AuthorizeToken has run, who made it. Failing to record an event
+// doesn't fail the request, but is logged.
+func recordAudit(context *gin.Context, event audit.Event) {
+	sink, ok := context.Value("audit").(audit.AuditSink)
+	if !ok {
+		return
+	}
+	event.IP = context.ClientIP()
+	event.UserAgent = context.Request.UserAgent()
+	event.RequestID = context.GetString("request_id")
+	if jwtUser, ok := context.Value("user").(tokenservice.JWTUser); ok {
+		if event.Actor == "" {
+			event.Actor = jwtUser.Username
+		}
+		if event.Client == "" {
+			event.Client = jwtUser.ClientID
+		}
+	}
+	if err := sink.Record(context.Request.Context(), event); err != nil {
+		requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+		requestLogger.WithError(err).WithField("event", event.Type).Error("Failed to record audit event")
+	}
+}
+
+// auditOutcome is the outcome of an event that failed with err, if it did
+func auditOutcome(event audit.Event, err error) audit.Event {
+	if err != nil {
+		event.Outcome = audit.OutcomeFailure
+		event.Reason = err.Error()
+	}
+	return event
+}
@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+
+	"auth-server/pkg/dpop"
+	"auth-server/pkg/problem"
+	tokenservice "auth-server/pkg/v1/service"
+)
+
+// tokenTypeDPoP is the token_type of access tokens bound to a DPoP key
+const tokenTypeDPoP string = "DPoP"
+
+// dpopProof checks the DPoP proof sent to a token endpoint, if there is
+// one, returning the thumbprint of the key tokens should be bound to. On
+// failure the response has been sent, with the codes RFC 9449 uses.
+func dpopProof(context *gin.Context, dpopService tokenservice.DPoPService) (string, bool) {
+	proofs := context.Request.Header.Values(dpop.Header)
+	if len(proofs) == 0 {
+		return "", true
+	}
+	if len(proofs) > 1 {
+		problem.Abort(context, &problem.Error{Problem: problem.InvalidDPoPProof, Detail: fmt.Sprintf("Only one %s header is allowed", dpop.Header), Scheme: dpop.Scheme})
+		return "", false
+	}
+
+	thumbprint, err := dpopService.Verify(proofs[0], context.Request.Method, context.Request.URL.Path, "")
+	if nonce := dpopService.Nonce(); nonce != "" {
+		context.Header(dpop.NonceHeader, nonce)
+	}
+	if errors.Is(err, dpop.ErrUseNonce) {
+		problem.Abort(context, &problem.Error{Problem: problem.UseDPoPNonce, Scheme: dpop.Scheme})
+		return "", false
+	}
+	if err != nil {
+		problem.Abort(context, &problem.Error{Problem: problem.InvalidDPoPProof, Cause: err, Scheme: dpop.Scheme})
+		return "", false
+	}
+	return thumbprint, true
+}
+
+// dpopConfirmation binds tokens to a DPoP key, when there is one
+func dpopConfirmation(thumbprint string) *tokenservice.Confirmation {
+	if thumbprint == "" {
+		return nil
+	}
+	return &tokenservice.Confirmation{KeyThumbprint: thumbprint}
+}
+
+// tokenResponse adds token_type to a response when its tokens are bound to
+// a DPoP key, so clients know to send them with the DPoP scheme
+func tokenResponse(response gin.H, thumbprint string) gin.H {
+	if thumbprint != "" {
+		response["token_type"] = tokenTypeDPoP
+	}
+	return response
+}
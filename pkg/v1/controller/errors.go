@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+
+	"auth-server/pkg/password"
+	"auth-server/pkg/problem"
+	"auth-server/pkg/store"
+	tokenservice "auth-server/pkg/v1/service"
+)
+
+// serviceProblems maps the errors services return to what clients are told.
+// Their messages are returned, as they're written for clients.
+var serviceProblems = []struct {
+	err     error
+	problem problem.Problem
+}{
+	{tokenservice.ErrUserExists, problem.Conflict},
+	{tokenservice.ErrInvalidCredentials, problem.InvalidCredentials},
+	{tokenservice.ErrEmailNotVerified, problem.EmailNotVerified},
+	{tokenservice.ErrIncorrectPassword, problem.IncorrectPassword},
+	{tokenservice.ErrUserDisabled, problem.UserDisabled},
+	{tokenservice.ErrUserLocked, problem.UserLocked},
+	{tokenservice.ErrInvalidUsername, problem.InvalidRequest},
+	{tokenservice.ErrInvalidEmail, problem.InvalidRequest},
+	{tokenservice.ErrInvalidActionToken, problem.InvalidActionToken},
+	{tokenservice.ErrInvalidEmailLogin, problem.InvalidCredentials},
+	{tokenservice.ErrTooManyEmailLogins, problem.TooManyRequests},
+	{tokenservice.ErrUnknownEmailLoginMethod, problem.InvalidRequest},
+	{tokenservice.ErrInvalidRefreshToken, problem.TokenRevoked},
+	{tokenservice.ErrSessionNotFound, problem.NotFound},
+	{tokenservice.ErrInvalidAPIKey, problem.InvalidAPIKey},
+	{store.ErrNotFound, problem.NotFound},
+	{store.ErrConflict, problem.Conflict},
+}
+
+func init() {
+	// Name fields in binding errors the way clients send them
+	if validate, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+			for _, tag := range []string{"json", "form"} {
+				if name := strings.SplitN(field.Tag.Get(tag), ",", 2)[0]; name != "" && name != "-" {
+					return name
+				}
+			}
+			return field.Name
+		})
+	}
+}
+
+// serviceProblem is the problem to respond with for an error from a
+// service. Errors it doesn't know are internal.
+func serviceProblem(err error) *problem.Error {
+	var policyError *password.PolicyError
+	if errors.As(err, &policyError) {
+		return &problem.Error{Problem: problem.WeakPassword, Detail: policyError.Error(), Violations: policyError.Violations}
+	}
+	for _, known := range serviceProblems {
+		if errors.Is(err, known.err) {
+			return problem.New(known.problem, known.err.Error())
+		}
+	}
+	return problem.Wrap(problem.Internal, err)
+}
+
+// bindingProblem describes a request that couldn't be bound, naming the
+// fields that failed validation rather than returning the validator's text
+func bindingProblem(err error) *problem.Error {
+	problemErr := problem.Wrap(problem.InvalidRequest, err)
+
+	var validationErrors validator.ValidationErrors
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &validationErrors):
+		for _, fieldError := range validationErrors {
+			problemErr.InvalidParams = append(problemErr.InvalidParams, problem.InvalidParam{Name: fieldError.Field(), Reason: fieldError.Tag()})
+		}
+		problemErr.Detail = "Some fields are missing or invalid"
+	case errors.As(err, &syntaxError):
+		problemErr.Detail = "The request body isn't valid JSON"
+	case errors.As(err, &typeError):
+		problemErr.Detail = fmt.Sprintf("%s must be a %s", typeError.Field, typeError.Type)
+	}
+	return problemErr
+}
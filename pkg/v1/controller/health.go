@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"auth-server/pkg/version"
+)
+
+const (
+	healthRoute  string = "/healthz"
+	readyRoute   string = "/readyz"
+	versionRoute string = "/version"
+
+	checkOK      string = "ok"
+	checkFailing string = "failing"
+)
+
+// ReadinessCheck is one thing that must work before the server can take requests
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// HealthController answers orchestrators' probes, and says which build is
+// running. Its routes don't need a token.
+type HealthController struct {
+	log    *log.Entry
+	group  *gin.RouterGroup
+	checks []ReadinessCheck
+}
+
+func NewHealthController(group *gin.RouterGroup, checks []ReadinessCheck) *HealthController {
+	healthController := &HealthController{
+		log:    log.WithFields(log.Fields{"logger": "HealthControllerV1"}),
+		group:  group,
+		checks: checks,
+	}
+	healthController.registerRoutes()
+	return healthController
+}
+
+func (c *HealthController) registerRoutes() {
+	c.group.GET(healthRoute, c.Health)
+	c.group.GET(readyRoute, c.Ready)
+	c.group.GET(versionRoute, c.Version)
+}
+
+// Health says the process is alive. It doesn't check anything else, so a
+// failing store doesn't get the process restarted.
+func (c *HealthController) Health(context *gin.Context) {
+	// Probes are frequent, so they're only logged at debug level
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Debug("Handling request")
+
+	context.JSON(http.StatusOK, gin.H{"status": checkOK})
+}
+
+// Ready runs every readiness check, answering 503 when any fails. Why a
+// check failed is logged rather than returned, as anyone can ask.
+func (c *HealthController) Ready(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Debug("Handling request")
+	span := startSpan(context, "HealthController.Ready")
+	defer span.End()
+
+	status, checks := http.StatusOK, gin.H{}
+	for _, check := range c.checks {
+		if err := check.Check(context.Request.Context()); err != nil {
+			requestLogger.WithError(err).WithField("check", check.Name).Warn("Readiness check failed")
+			status, checks[check.Name] = http.StatusServiceUnavailable, gin.H{"status": checkFailing}
+			continue
+		}
+		checks[check.Name] = gin.H{"status": checkOK}
+	}
+
+	overall := checkOK
+	if status != http.StatusOK {
+		overall = checkFailing
+	}
+	context.JSON(status, gin.H{"status": overall, "checks": checks})
+}
+
+// Version returns the version, commit and build date of the running binary
+func (c *HealthController) Version(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Debug("Handling request")
+
+	context.JSON(http.StatusOK, version.Get())
+}
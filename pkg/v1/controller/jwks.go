@@ -0,0 +1,46 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	tokenservice "auth-server/pkg/v1/service"
+)
+
+const (
+	jwksRoute string = "/jwks.json"
+)
+
+// JWKSController publishes the public keys access tokens are signed with
+type JWKSController struct {
+	log        *log.Entry
+	group      *gin.RouterGroup
+	jwtService tokenservice.JWTService
+}
+
+func NewJWKSController(group *gin.RouterGroup, jwtService tokenservice.JWTService) *JWKSController {
+	jwksController := &JWKSController{
+		log:        log.WithFields(log.Fields{"logger": "JWKSControllerV1"}),
+		group:      group,
+		jwtService: jwtService,
+	}
+	jwksController.registerRoutes()
+	return jwksController
+}
+
+func (c *JWKSController) registerRoutes() {
+	c.group.GET(jwksRoute, c.JWKS)
+}
+
+func (c *JWKSController) JWKS(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "JWKSController.JWKS")
+	defer span.End()
+
+	// Resource servers fetch these again when they see a new key ID
+	context.Header("Cache-Control", "public, max-age=300")
+	context.JSON(http.StatusOK, c.jwtService.JWKS())
+}
@@ -6,6 +6,10 @@ import (
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 
+	"auth-server/pkg/audit"
+	"auth-server/pkg/metrics"
+	"auth-server/pkg/problem"
+	"auth-server/pkg/v1/middleware"
 	tokenservice "auth-server/pkg/v1/service"
 )
 
@@ -19,16 +23,20 @@ type LoginRequest struct {
 }
 
 type LoginController struct {
-	log        *log.Entry
-	group      *gin.RouterGroup
-	jwtService tokenservice.JWTService
+	log         *log.Entry
+	group       *gin.RouterGroup
+	jwtService  tokenservice.JWTService
+	userService tokenservice.UserService
+	dpopService tokenservice.DPoPService
 }
 
-func NewLoginController(group *gin.RouterGroup, jwtService tokenservice.JWTService) *LoginController {
+func NewLoginController(group *gin.RouterGroup, jwtService tokenservice.JWTService, userService tokenservice.UserService, dpopService tokenservice.DPoPService) *LoginController {
 	loginController := &LoginController{
-		log:        log.WithFields(log.Fields{"logger": "LoginControllerV1"}),
-		group:      group,
-		jwtService: jwtService,
+		log:         log.WithFields(log.Fields{"logger": "LoginControllerV1"}),
+		group:       group,
+		jwtService:  jwtService,
+		userService: userService,
+		dpopService: dpopService,
 	}
 	loginController.registerRoutes()
 	return loginController
@@ -39,26 +47,44 @@ func (c *LoginController) registerRoutes() {
 	c.group.POST(loginRoute, c.Login)
 }
 
+// Login issues tokens for a username and password. When a DPoP proof is
+// sent, both tokens are bound to its key.
 func (c *LoginController) Login(context *gin.Context) {
 	var request LoginRequest
 	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
 	requestLogger.Info("Handling request")
+	span := startSpan(context, "LoginController.Login")
+	defer span.End()
 
 	if err := context.ShouldBindJSON(&request); err != nil {
-		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		problem.Abort(context, bindingProblem(err))
+		return
+	}
+	thumbprint, valid := dpopProof(context, c.dpopService)
+	if !valid {
 		return
 	}
 
-	// TODO: Authenticate User
+	jwtUser, err := c.userService.Authenticate(context.Request.Context(), request.Username, request.Password)
+	countLogin(metrics.GrantPassword, err)
+	recordAudit(context, auditOutcome(audit.Event{Type: audit.EventLogin, Actor: request.Username, Subject: request.Username, Method: metrics.GrantPassword}, err))
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+	middleware.LogCaller(context, jwtUser)
 
 	// Generate JWTs
-	accessToken, refreshToken, err := c.jwtService.GenerateToken(tokenservice.JWTUser{Username: request.Username}, true)
+	accessToken, refreshToken, err := c.jwtService.GenerateBoundToken(context.Request.Context(), jwtUser, true, dpopConfirmation(thumbprint))
 	if err != nil {
-		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		problem.Abort(context, problem.Wrap(problem.Internal, err))
+		return
 	}
+	countTokens(metrics.GrantPassword, refreshToken)
+	recordAudit(context, audit.Event{Type: audit.EventTokenIssued, Actor: jwtUser.Username, Subject: jwtUser.Username, Method: metrics.GrantPassword})
 
-	context.JSON(http.StatusOK, gin.H{
+	context.JSON(http.StatusOK, tokenResponse(gin.H{
 		"access_token":  accessToken,
 		"refresh_token": refreshToken,
-	})
+	}, thumbprint))
 }
@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"auth-server/pkg/audit"
+	"auth-server/pkg/config"
+	"auth-server/pkg/metrics"
+	"auth-server/pkg/problem"
+	"auth-server/pkg/v1/middleware"
+	tokenservice "auth-server/pkg/v1/service"
+)
+
+const (
+	emailLoginRoute       string = "/login/email"
+	emailLoginVerifyRoute string = "/login/email/verify"
+
+	// emailLoginCookie holds the nonce binding a link or code to the browser
+	emailLoginCookie string = "email_login_nonce"
+)
+
+type EmailLoginRequest struct {
+	Email string `json:"email" binding:"required"`
+	// Method is either "link" or "code"
+	Method string `json:"method" binding:"required"`
+}
+
+type EmailLoginVerifyRequest struct {
+	// Nonce may be left out when the browser sends the cookie instead
+	Nonce string `json:"nonce" form:"nonce"`
+	Code  string `json:"code" form:"code"`
+	Token string `json:"token" form:"token"`
+}
+
+type EmailLoginController struct {
+	log               *log.Entry
+	group             *gin.RouterGroup
+	config            *config.Holder
+	jwtService        tokenservice.JWTService
+	emailLoginService tokenservice.EmailLoginService
+	dpopService       tokenservice.DPoPService
+}
+
+func NewEmailLoginController(group *gin.RouterGroup, config *config.Holder, jwtService tokenservice.JWTService, emailLoginService tokenservice.EmailLoginService, dpopService tokenservice.DPoPService) *EmailLoginController {
+	emailLoginController := &EmailLoginController{
+		log:               log.WithFields(log.Fields{"logger": "EmailLoginControllerV1"}),
+		group:             group,
+		config:            config,
+		jwtService:        jwtService,
+		emailLoginService: emailLoginService,
+		dpopService:       dpopService,
+	}
+	emailLoginController.registerRoutes()
+	return emailLoginController
+}
+
+func (c *EmailLoginController) registerRoutes() {
+	c.group.POST(emailLoginRoute, c.Start)
+	// GET is used by the magic link
+	c.group.GET(emailLoginVerifyRoute, c.Verify)
+	c.group.POST(emailLoginVerifyRoute, c.Verify)
+}
+
+func (c *EmailLoginController) Start(context *gin.Context) {
+	var request EmailLoginRequest
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "EmailLoginController.Start")
+	defer span.End()
+
+	if err := context.ShouldBindJSON(&request); err != nil {
+		problem.Abort(context, bindingProblem(err))
+		return
+	}
+
+	nonce, err := c.emailLoginService.Start(context.Request.Context(), request.Email, request.Method)
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+
+	// Lax, so the cookie is still sent when following the link from an email
+	context.SetSameSite(http.SameSiteLaxMode)
+	context.SetCookie(
+		emailLoginCookie, nonce, int(c.config.Get().EmailLogin.Expire.Seconds()), "/v1"+emailLoginRoute, "",
+		strings.HasPrefix(c.config.Get().PublicURL, "https://"), true,
+	)
+	context.JSON(http.StatusAccepted, gin.H{"nonce": nonce})
+}
+
+// Verify issues tokens for a code or link. When a DPoP proof is sent, both
+// tokens are bound to its key.
+func (c *EmailLoginController) Verify(context *gin.Context) {
+	var request EmailLoginVerifyRequest
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "EmailLoginController.Verify")
+	defer span.End()
+
+	// Links from emails put everything in the query string
+	bind := context.ShouldBindJSON
+	if context.Request.Method == http.MethodGet {
+		bind = context.ShouldBindQuery
+	}
+	if err := bind(&request); err != nil {
+		problem.Abort(context, bindingProblem(err))
+		return
+	}
+	if request.Nonce == "" {
+		request.Nonce, _ = context.Cookie(emailLoginCookie)
+	}
+	if request.Nonce == "" || (request.Code == "") == (request.Token == "") {
+		problem.Abort(context, problem.New(problem.InvalidRequest, "A nonce and either a code or a token are required"))
+		return
+	}
+	thumbprint, valid := dpopProof(context, c.dpopService)
+	if !valid {
+		return
+	}
+
+	var jwtUser tokenservice.JWTUser
+	var err error
+	if request.Code != "" {
+		jwtUser, err = c.emailLoginService.VerifyCode(context.Request.Context(), request.Nonce, request.Code)
+	} else {
+		jwtUser, err = c.emailLoginService.VerifyLink(context.Request.Context(), request.Nonce, request.Token)
+	}
+	countLogin(metrics.GrantEmail, err)
+	recordAudit(context, auditOutcome(audit.Event{Type: audit.EventLogin, Actor: jwtUser.Username, Subject: jwtUser.Username, Method: metrics.GrantEmail}, err))
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+	middleware.LogCaller(context, jwtUser)
+
+	// Generate JWTs
+	accessToken, refreshToken, err := c.jwtService.GenerateBoundToken(context.Request.Context(), jwtUser, true, dpopConfirmation(thumbprint))
+	if err != nil {
+		problem.Abort(context, problem.Wrap(problem.Internal, err))
+		return
+	}
+	countTokens(metrics.GrantEmail, refreshToken)
+	recordAudit(context, audit.Event{Type: audit.EventTokenIssued, Actor: jwtUser.Username, Subject: jwtUser.Username, Method: metrics.GrantEmail})
+
+	// The nonce has done its job
+	context.SetCookie(emailLoginCookie, "", -1, "/v1"+emailLoginRoute, "", false, true)
+	context.JSON(http.StatusOK, tokenResponse(gin.H{
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+	}, thumbprint))
+}
@@ -6,6 +6,9 @@ import (
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 
+	"auth-server/pkg/audit"
+	"auth-server/pkg/metrics"
+	"auth-server/pkg/problem"
 	tokenservice "auth-server/pkg/v1/service"
 )
 
@@ -42,13 +45,21 @@ func (c *LogoutController) Logout(context *gin.Context) {
 	var request LogoutRequest
 	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
 	requestLogger.Info("Handling request")
+	span := startSpan(context, "LogoutController.Logout")
+	defer span.End()
 
 	if err := context.ShouldBindJSON(&request); err != nil {
-		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		problem.Abort(context, bindingProblem(err))
 		return
 	}
 
-	// Generate JWTs
-	c.jwtService.RemoveRefreshToken(request.RefreshToken)
+	// Find whose session it was, for the audit log
+	event := audit.Event{Type: audit.EventLogout, Method: metrics.GrantRefreshToken}
+	if _, authClaims, err := c.jwtService.ValidateRefreshToken(context.Request.Context(), request.RefreshToken); err == nil {
+		event.Actor, event.Subject = authClaims.User.Username, authClaims.User.Username
+	}
+
+	c.jwtService.RemoveRefreshToken(context.Request.Context(), request.RefreshToken)
+	recordAudit(context, event)
 	context.Status(http.StatusNoContent)
 }
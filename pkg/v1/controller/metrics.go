@@ -0,0 +1,30 @@
+package controller
+
+import (
+	"errors"
+
+	"auth-server/pkg/metrics"
+	tokenservice "auth-server/pkg/v1/service"
+)
+
+// countLogin records the outcome of a login, by method
+func countLogin(method string, err error) {
+	outcome := metrics.OutcomeError
+	switch {
+	case err == nil:
+		outcome = metrics.OutcomeSuccess
+	case errors.Is(err, tokenservice.ErrInvalidCredentials), errors.Is(err, tokenservice.ErrInvalidEmailLogin):
+		outcome = metrics.OutcomeInvalidCredentials
+	case errors.Is(err, tokenservice.ErrEmailNotVerified), errors.Is(err, tokenservice.ErrUserDisabled), errors.Is(err, tokenservice.ErrUserLocked):
+		outcome = metrics.OutcomeForbidden
+	}
+	metrics.Logins.WithLabelValues(method, outcome).Inc()
+}
+
+// countTokens records the tokens issued for a grant
+func countTokens(grant string, refreshToken string) {
+	metrics.TokensIssued.WithLabelValues("access", grant).Inc()
+	if refreshToken != "" {
+		metrics.TokensIssued.WithLabelValues("refresh", grant).Inc()
+	}
+}
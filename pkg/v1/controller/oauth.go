@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"auth-server/pkg/audit"
+	"auth-server/pkg/config"
+	"auth-server/pkg/metrics"
+	"auth-server/pkg/problem"
+	"auth-server/pkg/v1/middleware"
+	tokenservice "auth-server/pkg/v1/service"
+)
+
+const (
+	oauthTokenRoute string = "/oauth/token"
+
+	grantTypeClientCredentials string = "client_credentials"
+)
+
+// OAuthController is the OAuth 2.0 token endpoint for registered clients.
+// Unlike the rest of the API, its errors follow RFC 6749, so off-the-shelf
+// OAuth libraries understand them.
+type OAuthController struct {
+	log           *log.Entry
+	group         *gin.RouterGroup
+	config        *config.Holder
+	jwtService    tokenservice.JWTService
+	clientService tokenservice.ClientService
+}
+
+func NewOAuthController(group *gin.RouterGroup, config *config.Holder, jwtService tokenservice.JWTService, clientService tokenservice.ClientService) *OAuthController {
+	oauthController := &OAuthController{
+		log:           log.WithFields(log.Fields{"logger": "OAuthControllerV1"}),
+		group:         group,
+		config:        config,
+		jwtService:    jwtService,
+		clientService: clientService,
+	}
+	oauthController.registerRoutes()
+	return oauthController
+}
+
+func (c *OAuthController) registerRoutes() {
+	c.group.POST(oauthTokenRoute, c.Token)
+}
+
+// Token issues an access token to a client authenticating with its TLS
+// client certificate (tls_client_auth, RFC 8705). The token is bound to the
+// certificate, so it's useless without it.
+func (c *OAuthController) Token(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "OAuthController.Token")
+	defer span.End()
+
+	if grantType := context.PostForm("grant_type"); grantType != grantTypeClientCredentials {
+		oauthError(context, http.StatusBadRequest, "unsupported_grant_type", "Only client_credentials is supported")
+		return
+	}
+	clientID := context.PostForm("client_id")
+	if clientID == "" {
+		oauthError(context, http.StatusBadRequest, "invalid_request", "Missing client_id")
+		return
+	}
+
+	certificate := middleware.ClientCertificate(context.Request)
+	jwtUser, err := c.clientService.Authenticate(clientID, certificate, strings.Fields(context.PostForm("scope")))
+	recordAudit(context, auditOutcome(audit.Event{Type: audit.EventTokenIssued, Actor: clientID, Client: clientID, Method: metrics.GrantClientCredentials}, err))
+	if errors.Is(err, tokenservice.ErrInvalidClient) {
+		oauthError(context, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+	if errors.Is(err, tokenservice.ErrInvalidScope) {
+		oauthError(context, http.StatusBadRequest, "invalid_scope", err.Error())
+		return
+	}
+	if err != nil {
+		oauthServerError(context, err)
+		return
+	}
+	middleware.LogCaller(context, jwtUser)
+
+	confirmation := &tokenservice.Confirmation{CertificateThumbprint: tokenservice.CertificateThumbprint(certificate)}
+	accessToken, _, err := c.jwtService.GenerateBoundToken(context.Request.Context(), jwtUser, false, confirmation)
+	if err != nil {
+		oauthServerError(context, err)
+		return
+	}
+	countTokens(metrics.GrantClientCredentials, "")
+
+	context.Header("Cache-Control", "no-store")
+	context.JSON(http.StatusOK, gin.H{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(c.config.Get().AccessTokenExpire.Seconds()),
+		"scope":        strings.Join(jwtUser.Scopes, " "),
+	})
+}
+
+// oauthError responds in the format RFC 6749 requires of token endpoints,
+// rather than as problem details, so OAuth client libraries understand it
+func oauthError(context *gin.Context, status int, code string, description string) {
+	context.Header("Cache-Control", "no-store")
+	body := gin.H{"error": code, "error_description": description}
+	if requestID := context.GetString("request_id"); requestID != "" {
+		body["request_id"] = requestID
+	}
+	context.AbortWithStatusJSON(status, body)
+}
+
+// oauthServerError responds with server_error. Like problem.Abort, err is
+// added to the request logger so it's logged with the request, but never
+// returned.
+func oauthServerError(context *gin.Context, err error) {
+	if requestLogger, ok := context.Value("request_logger").(*log.Entry); ok {
+		context.Set("request_logger", requestLogger.WithField("error_code", problem.Internal.Code).WithError(err))
+	}
+	oauthError(context, http.StatusInternalServerError, "server_error", problem.Internal.Title)
+}
@@ -0,0 +1,607 @@
+package controller
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"auth-server/pkg/config"
+	"auth-server/pkg/dpop"
+	"auth-server/pkg/openapi"
+	"auth-server/pkg/problem"
+	"auth-server/pkg/store"
+	"auth-server/pkg/version"
+)
+
+const (
+	openAPIRoute string = "/openapi.json"
+	docsRoute    string = "/docs"
+
+	jsonContentType string = "application/json"
+	formContentType string = "application/x-www-form-urlencoded"
+)
+
+// Security requirements
+var (
+	// tokenSecurity is what routes behind AuthorizeToken accept
+	tokenSecurity = []map[string][]string{{"bearer": {}}, {"dpop": {}}, {"apiKey": {}}, {"apiKeyHeader": {}}}
+	// accessSecurity is for routes that refuse API keys
+	accessSecurity = []map[string][]string{{"bearer": {}}, {"dpop": {}}}
+)
+
+var swaggerUIPage = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Auth Server API</title>
+  <link rel="stylesheet" href="{{.AssetsURL}}/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="{{.AssetsURL}}/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({url: "{{.SpecURL}}", dom_id: "#swagger-ui"});
+  </script>
+</body>
+</html>
+`))
+
+// OpenAPIController serves the OpenAPI document describing /v1, and
+// optionally a Swagger UI page for browsing it
+type OpenAPIController struct {
+	log    *log.Entry
+	group  *gin.RouterGroup
+	config *config.Holder
+}
+
+func NewOpenAPIController(group *gin.RouterGroup, config *config.Holder) *OpenAPIController {
+	openAPIController := &OpenAPIController{
+		log:    log.WithFields(log.Fields{"logger": "OpenAPIControllerV1"}),
+		group:  group,
+		config: config,
+	}
+	openAPIController.registerRoutes()
+	return openAPIController
+}
+
+func (c *OpenAPIController) registerRoutes() {
+	c.group.GET(openAPIRoute, c.Document)
+	c.group.GET(docsRoute, c.Docs)
+}
+
+// Document returns the OpenAPI document
+func (c *OpenAPIController) Document(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+
+	context.JSON(http.StatusOK, OpenAPIDocument(c.config.Get().PublicURL))
+}
+
+// Docs serves Swagger UI, when SWAGGER_UI is set
+func (c *OpenAPIController) Docs(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+
+	swaggerUI := c.config.Get().SwaggerUI
+	if !swaggerUI.Enabled {
+		problem.NotFoundHandler(context)
+		return
+	}
+	context.Header("Content-Type", "text/html; charset=utf-8")
+	context.Status(http.StatusOK)
+	err := swaggerUIPage.Execute(context.Writer, gin.H{"AssetsURL": swaggerUI.AssetsURL, "SpecURL": "/v1" + openAPIRoute})
+	if err != nil {
+		requestLogger.WithError(err).Error("Failed to render Swagger UI")
+	}
+}
+
+// OpenAPIDocument describes every /v1 route. Request bodies come from the
+// structs the handlers bind, so only responses need keeping up to date by
+// hand. The tests in pkg/app fail when a route or response drifts from it.
+func OpenAPIDocument(publicURL string) *openapi.Document {
+	document := &openapi.Document{
+		OpenAPI: openapi.Version,
+		Info: openapi.Info{
+			Title:       "Auth Server",
+			Description: "Issues and checks JWT access tokens. Errors are problem details (RFC 7807) with a stable code, except at /v1/oauth/token, which follows RFC 6749.",
+			Version:     version.Version,
+		},
+		Servers: []openapi.Server{{URL: publicURL}},
+		Tags: []openapi.Tag{
+			{Name: "tokens", Description: "Logging in, and refreshing and revoking tokens"},
+			{Name: "registration", Description: "Creating accounts and verifying email addresses"},
+			{Name: "passwords", Description: "Resetting and changing passwords"},
+			{Name: "api-keys", Description: "Long-lived keys that can be used instead of access tokens"},
+			{Name: "webhooks", Description: "Webhook deliveries, for admins"},
+			{Name: "admin", Description: "Managing users, for admins"},
+			{Name: "proxies", Description: "Answering reverse proxies about requests"},
+			{Name: "docs", Description: "This document"},
+		},
+		Paths: map[string]openapi.PathItem{},
+		Components: openapi.Components{
+			Schemas: map[string]*openapi.Schema{},
+			SecuritySchemes: map[string]openapi.SecurityScheme{
+				"bearer":       {Type: "http", Scheme: "bearer", BearerFormat: "JWT", Description: "An access token"},
+				"dpop":         {Type: "http", Scheme: dpop.Scheme, Description: "A DPoP-bound access token, sent with a proof in the DPoP header"},
+				"apiKey":       {Type: "apiKey", In: "header", Name: "X-API-Key", Description: "An API key"},
+				"apiKeyHeader": {Type: "http", Scheme: "ApiKey", Description: "An API key, in the Authorization header"},
+			},
+		},
+	}
+	addSchemas(document)
+
+	// Tokens
+	document.Paths["/v1/login"] = openapi.PathItem{"post": {
+		Tags: []string{"tokens"}, OperationID: "login", Summary: "Log in with a username and password",
+		Description: "Send a DPoP proof to bind both tokens to its key.",
+		Parameters:  []openapi.Parameter{dpopParameter()},
+		RequestBody: jsonBody(LoginRequest{}),
+		Responses: responses(
+			http.StatusOK, "Tokens", openapi.Ref("TokenResponse"),
+			http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden,
+		),
+	}}
+	document.Paths["/v1/token"] = openapi.PathItem{"post": {
+		Tags: []string{"tokens"}, OperationID: "refreshToken", Summary: "Get a new access token with a refresh token",
+		Description: "Refresh tokens bound to a DPoP key need a proof signed with it.",
+		Parameters:  []openapi.Parameter{dpopParameter()},
+		RequestBody: jsonBody(TokenRequest{}),
+		Responses: responses(
+			http.StatusOK, "A new access token", openapi.Ref("TokenResponse"),
+			http.StatusBadRequest, http.StatusUnauthorized,
+		),
+	}}
+	document.Paths["/v1/logout"] = openapi.PathItem{"delete": {
+		Tags: []string{"tokens"}, OperationID: "logout", Summary: "Revoke a refresh token",
+		RequestBody: jsonBody(LogoutRequest{}),
+		Responses:   responses(http.StatusNoContent, "Revoked", nil, http.StatusBadRequest),
+	}}
+	document.Paths["/v1/login/email"] = openapi.PathItem{"post": {
+		Tags: []string{"tokens"}, OperationID: "startEmailLogin", Summary: "Email a login link or code",
+		Description: "The nonce is also set as a cookie, and must be presented with the link or code.",
+		RequestBody: jsonBody(EmailLoginRequest{}),
+		Responses: responses(
+			http.StatusAccepted, "Sent, if the address belongs to a user", openapi.Object(map[string]*openapi.Schema{"nonce": openapi.String()}),
+			http.StatusBadRequest, http.StatusTooManyRequests,
+		),
+	}}
+	verifyEmailLogin := func(operationID string) *openapi.Operation {
+		return &openapi.Operation{
+			Tags: []string{"tokens"}, OperationID: operationID, Summary: "Log in with an emailed link or code",
+			Parameters: []openapi.Parameter{dpopParameter()},
+			Responses: responses(
+				http.StatusOK, "Tokens", openapi.Ref("TokenResponse"),
+				http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests,
+			),
+		}
+	}
+	document.Paths["/v1/login/email/verify"] = openapi.PathItem{
+		"get":  withQuery(verifyEmailLogin("verifyEmailLoginLink"), EmailLoginVerifyRequest{}),
+		"post": withBody(verifyEmailLogin("verifyEmailLogin"), EmailLoginVerifyRequest{}),
+	}
+	document.Paths["/v1/oauth/token"] = openapi.PathItem{"post": {
+		Tags: []string{"tokens"}, OperationID: "oauthToken", Summary: "Get an access token for a client",
+		Description: "The client_credentials grant, authenticating with a TLS client certificate (RFC 8705). Errors follow RFC 6749.",
+		RequestBody: &openapi.RequestBody{Required: true, Content: map[string]openapi.MediaType{formContentType: {Schema: &openapi.Schema{
+			Type: "object",
+			Properties: map[string]*openapi.Schema{
+				"grant_type": {Type: "string", Enum: []string{grantTypeClientCredentials}},
+				"client_id":  openapi.String(),
+				"scope":      {Type: "string", Description: "Space-separated scopes, a subset of the client's"},
+			},
+			Required: []string{"client_id", "grant_type"},
+		}}}},
+		Responses: map[string]openapi.Response{
+			"200": jsonResponse("An access token bound to the client's certificate", openapi.Ref("OAuthTokenResponse")),
+			"400": jsonResponse("The request is invalid", openapi.Ref("OAuthError")),
+			"401": jsonResponse("The client isn't known, or used the wrong certificate", openapi.Ref("OAuthError")),
+			"500": jsonResponse("Something went wrong", openapi.Ref("OAuthError")),
+		},
+	}}
+
+	// Registration
+	document.Paths["/v1/register"] = openapi.PathItem{"post": {
+		Tags: []string{"registration"}, OperationID: "register", Summary: "Create an account",
+		Description: "A verification link is emailed to the new user.",
+		RequestBody: jsonBody(RegisterRequest{}),
+		Responses: responses(
+			http.StatusCreated, "The new user", openapi.Ref("User"),
+			http.StatusBadRequest, http.StatusConflict,
+		),
+	}}
+	verifyEmail := func(operationID string) *openapi.Operation {
+		return &openapi.Operation{
+			Tags: []string{"registration"}, OperationID: operationID, Summary: "Verify an email address",
+			Responses: responses(
+				http.StatusOK, "Verified", openapi.Object(map[string]*openapi.Schema{"username": openapi.String(), "email_verified": openapi.Boolean()}),
+				http.StatusBadRequest,
+			),
+		}
+	}
+	document.Paths["/v1/register/verify"] = openapi.PathItem{
+		"get":  withQuery(verifyEmail("verifyEmailLink"), VerifyEmailRequest{}),
+		"post": withBody(verifyEmail("verifyEmail"), VerifyEmailRequest{}),
+	}
+	document.Paths["/v1/register/resend"] = openapi.PathItem{"post": {
+		Tags: []string{"registration"}, OperationID: "resendVerification", Summary: "Email a new verification link",
+		RequestBody: jsonBody(ResendVerificationRequest{}),
+		Responses:   responses(http.StatusAccepted, "Sent, if the address needs verifying", nil, http.StatusBadRequest),
+	}}
+
+	// Passwords
+	document.Paths["/v1/password/forgot"] = openapi.PathItem{"post": {
+		Tags: []string{"passwords"}, OperationID: "forgotPassword", Summary: "Email a password reset token",
+		RequestBody: jsonBody(ForgotPasswordRequest{}),
+		Responses:   responses(http.StatusAccepted, "Sent, if the address belongs to a user", nil, http.StatusBadRequest),
+	}}
+	document.Paths["/v1/password/reset"] = openapi.PathItem{"post": {
+		Tags: []string{"passwords"}, OperationID: "resetPassword", Summary: "Set a new password with a reset token",
+		Description: "Revokes all of the user's refresh tokens.",
+		RequestBody: jsonBody(ResetPasswordRequest{}),
+		Responses:   responses(http.StatusNoContent, "Changed", nil, http.StatusBadRequest),
+	}}
+	document.Paths["/v1/password/change"] = openapi.PathItem{"post": {
+		Tags: []string{"passwords"}, OperationID: "changePassword", Summary: "Change the caller's password",
+		Description: "Revokes all of the user's refresh tokens.",
+		Security:    tokenSecurity,
+		RequestBody: jsonBody(ChangePasswordRequest{}),
+		Responses:   responses(http.StatusNoContent, "Changed", nil, http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden),
+	}}
+
+	// API keys
+	ownerParameters := []openapi.Parameter{
+		{Name: "owner_type", In: "query", Description: "For admins, list another owner's keys", Schema: &openapi.Schema{Type: "string", Enum: []string{store.OwnerUser, store.OwnerClient}}},
+		{Name: "owner", In: "query", Description: "For admins, the owner whose keys to list", Schema: openapi.String()},
+	}
+	document.Paths["/v1/apikeys"] = openapi.PathItem{
+		"post": {
+			Tags: []string{"api-keys"}, OperationID: "createAPIKey", Summary: "Create an API key",
+			Description: "The full key is only returned here. Admins can create keys for other users, or for clients. Keys can only be managed with an access token, not with another key.",
+			Security:    accessSecurity,
+			RequestBody: jsonBody(CreateAPIKeyRequest{}),
+			Responses: responses(
+				http.StatusCreated, "The new key", openapi.Ref("CreatedAPIKey"),
+				http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden,
+			),
+		},
+		"get": {
+			Tags: []string{"api-keys"}, OperationID: "listAPIKeys", Summary: "List the caller's API keys",
+			Security:   accessSecurity,
+			Parameters: ownerParameters,
+			Responses: responses(
+				http.StatusOK, "The keys", openapi.Object(map[string]*openapi.Schema{"api_keys": openapi.Array(openapi.Ref("APIKey"))}),
+				http.StatusUnauthorized, http.StatusForbidden,
+			),
+		},
+	}
+	keyID := openapi.Parameter{Name: "id", In: "path", Required: true, Schema: openapi.String()}
+	document.Paths["/v1/apikeys/{id}"] = openapi.PathItem{
+		"get": {
+			Tags: []string{"api-keys"}, OperationID: "getAPIKey", Summary: "Get an API key",
+			Security:   accessSecurity,
+			Parameters: []openapi.Parameter{keyID},
+			Responses:  responses(http.StatusOK, "The key", openapi.Ref("APIKey"), http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound),
+		},
+		"patch": {
+			Tags: []string{"api-keys"}, OperationID: "updateAPIKey", Summary: "Update an API key",
+			Description: "Only the fields sent are changed.",
+			Security:    accessSecurity,
+			Parameters:  []openapi.Parameter{keyID},
+			RequestBody: jsonBody(UpdateAPIKeyRequest{}),
+			Responses:   responses(http.StatusOK, "The key", openapi.Ref("APIKey"), http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound),
+		},
+		"delete": {
+			Tags: []string{"api-keys"}, OperationID: "deleteAPIKey", Summary: "Delete an API key",
+			Security:   accessSecurity,
+			Parameters: []openapi.Parameter{keyID},
+			Responses:  responses(http.StatusNoContent, "Deleted", nil, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound),
+		},
+	}
+
+	// Webhooks
+	minLimit, maxLimit := 1, maxDeliveriesLimit
+	document.Paths["/v1/webhooks/deliveries"] = openapi.PathItem{"get": {
+		Tags: []string{"webhooks"}, OperationID: "listWebhookDeliveries", Summary: "List recent webhook deliveries, newest first",
+		Security: tokenSecurity,
+		Parameters: []openapi.Parameter{
+			{Name: "status", In: "query", Schema: &openapi.Schema{Type: "string", Enum: []string{store.DeliveryPending, store.DeliveryDelivered, store.DeliveryFailed}}},
+			{Name: "limit", In: "query", Description: "Defaults to " + strconv.Itoa(defaultDeliveriesLimit), Schema: &openapi.Schema{Type: "integer", Minimum: &minLimit, Maximum: &maxLimit}},
+		},
+		Responses: responses(
+			http.StatusOK, "The deliveries", openapi.Object(map[string]*openapi.Schema{"deliveries": openapi.Array(openapi.Ref("WebhookDelivery"))}),
+			http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden,
+		),
+	}}
+
+	// Admin
+	adminUser := openapi.Ref("AdminUser")
+	username := openapi.Parameter{Name: "username", In: "path", Required: true, Schema: openapi.String()}
+	// adminOperation describes an operation on the user named in the path
+	adminOperation := func(operationID string, summary string, description string, status int, schema *openapi.Schema, problemStatuses ...int) *openapi.Operation {
+		statusDescription := "The user"
+		if schema == nil {
+			statusDescription = http.StatusText(status)
+		}
+		return &openapi.Operation{
+			Tags: []string{"admin"}, OperationID: operationID, Summary: summary, Description: description,
+			Security:   tokenSecurity,
+			Parameters: []openapi.Parameter{username},
+			Responses:  responses(status, statusDescription, schema, append(problemStatuses, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound)...),
+		}
+	}
+	document.Paths["/v1/admin/users"] = openapi.PathItem{
+		"get": withQuery(&openapi.Operation{
+			Tags: []string{"admin"}, OperationID: "listUsers", Summary: "List users, oldest first",
+			Description: "q matches part of the username or email address. limit defaults to " + strconv.Itoa(defaultAdminUsersLimit) + ", and can be up to 500.",
+			Security:    tokenSecurity,
+			Responses: responses(
+				http.StatusOK, "A page of users, and how many match in all", openapi.Object(map[string]*openapi.Schema{
+					"users":  openapi.Array(adminUser),
+					"total":  openapi.Integer(),
+					"offset": openapi.Integer(),
+					"limit":  openapi.Integer(),
+				}),
+				http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden,
+			),
+		}, ListUsersRequest{}),
+		"post": {
+			Tags: []string{"admin"}, OperationID: "createUser", Summary: "Create a user",
+			Description: "No verification email is sent.",
+			Security:    tokenSecurity,
+			RequestBody: jsonBody(CreateUserRequest{}),
+			Responses: responses(
+				http.StatusCreated, "The new user", adminUser,
+				http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusConflict,
+			),
+		},
+	}
+	document.Paths["/v1/admin/users/{username}"] = openapi.PathItem{
+		"get": adminOperation("getUser", "Get a user", "", http.StatusOK, adminUser),
+		"patch": withBody(adminOperation(
+			"updateUser", "Change a user's email address", "A new address is unverified unless email_verified is sent too.",
+			http.StatusOK, adminUser, http.StatusBadRequest, http.StatusConflict,
+		), UpdateUserRequest{}),
+		"delete": adminOperation(
+			"deleteUser", "Delete a user", "They're signed out everywhere, and their API keys are deleted. Admins can't delete themselves.",
+			http.StatusNoContent, nil,
+		),
+	}
+	document.Paths["/v1/admin/users/{username}/roles"] = openapi.PathItem{"put": withBody(adminOperation(
+		"setUserRoles", "Replace a user's roles and scopes", "They're signed out everywhere, so refreshed tokens can't keep the old ones.",
+		http.StatusOK, adminUser, http.StatusBadRequest,
+	), SetUserRolesRequest{})}
+	document.Paths["/v1/admin/users/{username}/disable"] = openapi.PathItem{"post": adminOperation(
+		"disableUser", "Disable a user", "Their refresh tokens are revoked straight away. Admins can't disable themselves.",
+		http.StatusOK, adminUser,
+	)}
+	document.Paths["/v1/admin/users/{username}/enable"] = openapi.PathItem{"post": adminOperation(
+		"enableUser", "Enable a disabled user", "", http.StatusOK, adminUser,
+	)}
+	document.Paths["/v1/admin/users/{username}/password-reset"] = openapi.PathItem{"post": adminOperation(
+		"requireUserPasswordReset", "Make a user choose a new password",
+		"Their password stops working, they're signed out everywhere, and they're emailed a reset token.",
+		http.StatusNoContent, nil,
+	)}
+	document.Paths["/v1/admin/users/{username}/unlock"] = openapi.PathItem{"post": adminOperation(
+		"unlockUser", "Unlock a user locked out after too many failed logins", "", http.StatusOK, adminUser,
+	)}
+	sessionList := openapi.Object(map[string]*openapi.Schema{"sessions": openapi.Array(openapi.Ref("Session"))})
+	sessions := adminOperation("listUserSessions", "List a user's sessions, newest first",
+		"Each session is a refresh token that hasn't expired or been revoked. Its ID can't be used as a token.",
+		http.StatusOK, sessionList,
+	)
+	sessions.Responses["200"] = jsonResponse("The user's sessions", sessionList)
+	document.Paths["/v1/admin/users/{username}/sessions"] = openapi.PathItem{
+		"get": sessions,
+		"delete": adminOperation(
+			"revokeUserSessions", "Sign a user out everywhere", "Access tokens keep working until they expire.",
+			http.StatusNoContent, nil,
+		),
+	}
+	revokeSession := adminOperation(
+		"revokeUserSession", "Revoke one of a user's sessions", "Access tokens issued with it keep working until they expire.",
+		http.StatusNoContent, nil,
+	)
+	revokeSession.Parameters = append(revokeSession.Parameters, openapi.Parameter{Name: "id", In: "path", Required: true, Schema: openapi.String()})
+	document.Paths["/v1/admin/users/{username}/sessions/{id}"] = openapi.PathItem{"delete": revokeSession}
+	document.Paths["/v1/admin/clients"] = openapi.PathItem{"get": {
+		Tags: []string{"admin"}, OperationID: "listClients", Summary: "List the OAuth clients registered in CLIENTS",
+		Security: tokenSecurity,
+		Responses: responses(
+			http.StatusOK, "The clients", openapi.Object(map[string]*openapi.Schema{"clients": openapi.Array(openapi.Ref("Client"))}),
+			http.StatusUnauthorized, http.StatusForbidden,
+		),
+	}}
+
+	// Proxies
+	verifyResponses := responses(http.StatusOK, "Let the request through", nil, http.StatusUnauthorized, http.StatusForbidden)
+	verifyResponses["200"] = openapi.Response{Description: "Let the request through", Headers: map[string]openapi.Header{
+		authUserHeader:   {Description: "The caller's username or client ID", Schema: openapi.String()},
+		authRolesHeader:  {Description: "The caller's comma-separated roles", Schema: openapi.String()},
+		authScopesHeader: {Description: "The caller's comma-separated scopes", Schema: openapi.String()},
+	}}
+	verifyResponses["302"] = openapi.Response{Description: "Browsers without a valid token are sent to FORWARD_AUTH_LOGIN_URL, when it's set"}
+	document.Paths["/v1/verify"] = openapi.PathItem{"get": {
+		Tags: []string{"proxies"}, OperationID: "verify", Summary: "Check a request for a reverse proxy's forward auth",
+		Description: "The token may also be sent in the FORWARD_AUTH_COOKIE cookie.",
+		Security:    tokenSecurity,
+		Parameters: []openapi.Parameter{
+			{Name: "roles", In: "query", Description: "Comma-separated roles the caller must all have", Schema: openapi.String()},
+			{Name: "scopes", In: "query", Description: "Comma-separated scopes the caller must all have", Schema: openapi.String()},
+		},
+		Responses: verifyResponses,
+	}}
+	document.Paths["/v1/test/ping"] = openapi.PathItem{"get": {
+		Tags: []string{"proxies"}, OperationID: "ping", Summary: "Check an access token or API key",
+		Security:  tokenSecurity,
+		Responses: responses(http.StatusOK, "A greeting", openapi.Object(map[string]*openapi.Schema{"message": openapi.String()}), http.StatusUnauthorized),
+	}}
+
+	// Docs
+	document.Paths["/v1"+openAPIRoute] = openapi.PathItem{"get": {
+		Tags: []string{"docs"}, OperationID: "openAPI", Summary: "This document",
+		Responses: map[string]openapi.Response{"200": jsonResponse("The OpenAPI document", &openapi.Schema{Type: "object"})},
+	}}
+	document.Paths["/v1"+docsRoute] = openapi.PathItem{"get": {
+		Tags: []string{"docs"}, OperationID: "docs", Summary: "Browse this document with Swagger UI, when SWAGGER_UI is set",
+		Responses: responses(http.StatusOK, "A Swagger UI page", nil, http.StatusNotFound),
+	}}
+
+	return document
+}
+
+// addSchemas adds the shared response schemas to a document's components
+func addSchemas(document *openapi.Document) {
+	codes := make([]string, 0, len(problem.Catalogue))
+	for _, known := range problem.Catalogue {
+		codes = append(codes, known.Code)
+	}
+	problemSchema := openapi.Object(map[string]*openapi.Schema{
+		"type":   openapi.String(),
+		"title":  openapi.String(),
+		"status": openapi.Integer(),
+		"detail": openapi.String(),
+		"code":   {Type: "string", Enum: codes, Description: "Stable, for clients to match on"},
+	})
+	problemSchema.Properties["request_id"] = openapi.String()
+	problemSchema.Properties["violations"] = openapi.Array(openapi.Object(map[string]*openapi.Schema{"code": openapi.String(), "message": openapi.String()}))
+	problemSchema.Properties["invalid_params"] = openapi.Array(openapi.Object(map[string]*openapi.Schema{"name": openapi.String(), "reason": openapi.String()}))
+
+	tokenResponse := openapi.Object(map[string]*openapi.Schema{"access_token": openapi.String()})
+	tokenResponse.Properties["refresh_token"] = &openapi.Schema{Type: "string", Description: "Not returned when refreshing"}
+	tokenResponse.Properties["token_type"] = &openapi.Schema{Type: "string", Enum: []string{tokenTypeDPoP}, Description: "Set when the tokens are bound to a DPoP key"}
+
+	oauthError := openapi.Object(map[string]*openapi.Schema{"error": openapi.String(), "error_description": openapi.String()})
+	oauthError.Properties["request_id"] = openapi.String()
+
+	nullableDateTime := func() *openapi.Schema {
+		schema := openapi.DateTime()
+		schema.Nullable = true
+		return schema
+	}
+	apiKey := func() *openapi.Schema {
+		return openapi.Object(map[string]*openapi.Schema{
+			"id":           openapi.String(),
+			"name":         openapi.String(),
+			"owner_type":   {Type: "string", Enum: []string{store.OwnerUser, store.OwnerClient}},
+			"owner":        openapi.String(),
+			"scopes":       openapi.Array(openapi.String()),
+			"created_at":   openapi.DateTime(),
+			"expires_at":   nullableDateTime(),
+			"last_used_at": nullableDateTime(),
+		})
+	}
+	createdAPIKey := apiKey()
+	createdAPIKey.Properties["key"] = &openapi.Schema{Type: "string", Description: "The full key, which is never shown again"}
+	createdAPIKey.Required = append(createdAPIKey.Required, "key")
+
+	document.Components.Schemas["Problem"] = problemSchema
+	document.Components.Schemas["OAuthError"] = oauthError
+	document.Components.Schemas["TokenResponse"] = tokenResponse
+	document.Components.Schemas["OAuthTokenResponse"] = openapi.Object(map[string]*openapi.Schema{
+		"access_token": openapi.String(),
+		"token_type":   openapi.String(),
+		"expires_in":   openapi.Integer(),
+		"scope":        openapi.String(),
+	})
+	document.Components.Schemas["User"] = openapi.Object(map[string]*openapi.Schema{
+		"id":             openapi.String(),
+		"username":       openapi.String(),
+		"email":          openapi.String(),
+		"email_verified": openapi.Boolean(),
+	})
+	document.Components.Schemas["AdminUser"] = openapi.Object(map[string]*openapi.Schema{
+		"id":             openapi.String(),
+		"username":       openapi.String(),
+		"email":          openapi.String(),
+		"email_verified": openapi.Boolean(),
+		"disabled":       openapi.Boolean(),
+		"roles":          openapi.Array(openapi.String()),
+		"scopes":         openapi.Array(openapi.String()),
+		"failed_logins":  openapi.Integer(),
+		"locked_until":   {Type: "string", Format: "date-time", Nullable: true, Description: "Set while the user is locked out"},
+		"created_at":     openapi.DateTime(),
+		"updated_at":     openapi.DateTime(),
+	})
+	document.Components.Schemas["Session"] = openapi.Object(map[string]*openapi.Schema{
+		"id":         openapi.String(),
+		"issued_at":  openapi.DateTime(),
+		"expires_at": openapi.DateTime(),
+		"bound":      {Type: "boolean", Description: "Set when the refresh token only works with a DPoP key or client certificate"},
+	})
+	document.Components.Schemas["Client"] = openapi.Object(map[string]*openapi.Schema{
+		"client_id":                  openapi.String(),
+		"token_endpoint_auth_method": openapi.String(),
+		"tls_client_auth_subject_dn": {Type: "string", Description: "Empty when the client is matched by tls_client_auth_san_dns"},
+		"tls_client_auth_san_dns":    openapi.String(),
+		"roles":                      openapi.Array(openapi.String()),
+		"scopes":                     openapi.Array(openapi.String()),
+	})
+	document.Components.Schemas["APIKey"] = apiKey()
+	document.Components.Schemas["CreatedAPIKey"] = createdAPIKey
+	document.Components.Schemas["WebhookDelivery"] = openapi.Object(map[string]*openapi.Schema{
+		"id":               openapi.String(),
+		"event_id":         openapi.String(),
+		"event_type":       openapi.String(),
+		"url":              openapi.String(),
+		"status":           {Type: "string", Enum: []string{store.DeliveryPending, store.DeliveryDelivered, store.DeliveryFailed}},
+		"attempts":         openapi.Integer(),
+		"last_error":       openapi.String(),
+		"last_status_code": openapi.Integer(),
+		"created_at":       openapi.DateTime(),
+		"next_attempt_at":  nullableDateTime(),
+		"delivered_at":     nullableDateTime(),
+		"payload":          {Type: "object", Description: "The event, as it was sent"},
+	})
+}
+
+// responses describes an operation's successful response, with schema as
+// its JSON body when it has one, and the problems it can respond with
+func responses(status int, description string, schema *openapi.Schema, problemStatuses ...int) map[string]openapi.Response {
+	success := openapi.Response{Description: description}
+	if schema != nil {
+		success = jsonResponse(description, schema)
+	}
+	described := map[string]openapi.Response{strconv.Itoa(status): success}
+	for _, problemStatus := range problemStatuses {
+		described[strconv.Itoa(problemStatus)] = openapi.Response{
+			Description: http.StatusText(problemStatus),
+			Content:     map[string]openapi.MediaType{problem.ContentType: {Schema: openapi.Ref("Problem")}},
+		}
+	}
+	described["500"] = openapi.Response{
+		Description: http.StatusText(http.StatusInternalServerError),
+		Content:     map[string]openapi.MediaType{problem.ContentType: {Schema: openapi.Ref("Problem")}},
+	}
+	return described
+}
+
+func jsonResponse(description string, schema *openapi.Schema) openapi.Response {
+	return openapi.Response{Description: description, Content: map[string]openapi.MediaType{jsonContentType: {Schema: schema}}}
+}
+
+// jsonBody describes a request body bound from request
+func jsonBody(request interface{}) *openapi.RequestBody {
+	return &openapi.RequestBody{Required: true, Content: map[string]openapi.MediaType{jsonContentType: {Schema: openapi.SchemaOf(request)}}}
+}
+
+func withBody(operation *openapi.Operation, request interface{}) *openapi.Operation {
+	operation.RequestBody = jsonBody(request)
+	return operation
+}
+
+// withQuery adds the query parameters request is bound from, for links in emails
+func withQuery(operation *openapi.Operation, request interface{}) *openapi.Operation {
+	operation.Parameters = append(operation.Parameters, openapi.QueryParameters(request)...)
+	return operation
+}
+
+func dpopParameter() openapi.Parameter {
+	return openapi.Parameter{
+		Name: dpop.Header, In: "header", Schema: openapi.String(),
+		Description: "A DPoP proof (RFC 9449), to bind the tokens to its key",
+	}
+}
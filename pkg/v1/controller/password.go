@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"auth-server/pkg/audit"
+	"auth-server/pkg/problem"
+	tokenservice "auth-server/pkg/v1/service"
+)
+
+const (
+	passwordForgotRoute string = "/password/forgot"
+	passwordResetRoute  string = "/password/reset"
+	passwordChangeRoute string = "/password/change"
+)
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+type PasswordController struct {
+	log         *log.Entry
+	group       *gin.RouterGroup
+	userService tokenservice.UserService
+	authorize   gin.HandlerFunc
+}
+
+// NewPasswordController registers the password routes. authorize guards the
+// routes that need a logged-in user.
+func NewPasswordController(group *gin.RouterGroup, userService tokenservice.UserService, authorize gin.HandlerFunc) *PasswordController {
+	passwordController := &PasswordController{
+		log:         log.WithFields(log.Fields{"logger": "PasswordControllerV1"}),
+		group:       group,
+		userService: userService,
+		authorize:   authorize,
+	}
+	passwordController.registerRoutes()
+	return passwordController
+}
+
+func (c *PasswordController) registerRoutes() {
+	c.group.POST(passwordForgotRoute, c.ForgotPassword)
+	c.group.POST(passwordResetRoute, c.ResetPassword)
+	c.group.POST(passwordChangeRoute, c.authorize, c.ChangePassword)
+}
+
+func (c *PasswordController) ForgotPassword(context *gin.Context) {
+	var request ForgotPasswordRequest
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "PasswordController.ForgotPassword")
+	defer span.End()
+
+	if err := context.ShouldBindJSON(&request); err != nil {
+		problem.Abort(context, bindingProblem(err))
+		return
+	}
+
+	// Always accept, so the response doesn't reveal which addresses are registered
+	if err := c.userService.ForgotPassword(context.Request.Context(), request.Email); err != nil {
+		requestLogger.WithError(err).Error("Failed to start a password reset")
+	}
+	context.Status(http.StatusAccepted)
+}
+
+func (c *PasswordController) ResetPassword(context *gin.Context) {
+	var request ResetPasswordRequest
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "PasswordController.ResetPassword")
+	defer span.End()
+
+	if err := context.ShouldBindJSON(&request); err != nil {
+		problem.Abort(context, bindingProblem(err))
+		return
+	}
+
+	user, err := c.userService.ResetPassword(context.Request.Context(), request.Token, request.Password)
+	recordAudit(context, auditOutcome(audit.Event{Type: audit.EventPasswordReset, Actor: user.Username, Subject: user.Username}, err))
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+	// Resetting a password ends every session the user had
+	recordAudit(context, audit.Event{Type: audit.EventSessionsRevoked, Actor: user.Username, Subject: user.Username})
+	context.Status(http.StatusNoContent)
+}
+
+func (c *PasswordController) ChangePassword(context *gin.Context) {
+	var request ChangePasswordRequest
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "PasswordController.ChangePassword")
+	defer span.End()
+
+	if err := context.ShouldBindJSON(&request); err != nil {
+		problem.Abort(context, bindingProblem(err))
+		return
+	}
+
+	jwtUser, _ := context.MustGet("user").(tokenservice.JWTUser)
+	err := c.userService.ChangePassword(context.Request.Context(), jwtUser.Username, request.CurrentPassword, request.NewPassword)
+	recordAudit(context, auditOutcome(audit.Event{Type: audit.EventPasswordChanged, Subject: jwtUser.Username}, err))
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+	// So does changing it
+	recordAudit(context, audit.Event{Type: audit.EventSessionsRevoked, Subject: jwtUser.Username})
+	context.Status(http.StatusNoContent)
+}
@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"auth-server/pkg/problem"
+	tokenservice "auth-server/pkg/v1/service"
+)
+
+const (
+	registerRoute       string = "/register"
+	registerVerifyRoute string = "/register/verify"
+	registerResendRoute string = "/register/resend"
+)
+
+type RegisterRequest struct {
+	Username string `json:"username" binding:"required"`
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" form:"token" binding:"required"`
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+type RegisterController struct {
+	log         *log.Entry
+	group       *gin.RouterGroup
+	userService tokenservice.UserService
+}
+
+func NewRegisterController(group *gin.RouterGroup, userService tokenservice.UserService) *RegisterController {
+	registerController := &RegisterController{
+		log:         log.WithFields(log.Fields{"logger": "RegisterControllerV1"}),
+		group:       group,
+		userService: userService,
+	}
+	registerController.registerRoutes()
+	return registerController
+}
+
+func (c *RegisterController) registerRoutes() {
+	c.group.POST(registerRoute, c.Register)
+	// GET is used by the link in the verification email
+	c.group.GET(registerVerifyRoute, c.VerifyEmail)
+	c.group.POST(registerVerifyRoute, c.VerifyEmail)
+	c.group.POST(registerResendRoute, c.ResendVerification)
+}
+
+func (c *RegisterController) Register(context *gin.Context) {
+	var request RegisterRequest
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "RegisterController.Register")
+	defer span.End()
+
+	if err := context.ShouldBindJSON(&request); err != nil {
+		problem.Abort(context, bindingProblem(err))
+		return
+	}
+
+	user, err := c.userService.Register(context.Request.Context(), request.Username, request.Email, request.Password)
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+
+	context.JSON(http.StatusCreated, gin.H{
+		"id":             user.ID,
+		"username":       user.Username,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+	})
+}
+
+func (c *RegisterController) VerifyEmail(context *gin.Context) {
+	var request VerifyEmailRequest
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "RegisterController.VerifyEmail")
+	defer span.End()
+
+	// Links from emails put everything in the query string
+	bind := context.ShouldBindJSON
+	if context.Request.Method == http.MethodGet {
+		bind = context.ShouldBindQuery
+	}
+	if err := bind(&request); err != nil {
+		problem.Abort(context, bindingProblem(err))
+		return
+	}
+
+	user, err := c.userService.VerifyEmail(context.Request.Context(), request.Token)
+	if err != nil {
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{
+		"username":       user.Username,
+		"email_verified": user.EmailVerified,
+	})
+}
+
+func (c *RegisterController) ResendVerification(context *gin.Context) {
+	var request ResendVerificationRequest
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "RegisterController.ResendVerification")
+	defer span.End()
+
+	if err := context.ShouldBindJSON(&request); err != nil {
+		problem.Abort(context, bindingProblem(err))
+		return
+	}
+
+	if err := c.userService.ResendVerification(context.Request.Context(), request.Email); err != nil {
+		requestLogger.WithError(err).Error("Failed to resend verification email")
+	}
+	context.Status(http.StatusAccepted)
+}
@@ -1,11 +1,17 @@
 package controller
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 
+	"auth-server/pkg/audit"
+	"auth-server/pkg/dpop"
+	"auth-server/pkg/metrics"
+	"auth-server/pkg/problem"
+	"auth-server/pkg/v1/middleware"
 	tokenservice "auth-server/pkg/v1/service"
 )
 
@@ -18,16 +24,18 @@ type TokenRequest struct {
 }
 
 type TokenController struct {
-	log        *log.Entry
-	group      *gin.RouterGroup
-	jwtService tokenservice.JWTService
+	log         *log.Entry
+	group       *gin.RouterGroup
+	jwtService  tokenservice.JWTService
+	dpopService tokenservice.DPoPService
 }
 
-func NewTokenController(group *gin.RouterGroup, jwtService tokenservice.JWTService) *TokenController {
+func NewTokenController(group *gin.RouterGroup, jwtService tokenservice.JWTService, dpopService tokenservice.DPoPService) *TokenController {
 	loginController := &TokenController{
-		log:        log.WithFields(log.Fields{"logger": "TokenControllerV1"}),
-		group:      group,
-		jwtService: jwtService,
+		log:         log.WithFields(log.Fields{"logger": "TokenControllerV1"}),
+		group:       group,
+		jwtService:  jwtService,
+		dpopService: dpopService,
 	}
 	loginController.registerRoutes()
 	return loginController
@@ -38,36 +46,80 @@ func (c *TokenController) registerRoutes() {
 	c.group.POST(tokenRoute, c.Token)
 }
 
+// Token issues a new access token for a refresh token. Refresh tokens bound
+// to a DPoP key need a proof signed with it, and so does the new token.
 func (c *TokenController) Token(context *gin.Context) {
 	var request TokenRequest
 	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
 	requestLogger.Info("Handling request")
+	span := startSpan(context, "TokenController.Token")
+	defer span.End()
 
 	if err := context.ShouldBindJSON(&request); err != nil {
-		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		problem.Abort(context, bindingProblem(err))
+		return
+	}
+	thumbprint, valid := dpopProof(context, c.dpopService)
+	if !valid {
 		return
 	}
 
 	// Lookup refresh token to make sure it's valid
-	refreshToken, authClaims, err := c.jwtService.ValidateRefreshToken(request.RefreshToken)
+	refreshToken, authClaims, err := c.jwtService.ValidateRefreshToken(context.Request.Context(), request.RefreshToken)
+	if errors.Is(err, tokenservice.ErrInvalidRefreshToken) {
+		metrics.RefreshFailures.WithLabelValues(metrics.ReasonRevoked).Inc()
+		recordAudit(context, refreshFailure("", metrics.ReasonRevoked))
+		problem.Abort(context, serviceProblem(err))
+		return
+	}
 	if err != nil {
-		context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		metrics.RefreshFailures.WithLabelValues(metrics.TokenFailureReason(err)).Inc()
+		recordAudit(context, refreshFailure("", metrics.TokenFailureReason(err)))
+		if metrics.TokenFailureReason(err) == metrics.ReasonExpired {
+			problem.Abort(context, problem.New(problem.TokenExpired, "Refresh token has expired"))
+			return
+		}
+		problem.Abort(context, problem.Wrap(problem.InvalidToken, err))
 		return
 	}
 
 	if !refreshToken.Valid {
-		context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Invalid refresh token"})
+		metrics.RefreshFailures.WithLabelValues(metrics.ReasonInvalid).Inc()
+		recordAudit(context, refreshFailure("", metrics.ReasonInvalid))
+		problem.Abort(context, problem.New(problem.InvalidToken, "Invalid refresh token"))
+		return
+	}
+	middleware.LogCaller(context, authClaims.User)
+
+	if boundKey := authClaims.Confirmation.BoundKey(); boundKey != "" && boundKey != thumbprint {
+		metrics.RefreshFailures.WithLabelValues(metrics.ReasonDPoP).Inc()
+		recordAudit(context, refreshFailure(authClaims.User.Username, metrics.ReasonDPoP))
+		problem.Abort(context, &problem.Error{Problem: problem.InvalidDPoPProof, Detail: "Refresh token is bound to a DPoP key, and needs a proof signed with it", Scheme: dpop.Scheme})
 		return
 	}
 
 	// Generate new JWT
-	accessToken, _, err := c.jwtService.GenerateToken(authClaims.User, false)
+	accessToken, _, err := c.jwtService.GenerateBoundToken(context.Request.Context(), authClaims.User, false, dpopConfirmation(thumbprint))
 	if err != nil {
-		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		problem.Abort(context, problem.Wrap(problem.Internal, err))
 		return
 	}
+	countTokens(metrics.GrantRefreshToken, "")
+	recordAudit(context, audit.Event{Type: audit.EventTokenRefreshed, Actor: authClaims.User.Username, Subject: authClaims.User.Username, Method: metrics.GrantRefreshToken})
 
-	context.JSON(http.StatusOK, gin.H{
+	context.JSON(http.StatusOK, tokenResponse(gin.H{
 		"access_token": accessToken,
-	})
+	}, thumbprint))
+}
+
+// refreshFailure is the audit event for a refresh token that was refused
+func refreshFailure(username string, reason string) audit.Event {
+	return audit.Event{
+		Type:    audit.EventTokenRefreshed,
+		Actor:   username,
+		Subject: username,
+		Method:  metrics.GrantRefreshToken,
+		Outcome: audit.OutcomeFailure,
+		Reason:  reason,
+	}
 }
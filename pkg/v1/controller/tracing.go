@@ -0,0 +1,17 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("auth-server/pkg/v1/controller")
+
+// startSpan traces a handler as part of the request's span. Services called
+// with the request's context from then on are traced as part of the handler.
+func startSpan(context *gin.Context, name string) trace.Span {
+	ctx, span := tracer.Start(context.Request.Context(), name)
+	context.Request = context.Request.WithContext(ctx)
+	return span
+}
@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"auth-server/pkg/config"
+	"auth-server/pkg/problem"
+	"auth-server/pkg/v1/middleware"
+	tokenservice "auth-server/pkg/v1/service"
+)
+
+const (
+	verifyRoute string = "/verify"
+
+	// Headers describing the caller, for the application behind the proxy
+	authUserHeader   string = "X-Auth-User"
+	authRolesHeader  string = "X-Auth-Roles"
+	authScopesHeader string = "X-Auth-Scopes"
+
+	// redirectParameter carries the page a browser was trying to reach to the login page
+	redirectParameter string = "rd"
+)
+
+// VerifyController answers forward-auth requests from reverse proxies such as
+// nginx (auth_request), Traefik (ForwardAuth) and Caddy (forward_auth).
+type VerifyController struct {
+	log           *log.Entry
+	group         *gin.RouterGroup
+	config        *config.Holder
+	jwtService    tokenservice.JWTService
+	apiKeyService tokenservice.APIKeyService
+}
+
+func NewVerifyController(group *gin.RouterGroup, config *config.Holder, jwtService tokenservice.JWTService, apiKeyService tokenservice.APIKeyService) *VerifyController {
+	verifyController := &VerifyController{
+		log:           log.WithFields(log.Fields{"logger": "VerifyControllerV1"}),
+		group:         group,
+		config:        config,
+		jwtService:    jwtService,
+		apiKeyService: apiKeyService,
+	}
+	verifyController.registerRoutes()
+	return verifyController
+}
+
+func (c *VerifyController) registerRoutes() {
+	c.group.GET(verifyRoute, c.Verify)
+}
+
+// Verify responds 200 with headers describing the caller when the request
+// should be let through, 401 when the caller isn't authenticated, and 403
+// when they lack any of the comma-separated "roles" or "scopes" required
+// by the query string.
+func (c *VerifyController) Verify(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "VerifyController.Verify")
+	defer span.End()
+
+	jwtUser, problemErr := middleware.Authenticate(context, c.jwtService, c.apiKeyService, nil, c.config.Get().ForwardAuth.Cookie)
+	if problemErr != nil {
+		if c.config.Get().ForwardAuth.LoginURL != "" && strings.Contains(context.GetHeader("Accept"), "text/html") {
+			context.Redirect(http.StatusFound, c.loginURL(context))
+			context.Abort()
+			return
+		}
+		problem.Abort(context, problemErr)
+		return
+	}
+	middleware.LogCaller(context, jwtUser)
+
+	for _, role := range queryList(context, "roles") {
+		if !jwtUser.HasRole(role) {
+			problem.Abort(context, problem.New(problem.InsufficientScope, "Missing required role "+role))
+			return
+		}
+	}
+	for _, scope := range queryList(context, "scopes") {
+		if !jwtUser.HasScope(scope) {
+			problem.Abort(context, problem.New(problem.InsufficientScope, "Missing required scope "+scope))
+			return
+		}
+	}
+
+	// Always send every header, even if empty, so proxies copying them
+	// upstream overwrite anything the client sent itself
+	headers := context.Writer.Header()
+	headers.Set(authUserHeader, jwtUser.Username)
+	headers.Set(authRolesHeader, strings.Join(jwtUser.Roles, ","))
+	headers.Set(authScopesHeader, strings.Join(jwtUser.Scopes, ","))
+	context.Status(http.StatusOK)
+}
+
+// loginURL sends the browser to log in, passing along the page it was
+// trying to reach when the proxy told us what that was.
+func (c *VerifyController) loginURL(context *gin.Context) string {
+	config := c.config.Get()
+	loginURL, err := url.Parse(config.ForwardAuth.LoginURL)
+	if err != nil {
+		return config.ForwardAuth.LoginURL
+	}
+
+	// nginx passes X-Original-URL, Traefik and Caddy pass X-Forwarded-*
+	original := context.GetHeader("X-Original-URL")
+	if original == "" && context.GetHeader("X-Forwarded-Host") != "" {
+		scheme := context.GetHeader("X-Forwarded-Proto")
+		if scheme == "" {
+			scheme = "http"
+		}
+		original = scheme + "://" + context.GetHeader("X-Forwarded-Host") + context.GetHeader("X-Forwarded-Uri")
+	}
+
+	if original != "" {
+		query := loginURL.Query()
+		query.Set(redirectParameter, original)
+		loginURL.RawQuery = query.Encode()
+	}
+	return loginURL.String()
+}
+
+// queryList collects a list from a query parameter, which may be repeated
+// and/or comma-separated
+func queryList(context *gin.Context, key string) []string {
+	items := []string{}
+	for _, value := range context.QueryArray(key) {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
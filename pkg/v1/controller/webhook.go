@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"auth-server/pkg/config"
+	"auth-server/pkg/problem"
+	"auth-server/pkg/store"
+	tokenservice "auth-server/pkg/v1/service"
+	"auth-server/pkg/webhook"
+)
+
+const (
+	webhookDeliveriesRoute string = "/webhooks/deliveries"
+
+	defaultDeliveriesLimit int = 50
+	maxDeliveriesLimit     int = 500
+)
+
+type WebhookController struct {
+	log        *log.Entry
+	group      *gin.RouterGroup
+	config     *config.Holder
+	dispatcher *webhook.Dispatcher
+	authorize  gin.HandlerFunc
+}
+
+// NewWebhookController registers the route admins use to see how webhook
+// deliveries are going
+func NewWebhookController(group *gin.RouterGroup, config *config.Holder, dispatcher *webhook.Dispatcher, authorize gin.HandlerFunc) *WebhookController {
+	webhookController := &WebhookController{
+		log:        log.WithFields(log.Fields{"logger": "WebhookControllerV1"}),
+		group:      group,
+		config:     config,
+		dispatcher: dispatcher,
+		authorize:  authorize,
+	}
+	webhookController.registerRoutes()
+	return webhookController
+}
+
+func (c *WebhookController) registerRoutes() {
+	c.group.GET(webhookDeliveriesRoute, c.authorize, c.Deliveries)
+}
+
+// Deliveries lists recent deliveries, newest first. They can be filtered by
+// status, and limit sets how many are returned.
+func (c *WebhookController) Deliveries(context *gin.Context) {
+	requestLogger, _ := context.MustGet("request_logger").(*log.Entry)
+	requestLogger.Info("Handling request")
+	span := startSpan(context, "WebhookController.Deliveries")
+	defer span.End()
+
+	jwtUser, _ := context.MustGet("user").(tokenservice.JWTUser)
+	if !jwtUser.HasRole(c.config.Get().AdminRole) {
+		problem.Abort(context, problem.New(problem.Forbidden, "Only admins can see webhook deliveries"))
+		return
+	}
+
+	status := context.Query("status")
+	if status != "" && status != store.DeliveryPending && status != store.DeliveryDelivered && status != store.DeliveryFailed {
+		problem.Abort(context, problem.New(problem.InvalidRequest, "status must be \"pending\", \"delivered\" or \"failed\""))
+		return
+	}
+	limit := defaultDeliveriesLimit
+	if value := context.Query("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxDeliveriesLimit {
+			problem.Abort(context, problem.New(problem.InvalidRequest, "limit must be from 1 to "+strconv.Itoa(maxDeliveriesLimit)))
+			return
+		}
+	}
+
+	deliveries, err := c.dispatcher.Deliveries(context.Request.Context(), status, limit)
+	if err != nil {
+		problem.Abort(context, problem.Wrap(problem.Internal, err))
+		return
+	}
+	response := make([]gin.H, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		response = append(response, deliveryResponse(delivery))
+	}
+	context.JSON(http.StatusOK, gin.H{"deliveries": response})
+}
+
+// deliveryResponse describes a delivery, leaving out times that haven't happened
+func deliveryResponse(delivery store.Delivery) gin.H {
+	response := gin.H{
+		"id":               delivery.ID,
+		"event_id":         delivery.EventID,
+		"event_type":       delivery.EventType,
+		"url":              delivery.URL,
+		"status":           delivery.Status,
+		"attempts":         delivery.Attempts,
+		"last_error":       delivery.LastError,
+		"last_status_code": delivery.LastStatusCode,
+		"created_at":       delivery.CreatedAt,
+		"next_attempt_at":  nil,
+		"delivered_at":     nil,
+		"payload":          delivery.Payload,
+	}
+	if delivery.Status == store.DeliveryPending {
+		response["next_attempt_at"] = delivery.NextAttemptAt
+	}
+	if !delivery.DeliveredAt.IsZero() {
+		response["delivered_at"] = delivery.DeliveredAt
+	}
+	return response
+}
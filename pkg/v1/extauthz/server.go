@@ -0,0 +1,285 @@
+package extauthz
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	log "github.com/sirupsen/logrus"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"auth-server/pkg/config"
+	"auth-server/pkg/metrics"
+	"auth-server/pkg/problem"
+	tokenservice "auth-server/pkg/v1/service"
+)
+
+const (
+	authorizationHeader string = "authorization"
+	bearerScheme        string = "bearer"
+
+	// Headers describing the caller, added to requests that are let through
+	authUserHeader   string = "X-Auth-User"
+	authRolesHeader  string = "X-Auth-Roles"
+	authScopesHeader string = "X-Auth-Scopes"
+)
+
+// Server implements Envoy's external authorization API
+// (envoy.service.auth.v3.Authorization/Check), so Envoy can ask whether to
+// let each request through.
+type Server struct {
+	log        *log.Entry
+	config     *config.Holder
+	jwtService tokenservice.JWTService
+}
+
+// NewServer creates an authorization Server. Routes are read from the
+// current config for each request, so they can be reloaded.
+func NewServer(config *config.Holder, jwtService tokenservice.JWTService) *Server {
+	return &Server{
+		log:        log.WithFields(log.Fields{"logger": "ExtAuthzServerV1"}),
+		config:     config,
+		jwtService: jwtService,
+	}
+}
+
+// Register adds the authorization service to a gRPC server
+func (s *Server) Register(grpcServer *grpc.Server) {
+	authv3.RegisterAuthorizationServer(grpcServer, s)
+}
+
+// ListenAndServe serves the authorization service on the configured address
+// until ctx is done. Checks in flight then get up to the server's shutdown
+// timeout to finish, before the rest are cut off.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	address := s.config.Get().ExtAuthz.Address
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	grpcServer := grpc.NewServer()
+	s.Register(grpcServer)
+	s.log.WithField("address", address).Info("Serving Envoy external authorization")
+
+	served := make(chan error, 1)
+	go func() {
+		served <- grpcServer.Serve(listener)
+	}()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(s.config.Get().Server.ShutdownTimeout):
+		grpcServer.Stop()
+	}
+	return <-served
+}
+
+// Check lets a request through when it carries a valid bearer token that
+// satisfies the best matching route. The caller is described to the
+// upstream service in X-Auth-* headers.
+func (s *Server) Check(ctx context.Context, request *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	httpRequest := request.GetAttributes().GetRequest().GetHttp()
+	requestLogger := s.log.WithFields(log.Fields{
+		"method": httpRequest.GetMethod(),
+		"host":   httpRequest.GetHost(),
+		"path":   httpRequest.GetPath(),
+	})
+	route, ok := s.matchRoute(httpRequest)
+	if !ok {
+		requestLogger.Debug("Denying request with an invalid path")
+		return deny(problem.New(problem.InvalidRequest, "Invalid request path")), nil
+	}
+
+	if route != nil && route.Public {
+		requestLogger.Debug("Allowing public route")
+		return allow(tokenservice.JWTUser{}), nil
+	}
+
+	splits := strings.SplitN(httpRequest.GetHeaders()[authorizationHeader], " ", 2)
+	if len(splits) != 2 || !strings.EqualFold(splits[0], bearerScheme) {
+		requestLogger.Debug("Denying request without a bearer token")
+		metrics.ValidationFailures.WithLabelValues(metrics.ReasonMissing).Inc()
+		return deny(problem.New(problem.MissingToken, "Missing bearer token")), nil
+	}
+
+	token, authClaims, err := s.jwtService.ValidateAccessToken(ctx, strings.TrimSpace(splits[1]))
+	if err != nil || !token.Valid {
+		requestLogger.WithError(err).Debug("Denying request with an invalid token")
+		metrics.ValidationFailures.WithLabelValues(metrics.TokenFailureReason(err)).Inc()
+		if metrics.TokenFailureReason(err) == metrics.ReasonExpired {
+			return deny(problem.New(problem.TokenExpired, "Access token has expired")), nil
+		}
+		return deny(problem.New(problem.InvalidToken, "Invalid access token")), nil
+	}
+
+	if err := authClaims.Confirmation.CheckCertificate(peerCertificate(request)); err != nil {
+		requestLogger.WithError(err).Debug("Denying request with a token bound to another certificate")
+		metrics.ValidationFailures.WithLabelValues(metrics.ReasonCertificate).Inc()
+		return deny(problem.New(problem.InvalidToken, err.Error())), nil
+	}
+	// Proofs are only checked against PUBLIC_URL, not the services behind Envoy
+	if authClaims.Confirmation.BoundKey() != "" {
+		requestLogger.Debug("Denying request with a DPoP-bound token")
+		metrics.ValidationFailures.WithLabelValues(metrics.ReasonDPoP).Inc()
+		return deny(problem.New(problem.InvalidToken, "DPoP-bound access tokens aren't accepted here")), nil
+	}
+
+	jwtUser := authClaims.User
+	if route != nil {
+		for _, role := range route.Roles {
+			if !jwtUser.HasRole(role) {
+				requestLogger.WithField("role", role).Debug("Denying request missing a role")
+				return deny(problem.New(problem.InsufficientScope, "Missing required role "+role)), nil
+			}
+		}
+		for _, scope := range route.Scopes {
+			if !jwtUser.HasScope(scope) {
+				requestLogger.WithField("scope", scope).Debug("Denying request missing a scope")
+				return deny(problem.New(problem.InsufficientScope, "Missing required scope "+scope)), nil
+			}
+		}
+	}
+
+	requestLogger.WithField("username", jwtUser.Username).Debug("Allowing request")
+	return allow(jwtUser), nil
+}
+
+// matchRoute finds the route with the longest prefix matching the request,
+// if any. The path is decoded and cleaned first, so "/public/../admin" and
+// "/%61dmin" get the rules for "/admin", and prefixes only match whole
+// segments, so "/api" doesn't match "/apis". It returns false for paths
+// that can't be decoded.
+func (s *Server) matchRoute(httpRequest *authv3.AttributeContext_HttpRequest) (*config.ExtAuthzRoute, bool) {
+	requestPath := httpRequest.GetPath()
+	if index := strings.IndexAny(requestPath, "?#"); index >= 0 {
+		requestPath = requestPath[:index]
+	}
+	requestPath, err := url.PathUnescape(requestPath)
+	if err != nil {
+		return nil, false
+	}
+	requestPath = path.Clean("/" + requestPath)
+
+	routes := s.config.Get().ExtAuthz.Routes
+	var best *config.ExtAuthzRoute
+	bestLength := -1
+	for index := range routes {
+		route := &routes[index]
+		prefix := path.Clean("/" + route.Prefix)
+		if prefix != "/" && requestPath != prefix && !strings.HasPrefix(requestPath, prefix+"/") {
+			continue
+		}
+		if route.Host != "" && !strings.EqualFold(route.Host, httpRequest.GetHost()) {
+			continue
+		}
+		if len(route.Methods) > 0 && !containsFold(route.Methods, httpRequest.GetMethod()) {
+			continue
+		}
+		if len(prefix) > bestLength {
+			best, bestLength = route, len(prefix)
+		}
+	}
+	return best, true
+}
+
+func allow(jwtUser tokenservice.JWTUser) *authv3.CheckResponse {
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(codes.OK)},
+		HttpResponse: &authv3.CheckResponse_OkResponse{
+			OkResponse: &authv3.OkHttpResponse{
+				// Always overwrite these, so clients can't send their own
+				Headers: []*corev3.HeaderValueOption{
+					header(authUserHeader, jwtUser.Username),
+					header(authRolesHeader, strings.Join(jwtUser.Roles, ",")),
+					header(authScopesHeader, strings.Join(jwtUser.Scopes, ",")),
+				},
+			},
+		},
+	}
+}
+
+// peerCertificate returns the client's TLS certificate, which Envoy only
+// sends when include_peer_certificate is set
+func peerCertificate(request *authv3.CheckRequest) *x509.Certificate {
+	encoded, err := url.QueryUnescape(request.GetAttributes().GetSource().GetCertificate())
+	if err != nil || encoded == "" {
+		return nil
+	}
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil
+	}
+	return certificate
+}
+
+// deny refuses a request, with the same problem details the auth server's
+// own endpoints respond with
+func deny(problemErr *problem.Error) *authv3.CheckResponse {
+	body, _ := json.Marshal(problemErr.Details(""))
+	headers := []*corev3.HeaderValueOption{header("Content-Type", problem.ContentType)}
+	if challenge := problemErr.Challenge(); challenge != "" {
+		headers = append(headers, header("WWW-Authenticate", challenge))
+	}
+	code := codes.Unauthenticated
+	switch problemErr.Status {
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	}
+
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(code), Message: problemErr.Detail},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode(problemErr.Status)},
+				Headers: headers,
+				Body:    string(body),
+			},
+		},
+	}
+}
+
+func header(key string, value string) *corev3.HeaderValueOption {
+	return &corev3.HeaderValueOption{
+		Header: &corev3.HeaderValue{Key: key, Value: value},
+		Append: &wrappers.BoolValue{Value: false},
+	}
+}
+
+func containsFold(items []string, value string) bool {
+	for _, item := range items {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
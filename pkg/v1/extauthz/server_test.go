@@ -0,0 +1,203 @@
+package extauthz
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/test/bufconn"
+
+	"auth-server/pkg/config"
+	tokenservice "auth-server/pkg/v1/service"
+)
+
+func testConfig(t *testing.T) config.Config {
+	routes, _ := json.Marshal([]config.ExtAuthzRoute{
+		{Prefix: "/admin", Roles: []string{"admin"}},
+		{Prefix: "/reports", Methods: []string{"GET"}, Scopes: []string{"reports:read"}},
+		{Prefix: "/public", Public: true},
+		{Prefix: "/public/private"},
+		{Prefix: "/internal", Host: "internal.example", Public: true},
+	})
+	appConfig, err := config.Load(config.LoadOptions{Overrides: map[string]string{
+		"ACCESS_TOKEN_SECRET":  strings.Repeat("a", 32),
+		"REFRESH_TOKEN_SECRET": strings.Repeat("r", 32),
+		"ACTION_TOKEN_SECRET":  strings.Repeat("x", 32),
+		"EXT_AUTHZ_ROUTES":     string(routes),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return appConfig
+}
+
+// newTestClient serves the authorization service over an in-memory connection
+func newTestClient(t *testing.T, configHolder *config.Holder) authv3.AuthorizationClient {
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	NewServer(configHolder, tokenservice.NewJWTService(configHolder, nil)).Register(grpcServer)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	connection, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { connection.Close() })
+	return authv3.NewAuthorizationClient(connection)
+}
+
+// testCertificate creates a self-signed client certificate, as Envoy would
+// pass it on: URL-encoded PEM
+func testCertificate(t *testing.T, name string) (*x509.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+}
+
+func TestCheck(t *testing.T) {
+	appConfig := testConfig(t)
+	configHolder := config.NewHolder(appConfig)
+	client := newTestClient(t, configHolder)
+	jwtService := tokenservice.NewJWTService(configHolder, nil)
+	ctx := context.Background()
+
+	token := func(user tokenservice.JWTUser) string {
+		accessToken, _, err := jwtService.GenerateToken(ctx, user, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return accessToken
+	}
+	userToken := token(tokenservice.JWTUser{Username: "alice"})
+	adminToken := token(tokenservice.JWTUser{Username: "root", Roles: []string{"admin"}})
+	readerToken := token(tokenservice.JWTUser{Username: "bob", Scopes: []string{"reports:read"}})
+
+	// Tokens issued under a config whose tokens expire before they're issued
+	expiredConfig := appConfig
+	expiredConfig.AccessTokenExpire = -time.Minute
+	expiredToken, _, err := tokenservice.NewJWTService(config.NewHolder(expiredConfig), nil).GenerateToken(ctx, tokenservice.JWTUser{Username: "alice"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, encodedCertificate := testCertificate(t, "billing")
+	_, otherCertificate := testCertificate(t, "billing")
+	boundToken, _, err := jwtService.GenerateBoundToken(ctx, tokenservice.JWTUser{ClientID: "billing", Username: "billing"}, false,
+		&tokenservice.Confirmation{CertificateThumbprint: tokenservice.CertificateThumbprint(certificate)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		host        string
+		path        string
+		token       string
+		certificate string
+		wantCode    codes.Code
+		wantStatus  int32
+		wantUser    string
+	}{
+		{name: "valid token", path: "/orders", token: userToken, wantCode: codes.OK, wantUser: "alice"},
+		{name: "missing token", path: "/orders", wantCode: codes.Unauthenticated, wantStatus: 401},
+		{name: "invalid token", path: "/orders", token: "not.a.token", wantCode: codes.Unauthenticated, wantStatus: 401},
+		{name: "expired token", path: "/orders", token: expiredToken, wantCode: codes.Unauthenticated, wantStatus: 401},
+
+		{name: "role present", path: "/admin/users", token: adminToken, wantCode: codes.OK, wantUser: "root"},
+		{name: "role missing", path: "/admin/users", token: userToken, wantCode: codes.PermissionDenied, wantStatus: 403},
+		{name: "role route itself", path: "/admin", token: userToken, wantCode: codes.PermissionDenied, wantStatus: 403},
+		{name: "scope present", path: "/reports/daily", token: readerToken, wantCode: codes.OK, wantUser: "bob"},
+		{name: "scope missing", path: "/reports/daily", token: userToken, wantCode: codes.PermissionDenied, wantStatus: 403},
+		{name: "scope route for another method", method: "POST", path: "/reports/daily", token: userToken, wantCode: codes.OK, wantUser: "alice"},
+
+		{name: "public", path: "/public/logo.png", wantCode: codes.OK},
+		{name: "longer prefix wins over public", path: "/public/private/file", wantCode: codes.Unauthenticated, wantStatus: 401},
+		{name: "public route for another host", path: "/internal/status", wantCode: codes.Unauthenticated, wantStatus: 401},
+		{name: "public route for its host", host: "internal.example", path: "/internal/status", wantCode: codes.OK},
+
+		{name: "prefix only matches whole segments", path: "/administrators", token: userToken, wantCode: codes.OK, wantUser: "alice"},
+		{name: "dot segments are cleaned", path: "/public/../admin/users", token: userToken, wantCode: codes.PermissionDenied, wantStatus: 403},
+		{name: "encoded path is decoded", path: "/%61dmin/users", token: userToken, wantCode: codes.PermissionDenied, wantStatus: 403},
+		{name: "encoded slashes are decoded", path: "/public%2F..%2Fadmin", token: userToken, wantCode: codes.PermissionDenied, wantStatus: 403},
+		{name: "doubled slashes are cleaned", path: "//admin", token: userToken, wantCode: codes.PermissionDenied, wantStatus: 403},
+		{name: "query string is ignored", path: "/admin?x=/public", token: userToken, wantCode: codes.PermissionDenied, wantStatus: 403},
+		{name: "undecodable path", path: "/admin%zz", token: adminToken, wantCode: codes.InvalidArgument, wantStatus: 400},
+
+		{name: "certificate-bound token with its certificate", path: "/orders", token: boundToken, certificate: encodedCertificate, wantCode: codes.OK, wantUser: "billing"},
+		{name: "certificate-bound token without a certificate", path: "/orders", token: boundToken, wantCode: codes.Unauthenticated, wantStatus: 401},
+		{name: "certificate-bound token with another certificate", path: "/orders", token: boundToken, certificate: otherCertificate, wantCode: codes.Unauthenticated, wantStatus: 401},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method := test.method
+			if method == "" {
+				method = "GET"
+			}
+			headers := map[string]string{}
+			if test.token != "" {
+				headers[authorizationHeader] = "Bearer " + test.token
+			}
+			response, err := client.Check(ctx, &authv3.CheckRequest{Attributes: &authv3.AttributeContext{
+				Source: &authv3.AttributeContext_Peer{Certificate: test.certificate},
+				Request: &authv3.AttributeContext_Request{Http: &authv3.AttributeContext_HttpRequest{
+					Method: method, Host: test.host, Path: test.path, Headers: headers,
+				}},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if code := codes.Code(response.GetStatus().GetCode()); code != test.wantCode {
+				t.Fatalf("got code %s, want %s", code, test.wantCode)
+			}
+			if test.wantCode != codes.OK {
+				if status := int32(response.GetDeniedResponse().GetStatus().GetCode()); status != test.wantStatus {
+					t.Errorf("got HTTP status %d, want %d", status, test.wantStatus)
+				}
+				return
+			}
+			headers = map[string]string{}
+			for _, header := range response.GetOkResponse().GetHeaders() {
+				headers[header.GetHeader().GetKey()] = header.GetHeader().GetValue()
+			}
+			if headers[authUserHeader] != test.wantUser {
+				t.Errorf("got %s %q, want %q", authUserHeader, headers[authUserHeader], test.wantUser)
+			}
+		})
+	}
+}
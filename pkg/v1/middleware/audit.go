@@ -0,0 +1,16 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"auth-server/pkg/audit"
+)
+
+// Audit makes sink available to downstream controllers as "audit", for
+// recording security events. It's separate from GinLogger, which logs
+// every request.
+func Audit(sink audit.AuditSink) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		context.Set("audit", sink)
+	}
+}
@@ -1,47 +1,219 @@
 package middleware
 
 import (
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 
+	"auth-server/pkg/dpop"
+	"auth-server/pkg/metrics"
+	"auth-server/pkg/problem"
+	"auth-server/pkg/resourceserver"
 	tokenservice "auth-server/pkg/v1/service"
 )
 
 const (
 	authorizationHeader string = "Authorization"
+	apiKeyHeader        string = "X-API-Key"
+	apiKeyScheme        string = "ApiKey"
 )
 
-// AuthorizeToken checks that a JWT token is valid and attaches the corresponding JWTUser to the context
-func AuthorizeToken(jwtService tokenservice.JWTService) gin.HandlerFunc {
+// AuthorizeToken checks that a JWT token is valid and attaches the corresponding JWTUser to the context.
+// When apiKeyService is set, an API key may be used instead, in the X-API-Key header or as an
+// "Authorization: ApiKey ..." header. Its owner is attached in the same way.
+// When dpopService is set, DPoP-bound tokens are accepted with the DPoP scheme.
+func AuthorizeToken(jwtService tokenservice.JWTService, apiKeyService tokenservice.APIKeyService, dpopService tokenservice.DPoPService) gin.HandlerFunc {
 	return func(context *gin.Context) {
-		authHeader := context.GetHeader(authorizationHeader)
-		if authHeader == "" {
-			context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("Missing %s header", authorizationHeader)})
+		// Trace authentication on its own, then return to the request's span
+		requestContext := context.Request.Context()
+		ctx, span := tracer.Start(requestContext, "AuthorizeToken")
+		context.Request = context.Request.WithContext(ctx)
+		jwtUser, problemErr := Authenticate(context, jwtService, apiKeyService, dpopService, "")
+		if problemErr != nil {
+			span.RecordError(problemErr)
+		}
+		span.End()
+		context.Request = context.Request.WithContext(requestContext)
+		if problemErr != nil {
+			problem.Abort(context, problemErr)
 			return
 		}
+		context.Set("user", jwtUser)
+		LogCaller(context, jwtUser)
 
-		splits := strings.Split(authHeader, " ")
-		if len(splits) < 2 {
-			context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing token"})
+		// TODO: Optionally check other fields on a user, like roles
+	}
+}
+
+// AuthorizeResourceServer checks access tokens with a resourceserver Validator, the way other
+// services check them, so its issuer, audience and leeway settings apply. API keys are checked
+// with apiKeyService first, as the validator doesn't know them. Either way the caller is attached
+// as a JWTUser, and the claims of a token as with Validator.GinMiddleware. validator is called
+// for each request, so it can be replaced along with the config.
+func AuthorizeResourceServer(validator func() *resourceserver.Validator, apiKeyService tokenservice.APIKeyService) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if rawKey, found := apiKeyFromRequest(context); found {
+			jwtUser, problemErr := authenticateAPIKey(context, apiKeyService, rawKey)
+			if problemErr != nil {
+				problem.Abort(context, problemErr)
+				return
+			}
+			context.Set("user", jwtUser)
+			LogCaller(context, jwtUser)
 			return
 		}
 
-		tokenString := splits[1]
-		token, authClaims, err := jwtService.ValidateAccessToken(tokenString)
+		tokenValidator := validator()
+		claims, err := tokenValidator.ValidateRequest(context.Request)
 		if err != nil {
-			context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			if nonce := tokenValidator.DPoPNonce(); nonce != "" {
+				context.Header(dpop.NonceHeader, nonce)
+			}
+			problem.Abort(context, resourceserver.Problem(err))
 			return
 		}
+		jwtUser := tokenservice.JWTUser(claims.User)
+		context.Set(resourceserver.GinContextKey, claims)
+		context.Request = context.Request.WithContext(resourceserver.NewContext(context.Request.Context(), claims))
+		context.Set("user", jwtUser)
+		LogCaller(context, jwtUser)
+	}
+}
 
-		if !token.Valid {
-			context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Invalid access token"})
-			return
+// Authenticate finds the caller's credentials and checks them, without aborting the request. On
+// failure it returns the problem to respond with. When tokenCookie is set, the access token
+// may also be sent in a cookie of that name. Certificate-bound access tokens are only accepted
+// over a connection using the same TLS client certificate. DPoP-bound access tokens are only
+// accepted with the DPoP scheme and a proof signed with the same key, which needs dpopService.
+func Authenticate(context *gin.Context, jwtService tokenservice.JWTService, apiKeyService tokenservice.APIKeyService, dpopService tokenservice.DPoPService, tokenCookie string) (tokenservice.JWTUser, *problem.Error) {
+	if rawKey, found := apiKeyFromRequest(context); found && apiKeyService != nil {
+		return authenticateAPIKey(context, apiKeyService, rawKey)
+	}
+
+	var scheme, tokenString string
+	authHeader := context.GetHeader(authorizationHeader)
+	if authHeader == "" && tokenCookie != "" {
+		tokenString, _ = context.Cookie(tokenCookie)
+	}
+	if authHeader == "" && tokenString == "" {
+		metrics.ValidationFailures.WithLabelValues(metrics.ReasonMissing).Inc()
+		return tokenservice.JWTUser{}, problem.New(problem.MissingToken, fmt.Sprintf("Missing %s header", authorizationHeader))
+	}
+
+	if tokenString == "" {
+		splits := strings.Split(authHeader, " ")
+		if len(splits) < 2 {
+			metrics.ValidationFailures.WithLabelValues(metrics.ReasonMissing).Inc()
+			return tokenservice.JWTUser{}, problem.New(problem.InvalidToken, fmt.Sprintf("The %s header has no token", authorizationHeader))
 		}
-		context.Set("user", authClaims.User)
+		scheme, tokenString = splits[0], splits[1]
+	}
 
-		// TODO: Optionally check other fields on a user, like roles
+	token, authClaims, err := jwtService.ValidateAccessToken(context.Request.Context(), tokenString)
+	if err != nil {
+		reason := metrics.TokenFailureReason(err)
+		metrics.ValidationFailures.WithLabelValues(reason).Inc()
+		if reason == metrics.ReasonExpired {
+			return tokenservice.JWTUser{}, &problem.Error{Problem: problem.TokenExpired, Detail: "The access token has expired", Cause: err, Scheme: tokenScheme(scheme)}
+		}
+		return tokenservice.JWTUser{}, &problem.Error{Problem: problem.InvalidToken, Detail: "The access token is invalid", Cause: err, Scheme: tokenScheme(scheme)}
+	}
+
+	if !token.Valid {
+		metrics.ValidationFailures.WithLabelValues(metrics.ReasonInvalid).Inc()
+		return tokenservice.JWTUser{}, &problem.Error{Problem: problem.InvalidToken, Detail: "The access token is invalid", Scheme: tokenScheme(scheme)}
+	}
+	if err := authClaims.Confirmation.CheckCertificate(ClientCertificate(context.Request)); err != nil {
+		metrics.ValidationFailures.WithLabelValues(metrics.ReasonCertificate).Inc()
+		return tokenservice.JWTUser{}, problem.New(problem.InvalidToken, err.Error())
+	}
+	if problemErr := checkDPoP(context, dpopService, scheme, tokenString, authClaims.Confirmation.BoundKey()); problemErr != nil {
+		metrics.ValidationFailures.WithLabelValues(metrics.ReasonDPoP).Inc()
+		return tokenservice.JWTUser{}, problemErr
+	}
+	return authClaims.User, nil
+}
+
+// authenticateAPIKey checks an API key, returning its owner. Routes that
+// mustn't be used with a key can tell from "api_key" in the context.
+func authenticateAPIKey(context *gin.Context, apiKeyService tokenservice.APIKeyService, rawKey string) (tokenservice.JWTUser, *problem.Error) {
+	jwtUser, err := apiKeyService.Authenticate(context.Request.Context(), rawKey)
+	if errors.Is(err, tokenservice.ErrInvalidAPIKey) {
+		return tokenservice.JWTUser{}, &problem.Error{Problem: problem.InvalidAPIKey, Scheme: apiKeyScheme}
+	}
+	if err != nil {
+		return tokenservice.JWTUser{}, problem.Wrap(problem.Internal, err)
+	}
+	context.Set("api_key", true)
+	return jwtUser, nil
+}
+
+// checkDPoP makes sure DPoP-bound tokens come with the DPoP scheme and a
+// proof signed with the key they're bound to, and that other tokens don't.
+// A nonce for the next proof is sent whenever one is needed.
+func checkDPoP(context *gin.Context, dpopService tokenservice.DPoPService, scheme string, tokenString string, boundKey string) *problem.Error {
+	if !strings.EqualFold(scheme, dpop.Scheme) {
+		if boundKey != "" {
+			return problem.New(problem.InvalidToken, fmt.Sprintf("Access token is bound to a DPoP key, and must be sent with the %s scheme", dpop.Scheme))
+		}
+		return nil
+	}
+	if boundKey == "" {
+		return &problem.Error{Problem: problem.InvalidToken, Detail: "Access token isn't bound to a DPoP key", Scheme: dpop.Scheme}
+	}
+	if dpopService == nil {
+		return &problem.Error{Problem: problem.InvalidToken, Detail: "DPoP-bound access tokens aren't accepted here", Scheme: dpop.Scheme}
+	}
+
+	proofs := context.Request.Header.Values(dpop.Header)
+	if len(proofs) != 1 {
+		return &problem.Error{Problem: problem.InvalidDPoPProof, Detail: fmt.Sprintf("Exactly one %s header is required", dpop.Header), Scheme: dpop.Scheme}
+	}
+	thumbprint, err := dpopService.Verify(proofs[0], context.Request.Method, context.Request.URL.Path, tokenString)
+	if nonce := dpopService.Nonce(); nonce != "" {
+		context.Header(dpop.NonceHeader, nonce)
+	}
+	if errors.Is(err, dpop.ErrUseNonce) {
+		return &problem.Error{Problem: problem.UseDPoPNonce, Scheme: dpop.Scheme}
+	}
+	if err != nil {
+		return &problem.Error{Problem: problem.InvalidDPoPProof, Cause: err, Scheme: dpop.Scheme}
+	}
+	if thumbprint != boundKey {
+		return &problem.Error{Problem: problem.InvalidToken, Detail: "Access token is bound to a different DPoP key", Scheme: dpop.Scheme}
+	}
+	return nil
+}
+
+// tokenScheme is the scheme to challenge for a token sent with scheme
+func tokenScheme(scheme string) string {
+	if strings.EqualFold(scheme, dpop.Scheme) {
+		return dpop.Scheme
+	}
+	return ""
+}
+
+// ClientCertificate returns the TLS client certificate the request was sent with, if any. The
+// server has already checked it was issued by TLS_CLIENT_CA_FILE.
+func ClientCertificate(request *http.Request) *x509.Certificate {
+	if request.TLS == nil || len(request.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return request.TLS.PeerCertificates[0]
+}
+
+// apiKeyFromRequest finds an API key in either of the supported headers
+func apiKeyFromRequest(context *gin.Context) (string, bool) {
+	if rawKey := context.GetHeader(apiKeyHeader); rawKey != "" {
+		return rawKey, true
+	}
+	splits := strings.SplitN(context.GetHeader(authorizationHeader), " ", 2)
+	if len(splits) == 2 && strings.EqualFold(splits[0], apiKeyScheme) {
+		return strings.TrimSpace(splits[1]), true
 	}
+	return "", false
 }
@@ -1,29 +1,57 @@
 package middleware
 
 import (
+	"math/rand"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+
+	"auth-server/pkg/config"
+	tokenservice "auth-server/pkg/v1/service"
+)
+
+const (
+	redacted string = "[REDACTED]"
+	// allHeaders in LOG_HEADERS logs every request header
+	allHeaders string = "*"
 )
 
 // GinLogger creates a contextual logger used for request/response information. The logger is
 // also added to the request context, should any downstream controllers wish to use it.
-func GinLogger() gin.HandlerFunc {
+// Successful requests to LOG_SKIP_PATHS, such as health checks, aren't logged, and only
+// LOG_SAMPLE_RATIO of the other successful requests are.
+func GinLogger(configHolder *config.Holder) gin.HandlerFunc {
 	logger := log.StandardLogger()
 
 	return func(context *gin.Context) {
+		logConfig := configHolder.Get().Log
+
 		// Create a contextual logger for downstream controllers
-		contextLogger := logger.WithFields(
-			log.Fields{
-				"method":     context.Request.Method,
-				"uri":        context.Request.RequestURI,
-				"referer":    context.Request.Referer(),
-				"source_ip":  context.ClientIP(),
-				"user_agent": context.Request.UserAgent(),
-			},
-		)
+		fields := log.Fields{
+			"method":     context.Request.Method,
+			"uri":        redactQuery(context.Request.RequestURI, logConfig.RedactQueryParams),
+			"referer":    redactQuery(context.Request.Referer(), logConfig.RedactQueryParams),
+			"source_ip":  context.ClientIP(),
+			"user_agent": context.Request.UserAgent(),
+		}
+		// Set when RequestID has run first
+		if requestID := context.GetString("request_id"); requestID != "" {
+			fields["request_id"] = requestID
+		}
+		if headers := loggedHeaders(context.Request.Header, logConfig); len(headers) > 0 {
+			fields["headers"] = headers
+		}
+		// Set when Tracing has started a span for the request
+		if spanContext := trace.SpanContextFromContext(context.Request.Context()); spanContext.IsValid() {
+			fields["trace_id"] = spanContext.TraceID().String()
+			fields["span_id"] = spanContext.SpanID().String()
+		}
+		contextLogger := logger.WithFields(fields)
 
 		context.Set("request_logger", contextLogger)
 
@@ -32,6 +60,11 @@ func GinLogger() gin.HandlerFunc {
 		// Fulfill request
 		context.Next()
 
+		// Pick up fields added while handling the request, such as the caller
+		if requestLogger, ok := context.Value("request_logger").(*log.Entry); ok {
+			contextLogger = requestLogger
+		}
+
 		dataLength := context.Writer.Size()
 		if dataLength < 0 {
 			dataLength = 0
@@ -44,7 +77,7 @@ func GinLogger() gin.HandlerFunc {
 				"logger":              "RequestLogger",
 				"status":              statusCode,
 				"response_data_bytes": dataLength,
-				"latency_ns":          time.Since(startTime),
+				"latency_ns":          time.Since(startTime).Nanoseconds(),
 			},
 		)
 
@@ -53,6 +86,15 @@ func GinLogger() gin.HandlerFunc {
 			return
 		}
 
+		if statusCode < http.StatusBadRequest {
+			if skipPath(logConfig.SkipPaths, context.Request.URL.Path) {
+				return
+			}
+			if logConfig.SampleRatio < 1 && rand.Float64() >= logConfig.SampleRatio {
+				return
+			}
+		}
+
 		message := "Request finished"
 		if statusCode >= http.StatusInternalServerError {
 			contextLogger.Error(message)
@@ -63,3 +105,72 @@ func GinLogger() gin.HandlerFunc {
 		}
 	}
 }
+
+// LogCaller adds who's making a request to its logs, once they're known
+func LogCaller(context *gin.Context, jwtUser tokenservice.JWTUser) {
+	requestLogger, ok := context.Value("request_logger").(*log.Entry)
+	if !ok {
+		return
+	}
+	fields := log.Fields{"subject": jwtUser.Username}
+	if jwtUser.ClientID != "" {
+		fields["client_id"] = jwtUser.ClientID
+	}
+	context.Set("request_logger", requestLogger.WithFields(fields))
+}
+
+func skipPath(skipPaths []string, path string) bool {
+	for _, skipPath := range skipPaths {
+		if path == skipPath {
+			return true
+		}
+	}
+	return false
+}
+
+// redactQuery hides the values of sensitive query parameters in a URI,
+// leaving the rest as it was sent
+func redactQuery(uri string, params []string) string {
+	index := strings.IndexByte(uri, '?')
+	if index < 0 || len(params) == 0 {
+		return uri
+	}
+	pairs := strings.Split(uri[index+1:], "&")
+	for i, pair := range pairs {
+		rawKey := strings.SplitN(pair, "=", 2)[0]
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			key = rawKey
+		}
+		if containsFold(params, key) {
+			pairs[i] = rawKey + "=" + redacted
+		}
+	}
+	return uri[:index+1] + strings.Join(pairs, "&")
+}
+
+// loggedHeaders picks the request headers to log, hiding sensitive values
+func loggedHeaders(header http.Header, logConfig config.LogConfig) map[string]string {
+	headers := map[string]string{}
+	all := containsFold(logConfig.Headers, allHeaders)
+	for name, values := range header {
+		if !all && !containsFold(logConfig.Headers, name) {
+			continue
+		}
+		if containsFold(logConfig.RedactHeaders, name) {
+			headers[name] = redacted
+			continue
+		}
+		headers[name] = strings.Join(values, ", ")
+	}
+	return headers
+}
+
+func containsFold(items []string, value string) bool {
+	for _, item := range items {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"auth-server/pkg/metrics"
+)
+
+// Metrics records how long each request takes, by the route pattern it
+// matched. Requests matching no route are recorded without a method or
+// route, so clients can't create new series.
+func Metrics() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		startTime := time.Now()
+
+		context.Next()
+
+		method, route := context.Request.Method, context.FullPath()
+		if route == "" {
+			method = ""
+		}
+		metrics.RequestDuration.WithLabelValues(method, route, strconv.Itoa(context.Writer.Status())).Observe(metrics.Since(startTime))
+	}
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// RequestIDHeader carries the ID of a request, both ways
+	RequestIDHeader string = "X-Request-ID"
+
+	maxRequestIDLength int = 128
+)
+
+// RequestID gives each request an ID, so its logs and error responses can
+// be tied together. The caller's X-Request-ID is kept when it's sensible,
+// so a proxy's ID carries through; otherwise a new one is made. The ID is
+// echoed in the response, and set as "request_id" in the context.
+// Use it before GinLogger, so request logs carry the ID.
+func RequestID() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		requestID := context.GetHeader(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		context.Set("request_id", requestID)
+		context.Header(RequestIDHeader, requestID)
+		trace.SpanFromContext(context.Request.Context()).SetAttributes(attribute.String("http.request_id", requestID))
+
+		context.Next()
+	}
+}
+
+// validRequestID accepts printable ASCII without spaces, so IDs can't
+// forge log lines or headers
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, char := range requestID {
+		if char <= ' ' || char > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	buffer := make([]byte, 16)
+	if _, err := rand.Read(buffer); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buffer)
+}
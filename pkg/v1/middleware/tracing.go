@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("auth-server/pkg/v1/middleware")
+
+// Tracing starts a span for each request, continuing the caller's trace
+// when it sends a W3C traceparent header. The span is added to the request
+// context, so anything traced while handling the request is part of it.
+// Use it before GinLogger, so request logs carry the trace and span IDs.
+func Tracing() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(context.Request.Context(), propagation.HeaderCarrier(context.Request.Header))
+
+		// Name spans after the route rather than the path, which may hold IDs
+		route := context.FullPath()
+		name := context.Request.Method + " " + route
+		if route == "" {
+			name = context.Request.Method
+		}
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(context.Request.Method),
+				semconv.HTTPRouteKey.String(route),
+				semconv.HTTPTargetKey.String(context.Request.URL.Path),
+				semconv.HTTPClientIPKey.String(context.ClientIP()),
+				semconv.HTTPUserAgentKey.String(context.Request.UserAgent()),
+			),
+		)
+		defer span.End()
+		context.Request = context.Request.WithContext(ctx)
+
+		// Fulfill request
+		context.Next()
+
+		status := context.Writer.Status()
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+		// Client errors are the client's problem, not the server's
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
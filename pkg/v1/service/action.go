@@ -0,0 +1,135 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"auth-server/pkg/config"
+)
+
+const (
+	// ActionVerifyEmail confirms ownership of an email address
+	ActionVerifyEmail string = "verify_email"
+	// ActionResetPassword lets a user choose a new password
+	ActionResetPassword string = "reset_password"
+	// ActionEmailLogin logs a user in from a magic link
+	ActionEmailLogin string = "email_login"
+)
+
+// ErrInvalidActionToken is returned for action tokens that are malformed,
+// expired, meant for another action, or already used.
+var ErrInvalidActionToken = errors.New("Invalid or expired token")
+
+// ActionTokenService issues signed, expiring, single-use tokens that are
+// emailed to users to confirm an action.
+type ActionTokenService interface {
+	Issue(action string, subject string, fingerprint string, expire time.Duration) (string, error)
+	Validate(action string, encodedToken string) (*ActionClaims, error)
+	Consume(action string, encodedToken string) (*ActionClaims, error)
+}
+
+// ActionClaims identifies the user and the action a token was issued for.
+// Fingerprint captures the state the action depends on, so callers can
+// reject tokens issued before that state changed. Used tokens are only
+// remembered in memory, so actions that must stay single use across restarts
+// and replicas need a fingerprint that using the token changes.
+type ActionClaims struct {
+	jwt.StandardClaims
+	Action      string `json:"act"`
+	Fingerprint string `json:"fp,omitempty"`
+}
+
+type actionTokenService struct {
+	config *config.Holder
+	lock   sync.Mutex
+	// usedTokens maps the ID of each consumed token to its expiry, so it
+	// can be forgotten once it would be rejected anyway.
+	usedTokens map[string]int64
+}
+
+// NewActionTokenService creates an ActionTokenService signing with ACTION_TOKEN_SECRET
+func NewActionTokenService(config *config.Holder) ActionTokenService {
+	return &actionTokenService{
+		config:     config,
+		usedTokens: map[string]int64{},
+	}
+}
+
+func (s *actionTokenService) Issue(action string, subject string, fingerprint string, expire time.Duration) (string, error) {
+	tokenID, err := randomID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := &ActionClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:      tokenID,
+			Subject: subject,
+
+			ExpiresAt: now.Add(expire).Unix(),
+			Issuer:    s.config.Get().Issuer,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+		},
+		Action:      action,
+		Fingerprint: fingerprint,
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(s.config.Get().ActionTokenSecret))
+}
+
+// Validate checks a token without using it up
+func (s *actionTokenService) Validate(action string, encodedToken string) (*ActionClaims, error) {
+	claims := &ActionClaims{}
+	token, err := jwt.ParseWithClaims(encodedToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, valid := token.Method.(*jwt.SigningMethodHMAC); !valid {
+			return nil, fmt.Errorf("Invalid token algorithm %v", token.Header["alg"])
+		}
+		return []byte(s.config.Get().ActionTokenSecret), nil
+	})
+	if err != nil || !token.Valid || claims.Action != action || claims.Id == "" {
+		return nil, ErrInvalidActionToken
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, used := s.usedTokens[claims.Id]; used {
+		return nil, ErrInvalidActionToken
+	}
+	return claims, nil
+}
+
+// Consume checks a token and marks it as used
+func (s *actionTokenService) Consume(action string, encodedToken string) (*ActionClaims, error) {
+	claims, err := s.Validate(action, encodedToken)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now().Unix()
+	for tokenID, expiresAt := range s.usedTokens {
+		if expiresAt < now {
+			delete(s.usedTokens, tokenID)
+		}
+	}
+	if _, used := s.usedTokens[claims.Id]; used {
+		return nil, ErrInvalidActionToken
+	}
+	s.usedTokens[claims.Id] = claims.ExpiresAt
+
+	return claims, nil
+}
+
+// randomID returns 128 random bits, hex-encoded
+func randomID() (string, error) {
+	return randomHex(16)
+}
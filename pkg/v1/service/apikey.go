@@ -0,0 +1,166 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"auth-server/pkg/config"
+	"auth-server/pkg/store"
+)
+
+const (
+	// apiKeyPrefix starts every API key, to make them easy to recognize
+	apiKeyPrefix string = "ak_"
+	// lastUsedResolution limits how often using a key is written to the store
+	lastUsedResolution time.Duration = time.Minute
+)
+
+// ErrInvalidAPIKey is returned for API keys that are malformed, unknown, expired or whose owner is gone
+var ErrInvalidAPIKey = errors.New("Invalid API key")
+
+// APIKeyService manages API keys and authenticates requests made with them.
+// Keys look like "ak_<id>_<secret>", and only a hash of the secret is stored.
+type APIKeyService interface {
+	Create(ctx context.Context, ownerType string, owner string, name string, scopes []string, expiresAt time.Time) (store.APIKey, string, error)
+	Get(ctx context.Context, id string) (store.APIKey, error)
+	List(ctx context.Context, ownerType string, owner string) ([]store.APIKey, error)
+	Update(ctx context.Context, key store.APIKey) error
+	Delete(ctx context.Context, id string) error
+	Authenticate(ctx context.Context, rawKey string) (JWTUser, error)
+}
+
+type apiKeyService struct {
+	log    *log.Entry
+	config *config.Holder
+	keys   store.APIKeyStore
+	users  store.UserStore
+}
+
+func NewAPIKeyService(config *config.Holder, keys store.APIKeyStore, users store.UserStore) APIKeyService {
+	return &apiKeyService{
+		log:    log.WithFields(log.Fields{"logger": "APIKeyServiceV1"}),
+		config: config,
+		keys:   keys,
+		users:  users,
+	}
+}
+
+// Create stores a new key, returning the full key. This is the only time it
+// is available, so it must be handed to the caller.
+func (s *apiKeyService) Create(ctx context.Context, ownerType string, owner string, name string, scopes []string, expiresAt time.Time) (store.APIKey, string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return store.APIKey{}, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return store.APIKey{}, "", err
+	}
+
+	key := store.APIKey{
+		ID:         id,
+		Name:       name,
+		OwnerType:  ownerType,
+		Owner:      owner,
+		SecretHash: hashSecret(secret),
+		Scopes:     scopes,
+		CreatedAt:  time.Now().UTC(),
+		ExpiresAt:  expiresAt,
+	}
+	if err := s.keys.Create(ctx, key); err != nil {
+		return store.APIKey{}, "", err
+	}
+	return key, apiKeyPrefix + id + "_" + secret, nil
+}
+
+func (s *apiKeyService) Get(ctx context.Context, id string) (store.APIKey, error) {
+	return s.keys.Get(ctx, id)
+}
+
+func (s *apiKeyService) List(ctx context.Context, ownerType string, owner string) ([]store.APIKey, error) {
+	return s.keys.List(ctx, ownerType, owner)
+}
+
+func (s *apiKeyService) Update(ctx context.Context, key store.APIKey) error {
+	return s.keys.Update(ctx, key)
+}
+
+func (s *apiKeyService) Delete(ctx context.Context, id string) error {
+	return s.keys.Delete(ctx, id)
+}
+
+// Authenticate describes the owner of a key in the same way as the owner of
+// an access token, with the owner's current roles, limited to the key's
+// scopes that the owner still has.
+func (s *apiKeyService) Authenticate(ctx context.Context, rawKey string) (JWTUser, error) {
+	if !strings.HasPrefix(rawKey, apiKeyPrefix) {
+		return JWTUser{}, ErrInvalidAPIKey
+	}
+	parts := strings.SplitN(strings.TrimPrefix(rawKey, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 {
+		return JWTUser{}, ErrInvalidAPIKey
+	}
+
+	key, err := s.keys.Get(ctx, parts[0])
+	if errors.Is(err, store.ErrNotFound) {
+		return JWTUser{}, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return JWTUser{}, err
+	}
+
+	now := time.Now().UTC()
+	if subtle.ConstantTimeCompare([]byte(hashSecret(parts[1])), []byte(key.SecretHash)) != 1 || key.Expired(now) {
+		return JWTUser{}, ErrInvalidAPIKey
+	}
+
+	jwtUser := JWTUser{Username: key.Owner}
+	var ownerScopes []string
+	switch key.OwnerType {
+	case store.OwnerUser:
+		user, err := s.users.Get(ctx, key.Owner)
+		if err != nil || user.Disabled {
+			return JWTUser{}, ErrInvalidAPIKey
+		}
+		jwtUser.Roles = user.Roles
+		ownerScopes = user.Scopes
+	case store.OwnerClient:
+		client, found := findClient(s.config.Get().Clients, key.Owner)
+		if !found {
+			return JWTUser{}, ErrInvalidAPIKey
+		}
+		jwtUser.ClientID = key.Owner
+		jwtUser.Roles = client.Roles
+		ownerScopes = client.Scopes
+	}
+	// Scopes taken away from the owner are taken away from their keys too
+	for _, scope := range key.Scopes {
+		if contains(ownerScopes, scope) {
+			jwtUser.Scopes = append(jwtUser.Scopes, scope)
+		}
+	}
+
+	if now.Sub(key.LastUsedAt) >= lastUsedResolution {
+		key.LastUsedAt = now
+		if err := s.keys.Update(ctx, key); err != nil {
+			s.log.WithError(err).WithField("api_key", key.ID).Warn("Failed to record API key use")
+		}
+	}
+	return jwtUser, nil
+}
+
+// randomHex returns length random bytes, hex-encoded
+func randomHex(length int) (string, error) {
+	buffer := make([]byte, length)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buffer), nil
+}
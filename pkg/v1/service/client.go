@@ -0,0 +1,78 @@
+package service
+
+import (
+	"crypto/x509"
+	"errors"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"auth-server/pkg/config"
+)
+
+var (
+	// ErrInvalidClient is returned when a client isn't registered, or its certificate doesn't match
+	ErrInvalidClient = errors.New("Unknown client, or its certificate doesn't match")
+	// ErrInvalidScope is returned when a client asks for scopes it wasn't granted
+	ErrInvalidScope = errors.New("Client isn't allowed some of the requested scopes")
+)
+
+// ClientService authenticates OAuth clients registered in CLIENTS
+type ClientService interface {
+	// Authenticate checks a client's TLS certificate, returning who to issue
+	// tokens to. When scopes is not empty, the tokens only carry those scopes.
+	Authenticate(clientID string, certificate *x509.Certificate, scopes []string) (JWTUser, error)
+}
+
+type clientService struct {
+	log    *log.Entry
+	config *config.Holder
+}
+
+func NewClientService(config *config.Holder) ClientService {
+	return &clientService{
+		log:    log.WithFields(log.Fields{"logger": "ClientServiceV1"}),
+		config: config,
+	}
+}
+
+func (s *clientService) Authenticate(clientID string, certificate *x509.Certificate, scopes []string) (JWTUser, error) {
+	client, found := findClient(s.config.Get().Clients, clientID)
+	if !found || certificate == nil || !certificateMatches(client, certificate) {
+		return JWTUser{}, ErrInvalidClient
+	}
+
+	jwtUser := JWTUser{Username: client.ClientID, ClientID: client.ClientID, Roles: client.Roles, Scopes: client.Scopes}
+	if len(scopes) > 0 {
+		for _, scope := range scopes {
+			if !contains(client.Scopes, scope) {
+				return JWTUser{}, ErrInvalidScope
+			}
+		}
+		jwtUser.Scopes = scopes
+	}
+	return jwtUser, nil
+}
+
+func findClient(clients []config.ClientConfig, clientID string) (config.ClientConfig, bool) {
+	for _, client := range clients {
+		if client.ClientID == clientID {
+			return client, true
+		}
+	}
+	return config.ClientConfig{}, false
+}
+
+// certificateMatches checks the certificate is the one registered for the
+// client. The TLS handshake has already checked who issued it.
+func certificateMatches(client config.ClientConfig, certificate *x509.Certificate) bool {
+	if client.SubjectDN != "" {
+		return certificate.Subject.String() == client.SubjectDN
+	}
+	for _, name := range certificate.DNSNames {
+		if strings.EqualFold(name, client.SANDNS) {
+			return true
+		}
+	}
+	return false
+}
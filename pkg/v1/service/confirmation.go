@@ -0,0 +1,55 @@
+package service
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+)
+
+var (
+	// ErrCertificateRequired is returned when a certificate-bound token is used without a TLS client certificate
+	ErrCertificateRequired = errors.New("Access token is bound to a TLS client certificate, but none was presented")
+	// ErrCertificateMismatch is returned when a certificate-bound token is used with another certificate
+	ErrCertificateMismatch = errors.New("Access token is bound to a different TLS client certificate")
+)
+
+// Confirmation binds a token to a key, as the cnf claim (RFC 7800)
+type Confirmation struct {
+	// CertificateThumbprint binds the token to a TLS client certificate (RFC 8705)
+	CertificateThumbprint string `json:"x5t#S256,omitempty"`
+	// KeyThumbprint binds the token to the key signing its DPoP proofs (RFC 9449)
+	KeyThumbprint string `json:"jkt,omitempty"`
+}
+
+// BoundKey returns the thumbprint of the DPoP key a token is bound to, if any
+func (c *Confirmation) BoundKey() string {
+	if c == nil {
+		return ""
+	}
+	return c.KeyThumbprint
+}
+
+// CertificateThumbprint returns the base64url-encoded SHA-256 hash of a
+// certificate, as used in x5t#S256
+func CertificateThumbprint(certificate *x509.Certificate) string {
+	sum := sha256.Sum256(certificate.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// CheckCertificate makes sure a certificate-bound token is presented with
+// the certificate it's bound to. Tokens that aren't bound to a certificate
+// pass, whether or not there is one.
+func (c *Confirmation) CheckCertificate(certificate *x509.Certificate) error {
+	if c == nil || c.CertificateThumbprint == "" {
+		return nil
+	}
+	if certificate == nil {
+		return ErrCertificateRequired
+	}
+	if subtle.ConstantTimeCompare([]byte(CertificateThumbprint(certificate)), []byte(c.CertificateThumbprint)) != 1 {
+		return ErrCertificateMismatch
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package service
+
+import (
+	"auth-server/pkg/config"
+	"auth-server/pkg/dpop"
+)
+
+// DPoPService checks DPoP proofs (RFC 9449) sent to this server
+type DPoPService interface {
+	// Verify checks a proof sent with a request for path, returning the
+	// thumbprint of the key it was signed with. accessToken is set when
+	// the proof accompanies one.
+	Verify(proof string, method string, path string, accessToken string) (string, error)
+	// Nonce returns a nonce for the client's next proof, or an empty string
+	// when nonces aren't required
+	Nonce() string
+}
+
+type dpopService struct {
+	config   *config.Holder
+	verifier *dpop.Verifier
+}
+
+// NewDPoPService creates a DPoPService checking proofs against PUBLIC_URL.
+// The verifier may be shared with anything else checking proofs, so they
+// all remember which proofs were used and accept the same nonces.
+func NewDPoPService(config *config.Holder, verifier *dpop.Verifier) DPoPService {
+	return &dpopService{config: config, verifier: verifier}
+}
+
+func (s *dpopService) Verify(proof string, method string, path string, accessToken string) (string, error) {
+	return s.verifier.Verify(proof, method, s.config.Get().PublicURL+path, accessToken)
+}
+
+func (s *dpopService) Nonce() string {
+	if !s.verifier.RequiresNonce() {
+		return ""
+	}
+	return s.verifier.Nonce()
+}
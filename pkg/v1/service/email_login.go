@@ -0,0 +1,303 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"auth-server/pkg/config"
+	"auth-server/pkg/mailer"
+	"auth-server/pkg/store"
+)
+
+const (
+	// EmailLoginLink sends a magic link
+	EmailLoginLink string = "link"
+	// EmailLoginCode sends a one-time code
+	EmailLoginCode string = "code"
+)
+
+var (
+	// ErrInvalidEmailLogin is returned for a wrong, expired or already used code or link
+	ErrInvalidEmailLogin = errors.New("Invalid or expired login code")
+	// ErrUnknownEmailLoginMethod is returned when asked for something other than a link or code
+	ErrUnknownEmailLoginMethod = fmt.Errorf("Login method must be %q or %q", EmailLoginLink, EmailLoginCode)
+	// ErrTooManyEmailLogins is returned when an address has been sent too many
+	// emails, or a user has entered too many wrong codes, for now
+	ErrTooManyEmailLogins = errors.New("Too many login attempts; try again later")
+)
+
+// EmailLoginService logs users in without a password, by emailing them a
+// magic link or a one-time code. Both are bound to the browser that asked
+// for them by a nonce, which must be presented along with the link or code.
+type EmailLoginService interface {
+	Start(ctx context.Context, email string, method string) (string, error)
+	// VerifyCode and VerifyLink log a user in. When they fail, the JWTUser
+	// still has the username the code or link was sent to, if it's known,
+	// so the failure can be audited.
+	VerifyCode(ctx context.Context, nonce string, code string) (JWTUser, error)
+	VerifyLink(ctx context.Context, nonce string, encodedToken string) (JWTUser, error)
+}
+
+// loginCode is a user's outstanding one-time code. Each user has at most
+// one; a new one replaces it.
+type loginCode struct {
+	nonceHash string
+	codeHash  []byte
+	expiresAt time.Time
+}
+
+// loginWindow counts emails sent to an address, or a user's wrong codes,
+// over a window of EmailLogin.Expire from the first one
+type loginWindow struct {
+	count     int
+	expiresAt time.Time
+}
+
+type emailLoginService struct {
+	log          *log.Entry
+	config       *config.Holder
+	users        store.UserStore
+	mailer       mailer.Mailer
+	actionTokens ActionTokenService
+	lock         sync.Mutex
+	// codes are keyed by username
+	codes map[string]*loginCode
+	// failures are keyed by username, so they outlast the codes they were made against
+	failures map[string]*loginWindow
+	// emails are keyed by lowercased address, whether it belongs to a user or not
+	emails map[string]*loginWindow
+}
+
+func NewEmailLoginService(config *config.Holder, users store.UserStore, mailer mailer.Mailer, actionTokens ActionTokenService) EmailLoginService {
+	return &emailLoginService{
+		log:          log.WithFields(log.Fields{"logger": "EmailLoginServiceV1"}),
+		config:       config,
+		users:        users,
+		mailer:       mailer,
+		actionTokens: actionTokens,
+		codes:        map[string]*loginCode{},
+		failures:     map[string]*loginWindow{},
+		emails:       map[string]*loginWindow{},
+	}
+}
+
+// Start emails a link or code to the user, returning the nonce the browser
+// must hold on to. A nonce is returned even if the address isn't
+// registered, so the response doesn't reveal which addresses are. The email
+// is sent in the background, so neither does how long it takes, and failures
+// to send it are only logged. Each address can only ask for
+// EmailLogin.MaxEmails emails in a window, registered or not.
+func (s *emailLoginService) Start(ctx context.Context, email string, method string) (string, error) {
+	if method != EmailLoginLink && method != EmailLoginCode {
+		return "", ErrUnknownEmailLoginMethod
+	}
+
+	s.lock.Lock()
+	emails := s.window(s.emails, strings.ToLower(email))
+	allowed := emails.count < s.config.Get().EmailLogin.MaxEmails
+	if allowed {
+		emails.count++
+	}
+	s.lock.Unlock()
+	if !allowed {
+		return "", ErrTooManyEmailLogins
+	}
+
+	nonce, err := randomID()
+	if err != nil {
+		return "", err
+	}
+
+	user, err := s.users.GetByEmail(ctx, email)
+	if errors.Is(err, store.ErrNotFound) || (err == nil && user.Disabled) {
+		return nonce, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	send := s.sendLink
+	if method == EmailLoginCode {
+		send = s.sendCode
+	}
+	go func() {
+		if err := send(user, nonce); err != nil {
+			s.log.WithError(err).WithField("username", user.Username).Error("Failed to send login email")
+		}
+	}()
+	return nonce, nil
+}
+
+// VerifyCode logs in with the code sent for nonce. Wrong codes count against
+// the user rather than the code, so asking for a new code doesn't allow more
+// guesses: once a user has entered EmailLogin.MaxAttempts wrong codes, their
+// code is discarded and new ones don't work until the window is over.
+func (s *emailLoginService) VerifyCode(ctx context.Context, nonce string, code string) (JWTUser, error) {
+	nonceHash := hashSecret(nonce)
+	maxAttempts := s.config.Get().EmailLogin.MaxAttempts
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Each user has one code at most, so this is no more than one per user
+	username, pending := "", (*loginCode)(nil)
+	for codeUsername, code := range s.codes {
+		if subtle.ConstantTimeCompare([]byte(code.nonceHash), []byte(nonceHash)) == 1 {
+			username, pending = codeUsername, code
+		}
+	}
+	if pending == nil {
+		return JWTUser{}, ErrInvalidEmailLogin
+	}
+	now := time.Now()
+	if now.After(pending.expiresAt) {
+		delete(s.codes, username)
+		return JWTUser{Username: username}, ErrInvalidEmailLogin
+	}
+	failures := s.window(s.failures, username)
+	if failures.count >= maxAttempts {
+		delete(s.codes, username)
+		return JWTUser{Username: username}, ErrTooManyEmailLogins
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(code)), pending.codeHash) != 1 {
+		failures.count++
+		if failures.count >= maxAttempts {
+			delete(s.codes, username)
+		}
+		return JWTUser{Username: username}, ErrInvalidEmailLogin
+	}
+
+	delete(s.codes, username)
+	delete(s.failures, username)
+	return s.login(ctx, username)
+}
+
+func (s *emailLoginService) VerifyLink(ctx context.Context, nonce string, encodedToken string) (JWTUser, error) {
+	claims, err := s.actionTokens.Validate(ActionEmailLogin, encodedToken)
+	if err != nil {
+		return JWTUser{}, ErrInvalidEmailLogin
+	}
+	// Check the browser before using up the link, so opening it somewhere
+	// else doesn't stop it working in the right place.
+	if subtle.ConstantTimeCompare([]byte(claims.Fingerprint), []byte(hashSecret(nonce))) != 1 {
+		return JWTUser{Username: claims.Subject}, ErrInvalidEmailLogin
+	}
+	if _, err := s.actionTokens.Consume(ActionEmailLogin, encodedToken); err != nil {
+		return JWTUser{Username: claims.Subject}, ErrInvalidEmailLogin
+	}
+	return s.login(ctx, claims.Subject)
+}
+
+// login looks up a user who has proven they own their email address. Like
+// VerifyCode and VerifyLink, it names the user even when it fails.
+func (s *emailLoginService) login(ctx context.Context, username string) (JWTUser, error) {
+	user, err := s.users.Get(ctx, username)
+	if errors.Is(err, store.ErrNotFound) {
+		return JWTUser{Username: username}, ErrInvalidEmailLogin
+	}
+	if err != nil {
+		return JWTUser{Username: username}, err
+	}
+	if user.Disabled {
+		return JWTUser{Username: username}, ErrUserDisabled
+	}
+	// Being locked out after wrong passwords locks out every way of logging in
+	if user.Locked(time.Now().UTC()) {
+		return JWTUser{Username: username}, ErrUserLocked
+	}
+
+	if !user.EmailVerified {
+		user.EmailVerified = true
+		user.UpdatedAt = time.Now().UTC()
+		if err := s.users.Update(ctx, user); err != nil {
+			return JWTUser{Username: username}, err
+		}
+	}
+	return newJWTUser(user), nil
+}
+
+func (s *emailLoginService) sendCode(user store.User, nonce string) error {
+	config := s.config.Get()
+	number, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return err
+	}
+	code := fmt.Sprintf("%06d", number.Int64())
+
+	now := time.Now()
+	s.lock.Lock()
+	for username, pending := range s.codes {
+		if now.After(pending.expiresAt) {
+			delete(s.codes, username)
+		}
+	}
+	s.codes[user.Username] = &loginCode{
+		nonceHash: hashSecret(nonce),
+		codeHash:  []byte(hashSecret(code)),
+		expiresAt: now.Add(config.EmailLogin.Expire),
+	}
+	s.lock.Unlock()
+
+	return s.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: fmt.Sprintf("Your login code is %s", code),
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nEnter this code to log in. It expires in %s.\n\n%s\n\nIf you didn't try to log in, you can ignore this email.\n",
+			user.Username, config.EmailLogin.Expire, code,
+		),
+	})
+}
+
+func (s *emailLoginService) sendLink(user store.User, nonce string) error {
+	config := s.config.Get()
+	token, err := s.actionTokens.Issue(ActionEmailLogin, user.Username, hashSecret(nonce), config.EmailLogin.Expire)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/v1/login/email/verify?token=%s", config.PublicURL, url.QueryEscape(token))
+	return s.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nOpen this link in the same browser you logged in from. It expires in %s.\n\n%s\n\nIf you didn't try to log in, you can ignore this email.\n",
+			user.Username, config.EmailLogin.Expire, link,
+		),
+	})
+}
+
+// window returns key's current window, starting a new one if it has none.
+// Windows that are over are dropped first. The caller holds the lock.
+func (s *emailLoginService) window(windows map[string]*loginWindow, key string) *loginWindow {
+	now := time.Now()
+	for windowKey, window := range windows {
+		if now.After(window.expiresAt) {
+			delete(windows, windowKey)
+		}
+	}
+	window, found := windows[key]
+	if !found {
+		window = &loginWindow{expiresAt: now.Add(s.config.Get().EmailLogin.Expire)}
+		windows[key] = window
+	}
+	return window
+}
+
+// hashSecret returns the hex-encoded SHA-256 hash of a secret, so secrets
+// themselves don't need to be kept around.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,62 +1,144 @@
 package service
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 
 	"auth-server/pkg/config"
-	"auth-server/pkg/utils"
+	"auth-server/pkg/jwk"
+	"auth-server/pkg/metrics"
+	"auth-server/pkg/signing"
 )
 
+// ErrInvalidRefreshToken is returned for refresh tokens that were never issued, or have been revoked
+var ErrInvalidRefreshToken = errors.New("Invalid refresh token")
+
+// ErrSessionNotFound is returned for session IDs a user has no refresh token for
+var ErrSessionNotFound = errors.New("Session not found")
+
 type JWTService interface {
-	GenerateToken(user JWTUser, generateRefreshToken bool) (string, string, error)
-	ValidateAccessToken(encodedToken string) (*jwt.Token, *AuthCustomClaims, error)
-	ValidateRefreshToken(encodedToken string) (*jwt.Token, *AuthCustomClaims, error)
-	RemoveRefreshToken(encodedToken string)
+	GenerateToken(ctx context.Context, user JWTUser, generateRefreshToken bool) (string, string, error)
+	// GenerateBoundToken is like GenerateToken, but the tokens can only be
+	// used by whoever holds the key in confirmation
+	GenerateBoundToken(ctx context.Context, user JWTUser, generateRefreshToken bool, confirmation *Confirmation) (string, string, error)
+	ValidateAccessToken(ctx context.Context, encodedToken string) (*jwt.Token, *AuthCustomClaims, error)
+	ValidateRefreshToken(ctx context.Context, encodedToken string) (*jwt.Token, *AuthCustomClaims, error)
+	RemoveRefreshToken(ctx context.Context, encodedToken string)
+	RemoveUserRefreshTokens(ctx context.Context, username string)
+	// Sessions lists a user's refresh tokens that are still valid, newest first
+	Sessions(ctx context.Context, username string) []Session
+	// RemoveSession revokes one of a user's refresh tokens, by its session ID
+	RemoveSession(ctx context.Context, username string, sessionID string) error
+	// JWKS lists the public keys access tokens are signed with. It's empty
+	// when they're signed with ACCESS_TOKEN_SECRET instead.
+	JWKS() jwk.Set
+	// SetSigningKeys replaces the keys access tokens are signed with, such
+	// as when the config is reloaded
+	SetSigningKeys(signingKeys []signing.Key)
+	// CheckSigningKeys returns an error when there's nothing to sign access
+	// tokens with, for readiness checks
+	CheckSigningKeys() error
 }
 
 type JWTUser struct {
 	Username string
+	// ClientID is set when the caller is a client rather than a user
+	ClientID string   `json:",omitempty"`
+	Roles    []string `json:",omitempty"`
+	Scopes   []string `json:",omitempty"`
+}
+
+// HasRole reports whether the user was granted a role
+func (u JWTUser) HasRole(role string) bool {
+	return contains(u.Roles, role)
+}
+
+// HasScope reports whether the user was granted a scope
+func (u JWTUser) HasScope(scope string) bool {
+	return contains(u.Scopes, scope)
+}
+
+func contains(items []string, value string) bool {
+	for _, item := range items {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Session describes a refresh token without giving it away
+type Session struct {
+	// ID is derived from the refresh token, but can't be used as one
+	ID        string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	// Bound is set when the refresh token only works with a key or certificate
+	Bound bool
 }
 
 type AuthCustomClaims struct {
 	jwt.StandardClaims
 	User JWTUser
+	// Confirmation is set for tokens bound to a key the caller must prove they hold
+	Confirmation *Confirmation `json:"cnf,omitempty"`
 }
 
 type jwtService struct {
-	config             config.Config
-	validRefreshTokens []string
+	config *config.Holder
+	// signingKeys sign access tokens, the first one being current. When
+	// there are none, access tokens are signed with AccessTokenSecret.
+	signingKeys []signing.Key
+	keysLock    sync.RWMutex
+	lock        sync.Mutex
+	// validRefreshTokens maps each issued refresh token to its username
+	validRefreshTokens map[string]string
 }
 
-func NewJWTService(config config.Config) JWTService {
+func NewJWTService(config *config.Holder, signingKeys []signing.Key) JWTService {
+	metrics.SigningKeys.Set(float64(len(signingKeys)))
 	return &jwtService{
-		config: config,
+		config:      config,
+		signingKeys: signingKeys,
 		// TODO: move list to DB
-		validRefreshTokens: []string{},
+		validRefreshTokens: map[string]string{},
 	}
 }
 
-func (s *jwtService) GenerateToken(user JWTUser, generateRefreshToken bool) (string, string, error) {
+func (s *jwtService) GenerateToken(ctx context.Context, user JWTUser, generateRefreshToken bool) (string, string, error) {
+	return s.GenerateBoundToken(ctx, user, generateRefreshToken, nil)
+}
+
+func (s *jwtService) GenerateBoundToken(ctx context.Context, user JWTUser, generateRefreshToken bool, confirmation *Confirmation) (string, string, error) {
+	_, span := tracer.Start(ctx, "JWTService.GenerateBoundToken")
+	defer span.End()
+
+	config := s.config.Get()
 	now := time.Now()
 
 	// Access token, including expiration date
 	accessClaims := &AuthCustomClaims{
 		StandardClaims: jwt.StandardClaims{
-			Subject: user.Username,
+			Subject:  user.Username,
+			Audience: config.Audience,
 
-			ExpiresAt: now.Add(s.config.AccessTokenExpire).Unix(),
-			Issuer:    s.config.Issuer,
+			ExpiresAt: now.Add(config.AccessTokenExpire).Unix(),
+			Issuer:    config.Issuer,
 			IssuedAt:  now.Unix(),
 			NotBefore: now.Unix(),
 		},
-		User: user,
+		User:         user,
+		Confirmation: confirmation,
 	}
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	accessTokenString, err := accessToken.SignedString([]byte(s.config.AccessTokenSecret))
+	accessTokenString, err := s.signAccessToken(accessClaims)
 	if err != nil {
 		return "", "", err
 	}
@@ -71,27 +153,73 @@ func (s *jwtService) GenerateToken(user JWTUser, generateRefreshToken bool) (str
 		StandardClaims: jwt.StandardClaims{
 			Subject: user.Username,
 
-			ExpiresAt: now.Add(s.config.RefreshTokenExpire).Unix(),
-			Issuer:    s.config.Issuer,
+			ExpiresAt: now.Add(config.RefreshTokenExpire).Unix(),
+			Issuer:    config.Issuer,
 			IssuedAt:  now.Unix(),
 			NotBefore: now.Unix(),
 		},
 		User: user,
+		// Refresh tokens are bound to the same key, so only its holder can use them
+		Confirmation: confirmation,
 	}
 	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	refreshTokenString, err := refreshToken.SignedString([]byte(s.config.RefreshTokenSecret))
+	start := time.Now()
+	refreshTokenString, err := refreshToken.SignedString([]byte(config.RefreshTokenSecret))
+	metrics.SigningDuration.WithLabelValues(jwt.SigningMethodHS256.Alg()).Observe(metrics.Since(start))
 	if err != nil {
 		return "", "", err
 	}
 
 	// Store refresh token
-	s.validRefreshTokens = append(s.validRefreshTokens, refreshTokenString)
+	s.lock.Lock()
+	s.validRefreshTokens[refreshTokenString] = user.Username
+	metrics.RefreshSessions.Set(float64(len(s.validRefreshTokens)))
+	s.lock.Unlock()
 
 	return accessTokenString, refreshTokenString, nil
 }
 
-func (s *jwtService) ValidateAccessToken(encodedToken string) (*jwt.Token, *AuthCustomClaims, error) {
-	token, authClaims, err := validateToken(encodedToken, s.config.AccessTokenSecret)
+// signAccessToken uses the current signing key, if there is one
+func (s *jwtService) signAccessToken(claims *AuthCustomClaims) (string, error) {
+	var token *jwt.Token
+	var key interface{}
+	if signingKeys := s.currentSigningKeys(); len(signingKeys) == 0 {
+		token, key = jwt.NewWithClaims(jwt.SigningMethodHS256, claims), []byte(s.config.Get().AccessTokenSecret)
+	} else {
+		token, key = jwt.NewWithClaims(signingKeys[0].Method, claims), signingKeys[0].Private
+		token.Header["kid"] = signingKeys[0].ID
+	}
+
+	start := time.Now()
+	defer func() {
+		metrics.SigningDuration.WithLabelValues(token.Method.Alg()).Observe(metrics.Since(start))
+	}()
+	return token.SignedString(key)
+}
+
+func (s *jwtService) ValidateAccessToken(ctx context.Context, encodedToken string) (*jwt.Token, *AuthCustomClaims, error) {
+	_, span := tracer.Start(ctx, "JWTService.ValidateAccessToken")
+	defer span.End()
+
+	start := time.Now()
+	defer func() {
+		metrics.VerificationDuration.WithLabelValues("access").Observe(metrics.Since(start))
+	}()
+
+	authClaims := &AuthCustomClaims{}
+	token, err := jwt.ParseWithClaims(encodedToken, authClaims, func(token *jwt.Token) (interface{}, error) {
+		if _, valid := token.Method.(*jwt.SigningMethodHMAC); valid {
+			return []byte(s.config.Get().AccessTokenSecret), nil
+		}
+		// Older keys are still accepted, so tokens outlive a key rotation
+		keyID, _ := token.Header["kid"].(string)
+		for _, key := range s.currentSigningKeys() {
+			if key.ID == keyID && key.Method.Alg() == token.Method.Alg() {
+				return key.Public.PublicKey()
+			}
+		}
+		return nil, fmt.Errorf("Unknown signing key %q for algorithm %v", keyID, token.Header["alg"])
+	})
 	if err != nil {
 		return nil, nil, err
 	}
@@ -99,26 +227,151 @@ func (s *jwtService) ValidateAccessToken(encodedToken string) (*jwt.Token, *Auth
 	return token, authClaims, err
 }
 
-func (s *jwtService) ValidateRefreshToken(encodedToken string) (*jwt.Token, *AuthCustomClaims, error) {
-	tokenIndex := utils.IndexOf(s.validRefreshTokens, encodedToken)
-	if utils.IndexOf(s.validRefreshTokens, encodedToken) == -1 {
-		return nil, nil, errors.New("Invalid refresh token")
+func (s *jwtService) JWKS() jwk.Set {
+	return signing.Set(s.currentSigningKeys())
+}
+
+func (s *jwtService) SetSigningKeys(signingKeys []signing.Key) {
+	s.keysLock.Lock()
+	defer s.keysLock.Unlock()
+	s.signingKeys = signingKeys
+	metrics.SigningKeys.Set(float64(len(signingKeys)))
+}
+
+func (s *jwtService) CheckSigningKeys() error {
+	signingKeys := s.currentSigningKeys()
+	if len(signingKeys) == 0 {
+		if s.config.Get().AccessTokenSecret == "" {
+			return errors.New("No signing keys are loaded, and ACCESS_TOKEN_SECRET is empty")
+		}
+		return nil
 	}
-	token, authClaims, err := validateToken(encodedToken, s.config.RefreshTokenSecret)
+	if signingKeys[0].Private == nil {
+		return fmt.Errorf("Signing key %s has no private key", signingKeys[0].ID)
+	}
+	return nil
+}
+
+func (s *jwtService) currentSigningKeys() []signing.Key {
+	s.keysLock.RLock()
+	defer s.keysLock.RUnlock()
+	return s.signingKeys
+}
+
+func (s *jwtService) ValidateRefreshToken(ctx context.Context, encodedToken string) (*jwt.Token, *AuthCustomClaims, error) {
+	_, span := tracer.Start(ctx, "JWTService.ValidateRefreshToken")
+	defer span.End()
+
+	s.lock.Lock()
+	_, exists := s.validRefreshTokens[encodedToken]
+	s.lock.Unlock()
+	if !exists {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+	start := time.Now()
+	token, authClaims, err := validateToken(encodedToken, s.config.Get().RefreshTokenSecret)
+	metrics.VerificationDuration.WithLabelValues("refresh").Observe(metrics.Since(start))
 	if err != nil {
-		// Cleanup after ourselves. This is not thread-safe, FYI
-		s.validRefreshTokens = utils.RemoveIndex(s.validRefreshTokens, tokenIndex)
+		// Cleanup after ourselves
+		s.forgetRefreshToken(encodedToken)
 		return nil, nil, err
 	}
 	return token, authClaims, nil
 }
 
-func (s *jwtService) RemoveRefreshToken(encodedToken string) {
-	tokenIndex := utils.IndexOf(s.validRefreshTokens, encodedToken)
-	if utils.IndexOf(s.validRefreshTokens, encodedToken) == -1 {
-		return
+func (s *jwtService) RemoveRefreshToken(ctx context.Context, encodedToken string) {
+	_, span := tracer.Start(ctx, "JWTService.RemoveRefreshToken")
+	defer span.End()
+
+	if s.forgetRefreshToken(encodedToken) {
+		metrics.Revocations.WithLabelValues("logout").Inc()
+	}
+}
+
+// forgetRefreshToken removes a refresh token, reporting whether it was there
+func (s *jwtService) forgetRefreshToken(encodedToken string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, exists := s.validRefreshTokens[encodedToken]
+	delete(s.validRefreshTokens, encodedToken)
+	metrics.RefreshSessions.Set(float64(len(s.validRefreshTokens)))
+	return exists
+}
+
+// RemoveUserRefreshTokens revokes every refresh token issued to a user
+func (s *jwtService) RemoveUserRefreshTokens(ctx context.Context, username string) {
+	_, span := tracer.Start(ctx, "JWTService.RemoveUserRefreshTokens")
+	defer span.End()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for encodedToken, owner := range s.validRefreshTokens {
+		if owner == username {
+			delete(s.validRefreshTokens, encodedToken)
+			metrics.Revocations.WithLabelValues("all_sessions").Inc()
+		}
+	}
+	metrics.RefreshSessions.Set(float64(len(s.validRefreshTokens)))
+}
+
+func (s *jwtService) Sessions(ctx context.Context, username string) []Session {
+	_, span := tracer.Start(ctx, "JWTService.Sessions")
+	defer span.End()
+
+	s.lock.Lock()
+	encodedTokens := []string{}
+	for encodedToken, owner := range s.validRefreshTokens {
+		if owner == username {
+			encodedTokens = append(encodedTokens, encodedToken)
+		}
+	}
+	s.lock.Unlock()
+
+	sessions := []Session{}
+	for _, encodedToken := range encodedTokens {
+		// Expired tokens are left for ValidateRefreshToken to clean up
+		_, authClaims, err := validateToken(encodedToken, s.config.Get().RefreshTokenSecret)
+		if err != nil {
+			continue
+		}
+		sessions = append(sessions, Session{
+			ID:        sessionID(encodedToken),
+			IssuedAt:  time.Unix(authClaims.IssuedAt, 0).UTC(),
+			ExpiresAt: time.Unix(authClaims.ExpiresAt, 0).UTC(),
+			Bound:     authClaims.Confirmation != nil,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].IssuedAt.Equal(sessions[j].IssuedAt) {
+			return sessions[i].IssuedAt.After(sessions[j].IssuedAt)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+func (s *jwtService) RemoveSession(ctx context.Context, username string, id string) error {
+	_, span := tracer.Start(ctx, "JWTService.RemoveSession")
+	defer span.End()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for encodedToken, owner := range s.validRefreshTokens {
+		if owner == username && sessionID(encodedToken) == id {
+			delete(s.validRefreshTokens, encodedToken)
+			metrics.Revocations.WithLabelValues("session").Inc()
+			metrics.RefreshSessions.Set(float64(len(s.validRefreshTokens)))
+			return nil
+		}
 	}
-	s.validRefreshTokens = utils.RemoveIndex(s.validRefreshTokens, tokenIndex)
+	return ErrSessionNotFound
+}
+
+// sessionID names a refresh token by part of its hash, so admins can tell
+// sessions apart without seeing tokens they could use
+func sessionID(encodedToken string) string {
+	sum := sha256.Sum256([]byte(encodedToken))
+	return hex.EncodeToString(sum[:12])
 }
 
 func validateToken(encodedToken string, tokenSecret string) (*jwt.Token, *AuthCustomClaims, error) {
@@ -0,0 +1,527 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+
+	"auth-server/pkg/config"
+	"auth-server/pkg/mailer"
+	"auth-server/pkg/password"
+	"auth-server/pkg/store"
+	"auth-server/pkg/webhook"
+)
+
+var (
+	// ErrUserExists is returned when a username or email address is already registered
+	ErrUserExists = errors.New("Username or email address is already registered")
+	// ErrInvalidCredentials is returned when a username/password pair doesn't match
+	ErrInvalidCredentials = errors.New("Invalid username or password")
+	// ErrEmailNotVerified is returned when a user logs in before verifying their email address
+	ErrEmailNotVerified = errors.New("Email address has not been verified")
+	// ErrIncorrectPassword is returned when changing a password and the current one doesn't match
+	ErrIncorrectPassword = errors.New("Current password is incorrect")
+	// ErrUserDisabled is returned when a disabled user tries to log in
+	ErrUserDisabled = errors.New("Account is disabled")
+	// ErrUserLocked is returned when a user tries to log in while locked out
+	ErrUserLocked = errors.New("Account is locked after too many failed logins, try again later")
+	// ErrInvalidUsername is returned when creating a user with a username that isn't allowed
+	ErrInvalidUsername = errors.New("Username must be 3-64 letters, digits, '.', '_' or '-'")
+	// ErrInvalidEmail is returned when an email address can't be parsed
+	ErrInvalidEmail = errors.New("Invalid email address")
+
+	usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{2,63}$`)
+)
+
+// UserService manages registered users and checks their credentials
+type UserService interface {
+	Register(ctx context.Context, username string, email string, password string) (store.User, error)
+	ResendVerification(ctx context.Context, email string) error
+	VerifyEmail(ctx context.Context, encodedToken string) (store.User, error)
+	Authenticate(ctx context.Context, username string, password string) (JWTUser, error)
+	ForgotPassword(ctx context.Context, email string) error
+	ResetPassword(ctx context.Context, encodedToken string, password string) (store.User, error)
+	ChangePassword(ctx context.Context, username string, currentPassword string, password string) error
+	// Create adds a user without emailing them, such as for an administrator.
+	// The user's ID, password hash and timestamps are filled in.
+	Create(ctx context.Context, user store.User, password string) (store.User, error)
+	// SetPassword replaces a user's password without needing the current one
+	SetPassword(ctx context.Context, username string, password string) error
+	// SetDisabled disables or re-enables a user. Disabled users are signed out everywhere.
+	SetDisabled(ctx context.Context, username string, disabled bool) error
+	// Get returns a user, for an administrator
+	Get(ctx context.Context, username string) (store.User, error)
+	// List returns a page of the users matching filter, oldest first, and
+	// how many match in all
+	List(ctx context.Context, filter UserFilter) ([]store.User, int, error)
+	// Update changes a user's email address, and whether it's verified.
+	// A new address is unverified unless EmailVerified says otherwise.
+	Update(ctx context.Context, username string, update UserUpdate) (store.User, error)
+	// SetRoles replaces a user's roles and scopes, and revokes their
+	// refresh tokens. Access tokens keep the old ones until they expire.
+	SetRoles(ctx context.Context, username string, roles []string, scopes []string) (store.User, error)
+	// Delete removes a user and their API keys, and signs them out everywhere
+	Delete(ctx context.Context, username string) error
+	// Unlock ends a lockout, and forgets failed logins
+	Unlock(ctx context.Context, username string) (store.User, error)
+	// RequirePasswordReset stops a user's password from working, signs
+	// them out everywhere, and emails them a token to choose a new one
+	RequirePasswordReset(ctx context.Context, username string) error
+	// Sessions lists a user's refresh tokens that are still valid, newest first
+	Sessions(ctx context.Context, username string) ([]Session, error)
+	// RevokeSession revokes one of a user's refresh tokens, by its session ID
+	RevokeSession(ctx context.Context, username string, sessionID string) error
+	// RevokeSessions signs a user out everywhere
+	RevokeSessions(ctx context.Context, username string) error
+	// SetPasswordPolicy replaces the policy new passwords are checked
+	// against, such as when the config is reloaded, and closes the old one
+	SetPasswordPolicy(policy *password.Policy)
+}
+
+type userService struct {
+	log          *log.Entry
+	config       *config.Holder
+	users        store.UserStore
+	apiKeys      store.APIKeyStore
+	mailer       mailer.Mailer
+	actionTokens ActionTokenService
+	jwtService   JWTService
+	webhooks     webhook.Publisher
+	policyLock   sync.RWMutex
+	policy       *password.Policy
+	// dummyHash is compared against when a user doesn't exist, so that
+	// response times don't reveal which usernames are registered.
+	dummyHash []byte
+}
+
+func NewUserService(config *config.Holder, users store.UserStore, apiKeys store.APIKeyStore, mailer mailer.Mailer, actionTokens ActionTokenService, jwtService JWTService, policy *password.Policy, webhooks webhook.Publisher) UserService {
+	dummyHash, _ := bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+	return &userService{
+		log:          log.WithFields(log.Fields{"logger": "UserServiceV1"}),
+		config:       config,
+		users:        users,
+		apiKeys:      apiKeys,
+		mailer:       mailer,
+		actionTokens: actionTokens,
+		jwtService:   jwtService,
+		webhooks:     webhooks,
+		policy:       policy,
+		dummyHash:    dummyHash,
+	}
+}
+
+func (s *userService) Register(ctx context.Context, username string, email string, password string) (store.User, error) {
+	user, err := s.Create(ctx, store.User{Username: username, Email: email}, password)
+	if err != nil {
+		return store.User{}, err
+	}
+
+	// The account exists either way, so a delivery problem shouldn't fail
+	// the request. The user can ask for another email.
+	if err := s.sendVerification(user); err != nil {
+		s.log.WithError(err).WithField("username", user.Username).Error("Failed to send verification email")
+	}
+	return user, nil
+}
+
+func (s *userService) Create(ctx context.Context, user store.User, password string) (store.User, error) {
+	if !usernamePattern.MatchString(user.Username) {
+		return store.User{}, ErrInvalidUsername
+	}
+	if !validEmail(user.Email) {
+		return store.User{}, ErrInvalidEmail
+	}
+	passwordHash, err := s.hashPassword(ctx, user.Username, password)
+	if err != nil {
+		return store.User{}, err
+	}
+	userID, err := randomID()
+	if err != nil {
+		return store.User{}, err
+	}
+
+	now := time.Now().UTC()
+	user.ID = userID
+	user.Email = strings.ToLower(user.Email)
+	user.PasswordHash = passwordHash
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	if err := s.users.Create(ctx, user); err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			return store.User{}, ErrUserExists
+		}
+		return store.User{}, err
+	}
+	s.webhooks.Publish(ctx, webhook.EventUserRegistered, webhookUser(user, ""))
+	return user, nil
+}
+
+func (s *userService) ResendVerification(ctx context.Context, email string) error {
+	user, err := s.users.GetByEmail(ctx, email)
+	if errors.Is(err, store.ErrNotFound) || (err == nil && user.EmailVerified) {
+		// Don't reveal whether the address is registered
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Sent in the background, so how long this takes doesn't reveal
+	// whether the address is registered either. Failures are only logged.
+	go func() {
+		if err := s.sendVerification(user); err != nil {
+			s.log.WithError(err).WithField("username", user.Username).Error("Failed to send verification email")
+		}
+	}()
+	return nil
+}
+
+func (s *userService) VerifyEmail(ctx context.Context, encodedToken string) (store.User, error) {
+	claims, err := s.actionTokens.Validate(ActionVerifyEmail, encodedToken)
+	if err != nil {
+		return store.User{}, err
+	}
+
+	user, err := s.users.Get(ctx, claims.Subject)
+	if errors.Is(err, store.ErrNotFound) {
+		return store.User{}, ErrInvalidActionToken
+	}
+	if err != nil {
+		return store.User{}, err
+	}
+	// A token sent to another address, or to an earlier user with the same
+	// name, or already used, doesn't match any more
+	if subtle.ConstantTimeCompare([]byte(claims.Fingerprint), []byte(verificationFingerprint(user))) != 1 {
+		return store.User{}, ErrInvalidActionToken
+	}
+	if _, err := s.actionTokens.Consume(ActionVerifyEmail, encodedToken); err != nil {
+		return store.User{}, err
+	}
+
+	user.EmailVerified = true
+	user.UpdatedAt = time.Now().UTC()
+	if err := s.users.Update(ctx, user); err != nil {
+		return store.User{}, err
+	}
+	return user, nil
+}
+
+func (s *userService) Authenticate(ctx context.Context, username string, password string) (JWTUser, error) {
+	user, err := s.users.Get(ctx, username)
+	if err != nil {
+		comparePassword(ctx, s.dummyHash, password)
+		if errors.Is(err, store.ErrNotFound) {
+			return JWTUser{}, ErrInvalidCredentials
+		}
+		return JWTUser{}, err
+	}
+
+	now := time.Now().UTC()
+	if user.Locked(now) {
+		return JWTUser{}, ErrUserLocked
+	}
+	if err := comparePassword(ctx, []byte(user.PasswordHash), password); err != nil {
+		s.failedLogin(ctx, user, now)
+		return JWTUser{}, ErrInvalidCredentials
+	}
+	if user.FailedLogins > 0 {
+		user.FailedLogins = 0
+		if err := s.users.Update(ctx, user); err != nil {
+			return JWTUser{}, err
+		}
+	}
+	if user.Disabled {
+		return JWTUser{}, ErrUserDisabled
+	}
+
+	jwtUser := newJWTUser(user)
+	if !user.EmailVerified {
+		if !s.config.Get().Registration.AllowUnverifiedLogin {
+			return JWTUser{}, ErrEmailNotVerified
+		}
+		jwtUser.Scopes = s.config.Get().Registration.UnverifiedLoginScopes
+	}
+	return jwtUser, nil
+}
+
+// failedLogin counts a wrong password, locking the user out once there
+// have been too many in a row
+func (s *userService) failedLogin(ctx context.Context, user store.User, now time.Time) {
+	lockout := s.config.Get().Lockout
+	if lockout.Threshold == 0 {
+		return
+	}
+
+	user.FailedLogins++
+	locked := user.FailedLogins >= lockout.Threshold
+	if locked {
+		user.FailedLogins = 0
+		user.LockedUntil = now.Add(lockout.Duration)
+	}
+	if err := s.users.Update(ctx, user); err != nil {
+		s.log.WithError(err).WithField("username", user.Username).Error("Failed to count failed login")
+		return
+	}
+	if locked {
+		s.log.WithFields(log.Fields{"username": user.Username, "locked_until": user.LockedUntil}).Warn("Locked out user")
+		event := webhookUser(user, "")
+		event.LockedUntil = &user.LockedUntil
+		s.webhooks.Publish(ctx, webhook.EventUserLockedOut, event)
+	}
+}
+
+// newJWTUser describes a user for their tokens
+func newJWTUser(user store.User) JWTUser {
+	return JWTUser{
+		Username: user.Username,
+		Roles:    user.Roles,
+		Scopes:   user.Scopes,
+	}
+}
+
+func (s *userService) ForgotPassword(ctx context.Context, email string) error {
+	user, err := s.users.GetByEmail(ctx, email)
+	if errors.Is(err, store.ErrNotFound) {
+		// Don't reveal whether the address is registered
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Sent in the background, so how long this takes doesn't reveal
+	// whether the address is registered either. Failures are only logged.
+	go func() {
+		err := s.sendPasswordReset(user, "Someone asked to reset the password for your account. If it was you, use the following "+
+			"within %s to choose a new one. Otherwise you can ignore this email.")
+		if err != nil {
+			s.log.WithError(err).WithField("username", user.Username).Error("Failed to send password reset email")
+		}
+	}()
+	return nil
+}
+
+// sendPasswordReset emails a user a password reset token, explained by
+// intro, which is given how long the token is valid
+func (s *userService) sendPasswordReset(user store.User, intro string) error {
+	config := s.config.Get()
+	token, err := s.actionTokens.Issue(ActionResetPassword, user.Username, passwordFingerprint(user), config.Password.ResetTokenExpire)
+	if err != nil {
+		return err
+	}
+
+	// Without a page to send users to, they get the raw token to submit themselves
+	instructions := token
+	if config.Password.ResetURL != "" {
+		instructions = fmt.Sprintf("%s?token=%s", config.Password.ResetURL, url.QueryEscape(token))
+	}
+	return s.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\n%s\n\n%s\n",
+			user.Username, fmt.Sprintf(intro, config.Password.ResetTokenExpire), instructions,
+		),
+	})
+}
+
+func (s *userService) ResetPassword(ctx context.Context, encodedToken string, newPassword string) (store.User, error) {
+	claims, err := s.actionTokens.Validate(ActionResetPassword, encodedToken)
+	if err != nil {
+		return store.User{}, err
+	}
+
+	user, err := s.users.Get(ctx, claims.Subject)
+	if errors.Is(err, store.ErrNotFound) {
+		return store.User{}, ErrInvalidActionToken
+	}
+	if err != nil {
+		return store.User{}, err
+	}
+	// A token issued before the password last changed has already been used
+	if subtle.ConstantTimeCompare([]byte(claims.Fingerprint), []byte(passwordFingerprint(user))) != 1 {
+		return store.User{}, ErrInvalidActionToken
+	}
+
+	// Only use up the token once the new password has been accepted
+	passwordHash, err := s.hashPassword(ctx, user.Username, newPassword)
+	if err != nil {
+		return store.User{}, err
+	}
+	if _, err := s.actionTokens.Consume(ActionResetPassword, encodedToken); err != nil {
+		return store.User{}, err
+	}
+
+	// Following the emailed token proves the user owns the address
+	user.EmailVerified = true
+	if err := s.setPassword(ctx, &user, passwordHash, passwordReset); err != nil {
+		return store.User{}, err
+	}
+	return user, nil
+}
+
+func (s *userService) ChangePassword(ctx context.Context, username string, currentPassword string, newPassword string) error {
+	user, err := s.users.Get(ctx, username)
+	if err != nil {
+		return err
+	}
+	if err := comparePassword(ctx, []byte(user.PasswordHash), currentPassword); err != nil {
+		return ErrIncorrectPassword
+	}
+
+	passwordHash, err := s.hashPassword(ctx, user.Username, newPassword)
+	if err != nil {
+		return err
+	}
+	return s.setPassword(ctx, &user, passwordHash, passwordChanged)
+}
+
+func (s *userService) SetPassword(ctx context.Context, username string, newPassword string) error {
+	user, err := s.users.Get(ctx, username)
+	if err != nil {
+		return err
+	}
+	passwordHash, err := s.hashPassword(ctx, user.Username, newPassword)
+	if err != nil {
+		return err
+	}
+	return s.setPassword(ctx, &user, passwordHash, passwordSet)
+}
+
+func (s *userService) SetDisabled(ctx context.Context, username string, disabled bool) error {
+	user, err := s.users.Get(ctx, username)
+	if err != nil {
+		return err
+	}
+	user.Disabled = disabled
+	user.UpdatedAt = time.Now().UTC()
+	if err := s.users.Update(ctx, user); err != nil {
+		return err
+	}
+
+	if disabled {
+		s.jwtService.RemoveUserRefreshTokens(ctx, user.Username)
+		s.webhooks.Publish(ctx, webhook.EventUserSessionsRevoked, webhookUser(user, "disabled"))
+	}
+	return nil
+}
+
+// How passwords are changed, for webhooks
+const (
+	passwordChanged string = "changed"
+	passwordReset   string = "reset"
+	passwordSet     string = "set"
+	// The password was replaced so that it can't be used until reset
+	passwordResetRequired string = "reset_required"
+)
+
+// setPassword saves a new password hash for the user and signs them out
+// everywhere. A new password also ends any lockout.
+func (s *userService) setPassword(ctx context.Context, user *store.User, passwordHash string, how string) error {
+	user.PasswordHash = passwordHash
+	user.FailedLogins = 0
+	user.LockedUntil = time.Time{}
+	user.UpdatedAt = time.Now().UTC()
+	if err := s.users.Update(ctx, *user); err != nil {
+		return err
+	}
+
+	s.jwtService.RemoveUserRefreshTokens(ctx, user.Username)
+	s.webhooks.Publish(ctx, webhook.EventUserPasswordChanged, webhookUser(*user, how))
+	s.webhooks.Publish(ctx, webhook.EventUserSessionsRevoked, webhookUser(*user, "password_changed"))
+	return nil
+}
+
+// validEmail says whether email is a bare address, without a display name
+func validEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email
+}
+
+// webhookUser describes a user in webhook events
+func webhookUser(user store.User, reason string) webhook.User {
+	return webhook.User{ID: user.ID, Username: user.Username, Email: user.Email, Reason: reason}
+}
+
+func (s *userService) SetPasswordPolicy(policy *password.Policy) {
+	// Checks hold the read lock, so none are still using the old policy
+	// once it's been swapped out
+	s.policyLock.Lock()
+	oldPolicy := s.policy
+	s.policy = policy
+	s.policyLock.Unlock()
+
+	if err := oldPolicy.Close(); err != nil {
+		s.log.WithError(err).Error("Failed to close the old password policy")
+	}
+}
+
+// hashPassword checks a new password against the password policy and hashes it
+func (s *userService) hashPassword(ctx context.Context, username string, newPassword string) (string, error) {
+	s.policyLock.RLock()
+	err := s.policy.Check(newPassword, username)
+	s.policyLock.RUnlock()
+	if err != nil {
+		return "", err
+	}
+
+	// Hashing is deliberately slow, so it gets a span of its own
+	_, span := tracer.Start(ctx, "bcrypt.GenerateFromPassword")
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	span.End()
+	if err != nil {
+		return "", err
+	}
+	return string(passwordHash), nil
+}
+
+// comparePassword checks a password against a bcrypt hash, in a span of its own
+func comparePassword(ctx context.Context, passwordHash []byte, password string) error {
+	_, span := tracer.Start(ctx, "bcrypt.CompareHashAndPassword")
+	defer span.End()
+	return bcrypt.CompareHashAndPassword(passwordHash, []byte(password))
+}
+
+// passwordFingerprint changes whenever the user's password does
+func passwordFingerprint(user store.User) string {
+	sum := sha256.Sum256([]byte(user.PasswordHash))
+	return hex.EncodeToString(sum[:8])
+}
+
+// verificationFingerprint changes whenever the user's address does, or it's
+// verified, so each verification token is tied to one address and works once
+// even if the server restarts
+func verificationFingerprint(user store.User) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%t", user.ID, user.Email, user.EmailVerified)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s *userService) sendVerification(user store.User) error {
+	config := s.config.Get()
+	token, err := s.actionTokens.Issue(ActionVerifyEmail, user.Username, verificationFingerprint(user), config.Registration.VerificationTokenExpire)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/v1/register/verify?token=%s", config.PublicURL, url.QueryEscape(token))
+	return s.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nPlease confirm your email address by opening the link below. It expires in %s.\n\n%s\n",
+			user.Username, config.Registration.VerificationTokenExpire, link,
+		),
+	})
+}
@@ -0,0 +1,211 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"auth-server/pkg/store"
+	"auth-server/pkg/webhook"
+)
+
+// UserFilter picks which users List returns. Empty fields match everyone.
+type UserFilter struct {
+	// Query matches part of the username or email address, ignoring case
+	Query         string
+	Role          string
+	Scope         string
+	Disabled      *bool
+	Locked        *bool
+	EmailVerified *bool
+	Offset        int
+	// Limit is the most users to return, or zero for all of them
+	Limit int
+}
+
+// UserUpdate holds the fields to change about a user. Nil fields are left alone.
+type UserUpdate struct {
+	Email         *string
+	EmailVerified *bool
+}
+
+func (s *userService) Get(ctx context.Context, username string) (store.User, error) {
+	return s.users.Get(ctx, username)
+}
+
+func (s *userService) List(ctx context.Context, filter UserFilter) ([]store.User, int, error) {
+	users, err := s.users.List(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	now := time.Now().UTC()
+	matching := []store.User{}
+	for _, user := range users {
+		if filter.matches(user, now) {
+			matching = append(matching, user)
+		}
+	}
+
+	total := len(matching)
+	if filter.Offset >= total {
+		return []store.User{}, total, nil
+	}
+	matching = matching[filter.Offset:]
+	if filter.Limit > 0 && filter.Limit < len(matching) {
+		matching = matching[:filter.Limit]
+	}
+	return matching, total, nil
+}
+
+func (f UserFilter) matches(user store.User, now time.Time) bool {
+	query := strings.ToLower(f.Query)
+	switch {
+	case query != "" && !strings.Contains(strings.ToLower(user.Username), query) && !strings.Contains(user.Email, query):
+		return false
+	case f.Role != "" && !contains(user.Roles, f.Role):
+		return false
+	case f.Scope != "" && !contains(user.Scopes, f.Scope):
+		return false
+	case f.Disabled != nil && *f.Disabled != user.Disabled:
+		return false
+	case f.Locked != nil && *f.Locked != user.Locked(now):
+		return false
+	case f.EmailVerified != nil && *f.EmailVerified != user.EmailVerified:
+		return false
+	}
+	return true
+}
+
+func (s *userService) Update(ctx context.Context, username string, update UserUpdate) (store.User, error) {
+	user, err := s.users.Get(ctx, username)
+	if err != nil {
+		return store.User{}, err
+	}
+
+	if update.Email != nil && !strings.EqualFold(*update.Email, user.Email) {
+		if !validEmail(*update.Email) {
+			return store.User{}, ErrInvalidEmail
+		}
+		user.Email = strings.ToLower(*update.Email)
+		user.EmailVerified = false
+	}
+	if update.EmailVerified != nil {
+		user.EmailVerified = *update.EmailVerified
+	}
+	user.UpdatedAt = time.Now().UTC()
+	if err := s.users.Update(ctx, user); err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			return store.User{}, ErrUserExists
+		}
+		return store.User{}, err
+	}
+	return user, nil
+}
+
+func (s *userService) SetRoles(ctx context.Context, username string, roles []string, scopes []string) (store.User, error) {
+	user, err := s.users.Get(ctx, username)
+	if err != nil {
+		return store.User{}, err
+	}
+	user.Roles = roles
+	user.Scopes = scopes
+	user.UpdatedAt = time.Now().UTC()
+	if err := s.users.Update(ctx, user); err != nil {
+		return store.User{}, err
+	}
+
+	// Refreshed tokens keep the roles they were issued with
+	s.jwtService.RemoveUserRefreshTokens(ctx, user.Username)
+	s.webhooks.Publish(ctx, webhook.EventUserSessionsRevoked, webhookUser(user, "roles_changed"))
+	return user, nil
+}
+
+func (s *userService) Delete(ctx context.Context, username string) error {
+	user, err := s.users.Get(ctx, username)
+	if err != nil {
+		return err
+	}
+	// Keys go first, so a user whose keys can't all be deleted is left to
+	// try again, and keys never outlive their user to be picked up by
+	// someone later registering the same name
+	keys, err := s.apiKeys.List(ctx, store.OwnerUser, user.Username)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.apiKeys.Delete(ctx, key.ID); err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+	}
+	if err := s.users.Delete(ctx, user.Username); err != nil {
+		return err
+	}
+
+	s.jwtService.RemoveUserRefreshTokens(ctx, user.Username)
+	s.webhooks.Publish(ctx, webhook.EventUserSessionsRevoked, webhookUser(user, "deleted"))
+	return nil
+}
+
+func (s *userService) Sessions(ctx context.Context, username string) ([]Session, error) {
+	user, err := s.users.Get(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	return s.jwtService.Sessions(ctx, user.Username), nil
+}
+
+func (s *userService) RevokeSession(ctx context.Context, username string, sessionID string) error {
+	user, err := s.users.Get(ctx, username)
+	if err != nil {
+		return err
+	}
+	if err := s.jwtService.RemoveSession(ctx, user.Username, sessionID); err != nil {
+		return err
+	}
+	s.webhooks.Publish(ctx, webhook.EventUserSessionsRevoked, webhookUser(user, "revoked"))
+	return nil
+}
+
+func (s *userService) RevokeSessions(ctx context.Context, username string) error {
+	user, err := s.users.Get(ctx, username)
+	if err != nil {
+		return err
+	}
+	s.jwtService.RemoveUserRefreshTokens(ctx, user.Username)
+	s.webhooks.Publish(ctx, webhook.EventUserSessionsRevoked, webhookUser(user, "revoked"))
+	return nil
+}
+
+func (s *userService) Unlock(ctx context.Context, username string) (store.User, error) {
+	user, err := s.users.Get(ctx, username)
+	if err != nil {
+		return store.User{}, err
+	}
+	user.FailedLogins = 0
+	user.LockedUntil = time.Time{}
+	user.UpdatedAt = time.Now().UTC()
+	if err := s.users.Update(ctx, user); err != nil {
+		return store.User{}, err
+	}
+	return user, nil
+}
+
+func (s *userService) RequirePasswordReset(ctx context.Context, username string) error {
+	user, err := s.users.Get(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	// bcrypt hashes start with "$", so no password matches this until it's reset
+	unusable, err := randomID()
+	if err != nil {
+		return err
+	}
+	if err := s.setPassword(ctx, &user, "!"+unusable, passwordResetRequired); err != nil {
+		return err
+	}
+	return s.sendPasswordReset(user, "An administrator has asked you to choose a new password, and your old one "+
+		"no longer works. Use the following within %s to choose a new one.")
+}
@@ -0,0 +1,28 @@
+// Package version holds what build this is. The values are set when
+// building with goreleaser, through ldflags such as
+// -X auth-server/pkg/version.Version=1.2.3
+package version
+
+import "runtime"
+
+var (
+	// Version is the release, such as "1.2.3"
+	Version = "dev"
+	// Commit is the git commit built
+	Commit = "none"
+	// Date is when the build was made, in RFC 3339
+	Date = "unknown"
+)
+
+// Info describes the build, as served by /version
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build's Info
+func Get() Info {
+	return Info{Version: Version, Commit: Commit, Date: Date, GoVersion: runtime.Version()}
+}
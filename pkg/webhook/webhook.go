@@ -0,0 +1,352 @@
+// Package webhook notifies other systems of identity events, such as a user
+// registering, with signed HTTP requests. Deliveries go through an outbox,
+// and are retried with exponential backoff until they succeed or run out of
+// attempts.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"auth-server/pkg/config"
+	"auth-server/pkg/store"
+)
+
+// Event types
+const (
+	EventUserRegistered      string = "user.registered"
+	EventUserPasswordChanged string = "user.password_changed"
+	EventUserLockedOut       string = "user.locked_out"
+	EventUserSessionsRevoked string = "user.sessions_revoked"
+)
+
+// EventTypes lists every event type, for filtering endpoints
+var EventTypes = []string{EventUserRegistered, EventUserPasswordChanged, EventUserLockedOut, EventUserSessionsRevoked}
+
+// Request headers
+const (
+	EventHeader     string = "X-Webhook-Event"
+	DeliveryHeader  string = "X-Webhook-Delivery"
+	SignatureHeader string = "X-Webhook-Signature"
+)
+
+const (
+	// keepFinished is how many delivered and failed deliveries are kept, for listing
+	keepFinished int = 500
+	// pollInterval is how often the outbox is checked for retries that are due
+	pollInterval time.Duration = time.Second * 5
+	// maxErrorLength keeps long responses out of the outbox
+	maxErrorLength int64 = 512
+)
+
+// Event is the body of each request
+type Event struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// User is the data of the user events
+type User struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	// Reason says why sessions were revoked or how a password was changed
+	Reason string `json:"reason,omitempty"`
+	// LockedUntil is when a lockout ends
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// Publisher sends events to the webhooks that want them
+type Publisher interface {
+	Publish(ctx context.Context, eventType string, data interface{})
+}
+
+// Dispatcher queues events in the outbox and delivers them in the background
+type Dispatcher struct {
+	log        *log.Entry
+	config     config.WebhooksConfig
+	deliveries store.DeliveryStore
+	client     *http.Client
+	// wake starts delivering as soon as an event is published
+	wake chan struct{}
+	stop chan struct{}
+	done sync.WaitGroup
+	// lock keeps the background deliveries from racing each other
+	lock sync.Mutex
+}
+
+// NewDispatcher creates a Dispatcher for the configured endpoints. Nothing
+// is delivered until Start is called.
+func NewDispatcher(webhooksConfig config.WebhooksConfig, deliveries store.DeliveryStore) (*Dispatcher, error) {
+	for _, endpoint := range webhooksConfig.Endpoints {
+		for _, eventType := range endpoint.Events {
+			if !contains(EventTypes, eventType) {
+				return nil, fmt.Errorf("Webhook %s has unknown event type %q", endpoint.URL, eventType)
+			}
+		}
+	}
+	return &Dispatcher{
+		log:        log.WithFields(log.Fields{"logger": "WebhookDispatcher"}),
+		config:     webhooksConfig,
+		deliveries: deliveries,
+		client:     &http.Client{Timeout: webhooksConfig.Timeout},
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}, nil
+}
+
+// Publish adds a delivery of the event to the outbox for each endpoint that
+// wants it. Failures are logged, rather than failing whatever caused the event.
+func (d *Dispatcher) Publish(ctx context.Context, eventType string, data interface{}) {
+	eventID, err := randomID()
+	if err != nil {
+		d.log.WithError(err).Error("Failed to publish event")
+		return
+	}
+	now := time.Now().UTC()
+	payload, err := json.Marshal(Event{ID: eventID, Type: eventType, CreatedAt: now, Data: data})
+	if err != nil {
+		d.log.WithError(err).WithField("event", eventType).Error("Failed to publish event")
+		return
+	}
+
+	for _, endpoint := range d.config.Endpoints {
+		if len(endpoint.Events) > 0 && !contains(endpoint.Events, eventType) {
+			continue
+		}
+		deliveryID, err := randomID()
+		if err != nil {
+			d.log.WithError(err).Error("Failed to publish event")
+			return
+		}
+		delivery := store.Delivery{
+			ID:            deliveryID,
+			EventID:       eventID,
+			EventType:     eventType,
+			URL:           endpoint.URL,
+			Payload:       payload,
+			Status:        store.DeliveryPending,
+			CreatedAt:     now,
+			NextAttemptAt: now,
+		}
+		if err := d.deliveries.Create(ctx, delivery); err != nil {
+			d.log.WithError(err).WithFields(log.Fields{"event": eventType, "url": endpoint.URL}).Error("Failed to queue webhook delivery")
+		}
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Deliveries lists the most recent deliveries first, optionally only those
+// with status, up to limit
+func (d *Dispatcher) Deliveries(ctx context.Context, status string, limit int) ([]store.Delivery, error) {
+	deliveries, err := d.deliveries.List(ctx, status)
+	if err != nil {
+		return nil, err
+	}
+	recent := make([]store.Delivery, 0, limit)
+	for i := len(deliveries) - 1; i >= 0 && len(recent) < limit; i-- {
+		recent = append(recent, deliveries[i])
+	}
+	return recent, nil
+}
+
+// Ping checks the outbox can still be written, for readiness checks
+func (d *Dispatcher) Ping(ctx context.Context) error {
+	return d.deliveries.Ping(ctx)
+}
+
+// Start delivers what's in the outbox in the background, including
+// deliveries left over from before a restart, until Close is called
+func (d *Dispatcher) Start() {
+	d.done.Add(1)
+	go func() {
+		defer d.done.Done()
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			d.deliverDue()
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+			case <-d.wake:
+			}
+		}
+	}()
+}
+
+// Close stops delivering. Pending deliveries stay in the outbox.
+func (d *Dispatcher) Close() {
+	close(d.stop)
+	d.done.Wait()
+}
+
+// deliverDue attempts every pending delivery whose next attempt is due
+func (d *Dispatcher) deliverDue() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	ctx := context.Background()
+	pending, err := d.deliveries.List(ctx, store.DeliveryPending)
+	if err != nil {
+		d.log.WithError(err).Error("Failed to read webhook outbox")
+		return
+	}
+	now := time.Now().UTC()
+	for _, delivery := range pending {
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+		if delivery.NextAttemptAt.After(now) {
+			continue
+		}
+		delivery = d.attempt(delivery)
+		if err := d.deliveries.Update(ctx, delivery); err != nil {
+			d.log.WithError(err).WithField("delivery", delivery.ID).Error("Failed to update webhook delivery")
+		}
+	}
+	d.prune(ctx)
+}
+
+// attempt sends a delivery once, returning it updated with the outcome
+func (d *Dispatcher) attempt(delivery store.Delivery) store.Delivery {
+	deliveryLog := d.log.WithFields(log.Fields{"delivery": delivery.ID, "event": delivery.EventType, "url": delivery.URL})
+	delivery.Attempts++
+	now := time.Now().UTC()
+
+	statusCode, err := d.send(delivery, now)
+	if err == nil {
+		delivery.Status = store.DeliveryDelivered
+		delivery.DeliveredAt = now
+		delivery.LastError, delivery.LastStatusCode = "", statusCode
+		deliveryLog.Debug("Delivered webhook")
+		return delivery
+	}
+
+	delivery.LastError, delivery.LastStatusCode = err.Error(), statusCode
+	if delivery.Attempts >= d.config.MaxAttempts {
+		delivery.Status = store.DeliveryFailed
+		deliveryLog.WithError(err).Error("Giving up on webhook delivery")
+		return delivery
+	}
+	delivery.NextAttemptAt = now.Add(d.backoff(delivery.Attempts))
+	deliveryLog.WithError(err).WithField("next_attempt_at", delivery.NextAttemptAt).Warn("Webhook delivery failed, will retry")
+	return delivery
+}
+
+// send signs and POSTs a delivery, returning the response's status code
+func (d *Dispatcher) send(delivery store.Delivery, now time.Time) (int, error) {
+	endpoint, found := d.endpoint(delivery.URL)
+	if !found {
+		return 0, fmt.Errorf("Webhook is no longer configured")
+	}
+
+	request, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(EventHeader, delivery.EventType)
+	request.Header.Set(DeliveryHeader, delivery.ID)
+	request.Header.Set(SignatureHeader, Sign(endpoint.Secret, now, delivery.Payload))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		io.Copy(ioutil.Discard, response.Body)
+		return response.StatusCode, nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxErrorLength))
+	return response.StatusCode, fmt.Errorf("Webhook responded with %s: %s", response.Status, bytes.TrimSpace(body))
+}
+
+// backoff is how long to wait after a failed attempt, doubling each time
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.config.RetryBackoff
+	for i := 1; i < attempts && wait < d.config.MaxRetryBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.config.MaxRetryBackoff {
+		wait = d.config.MaxRetryBackoff
+	}
+	return wait
+}
+
+// prune removes the oldest finished deliveries, beyond the ones kept for listing
+func (d *Dispatcher) prune(ctx context.Context) {
+	deliveries, err := d.deliveries.List(ctx, "")
+	if err != nil {
+		return
+	}
+	finished := []store.Delivery{}
+	for _, delivery := range deliveries {
+		if delivery.Status != store.DeliveryPending {
+			finished = append(finished, delivery)
+		}
+	}
+	for i := 0; i < len(finished)-keepFinished; i++ {
+		d.deliveries.Delete(ctx, finished[i].ID)
+	}
+}
+
+func (d *Dispatcher) endpoint(url string) (config.WebhookEndpoint, bool) {
+	for _, endpoint := range d.config.Endpoints {
+		if endpoint.URL == url {
+			return endpoint, true
+		}
+	}
+	return config.WebhookEndpoint{}, false
+}
+
+// Sign returns the signature header for a payload sent at timestamp:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<unix seconds>.<payload>">".
+// Receivers should recompute it, and reject old timestamps to stop replays.
+func Sign(secret string, timestamp time.Time, payload []byte) string {
+	unix := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unix + "."))
+	mac.Write(payload)
+	return fmt.Sprintf("t=%s,v1=%s", unix, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func randomID() (string, error) {
+	buffer := make([]byte, 16)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buffer), nil
+}
+
+func contains(items []string, value string) bool {
+	for _, item := range items {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
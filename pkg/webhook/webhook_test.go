@@ -0,0 +1,326 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"auth-server/pkg/config"
+	"auth-server/pkg/store"
+)
+
+const testSecret string = "0123456789abcdef"
+
+// receiver is a webhook endpoint that records what it's sent
+type receiver struct {
+	*httptest.Server
+	lock     sync.Mutex
+	status   int
+	requests []receivedRequest
+	received chan struct{}
+}
+
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+func newReceiver(t *testing.T, status int) *receiver {
+	r := &receiver{status: status, received: make(chan struct{}, 100)}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		r.lock.Lock()
+		r.requests = append(r.requests, receivedRequest{header: request.Header, body: body})
+		r.lock.Unlock()
+		writer.WriteHeader(r.status)
+		writer.Write([]byte("receiver said no"))
+		r.received <- struct{}{}
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) wait(t *testing.T) receivedRequest {
+	t.Helper()
+	select {
+	case <-r.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Nothing was delivered")
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.requests[len(r.requests)-1]
+}
+
+func (r *receiver) count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.requests)
+}
+
+func testConfig(endpoints ...config.WebhookEndpoint) config.WebhooksConfig {
+	return config.WebhooksConfig{
+		Endpoints:       endpoints,
+		Timeout:         time.Second,
+		MaxAttempts:     3,
+		RetryBackoff:    10 * time.Millisecond,
+		MaxRetryBackoff: 15 * time.Millisecond,
+	}
+}
+
+func newTestDispatcher(t *testing.T, webhooksConfig config.WebhooksConfig, deliveries store.DeliveryStore) *Dispatcher {
+	dispatcher, err := NewDispatcher(webhooksConfig, deliveries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dispatcher
+}
+
+// verify checks a signature header the way a receiver would
+func verify(secret string, header string, payload []byte) bool {
+	parts := strings.SplitN(header, ",", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "t=") {
+		return false
+	}
+	unix, err := strconv.ParseInt(strings.TrimPrefix(parts[0], "t="), 10, 64)
+	if err != nil {
+		return false
+	}
+	return Sign(secret, time.Unix(unix, 0), payload) == header
+}
+
+func TestSign(t *testing.T) {
+	timestamp := time.Unix(1700000000, 0)
+	payload := []byte(`{"id":"1"}`)
+	signature := Sign(testSecret, timestamp, payload)
+
+	tests := []struct {
+		name    string
+		secret  string
+		header  string
+		payload []byte
+		want    bool
+	}{
+		{name: "matching", secret: testSecret, header: signature, payload: payload, want: true},
+		{name: "other secret", secret: "fedcba9876543210", header: signature, payload: payload},
+		{name: "changed payload", secret: testSecret, header: signature, payload: []byte(`{"id":"2"}`)},
+		{name: "changed timestamp", secret: testSecret, header: strings.Replace(signature, "t=1700000000", "t=1700000001", 1), payload: payload},
+		{name: "malformed", secret: testSecret, header: "v1=abc", payload: payload},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := verify(test.secret, test.header, test.payload); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+	if !strings.HasPrefix(signature, "t=1700000000,v1=") {
+		t.Errorf("Unexpected signature format %q", signature)
+	}
+}
+
+func TestDeliversSignedEvents(t *testing.T) {
+	endpoint := newReceiver(t, http.StatusNoContent)
+	deliveries := store.NewMemoryDeliveryStore()
+	dispatcher := newTestDispatcher(t, testConfig(config.WebhookEndpoint{URL: endpoint.URL, Secret: testSecret}), deliveries)
+	dispatcher.Start()
+	defer dispatcher.Close()
+
+	dispatcher.Publish(context.Background(), EventUserRegistered, User{ID: "1", Username: "alice", Email: "alice@example.com"})
+	request := endpoint.wait(t)
+
+	if !verify(testSecret, request.header.Get(SignatureHeader), request.body) {
+		t.Errorf("Signature %q doesn't match the body", request.header.Get(SignatureHeader))
+	}
+	if request.header.Get(EventHeader) != EventUserRegistered {
+		t.Errorf("Got event header %q", request.header.Get(EventHeader))
+	}
+	var event struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data User   `json:"data"`
+	}
+	if err := json.Unmarshal(request.body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.ID == "" || event.Type != EventUserRegistered || event.Data.Username != "alice" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+
+	// The outcome is recorded once the request finishes
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		delivered, _ := dispatcher.Deliveries(context.Background(), store.DeliveryDelivered, 10)
+		if len(delivered) == 1 {
+			if delivered[0].ID != request.header.Get(DeliveryHeader) || delivered[0].Attempts != 1 || delivered[0].LastStatusCode != http.StatusNoContent {
+				t.Errorf("Unexpected delivery %+v", delivered[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The delivery was never marked delivered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPublishFiltersEventsPerEndpoint(t *testing.T) {
+	endpoints := []config.WebhookEndpoint{
+		{URL: "https://all.example/hooks", Secret: testSecret},
+		{URL: "https://registrations.example/hooks", Secret: testSecret, Events: []string{EventUserRegistered}},
+		{URL: "https://security.example/hooks", Secret: testSecret, Events: []string{EventUserLockedOut, EventUserSessionsRevoked}},
+	}
+	tests := []struct {
+		event string
+		want  []string
+	}{
+		{event: EventUserRegistered, want: []string{"https://all.example/hooks", "https://registrations.example/hooks"}},
+		{event: EventUserPasswordChanged, want: []string{"https://all.example/hooks"}},
+		{event: EventUserLockedOut, want: []string{"https://all.example/hooks", "https://security.example/hooks"}},
+		{event: EventUserSessionsRevoked, want: []string{"https://all.example/hooks", "https://security.example/hooks"}},
+	}
+	for _, test := range tests {
+		t.Run(test.event, func(t *testing.T) {
+			deliveries := store.NewMemoryDeliveryStore()
+			dispatcher := newTestDispatcher(t, testConfig(endpoints...), deliveries)
+			dispatcher.Publish(context.Background(), test.event, User{Username: "alice"})
+
+			pending, err := deliveries.List(context.Background(), store.DeliveryPending)
+			if err != nil {
+				t.Fatal(err)
+			}
+			urls := []string{}
+			for _, delivery := range pending {
+				urls = append(urls, delivery.URL)
+				if delivery.EventType != test.event {
+					t.Errorf("Got event type %q", delivery.EventType)
+				}
+			}
+			sort.Strings(urls)
+			if strings.Join(urls, " ") != strings.Join(test.want, " ") {
+				t.Errorf("Delivered to %v, want %v", urls, test.want)
+			}
+		})
+	}
+}
+
+func TestNewDispatcherRejectsUnknownEvents(t *testing.T) {
+	_, err := NewDispatcher(testConfig(config.WebhookEndpoint{URL: "https://example.com", Events: []string{"user.deleted"}}), store.NewMemoryDeliveryStore())
+	if err == nil {
+		t.Fatal("Expected an error for an unknown event type")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	dispatcher := newTestDispatcher(t, config.WebhooksConfig{RetryBackoff: time.Second, MaxRetryBackoff: 10 * time.Second}, store.NewMemoryDeliveryStore())
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: time.Second},
+		{attempts: 2, want: 2 * time.Second},
+		{attempts: 3, want: 4 * time.Second},
+		{attempts: 4, want: 8 * time.Second},
+		{attempts: 5, want: 10 * time.Second},
+		{attempts: 50, want: 10 * time.Second},
+	}
+	for _, test := range tests {
+		if got := dispatcher.backoff(test.attempts); got != test.want {
+			t.Errorf("backoff(%d) = %s, want %s", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestRetriesUntilMaxAttemptsThenFails(t *testing.T) {
+	endpoint := newReceiver(t, http.StatusInternalServerError)
+	deliveries := store.NewMemoryDeliveryStore()
+	webhooksConfig := testConfig(config.WebhookEndpoint{URL: endpoint.URL, Secret: testSecret})
+	dispatcher := newTestDispatcher(t, webhooksConfig, deliveries)
+	dispatcher.Publish(context.Background(), EventUserLockedOut, User{Username: "alice"})
+
+	ctx := context.Background()
+	attemptTimes := []time.Time{}
+	for attempt := 1; attempt <= webhooksConfig.MaxAttempts; attempt++ {
+		pending, _ := deliveries.List(ctx, store.DeliveryPending)
+		if len(pending) != 1 {
+			t.Fatalf("Before attempt %d: got %d pending deliveries, want 1", attempt, len(pending))
+		}
+		// Retries aren't sent before they're due
+		dispatcher.deliverDue()
+		if attempt > 1 && endpoint.count() >= attempt {
+			t.Fatalf("Attempt %d was sent before its backoff", attempt)
+		}
+		time.Sleep(time.Until(pending[0].NextAttemptAt) + time.Millisecond)
+		attemptTimes = append(attemptTimes, time.Now())
+		dispatcher.deliverDue()
+		endpoint.wait(t)
+	}
+
+	failed, _ := deliveries.List(ctx, store.DeliveryFailed)
+	if len(failed) != 1 {
+		t.Fatalf("Got %d failed deliveries, want 1", len(failed))
+	}
+	if failed[0].Attempts != webhooksConfig.MaxAttempts || failed[0].LastStatusCode != http.StatusInternalServerError || !strings.Contains(failed[0].LastError, "receiver said no") {
+		t.Errorf("Unexpected failed delivery %+v", failed[0])
+	}
+	if gap := attemptTimes[1].Sub(attemptTimes[0]); gap < webhooksConfig.RetryBackoff {
+		t.Errorf("The first retry came after %s, before the backoff", gap)
+	}
+
+	// Nothing more is sent once it's failed
+	time.Sleep(webhooksConfig.MaxRetryBackoff)
+	dispatcher.deliverDue()
+	if count := endpoint.count(); count != webhooksConfig.MaxAttempts {
+		t.Errorf("Got %d requests, want %d", count, webhooksConfig.MaxAttempts)
+	}
+}
+
+func TestPendingDeliveriesSurviveRestart(t *testing.T) {
+	directory, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	outbox := filepath.Join(directory, "outbox.json")
+	endpoint := newReceiver(t, http.StatusOK)
+	webhooksConfig := testConfig(config.WebhookEndpoint{URL: endpoint.URL, Secret: testSecret})
+
+	// Published, but the server stops before delivering it
+	deliveries, err := store.NewFileDeliveryStore(outbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatcher := newTestDispatcher(t, webhooksConfig, deliveries)
+	dispatcher.Publish(context.Background(), EventUserPasswordChanged, User{Username: "alice", Reason: "reset"})
+	if err := deliveries.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next run sends it
+	deliveries, err = store.NewFileDeliveryStore(outbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatcher = newTestDispatcher(t, webhooksConfig, deliveries)
+	dispatcher.Start()
+	request := endpoint.wait(t)
+	dispatcher.Close()
+
+	if request.header.Get(EventHeader) != EventUserPasswordChanged || !verify(testSecret, request.header.Get(SignatureHeader), request.body) {
+		t.Errorf("Unexpected request %v", request.header)
+	}
+	delivered, _ := deliveries.List(context.Background(), store.DeliveryDelivered)
+	if len(delivered) != 1 {
+		t.Errorf("Got %d delivered deliveries, want 1", len(delivered))
+	}
+}